@@ -0,0 +1,198 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"net"
+	"sort"
+)
+
+// AddrFlags describes how an interface address may be used as a source.
+type AddrFlags uint32
+
+const (
+	// AddrSecondary marks an additional address in a subnet that already
+	// has a primary address on the interface (IFA_F_SECONDARY on Linux).
+	AddrSecondary AddrFlags = 1 << iota
+	// AddrAnycast marks an anycast address, which must not originate
+	// traffic.  The system provider sets it on the IPv6 anycast addresses
+	// of Linux; elsewhere only other providers do.
+	AddrAnycast
+	// AddrTemporary marks a temporary IPv6 privacy address (RFC 8981,
+	// IFA_F_TEMPORARY on Linux).  It is used as a source like any other,
+	// unless the Router was created with WithStableSourceAddresses.
+	AddrTemporary
+)
+
+// InterfaceAddr is an interface address along with its flags.  A
+// RouteProvider may return it from Addrs in place of a *net.IPNet.
+type InterfaceAddr struct {
+	net.IPNet
+	Flags AddrFlags
+}
+
+// notPrimary are the flags of addresses only used as a source when no
+// other address fits.
+const notPrimary = AddrSecondary | AddrAnycast
+
+type ipAddrs struct {
+	v4, v6 []net.IPNet
+	// v4Flags and v6Flags hold the flags of the address at the same index
+	// in v4 and v6.  They are nil when no address has flags.
+	v4Flags, v6Flags []AddrFlags
+}
+
+func (a ipAddrs) family(ipv6 bool) []net.IPNet {
+	if ipv6 {
+		return a.v6
+	}
+	return a.v4
+}
+
+// flags returns the flags of the i'th address of family(ipv6).
+func (a ipAddrs) flags(ipv6 bool, i int) AddrFlags {
+	flags := a.v4Flags
+	if ipv6 {
+		flags = a.v6Flags
+	}
+	if i < len(flags) {
+		return flags[i]
+	}
+	return 0
+}
+
+// add appends addr, keeping the flag slices aligned with the addresses.
+func (a *ipAddrs) add(addr net.IPNet, flags AddrFlags, ipv6 bool) {
+	addrs, addrFlags := &a.v4, &a.v4Flags
+	if ipv6 {
+		addrs, addrFlags = &a.v6, &a.v6Flags
+	}
+	if flags != 0 || *addrFlags != nil {
+		for len(*addrFlags) < len(*addrs) {
+			*addrFlags = append(*addrFlags, 0)
+		}
+		*addrFlags = append(*addrFlags, flags)
+	}
+	*addrs = append(*addrs, addr)
+}
+
+// addrRef is the j'th address of a family on the interface of index
+// ifindex.
+type addrRef struct {
+	ifindex, j int
+}
+
+// prefixKey is the network of an address prefix, in the 4-byte form of
+// IPv4 addresses when bits is 32.
+type prefixKey struct {
+	net        [net.IPv6len]byte
+	ones, bits int
+}
+
+// newPrefixKey masks ip to its first ones bits, or fails if ip is not of
+// the given size: as for Contains, an IPv4 address is never in an IPv6
+// prefix.
+func newPrefixKey(ip net.IP, ones, bits int) (k prefixKey, ok bool) {
+	if ip4 := ip.To4(); ip4 != nil {
+		if bits != 8*net.IPv4len {
+			return k, false
+		}
+		ip = ip4
+	} else if len(ip) != bits/8 {
+		return k, false
+	}
+	for i, b := range ip {
+		if keep := ones - 8*i; keep < 8 {
+			b &^= 0xff >> max(keep, 0)
+		}
+		k.net[i] = b
+	}
+	k.ones, k.bits = ones, bits
+	return k, true
+}
+
+// addrIndex finds the interface addresses of one family containing an IP
+// without going over every interface, which routes without an output
+// interface would otherwise do for each lookup: the addresses are grouped
+// by prefix, and the prefix of the IP is looked up for each length in use.
+type addrIndex struct {
+	lengths  []prefixKey // the ones and bits in use, longest first
+	byPrefix map[prefixKey][]addrRef
+	// irregular are the addresses whose mask is not a prefix, which
+	// Contains checks one by one.
+	irregular []addrRef
+}
+
+func newAddrIndex(addrs map[int]ipAddrs, ipv6 bool) *addrIndex {
+	x := &addrIndex{byPrefix: make(map[prefixKey][]addrRef)}
+	for ifindex, a := range addrs {
+		for j, addr := range a.family(ipv6) {
+			ref := addrRef{ifindex, j}
+			ones, bits := addr.Mask.Size()
+			if addr.IP.To4() != nil && bits == 8*net.IPv6len && ones >= 8*(net.IPv6len-net.IPv4len) {
+				// Contains only uses the last 4 bytes of the mask.
+				ones, bits = ones-8*(net.IPv6len-net.IPv4len), 8*net.IPv4len
+			}
+			k, ok := newPrefixKey(addr.IP, ones, bits)
+			if !ok || bits == 0 {
+				x.irregular = append(x.irregular, ref)
+				continue
+			}
+			if !x.hasLength(ones, bits) {
+				x.lengths = append(x.lengths, prefixKey{ones: ones, bits: bits})
+			}
+			x.byPrefix[k] = append(x.byPrefix[k], ref)
+		}
+	}
+	sort.Slice(x.lengths, func(i, j int) bool {
+		return x.lengths[i].ones > x.lengths[j].ones
+	})
+	for _, refs := range x.byPrefix {
+		sortAddrRefs(refs)
+	}
+	sortAddrRefs(x.irregular)
+	return x
+}
+
+func (x *addrIndex) hasLength(ones, bits int) bool {
+	for _, l := range x.lengths {
+		if l.ones == ones && l.bits == bits {
+			return true
+		}
+	}
+	return false
+}
+
+// sortAddrRefs orders refs by interface, then address, so that lookups
+// don't depend on the order of the addrs map.
+func sortAddrRefs(refs []addrRef) {
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].ifindex != refs[j].ifindex {
+			return refs[i].ifindex < refs[j].ifindex
+		}
+		return refs[i].j < refs[j].j
+	})
+}
+
+// containing calls fn with each address whose prefix contains ip, most
+// specific prefixes first.
+func (x *addrIndex) containing(addrs map[int]ipAddrs, ip net.IP, ipv6 bool, fn func(ifindex, j int, addr net.IPNet)) {
+	for _, l := range x.lengths {
+		k, ok := newPrefixKey(ip, l.ones, l.bits)
+		if !ok {
+			continue
+		}
+		for _, ref := range x.byPrefix[k] {
+			fn(ref.ifindex, ref.j, addrs[ref.ifindex].family(ipv6)[ref.j])
+		}
+	}
+	for _, ref := range x.irregular {
+		if addr := addrs[ref.ifindex].family(ipv6)[ref.j]; addr.Contains(ip) {
+			fn(ref.ifindex, ref.j, addr)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"errors"
+	"net"
+	"sort"
+)
+
+// RouteCandidate is a destination ranked by OrderDestinations.
+type RouteCandidate struct {
+	IP net.IP
+	// Route is the route to IP, when Err is nil.
+	Route RouteResult
+	Err   error
+}
+
+func (r *router) OrderDestinations(dsts []net.IP) []RouteCandidate {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cands := make([]RouteCandidate, len(dsts))
+	for i, dst := range dsts {
+		res, err := r.resolve(0, nil, dst, 0, defaultTables, nil, nil)
+		if errors.Is(err, ErrNoRoute) && r.connectFallback {
+			if cres, cerr := r.connectRoute(dst); cerr == nil {
+				res, err = cres, nil
+			}
+		}
+		r.stats.lookup(err)
+		cands[i] = RouteCandidate{IP: dst, Route: res, Err: err}
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		return preferDestination(&cands[i], &cands[j])
+	})
+	return cands
+}
+
+// preferDestination reports whether a comes before b by the rules of RFC
+// 6724, section 6.  Rules 3, avoiding deprecated sources, 4, preferring home
+// addresses, and 7, preferring native transport, are left out as the table
+// doesn't tell them, and rule 9, preferring the longest matching prefix,
+// only applies to IPv6 as in glibc and Go.
+func preferDestination(a, b *RouteCandidate) bool {
+	srcA, srcB := a.Route.PreferredSrc, b.Route.PreferredSrc
+
+	// Rule 1: avoid unusable destinations.
+	usableA, usableB := a.Err == nil && srcA != nil, b.Err == nil && srcB != nil
+	if usableA != usableB {
+		return usableA
+	}
+	if !usableA {
+		return false
+	}
+
+	// Rule 2: prefer matching scope.
+	scopeA, scopeB := addrScope(a.IP), addrScope(b.IP)
+	if matchA, matchB := scopeA == addrScope(srcA), scopeB == addrScope(srcB); matchA != matchB {
+		return matchA
+	}
+
+	// Rule 5: prefer matching label.
+	policyA, policyB := lookupPolicy(a.IP), lookupPolicy(b.IP)
+	if matchA, matchB := policyA.label == lookupPolicy(srcA).label, policyB.label == lookupPolicy(srcB).label; matchA != matchB {
+		return matchA
+	}
+
+	// Rule 6: prefer higher precedence.
+	if policyA.precedence != policyB.precedence {
+		return policyA.precedence > policyB.precedence
+	}
+
+	// Rule 8: prefer smaller scope.
+	if scopeA != scopeB {
+		return scopeA < scopeB
+	}
+
+	// Rule 9: use longest matching prefix.
+	if FamilyOf(a.IP) == FamilyV6 && FamilyOf(b.IP) == FamilyV6 {
+		return commonPrefixLen(srcA, a.IP) > commonPrefixLen(srcB, b.IP)
+	}
+
+	// Rule 10: otherwise, leave the order unchanged.
+	return false
+}
+
+// The scopes of RFC 6724, section 3.1.
+const (
+	scopeLinkLocal = 0x2
+	scopeSiteLocal = 0x5
+	scopeGlobal    = 0xe
+)
+
+// addrScope returns the scope of ip.  IPv4 addresses have the scope of RFC
+// 6724, section 3.2: link-local for the autoconfigured and loopback ones,
+// global for the others.
+func addrScope(ip net.IP) uint8 {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return scopeLinkLocal
+	}
+	if FamilyOf(ip) == FamilyV6 {
+		switch {
+		case ip.IsMulticast():
+			return ip[1] & 0xf
+		case ip[0] == 0xfe && ip[1]&0xc0 == 0xc0:
+			// Site-local, deprecated by RFC 3879.
+			return scopeSiteLocal
+		}
+	}
+	return scopeGlobal
+}
+
+type policyEntry struct {
+	prefix            net.IPNet
+	precedence, label uint8
+}
+
+// defaultPolicy is the policy table of RFC 6724, section 2.1, by
+// decreasing prefix length.  IPv4 addresses are looked up in their
+// IPv4-mapped form.
+var defaultPolicy = []policyEntry{
+	{mustPolicyPrefix("::1/128"), 50, 0},
+	{mustPolicyPrefix("::ffff:0:0/96"), 35, 4},
+	{mustPolicyPrefix("::/96"), 1, 3},
+	{mustPolicyPrefix("2001::/32"), 5, 5},
+	{mustPolicyPrefix("2002::/16"), 30, 2},
+	{mustPolicyPrefix("3ffe::/16"), 1, 12},
+	{mustPolicyPrefix("fec0::/10"), 1, 11},
+	{mustPolicyPrefix("fc00::/7"), 3, 13},
+	{mustPolicyPrefix("::/0"), 40, 1},
+}
+
+func mustPolicyPrefix(s string) net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return *n
+}
+
+// lookupPolicy returns the entry of defaultPolicy with the longest prefix
+// containing ip.
+func lookupPolicy(ip net.IP) policyEntry {
+	ip16 := ip.To16()
+	for _, p := range defaultPolicy {
+		if p.prefix.Contains(ip16) {
+			return p
+		}
+	}
+	return defaultPolicy[len(defaultPolicy)-1]
+}
+
+// commonPrefixLen returns the number of leading bits src and dst have in
+// common, up to the 64 bits of the network prefix of src, which is assumed
+// as in most IPv6 networks.
+func commonPrefixLen(src, dst net.IP) int {
+	src, dst = src.To16(), dst.To16()
+	n := 0
+	for i := 0; i < 8; i++ {
+		x := src[i] ^ dst[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
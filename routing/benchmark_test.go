@@ -0,0 +1,136 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// benchmarkRouter builds a router with n /24 routes carved out of 10.0.0.0
+// upwards, all via 192.168.0.1 on eth0.  With overlap, the /24s are also
+// covered by /16 and /8 routes, and with withDefault a default route
+// catches everything else.
+func benchmarkRouter(b *testing.B, n int, overlap, withDefault bool) Router {
+	gateway := net.IPv4(192, 168, 0, 1).To4()
+	routes := make([]RouteEntry, 0, n+2)
+	for i := 0; i < n; i++ {
+		routes = append(routes, RouteEntry{
+			Dst:         net.IPNet{IP: benchmarkIP(i, 0), Mask: net.CIDRMask(24, 32)},
+			Src:         net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			Gateway:     gateway,
+			OutputIface: 1,
+			Priority:    uint32(i % 7),
+		})
+	}
+	if overlap {
+		for _, ones := range []int{8, 16} {
+			mask := net.CIDRMask(ones, 32)
+			routes = append(routes, RouteEntry{
+				Dst:         net.IPNet{IP: benchmarkIP(n/2, 0).Mask(mask), Mask: mask},
+				Src:         net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+				Gateway:     gateway,
+				OutputIface: 1,
+			})
+		}
+	}
+	if withDefault {
+		routes = append(routes, RouteEntry{
+			Dst:         net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			Src:         net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+			Gateway:     gateway,
+			OutputIface: 1,
+		})
+	}
+	ifaces := []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}}
+	addrs := map[int][]net.Addr{
+		1: {&net.IPNet{IP: net.IPv4(192, 168, 0, 2).To4(), Mask: net.CIDRMask(16, 32)}},
+	}
+	r, err := NewFromRoutes(routes, ifaces, addrs)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return r
+}
+
+// benchmarkIP returns host h of the i'th /24 above 10.0.0.0.
+func benchmarkIP(i, h int) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, 10<<24+uint32(i)<<8+uint32(h))
+	return ip
+}
+
+var benchmarkSizes = []int{10, 1000, 100000}
+
+func benchmarkRoute(b *testing.B, r Router, dst net.IP, wantErr bool) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, err := r.Route(dst); (err != nil) != wantErr {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRouteHit(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkRoute(b, benchmarkRouter(b, n, false, true), benchmarkIP(n/2, 9), false)
+		})
+	}
+}
+
+func BenchmarkRouteDefault(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkRoute(b, benchmarkRouter(b, n, false, true), net.IPv4(172, 16, 0, 1), false)
+		})
+	}
+}
+
+func BenchmarkRouteMiss(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkRoute(b, benchmarkRouter(b, n, false, false), net.IPv4(172, 16, 0, 1), true)
+		})
+	}
+}
+
+func BenchmarkRouteOverlap(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			benchmarkRoute(b, benchmarkRouter(b, n, true, true), benchmarkIP(n/2, 9), false)
+		})
+	}
+}
+
+// BenchmarkRouteAnyIface routes through a route without output interface,
+// whose source is looked for among the addresses of n interfaces, each
+// with the first host of its own /24.
+func BenchmarkRouteAnyIface(b *testing.B) {
+	for _, n := range []int{10, 1000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			ifaces := make([]net.Interface, n)
+			addrs := make(map[int][]net.Addr, n)
+			for i := range ifaces {
+				ifaces[i] = net.Interface{Index: i + 1, MTU: 1500, Name: fmt.Sprintf("eth%d", i), Flags: net.FlagUp}
+				addrs[i+1] = []net.Addr{&net.IPNet{IP: benchmarkIP(i, 1), Mask: net.CIDRMask(24, 32)}}
+			}
+			routes := []RouteEntry{{
+				Dst:     net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)},
+				Gateway: benchmarkIP(n/2, 254),
+			}}
+			r, err := NewFromRoutes(routes, ifaces, addrs)
+			if err != nil {
+				b.Fatal(err)
+			}
+			benchmarkRoute(b, r, net.IPv4(172, 16, 0, 1), false)
+		})
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrNoDefaultRoute is wrapped by the error SelfCheck reports for a family
+// loaded without a usable default route in TableMain.  It is a warning
+// rather than a fault of the table, as hosts without IPv6 connectivity are
+// common, which callers may tolerate.
+var ErrNoDefaultRoute = errors.New("no default route")
+
+// SelfCheck validates the table for internal consistency, and returns the
+// issues found joined into one error, or nil if there are none: routes out
+// of unknown interfaces, or without an output interface while their type
+// and gateway don't tell where they lead, malformed addresses and
+// non-contiguous masks in routes and interface addresses.  A family
+// loaded without a usable default route in TableMain is reported too, with
+// an error wrapping ErrNoDefaultRoute.
+func (tab *RouteTable) SelfCheck() error {
+	var errs []error
+	for _, rt := range tab.Routes() {
+		ipv6 := rt.ipv6()
+		if err := checkPrefix(rt.Dst, ipv6); err != nil {
+			errs = append(errs, fmt.Errorf("route %v: destination %w", &rt.Dst, err))
+			continue
+		}
+		if rt.Src.IP != nil {
+			if err := checkPrefix(rt.Src, ipv6); err != nil {
+				errs = append(errs, fmt.Errorf("route %v: source %w", &rt.Dst, err))
+			}
+		}
+		if rt.Gateway != nil && !rt.Gateway.IsUnspecified() {
+			if err := checkIP(rt.Gateway, ipv6); err != nil {
+				errs = append(errs, fmt.Errorf("route %v: gateway %w", &rt.Dst, err))
+			}
+		}
+		if rt.PrefSrc != nil {
+			if err := checkIP(rt.PrefSrc, ipv6); err != nil {
+				errs = append(errs, fmt.Errorf("route %v: preferred source %w", &rt.Dst, err))
+			}
+		}
+		switch {
+		case rt.OutputIface != 0:
+			if _, ok := tab.ifaces[rt.OutputIface]; !ok {
+				errs = append(errs, fmt.Errorf("route %v: %w: %d", &rt.Dst, ErrOutputNotFound, rt.OutputIface))
+			}
+		case rt.Type == TypeBlackhole, rt.Type == TypeUnreachable, rt.Type == TypeProhibit, rt.Type == TypeThrow:
+			// They lead nowhere.
+		case rt.Type == TypeLocal, rt.Scope == ScopeHost:
+			// They lead to the loopback interface.
+		case rt.Gateway == nil || rt.Gateway.IsUnspecified():
+			errs = append(errs, fmt.Errorf("route %v: neither output interface nor gateway", &rt.Dst))
+		}
+	}
+
+	for _, iface := range tab.Interfaces() {
+		for _, ipv6 := range []bool{false, true} {
+			for _, addr := range tab.addrs[iface.Index].family(ipv6) {
+				if err := checkPrefix(addr, ipv6); err != nil {
+					errs = append(errs, fmt.Errorf("address %v of %s: %w", &addr, iface.Name, err))
+				}
+			}
+		}
+	}
+
+	defaults := make(map[bool]bool)
+	for _, rt := range tab.DefaultRoutes() {
+		defaults[rt.ipv6()] = true
+	}
+	for _, ipv6 := range []bool{false, true} {
+		if familyEnabled(tab.family, ipv6) && !defaults[ipv6] {
+			errs = append(errs, fmt.Errorf("%w for %s", ErrNoDefaultRoute, map[bool]string{false: "IPv4", true: "IPv6"}[ipv6]))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkPrefix reports why n is not a well-formed prefix of the family of
+// ipv6, if it is not.
+func checkPrefix(n net.IPNet, ipv6 bool) error {
+	if err := checkIP(n.IP, ipv6); err != nil {
+		return err
+	}
+	if _, bits := n.Mask.Size(); bits == 0 {
+		return fmt.Errorf("mask %v is not contiguous", n.Mask)
+	}
+	return nil
+}
+
+// checkIP reports why ip is not an address of the family of ipv6, if it is
+// not.  IPv4 addresses may be in their 16-byte form.
+func checkIP(ip net.IP, ipv6 bool) error {
+	switch {
+	case ipv6 && len(ip) != net.IPv6len:
+		return fmt.Errorf("%v is not an IPv6 address", ip)
+	case !ipv6 && ip.To4() == nil:
+		return fmt.Errorf("%v is not an IPv4 address", ip)
+	}
+	return nil
+}
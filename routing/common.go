@@ -7,12 +7,19 @@
 package routing
 
 import (
+	"context"
 	"net"
+	"syscall"
 )
 
 // Router implements simple IPv4/IPv6 routing based on the kernel's routing
 // table.  This routing library has very few features and may actually route
 // incorrectly in some cases, but it should work the majority of the time.
+//
+// Router only holds the lookups every caller needs.  The Routers returned
+// by New, NewFromRoutes and LoadSnapshot also implement LinkRouter,
+// EgressRouter, PolicyRouter and DynamicRouter, which callers needing more
+// assert them to.
 type Router interface {
 	// Route returns where to route a packet based on the packet's source
 	// and destination IP address.
@@ -26,11 +33,261 @@ type Router interface {
 	// table, the first IP address of the interface is provided.
 	//
 	// If an error is encountered, iface, gateway, and
-	// preferredSrc will be nil, and err will be set.
+	// preferredSrc will be nil, and err will be set.  The unspecified
+	// address, 0.0.0.0 or ::, is not routed, failing with
+	// ErrUnspecifiedDestination, unless the Router was created with
+	// WithUnspecifiedDestination.
+	//
+	// As with the kernel's default rules, dst is looked up in TableLocal,
+	// which holds the addresses of the local machine, and then in
+	// TableMain.
 	Route(dst net.IP) (iface *net.Interface, gateway, preferredSrc net.IP, err error)
 
 	// RouteWithSrc routes based on source information as well as destination
 	// information.  Either or both of input/src can be nil.  If both are, this
-	// should behave exactly like Route(dst)
+	// should behave exactly like Route(dst).  If input is not the hardware
+	// address of any interface, the error wraps ErrInputNotFound.
 	RouteWithSrc(input net.HardwareAddr, src, dst net.IP) (iface *net.Interface, gateway, preferredSrc net.IP, err error)
 }
+
+// LinkRouter is implemented by the Routers of New, to prepare the link
+// layer of the packets routed.
+type LinkRouter interface {
+	// L2Target returns the address whose link-layer address must be
+	// resolved, by ARP or neighbor discovery, to send a packet to dst, and
+	// the interface to send it on: the gateway of the route to dst, or dst
+	// itself when it is on-link.  It fails if dst is an address of the
+	// local machine, which is reached without the link layer.
+	L2Target(dst net.IP) (net.IP, *net.Interface, error)
+
+	// GatewayNeighbor returns the link-layer address of the next hop to dst,
+	// the address L2Target tells to resolve, as found in the neighbor table
+	// of the provider when it is asked: the ARP cache or neighbor cache of
+	// the system, on Linux and Windows.  It fails with an error wrapping
+	// ErrNeighborUnresolved if the next hop is not resolved yet.
+	GatewayNeighbor(dst net.IP) (net.HardwareAddr, error)
+
+	// PacketHeaders returns the Ethernet and IP headers of a packet to dst,
+	// ready for the caller to add its own layers and serialize them: the
+	// source MAC is that of the interface of the route and the source IP its
+	// preferred source.  The destination MAC is the one GatewayNeighbor
+	// returns, or zero when the next hop is not resolved.
+	PacketHeaders(dst net.IP) (PacketHeaders, error)
+
+	// RouteSockaddr returns the address to give sendto on a raw socket to
+	// send a packet to dst, and the interface it goes out of.  The scope of
+	// an IPv6 address is the index of that interface when dst or the
+	// gateway to it is link-local.
+	RouteSockaddr(dst net.IP) (syscall.Sockaddr, *net.Interface, error)
+
+	// NextHopTargets returns the neighbors to resolve to send packets to
+	// dsts, as L2Target does for each of them, without duplicates and in
+	// the order of dsts, so that a sender can resolve them all before a
+	// burst.  Local destinations need none.  The targets of the other
+	// destinations are returned even if some fail, along with an error
+	// joining their errors.
+	NextHopTargets(dsts []net.IP) ([]NextHop, error)
+
+	// NextHopChain returns the gateways a packet to dst goes through when
+	// gateways are themselves reachable only through other gateways, as the
+	// kernel resolves recursive routes: the gateway of the route to dst,
+	// then the gateway of the route to that gateway, and so on down to one
+	// that is on-link.  It is empty if dst itself is on-link, and fails with
+	// ErrRouteLoop if a gateway resolves back to one already visited.
+	NextHopChain(dst net.IP) ([]net.IP, error)
+
+	// BroadcastFor returns the IPv4 broadcast address of the directly
+	// connected prefix dst is routed to.  It fails if dst is routed via a
+	// gateway, is an IPv6 address, or its prefix has no broadcast address
+	// (/31 and /32).
+	BroadcastFor(dst net.IP) (net.IP, error)
+
+	// InterfaceMTU returns the MTU of the interface with the given index,
+	// as loaded by the last Refresh.
+	InterfaceMTU(index int) (int, error)
+}
+
+// EgressRouter is implemented by the Routers of New, to choose between the
+// interfaces, gateways and source addresses a packet may leave through.
+type EgressRouter interface {
+	// RouteGet is like RouteWithSrc, but returns its answer as a
+	// RouteResult, which also tells how the preferred source was chosen.
+	RouteGet(input net.HardwareAddr, src, dst net.IP) (RouteResult, error)
+
+	// RouteFromSource is like RouteWithSrc with a nil input, but also
+	// forces src as the PreferredSrc of the result.  It fails if src is
+	// not an address of the output interface.
+	RouteFromSource(src, dst net.IP) (RouteResult, error)
+
+	// RouteVia is like Route, but only considers the routes going out of
+	// iface, to learn the gateway and source for sending through it even
+	// when it is not the best egress, as per-uplink health checks do.  It
+	// fails if iface is nil, and with an error wrapping ErrNoRoute if no
+	// route to dst goes out of iface.
+	RouteVia(iface *net.Interface, dst net.IP) (RouteResult, error)
+
+	// PreferredSource returns the source address Route selects for dst,
+	// without resolving the interface, for callers that only need the
+	// source of the packets they craft.
+	PreferredSource(dst net.IP) (net.IP, error)
+
+	// PrimaryInterface returns the interface the best default route leaves
+	// through, the one that reaches the Internet, and the source address
+	// packets sent through it would have.  The IPv4 default route is
+	// preferred, unless the Router was created with WithPreferIPv6; the
+	// other family is used if the preferred one has no default route.  It
+	// fails with an error wrapping ErrNoRoute if there is no default route.
+	PrimaryInterface() (*net.Interface, net.IP, error)
+
+	// SameEgress reports whether packets to a and b leave through the
+	// same interface and gateway, as returned by Route.  Destinations on
+	// a directly connected network are their own gateway, so they only
+	// share an egress with themselves.  It fails if either destination
+	// has no route.
+	SameEgress(a, b net.IP) (bool, error)
+
+	// OrderDestinations routes each of dsts, such as the addresses a host
+	// name resolved to, and returns them in the order RFC 6724
+	// destination address selection ranks them, as getaddrinfo does
+	// against the system table: the destinations that can't be routed
+	// last, then those whose source address matches their scope and
+	// label, the IPv6 ones before IPv4 by the default policy table, and
+	// so on.  Connecting to the candidates in order, or a few at a time
+	// as Happy Eyeballs (RFC 8305) does, follows the system's preference.
+	OrderDestinations(dsts []net.IP) []RouteCandidate
+
+	// RouteForAddr routes to addr, which is an IP literal, a host name, a
+	// "host:port" pair or a URL.  A host name is resolved, and the route to
+	// the first of its addresses, of either family, in the order of
+	// OrderDestinations, that can be routed is returned.  If resolution
+	// fails the resolver's error (usually a *net.DNSError) is wrapped; if
+	// no address can be routed the error of the last one is returned,
+	// which wraps ErrNoRoute when there was no route at all.
+	RouteForAddr(addr string) (RouteResult, error)
+
+	// RouteExplain is like Route, but also returns the steps of the
+	// decision in human-readable form: the routes matched or skipped, and
+	// how the source address was selected.  The steps are returned even
+	// when the lookup fails, for inclusion in bug reports.
+	RouteExplain(dst net.IP) (RouteResult, []string, error)
+
+	// IsMartian reports whether dst is not a valid destination to route
+	// to: an address of the unspecified, loopback, link-local,
+	// documentation, benchmarking or reserved ranges, or not an IP
+	// address at all.  Special-purpose addresses are valid when a route
+	// of TableMain other than a default or local one leads to them, and
+	// those of the prefixes given to WithAllowedMartians.
+	IsMartian(dst net.IP) bool
+}
+
+// PolicyRouter is implemented by the Routers of New, to look up the tables
+// other than TableLocal and TableMain and the routes restricted to some
+// packets.
+type PolicyRouter interface {
+	// RouteWithMark routes a locally generated packet carrying the given
+	// fwmark (SO_MARK) the way Linux policy routing does: the rules are
+	// evaluated by priority, and the first table a matching rule looks up
+	// that has a route for dst, not suppressed by the rule, gives the
+	// result.  Goto rules jump ahead, and blackhole, unreachable and
+	// prohibit rules fail the lookup with an error wrapping
+	// ErrRuleRejected.  If no table has a route, or the platform has no
+	// rules, the main table is used.  src may be nil.
+	RouteWithMark(mark uint32, src, dst net.IP) (RouteResult, error)
+
+	// RouteWithRuleTrace is like RouteWithMark, but also returns the rules
+	// evaluated and what each did with the packet, to tell why dst was
+	// looked up in a table.  The trace is returned even when the lookup
+	// fails.
+	RouteWithRuleTrace(mark uint32, src, dst net.IP) (RouteResult, RuleTrace, error)
+
+	// RouteInTable is like Route, but looks dst up in the given route
+	// table alone instead of TableLocal and TableMain, the tables all
+	// other methods but RouteWithMark use.
+	RouteInTable(tableID int, dst net.IP) (RouteResult, error)
+
+	// RouteWithTOS is like RouteGet with a nil input, for a packet with the
+	// given TOS byte: routes restricted to another TOS are skipped, as
+	// Linux does.  The other methods look up packets of TOS zero, for which
+	// all routes restricted to a TOS are skipped.
+	RouteWithTOS(tos byte, src, dst net.IP) (RouteResult, error)
+
+	// RouteWithRealm is like RouteGet with nil input and src, but only
+	// considers the routes whose Realm equals realm.
+	RouteWithRealm(dst net.IP, realm uint32) (RouteResult, error)
+
+	// IsAsymmetric reports whether the packets of a flow between src and
+	// dst leave in each direction through different interfaces, as
+	// policy rules selecting routes by source may make them do, which
+	// stateful firewalls and reverse path filtering drop.  The forward
+	// route, from src to dst, and the reverse one, from dst to src, are
+	// looked up as RouteWithMark does without a mark, as if both were
+	// locally generated: rules bound to an input interface other than lo
+	// don't apply.  They are returned for inspection.  When src or dst is a
+	// local address, the lookup towards it gives local delivery, and the
+	// packets to it are instead expected on the interface holding it: a
+	// flow sent by the host is asymmetric if it leaves through another
+	// interface than that holding src.
+	IsAsymmetric(src, dst net.IP) (asymmetric bool, forward, reverse RouteResult, err error)
+}
+
+// DynamicRouter is implemented by the Routers of New, to follow the changes
+// of the table.
+type DynamicRouter interface {
+	// Table returns the table of the last Refresh, SetTable or
+	// RefreshAddrs, which they replace rather than modify: its routes,
+	// interfaces and addresses can be inspected with the methods of
+	// RouteTable while the Router keeps being refreshed.
+	Table() *RouteTable
+
+	// Refresh reloads the interfaces, their addresses and the routes.
+	// Lookups running concurrently see either the old or the new table.
+	Refresh() error
+
+	// RefreshAddrs reloads only the addresses of the known interfaces,
+	// which change more often than the routes (DHCP renewals, SLAAC) and
+	// are cheaper to read.  Source selection uses the new addresses from
+	// then on.
+	RefreshAddrs() error
+
+	// SetTable replaces the routes and interfaces of the table with the
+	// given ones, as a RouteProvider would have loaded them, to push
+	// updates without creating another Router.  The addresses, policy
+	// rules, multicast routes and alternative names of the interfaces are
+	// kept from the current table.  As with Refresh, lookups running
+	// concurrently see either the old or the new table, and the next
+	// Refresh reloads the table from the provider.  It fails if ifaces
+	// holds a nil interface, or several interfaces of the same index,
+	// unless WithIgnoreDuplicateIndex was given.
+	SetTable(entries []RouteEntry, ifaces []*net.Interface) error
+
+	// Generation returns the number of times the table was loaded, by New,
+	// Refresh, RefreshAddrs and SetTable.  Results obtained while it keeps
+	// the same value are consistent with each other, so caches of results
+	// only need to compare it to tell they are stale.  It is cheap to call.
+	Generation() uint64
+
+	// Stats returns the counters of the Router.  They are zero, except
+	// Routes, unless it was created with WithStats.
+	Stats() Stats
+
+	// Snapshot returns a copy of the current table that later calls to
+	// Refresh and RefreshAddrs leave unchanged.
+	Snapshot() *RouteSnapshot
+
+	// WaitForRoute blocks until dst can be routed, refreshing the table
+	// as it changes, or until ctx is done, in which case it returns
+	// ctx.Err().  This avoids races with routes that appear at startup,
+	// such as those of a VPN being established.  Changes are waited for
+	// with Subscribe when the Router reads the operating system's table,
+	// and the table is polled otherwise.
+	WaitForRoute(ctx context.Context, dst net.IP) error
+
+	// DefaultRouteChanges returns a channel that receives an event whenever
+	// the best default route of a family changes gateway or interface,
+	// from the table of the provider, which the router is refreshed with.
+	// Other changes of the table are not reported.  Changes of the system
+	// table are received from Subscribe where it is supported, and are
+	// polled for otherwise and with other providers.  The channel is closed
+	// when ctx is done or the notifications fail.
+	DefaultRouteChanges(ctx context.Context) (<-chan DefaultRouteEvent, error)
+}
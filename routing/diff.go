@@ -0,0 +1,129 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+)
+
+// Equal reports whether rt and other describe the same route.  Addresses
+// are compared by value, so an IPv4 address held in 4 or 16 bytes is the
+// same address, and a nil Metrics map equals an empty one.  Lifetimes are
+// compared as they are, so a route whose remaining lifetime was counted
+// down between two Refreshes is not Equal to its former self.
+func (rt *RouteEntry) Equal(other *RouteEntry) bool {
+	if !ipNetEqual(rt.Dst, other.Dst) || !ipNetEqual(rt.Src, other.Src) || rt.Table != other.Table {
+		return false
+	}
+	if rt.InputIface != other.InputIface || rt.OutputIface != other.OutputIface || rt.InputIfaceName != other.InputIfaceName {
+		return false
+	}
+	if rt.ValidLifetime != other.ValidLifetime || rt.PreferredLifetime != other.PreferredLifetime || rt.Age != other.Age {
+		return false
+	}
+	if !rt.Gateway.Equal(other.Gateway) || !rt.PrefSrc.Equal(other.PrefSrc) {
+		return false
+	}
+	if rt.Priority != other.Priority || rt.Preference != other.Preference || rt.Realm != other.Realm || rt.Scope != other.Scope || rt.Protocol != other.Protocol || rt.Type != other.Type || rt.Weight != other.Weight || rt.TOS != other.TOS || rt.Flags != other.Flags {
+		return false
+	}
+	if len(rt.Metrics) != len(other.Metrics) {
+		return false
+	}
+	for k, v := range rt.Metrics {
+		if w, ok := other.Metrics[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+func ipNetEqual(a, b net.IPNet) bool {
+	return a.IP.Equal(b.IP) && bytes.Equal(canonicalMask(a), canonicalMask(b))
+}
+
+// canonicalMask returns the mask of n in 4 bytes if n is an IPv4 network,
+// even if it was given in 16.
+func canonicalMask(n net.IPNet) net.IPMask {
+	if len(n.Mask) == net.IPv6len && n.IP.To4() != nil {
+		return n.Mask[12:]
+	}
+	return n.Mask
+}
+
+// TableDiff compares two route tables, such as the Routes of a Router
+// before and after a Refresh.  Routes of the same table to the same
+// destination and source with the same priority and TOS are considered the
+// same route: added and removed hold the routes only found in new and old
+// respectively, and changed holds the new version of the routes that
+// differ otherwise.  Routes that are Equal in both tables are not
+// reported, and the order of the tables does not matter.
+func TableDiff(old, new []RouteEntry) (added, removed, changed []RouteEntry) {
+	groups := make(map[string][]int)
+	var keys []string
+	for i := range new {
+		key := routeKey(&new[i])
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	matched := make([]bool, len(new))
+	var unmatched []int
+	for i := range old {
+		found := false
+		for _, j := range groups[routeKey(&old[i])] {
+			if !matched[j] && old[i].Equal(&new[j]) {
+				matched[j], found = true, true
+				break
+			}
+		}
+		if !found {
+			unmatched = append(unmatched, i)
+		}
+	}
+
+	// Pair what is left of old with what is left of new by key; the rest
+	// was added or removed.
+	for _, i := range unmatched {
+		found := false
+		for _, j := range groups[routeKey(&old[i])] {
+			if !matched[j] {
+				matched[j], found = true, true
+				changed = append(changed, new[j])
+				break
+			}
+		}
+		if !found {
+			removed = append(removed, old[i])
+		}
+	}
+	for _, key := range keys {
+		for _, j := range groups[key] {
+			if !matched[j] {
+				added = append(added, new[j])
+			}
+		}
+	}
+	return
+}
+
+// routeKey identifies a route independently of its nexthop.
+func routeKey(rt *RouteEntry) string {
+	return strconv.FormatUint(uint64(rt.Table), 10) + " " + canonicalNet(rt.Dst) + " " + canonicalNet(rt.Src) + " " + strconv.FormatUint(uint64(rt.Priority), 10) + " " + strconv.Itoa(int(rt.TOS))
+}
+
+func canonicalNet(n net.IPNet) string {
+	if n.IP == nil {
+		return ""
+	}
+	ones, _ := canonicalMask(n).Size()
+	return n.IP.String() + "/" + strconv.Itoa(ones)
+}
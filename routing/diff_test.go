@@ -0,0 +1,94 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRouteEntryEqual(t *testing.T) {
+	a := RouteEntry{
+		Dst:         net.IPNet{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+		Gateway:     net.IPv4(192, 168, 1, 1).To4(),
+		OutputIface: 2,
+		Metrics:     map[int]uint32{},
+	}
+	b := RouteEntry{
+		Dst:         net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8+96, 128)},
+		Gateway:     net.IPv4(192, 168, 1, 1),
+		OutputIface: 2,
+	}
+	if !a.Equal(&b) || !b.Equal(&a) {
+		t.Errorf("\ngot:	not equal\nwant:	equal\n\n%+v\n%+v\n\n", a, b)
+	}
+	b.Metrics = map[int]uint32{2: 1400}
+	if a.Equal(&b) {
+		t.Errorf("\ngot:	equal\nwant:	not equal with different metrics\n\n")
+	}
+	b.Metrics = nil
+	b.Dst.Mask = net.CIDRMask(16+96, 128)
+	if a.Equal(&b) {
+		t.Errorf("\ngot:	equal\nwant:	not equal with different masks\n\n")
+	}
+	b.Dst.Mask = net.CIDRMask(8+96, 128)
+	b.Table = 100
+	if a.Equal(&b) {
+		t.Errorf("\ngot:	equal\nwant:	not equal with different tables\n\n")
+	}
+	b.Table = 0
+	b.InputIfaceName = "eth1"
+	if a.Equal(&b) {
+		t.Errorf("\ngot:	equal\nwant:	not equal with different input interface names\n\n")
+	}
+	b.InputIfaceName = ""
+	b.ValidLifetime = time.Hour
+	if a.Equal(&b) {
+		t.Errorf("\ngot:	equal\nwant:	not equal with different lifetimes\n\n")
+	}
+}
+
+func TestTableDiff(t *testing.T) {
+	prefix := func(a, b, c, d byte, ones int) net.IPNet {
+		return net.IPNet{IP: net.IPv4(a, b, c, d).To4(), Mask: net.CIDRMask(ones, 32)}
+	}
+	old := []RouteEntry{
+		{Dst: prefix(0, 0, 0, 0, 0), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Priority: 100},
+		{Dst: prefix(192, 168, 1, 0, 24), OutputIface: 1, Priority: 100},
+		{Dst: prefix(10, 0, 0, 0, 8), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1},
+	}
+	new := []RouteEntry{
+		{Dst: prefix(192, 168, 1, 0, 24), OutputIface: 1, Priority: 100},
+		{Dst: prefix(0, 0, 0, 0, 0), Gateway: net.IPv4(192, 168, 1, 2), OutputIface: 1, Priority: 100},
+		{Dst: prefix(172, 16, 0, 0, 12), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1},
+	}
+
+	added, removed, changed := TableDiff(old, new)
+	if len(added) != 1 || !added[0].Equal(&new[2]) {
+		t.Errorf("\ngot:	%+v\nwant:	%+v\n\n", added, new[2:3])
+	}
+	if len(removed) != 1 || !removed[0].Equal(&old[2]) {
+		t.Errorf("\ngot:	%+v\nwant:	%+v\n\n", removed, old[2:3])
+	}
+	if len(changed) != 1 || !changed[0].Equal(&new[1]) {
+		t.Errorf("\ngot:	%+v\nwant:	%+v\n\n", changed, new[1:2])
+	}
+
+	// The same route in another table is another route.
+	other := old[0]
+	other.Table = 100
+	added, removed, changed = TableDiff(old[:1], []RouteEntry{other})
+	if len(added) != 1 || len(removed) != 1 || len(changed) != 0 {
+		t.Errorf("\ngot:	%v %v %v\nwant:	one added and one removed\n\n", added, removed, changed)
+	}
+
+	added, removed, changed = TableDiff(old, old)
+	if len(added)+len(removed)+len(changed) != 0 {
+		t.Errorf("\ngot:	%v %v %v\nwant:	no difference\n\n", added, removed, changed)
+	}
+}
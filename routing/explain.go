@@ -0,0 +1,72 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"fmt"
+	"net"
+)
+
+// routeTrace records the steps of a lookup for RouteExplain.  The methods
+// of a nil *routeTrace do nothing, so that lookups only pay for tracing
+// when it is asked for.
+type routeTrace struct {
+	steps   []string
+	matched *RouteEntry
+}
+
+func (t *routeTrace) addf(format string, args ...interface{}) {
+	t.steps = append(t.steps, fmt.Sprintf(format, args...))
+}
+
+// skip records that rt contains the destination but was skipped.
+func (t *routeTrace) skip(rt *RouteEntry, reason string) {
+	if t != nil {
+		t.addf("skipped %v prio %d (%s)", &rt.Dst, rt.Priority, reason)
+	}
+}
+
+// match records that rt was selected.
+func (t *routeTrace) match(rt *RouteEntry) {
+	if t != nil {
+		t.addf("matched %v prio %d in table %d", &rt.Dst, rt.Priority, rt.Table)
+		t.matched = rt
+	}
+}
+
+func (r *router) RouteExplain(dst net.IP) (RouteResult, []string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t := &routeTrace{}
+	res, err := r.resolve(0, nil, dst, 0, defaultTables, nil, t)
+	r.stats.lookup(err)
+	rt := t.matched
+	switch {
+	case err != nil && rt == nil:
+		t.addf("no route matched %v", dst)
+	case err != nil:
+		t.addf("failed: %v", err)
+	case res.IsLocal:
+		t.addf("%v is local, delivered on %s", dst, r.ifaceName(res.ifindex))
+	default:
+		if rt.Gateway == nil || rt.Gateway.IsUnspecified() {
+			t.addf("%v is on-link", dst)
+		} else {
+			t.addf("next hop is gateway %v", res.Gateway)
+		}
+		switch {
+		case res.PreferredSrc.Equal(rt.PrefSrc):
+			t.addf("selected src %v on %s, the preferred source of the route", res.PreferredSrc, r.ifaceName(res.ifindex))
+		case res.SourceAmbiguous:
+			t.addf("selected src %v on %s, among other equally good addresses", res.PreferredSrc, r.ifaceName(res.ifindex))
+		default:
+			t.addf("selected src %v on %s", res.PreferredSrc, r.ifaceName(res.ifindex))
+		}
+	}
+	return res, t.steps, err
+}
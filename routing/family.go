@@ -0,0 +1,65 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// AddressFamily is the family of an IP address.
+type AddressFamily uint8
+
+const (
+	// FamilyInvalid is the family of values that are not IP addresses.
+	FamilyInvalid AddressFamily = iota
+	// FamilyV4 is the family of IPv4 addresses.
+	FamilyV4
+	// FamilyV6 is the family of IPv6 addresses.
+	FamilyV6
+	// FamilyAll stands for both families where one is asked for, as with
+	// WithFamily, as AF_UNSPEC does.
+	FamilyAll
+)
+
+func (f AddressFamily) String() string {
+	switch f {
+	case FamilyV4:
+		return "IPv4"
+	case FamilyV6:
+		return "IPv6"
+	case FamilyAll:
+		return "all"
+	}
+	return "invalid"
+}
+
+// sysFamily returns the syscall.AF_* constant of f.
+func (f AddressFamily) sysFamily() int {
+	switch f {
+	case FamilyV4:
+		return syscall.AF_INET
+	case FamilyV6:
+		return syscall.AF_INET6
+	}
+	return syscall.AF_UNSPEC
+}
+
+// FamilyOf returns the family of ip.  IPv4 addresses held in 16 bytes, as
+// net.ParseIP returns them, are FamilyV4 like those held in 4.
+func FamilyOf(ip net.IP) AddressFamily {
+	switch {
+	case ip.To4() != nil:
+		return FamilyV4
+	case len(ip) == net.IPv6len:
+		return FamilyV6
+	}
+	return FamilyInvalid
+}
+
+var errInvalidIP = errors.New("IP is not valid as IPv4 or IPv6")
@@ -0,0 +1,32 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFamilyOf(t *testing.T) {
+	for _, tt := range []struct {
+		ip   net.IP
+		want AddressFamily
+	}{
+		{net.IPv4(192, 0, 2, 1), FamilyV4},
+		{net.IPv4(192, 0, 2, 1).To4(), FamilyV4},
+		{net.ParseIP("::ffff:192.0.2.1"), FamilyV4},
+		{net.ParseIP("2001:db8::1"), FamilyV6},
+		{net.ParseIP("::"), FamilyV6},
+		{nil, FamilyInvalid},
+		{net.IP{192, 0, 2}, FamilyInvalid},
+		{make(net.IP, 8), FamilyInvalid},
+	} {
+		if got := FamilyOf(tt.ip); got != tt.want {
+			t.Errorf("%#v\ngot:	%v\nwant:	%v\n\n", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// HostResolver resolves host names to addresses.  *net.Resolver implements
+// it.
+type HostResolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// HostRouteCache caches the routes to host names, for tools probing the same
+// named targets over and over.  The addresses of a host are resolved again
+// once they are older than the TTL of the cache, and routed again once the
+// Router reloaded its table, as told by DynamicRouter.Generation, or on
+// every call for Routers that don't implement DynamicRouter.  It is safe for
+// concurrent use.
+type HostRouteCache struct {
+	r        Router
+	resolver HostResolver
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	hosts map[string]*hostRoute
+}
+
+// hostRoute is what HostRouteCache knows of a host.  The addresses are
+// never modified; the route is guarded by the mutex of the cache.
+type hostRoute struct {
+	ips        []net.IP
+	expires    time.Time
+	res        RouteResult
+	generation uint64
+	routed     bool
+}
+
+// NewHostRouteCache returns a cache of the routes r selects for host names
+// resolved by resolver, or net.DefaultResolver if it is nil.  DNS answers
+// are kept for ttl, as their own TTL is not known to net.Resolver.
+func NewHostRouteCache(r Router, resolver HostResolver, ttl time.Duration) *HostRouteCache {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &HostRouteCache{r: r, resolver: resolver, ttl: ttl, now: time.Now, hosts: make(map[string]*hostRoute)}
+}
+
+// Route returns the route to the first address of host that can be routed,
+// as EgressRouter.RouteForAddr does, from the cache when possible.
+// Failures are not cached.
+func (c *HostRouteCache) Route(ctx context.Context, host string) (RouteResult, error) {
+	// Lookups of other hosts go on while host is resolved.
+	c.mu.Lock()
+	now := c.now()
+	h := c.hosts[host]
+	c.mu.Unlock()
+	if h == nil || !now.Before(h.expires) {
+		ips, err := c.resolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return RouteResult{}, fmt.Errorf("resolving %s: %w", host, err)
+		}
+		h = &hostRoute{ips: ips, expires: now.Add(c.ttl)}
+		c.mu.Lock()
+		c.hosts[host] = h
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Read the generation first, so that a reload during the lookup makes
+	// the next call route again.
+	d, dynamic := c.r.(DynamicRouter)
+	var generation uint64
+	if dynamic {
+		generation = d.Generation()
+	}
+	if h.routed && h.generation == generation {
+		return h.res, nil
+	}
+	res, err := routeFirst(c.r, host, h.ips)
+	if err != nil {
+		h.routed = false
+		return RouteResult{}, err
+	}
+	h.res, h.generation, h.routed = res, generation, dynamic
+	return res, nil
+}
+
+// Forget drops host from the cache.
+func (c *HostRouteCache) Forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.hosts, host)
+}
@@ -0,0 +1,89 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux && integration
+// +build linux,integration
+
+package routing
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// ipRouteGet is the answer of `ip -json route get`.
+type ipRouteGet struct {
+	Type    string `json:"type"`
+	Dst     string `json:"dst"`
+	Gateway string `json:"gateway"`
+	Dev     string `json:"dev"`
+	PrefSrc string `json:"prefsrc"`
+}
+
+// TestCompareIPRouteGet checks the answers of RouteGet against those of the
+// kernel, as reported by iproute2, for destinations reached through each
+// route of the main and local tables.  Run it with -tags integration as root.
+func TestCompareIPRouteGet(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("not root")
+	}
+	ip, err := exec.LookPath("ip")
+	if err != nil {
+		t.Skip("iproute2 is not installed")
+	}
+	r, err := New()
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	dsts := []net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("2001:4860:4860::8888")}
+	for _, rt := range r.(DynamicRouter).Table().Routes() {
+		if rt.Table != TableMain && rt.Table != TableLocal || rt.Type == TypeMulticast || rt.Dst.IP.IsUnspecified() {
+			continue
+		}
+		// The first address of the prefix, or the only one of a host route.
+		dst := make(net.IP, len(rt.Dst.IP))
+		copy(dst, rt.Dst.IP)
+		if ones, bits := rt.Dst.Mask.Size(); ones < bits {
+			dst[len(dst)-1]++
+		}
+		dsts = append(dsts, dst)
+	}
+
+	for _, dst := range dsts {
+		out, err := exec.Command(ip, "-json", "route", "get", dst.String()).Output()
+		if err != nil {
+			// The kernel has no route either, or it is unreachable.
+			continue
+		}
+		var answers []ipRouteGet
+		if err := json.Unmarshal(out, &answers); err != nil || len(answers) != 1 {
+			t.Fatalf("ip route get %v: %q: %v", dst, out, err)
+		}
+		want := answers[0]
+
+		// Local and broadcast destinations are answered from the local
+		// table, which RouteGet looks up first as the kernel does.
+		res, err := r.(EgressRouter).RouteGet(nil, nil, dst)
+		if err != nil {
+			t.Errorf("%v\ngot:	%v\nwant:	%+v\n\n", dst, err, want)
+			continue
+		}
+		var dev, gateway string
+		if res.Iface != nil {
+			dev = res.Iface.Name
+		}
+		if res.Gateway != nil && !res.Gateway.Equal(dst) {
+			gateway = res.Gateway.String()
+		}
+		if dev != want.Dev || gateway != want.Gateway || !res.PreferredSrc.Equal(net.ParseIP(want.PrefSrc)) || res.IsLocal != (want.Type == "local") {
+			t.Errorf("%v\ngot:	dev %s via %q src %v local %v\nwant:	%s dev %s via %q src %s\n\n", dst, dev, gateway, res.PreferredSrc, res.IsLocal, want.Type, want.Dev, want.Gateway, want.PrefSrc)
+		}
+	}
+}
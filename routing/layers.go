@@ -0,0 +1,87 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
+)
+
+// defaultHopLimit is the TTL, or hop limit, of the headers of
+// PacketHeaders, that of Linux.
+const defaultHopLimit = 64
+
+// PacketHeaders are the link and network layers of a packet sent to a
+// destination, as filled by LinkRouter.PacketHeaders: the caller only needs
+// to set the protocol of the network layer and add its own layers before
+// serializing them.
+type PacketHeaders struct {
+	// Iface is the interface to send the packet on.
+	Iface *net.Interface
+	// Ethernet goes from the hardware address of Iface to that of the next
+	// hop.  DstMAC is left zero when the next hop isn't resolved.
+	Ethernet *layers.Ethernet
+	// Exactly one of IPv4 and IPv6 is set, with the preferred source of the
+	// route as the source address.
+	IPv4 *layers.IPv4
+	IPv6 *layers.IPv6
+}
+
+// Layers returns the headers in the order to serialize them, to which the
+// layers of the caller are appended.
+func (h PacketHeaders) Layers(l ...gopacket.SerializableLayer) []gopacket.SerializableLayer {
+	if h.IPv4 != nil {
+		return append([]gopacket.SerializableLayer{h.Ethernet, h.IPv4}, l...)
+	}
+	return append([]gopacket.SerializableLayer{h.Ethernet, h.IPv6}, l...)
+}
+
+func (r *router) PacketHeaders(dst net.IP) (PacketHeaders, error) {
+	res, err := r.RouteGet(nil, nil, dst)
+	if err != nil {
+		return PacketHeaders{}, err
+	}
+	if res.Iface == nil {
+		// Local routes need not have an output interface.
+		return PacketHeaders{}, fmt.Errorf("%w for %v", ErrOutputNotFound, dst)
+	}
+	h := PacketHeaders{
+		Iface: res.Iface,
+		Ethernet: &layers.Ethernet{
+			SrcMAC: res.Iface.HardwareAddr,
+			DstMAC: make(net.HardwareAddr, 6),
+		},
+	}
+	// The next hop is resolved when possible, but an unresolved one, or a
+	// provider without neighbor table, only leaves DstMAC zero.
+	if p, ok := r.provider.(NeighborProvider); ok && !res.IsLocal && res.Gateway != nil {
+		if mac, err := p.Neighbor(res.Gateway, res.Iface.Index); err == nil {
+			h.Ethernet.DstMAC = mac
+		}
+	}
+	if ip4 := dst.To4(); ip4 != nil {
+		h.Ethernet.EthernetType = layers.EthernetTypeIPv4
+		h.IPv4 = &layers.IPv4{
+			Version: 4,
+			TTL:     defaultHopLimit,
+			SrcIP:   res.PreferredSrc.To4(),
+			DstIP:   ip4,
+		}
+		return h, nil
+	}
+	h.Ethernet.EthernetType = layers.EthernetTypeIPv6
+	h.IPv6 = &layers.IPv6{
+		Version:  6,
+		HopLimit: defaultHopLimit,
+		SrcIP:    res.PreferredSrc,
+		DstIP:    dst,
+	}
+	return h, nil
+}
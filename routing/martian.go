@@ -0,0 +1,78 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"net"
+)
+
+// martianNets are the prefixes whose addresses are not valid destinations
+// on the internet, from the IANA special-purpose address registries.
+var martianNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range []string{
+		"0.0.0.0/8",       // this network
+		"127.0.0.0/8",     // loopback
+		"169.254.0.0/16",  // link-local
+		"192.0.0.0/24",    // IETF protocol assignments
+		"192.0.2.0/24",    // documentation (TEST-NET-1)
+		"198.18.0.0/15",   // benchmarking
+		"198.51.100.0/24", // documentation (TEST-NET-2)
+		"203.0.113.0/24",  // documentation (TEST-NET-3)
+		"240.0.0.0/4",     // reserved, and the limited broadcast address
+		"::/128",          // unspecified
+		"::1/128",         // loopback
+		"100::/64",        // discard-only
+		"2001:db8::/32",   // documentation
+		"3fff::/20",       // documentation
+		"fe80::/10",       // link-local
+	} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func (r *router) IsMartian(dst net.IP) bool {
+	family := FamilyOf(dst)
+	if family == FamilyInvalid {
+		return true
+	}
+	ipv6 := family == FamilyV6
+	dst = canonicalIP(dst, ipv6)
+	martian := false
+	for _, n := range martianNets {
+		if (len(n.IP) == net.IPv6len) == ipv6 && n.Contains(dst) {
+			martian = true
+			break
+		}
+	}
+	if !martian {
+		return false
+	}
+	for _, n := range r.allowedMartians {
+		if n.Contains(dst) {
+			return false
+		}
+	}
+
+	// A route specific to the destination, such as that of a lab network
+	// numbered from a documentation range, makes it routable here.
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rs := r.routes(TableMain, ipv6)
+	for i := range rs {
+		rt := &rs[i]
+		if !isDefaultRoute(rt) && rt.Scope != ScopeHost && r.usable(rt, dst) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"fmt"
+	"net"
+)
+
+// MulticastEntry is a multicast forwarding route, as listed by "ip mroute"
+// on Linux: the packets sent to Group by Source and received on InputIface
+// are forwarded to each of OutputIfaces.
+type MulticastEntry struct {
+	// Source is the unspecified address for the (*,G) entries that apply
+	// to every source.
+	Source, Group net.IP
+	// InputIface and OutputIfaces are interface indices, as in
+	// net.Interface.Index.
+	InputIface   int
+	OutputIfaces []int
+	// Packets and Bytes count the packets forwarded by the entry, and
+	// WrongIface those of Source and Group received on another interface
+	// than InputIface (RTA_MFC_STATS on Linux).
+	Packets, Bytes, WrongIface uint64
+}
+
+// MulticastProvider is implemented by a RouteProvider that also knows the
+// multicast forwarding routes, which New loads with WithMulticastRoutes.
+type MulticastProvider interface {
+	// MulticastRoutes returns the multicast routes of the given address
+	// family, in the same form as Routes.
+	MulticastRoutes(family AddressFamily) ([]MulticastEntry, error)
+}
+
+func (p systemProvider) MulticastRoutes(family AddressFamily) ([]MulticastEntry, error) {
+	return systemMulticastRoutes(family.sysFamily(), p.netlink)
+}
+
+// MulticastRoute returns the multicast route forwarding the packets source
+// sends to group: the (S,G) entry of source and group, or else the (*,G)
+// entry of group.  source may be nil to only look for the latter.  It fails
+// with an error wrapping ErrNoRoute if there is none, and always does for
+// tables loaded without WithMulticastRoutes.
+func (tab *RouteTable) MulticastRoute(group, source net.IP) (MulticastEntry, error) {
+	if FamilyOf(group) == FamilyInvalid || !group.IsMulticast() {
+		return MulticastEntry{}, fmt.Errorf("%v is not a multicast group", group)
+	}
+	var any *MulticastEntry
+	for i := range tab.multicast {
+		m := &tab.multicast[i]
+		if !m.Group.Equal(group) {
+			continue
+		}
+		switch {
+		case source != nil && m.Source.Equal(source):
+			return *m, nil
+		case m.Source.IsUnspecified() && any == nil:
+			any = m
+		}
+	}
+	if any == nil {
+		return MulticastEntry{}, fmt.Errorf("%w for %v from %v", ErrNoRoute, group, source)
+	}
+	return *any, nil
+}
+
+// loadMulticast reads the multicast routes of the provider, if asked to
+// with WithMulticastRoutes and if it has any.
+func (r *router) loadMulticast() ([]MulticastEntry, error) {
+	p, ok := r.provider.(MulticastProvider)
+	if !r.multicastRoutes || !ok {
+		return nil, nil
+	}
+	all, err := p.MulticastRoutes(r.family)
+	if err != nil {
+		return nil, err
+	}
+	var routes []MulticastEntry
+	for _, m := range all {
+		if familyEnabled(r.family, FamilyOf(m.Group) == FamilyV6) {
+			routes = append(routes, m)
+		}
+	}
+	return routes, nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrNeighborUnresolved is wrapped by the error returned by GatewayNeighbor
+// when the neighbor table has no usable entry for the next hop: none at all,
+// or one whose resolution is still in progress or failed.  Sending a packet
+// to the next hop, such as a UDP datagram, makes the system resolve it.
+var ErrNeighborUnresolved = errors.New("neighbor not resolved")
+
+// NeighborProvider is implemented by a RouteProvider that also knows the
+// neighbor table, the link-layer addresses resolved by ARP and neighbor
+// discovery.
+type NeighborProvider interface {
+	// Neighbor returns the link-layer address of ip on the interface of
+	// the given index.  It fails with an error wrapping
+	// ErrNeighborUnresolved if it is not known.
+	Neighbor(ip net.IP, ifindex int) (net.HardwareAddr, error)
+}
+
+func (p systemProvider) Neighbor(ip net.IP, ifindex int) (net.HardwareAddr, error) {
+	return systemNeighbor(ip, ifindex, p.netlink)
+}
+
+func (r *router) GatewayNeighbor(dst net.IP) (net.HardwareAddr, error) {
+	p, ok := r.provider.(NeighborProvider)
+	if !ok {
+		return nil, errors.New("neighbor table not available from the provider")
+	}
+	target, iface, err := r.L2Target(dst)
+	if err != nil {
+		return nil, err
+	}
+	mac, err := p.Neighbor(target, iface.Index)
+	if err != nil {
+		return nil, fmt.Errorf("next hop %v of %v: %w", target, dst, err)
+	}
+	return mac, nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// NewInNamespace creates a router reading the tables of the network
+// namespace at nsPath, such as /run/netns/<name> as "ip netns add" creates,
+// instead of those of the calling thread.  The namespace stays open, and
+// Refresh reads it again, until the router is closed: it implements
+// io.Closer, whose Close releases the namespace.
+//
+// Entering the namespace takes CAP_SYS_ADMIN.  The router is notified of
+// no change by Subscribe, which watches the caller's namespace, so
+// WaitForRoute and DefaultRouteChanges poll.  The namespace is ignored
+// with WithProvider.
+func NewInNamespace(nsPath string, opts ...Option) (Router, error) {
+	ns, err := os.Open(nsPath)
+	if err != nil {
+		return nil, err
+	}
+	return newInNamespace(ns, opts)
+}
+
+// NewForPID creates a router reading the tables of the network namespace
+// of the process pid, as NewInNamespace does with /proc/<pid>/ns/net.
+func NewForPID(pid int, opts ...Option) (Router, error) {
+	if _, err := os.Stat("/proc/self/ns/net"); err != nil {
+		return nil, fmt.Errorf("network namespaces not available, /proc may not be mounted: %w", err)
+	}
+	ns, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no process %d: %w", pid, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newInNamespace(ns, opts)
+}
+
+// newInNamespace creates a router reading the tables of the network
+// namespace ns, which it closes if that fails.
+func newInNamespace(ns *os.File, opts []Option) (Router, error) {
+	r, err := New(append(opts, withNetns(ns))...)
+	if err != nil {
+		ns.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close releases the network namespace of a router of NewInNamespace or
+// NewForPID, after which Refresh fails.  It does nothing for other routers.
+func (r *router) Close() error {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+	if r.netns == nil {
+		return nil
+	}
+	return r.netns.Close()
+}
+
+// withNetns makes the system provider read the tables of the network
+// namespace ns.
+func withNetns(ns *os.File) Option {
+	return optionFunc(func(r *router) {
+		r.netns = ns
+	})
+}
+
+// inNamespace calls fn on a thread in the network namespace ns, or on the
+// calling one if ns is nil.  The thread is left to exit afterwards rather
+// than switched back, as it may fail to be.
+func inNamespace(ns *os.File, fn func() error) error {
+	if ns == nil {
+		return fn()
+	}
+	done := make(chan error)
+	go func() {
+		// Never unlocked, so that the thread exits with the goroutine.
+		runtime.LockOSThread()
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			done <- fmt.Errorf("entering network namespace %s: %w", ns.Name(), os.NewSyscallError("setns", err))
+			return
+		}
+		done <- fn()
+	}()
+	return <-done
+}
+
+// socket opens a netlink socket in the namespace of nl.  Sockets stay in
+// the namespace they were opened in.
+func (nl netlinkConfig) socket(flags int) (fd int, err error) {
+	err = inNamespace(nl.netns, func() error {
+		fd, err = unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|flags, unix.NETLINK_ROUTE)
+		return os.NewSyscallError("socket", err)
+	})
+	return fd, err
+}
+
+func systemInterfaces(nl netlinkConfig) (ifaces []net.Interface, err error) {
+	err = inNamespace(nl.netns, func() error {
+		ifaces, err = net.Interfaces()
+		return err
+	})
+	return ifaces, err
+}
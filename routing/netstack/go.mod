@@ -0,0 +1,14 @@
+module github.com/gopacket/gopacket/routing/netstack
+
+go 1.26.3
+
+require github.com/gopacket/gopacket v0.0.0
+
+require (
+	golang.org/x/exp v0.0.0-20250711185948-6ae5c78190dc // indirect
+	golang.org/x/sys v0.43.0 // indirect
+	golang.org/x/time v0.15.0 // indirect
+	gvisor.dev/gvisor v0.0.0-20260527191743-a81fd9dd382e
+)
+
+replace github.com/gopacket/gopacket => ../..
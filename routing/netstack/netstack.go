@@ -0,0 +1,119 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package netstack reads the routing table of a gVisor netstack, the
+// userspace network stack of gVisor sandboxes and of tools such as
+// wireguard-go and tun2socks, for a routing.Router.
+//
+// The package is a module of its own, so that the routing package and the
+// programs not using it don't depend on gVisor.
+package netstack
+
+import (
+	"net"
+
+	"github.com/gopacket/gopacket/routing"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// rtaxMTU is the key of the route MTU in routing.RouteEntry.Metrics.
+const rtaxMTU = 2
+
+// Provider is a routing.RouteProvider serving the NICs, addresses and routes
+// of a netstack.  It reads them anew on each call, and so on each Refresh of
+// the Router.
+type Provider struct {
+	s *stack.Stack
+}
+
+// NewProvider returns a Provider reading the table of s.
+func NewProvider(s *stack.Stack) *Provider {
+	return &Provider{s: s}
+}
+
+// New creates a router selecting from the routes of s, as routing.New does
+// with the table of the system.
+func New(s *stack.Stack, opts ...routing.Option) (routing.Router, error) {
+	return routing.New(append(opts, routing.WithProvider(NewProvider(s)))...)
+}
+
+// Interfaces returns a net.Interface for each NIC of the stack, with its
+// NICID as Index.
+func (p *Provider) Interfaces() ([]net.Interface, error) {
+	var ifaces []net.Interface
+	for id, info := range p.s.NICInfo() {
+		iface := net.Interface{
+			Index:        int(id),
+			MTU:          int(info.MTU),
+			Name:         info.Name,
+			HardwareAddr: net.HardwareAddr(info.LinkAddress),
+		}
+		if len(iface.HardwareAddr) == 0 {
+			iface.HardwareAddr = nil
+		}
+		if info.Flags.Up {
+			iface.Flags |= net.FlagUp
+		}
+		if info.Flags.Running {
+			iface.Flags |= net.FlagRunning
+		}
+		if info.Flags.Loopback {
+			iface.Flags |= net.FlagLoopback
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
+
+// Addrs returns the IPv4 and IPv6 addresses of the NIC of iface, as
+// *net.IPNet.
+func (p *Provider) Addrs(iface *net.Interface) ([]net.Addr, error) {
+	info, ok := p.s.NICInfo()[tcpip.NICID(iface.Index)]
+	if !ok {
+		return nil, nil
+	}
+	var addrs []net.Addr
+	for _, pa := range info.ProtocolAddresses {
+		ip := net.IP(pa.AddressWithPrefix.Address.AsSlice())
+		if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+			continue
+		}
+		addrs = append(addrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(pa.AddressWithPrefix.PrefixLen, 8*len(ip))})
+	}
+	return addrs, nil
+}
+
+// Routes returns the routes of the stack's table, which are all of
+// routing.TableMain.  The netstack selects the first route of its table
+// that matches, which it keeps sorted from the longest prefix, so routes
+// of the same prefix are given increasing priorities in the order of the
+// table.
+func (p *Provider) Routes(family routing.AddressFamily) ([]routing.RouteEntry, error) {
+	var routes []routing.RouteEntry
+	for i, rt := range p.s.GetRouteTable() {
+		id := rt.Destination.ID()
+		dst := net.IP(id.AsSlice())
+		ipv6 := len(dst) == net.IPv6len
+		if family == routing.FamilyV4 && ipv6 || family == routing.FamilyV6 && !ipv6 {
+			continue
+		}
+		entry := routing.RouteEntry{
+			Dst:         net.IPNet{IP: dst, Mask: net.CIDRMask(rt.Destination.Prefix(), 8*len(dst))},
+			OutputIface: int(rt.NIC),
+			Priority:    uint32(i),
+			Table:       routing.TableMain,
+		}
+		if rt.Gateway.Len() != 0 && !rt.Gateway.Unspecified() {
+			entry.Gateway = net.IP(rt.Gateway.AsSlice())
+		}
+		if rt.MTU != 0 {
+			entry.Metrics = map[int]uint32{rtaxMTU: rt.MTU}
+		}
+		routes = append(routes, entry)
+	}
+	return routes, nil
+}
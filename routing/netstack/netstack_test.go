@@ -0,0 +1,81 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package netstack
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gopacket/gopacket/routing"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func newStack(t *testing.T) *stack.Stack {
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+	})
+	t.Cleanup(s.Close)
+	if err := s.CreateNICWithOptions(1, channel.New(16, 1500, "\x02\x00\x00\x00\x00\x01"), stack.NICOptions{Name: "eth0"}); err != nil {
+		t.Fatalf("\ngot:\t%v\nwant:\tnil\n\n", err)
+	}
+	addr := tcpip.AddressWithPrefix{Address: tcpip.AddrFrom4([4]byte{192, 168, 1, 2}), PrefixLen: 24}
+	if err := s.AddProtocolAddress(1, tcpip.ProtocolAddress{Protocol: ipv4.ProtocolNumber, AddressWithPrefix: addr}, stack.AddressProperties{}); err != nil {
+		t.Fatalf("\ngot:\t%v\nwant:\tnil\n\n", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: addr.Subnet(), NIC: 1},
+		{Destination: header.IPv4EmptySubnet, Gateway: tcpip.AddrFrom4([4]byte{192, 168, 1, 1}), NIC: 1},
+		{Destination: header.IPv6EmptySubnet, NIC: 1},
+	})
+	return s
+}
+
+func TestProvider(t *testing.T) {
+	p := NewProvider(newStack(t))
+
+	ifaces, err := p.Interfaces()
+	if err != nil || len(ifaces) != 1 || ifaces[0].Index != 1 || ifaces[0].Name != "eth0" || ifaces[0].MTU != 1500 {
+		t.Fatalf("\ngot:\t%+v %v\nwant:\teth0 of index 1\n\n", ifaces, err)
+	}
+	addrs, err := p.Addrs(&ifaces[0])
+	if err != nil || len(addrs) != 1 || addrs[0].String() != "192.168.1.2/24" {
+		t.Errorf("\ngot:\t%v %v\nwant:\t[192.168.1.2/24]\n\n", addrs, err)
+	}
+
+	routes, err := p.Routes(routing.FamilyV4)
+	if err != nil || len(routes) != 2 {
+		t.Fatalf("\ngot:\t%+v %v\nwant:\tthe two IPv4 routes\n\n", routes, err)
+	}
+	if routes[0].Dst.String() != "192.168.1.0/24" || routes[0].Gateway != nil || routes[0].OutputIface != 1 {
+		t.Errorf("\ngot:\t%+v\nwant:\t192.168.1.0/24 on-link on NIC 1\n\n", routes[0])
+	}
+	if routes[1].Dst.String() != "0.0.0.0/0" || !routes[1].Gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("\ngot:\t%+v\nwant:\t0.0.0.0/0 via 192.168.1.1\n\n", routes[1])
+	}
+	if routes, _ := p.Routes(routing.FamilyV6); len(routes) != 1 || routes[0].Dst.String() != "::/0" {
+		t.Errorf("\ngot:\t%+v\nwant:\tthe IPv6 default route\n\n", routes)
+	}
+}
+
+func TestNew(t *testing.T) {
+	r, err := New(newStack(t))
+	if err != nil {
+		t.Fatalf("\ngot:\t%#v\nwant:\tnil\n\n", err)
+	}
+	iface, gateway, src, err := r.Route(net.IPv4(8, 8, 8, 8))
+	if err != nil || iface.Name != "eth0" || !gateway.Equal(net.IPv4(192, 168, 1, 1)) || !src.Equal(net.IPv4(192, 168, 1, 2)) {
+		t.Errorf("\ngot:\t%v %v %v %v\nwant:\teth0 via 192.168.1.1 from 192.168.1.2\n\n", iface, gateway, src, err)
+	}
+	if _, gateway, _, err := r.Route(net.IPv4(192, 168, 1, 7)); err != nil || !gateway.Equal(net.IPv4(192, 168, 1, 7)) {
+		t.Errorf("\ngot:\t%v %v\nwant:\ton-link\n\n", gateway, err)
+	}
+}
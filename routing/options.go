@@ -0,0 +1,238 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"net"
+	"time"
+)
+
+// Option configures a Router created by New.
+type Option interface {
+	apply(r *router)
+}
+
+type optionFunc func(r *router)
+
+func (f optionFunc) apply(r *router) {
+	f(r)
+}
+
+// WithFamily restricts the Router to a single address family, either
+// FamilyV4 or FamilyV6.  Only the routes and interface addresses of that
+// family are loaded, and routing a destination of the other family fails
+// with ErrFamilyDisabled.  FamilyAll, the default, loads both families.
+func WithFamily(family AddressFamily) Option {
+	return optionFunc(func(r *router) {
+		r.family = family
+	})
+}
+
+// WithProvider makes New load the table from p instead of the operating
+// system.
+func WithProvider(p RouteProvider) Option {
+	return optionFunc(func(r *router) {
+		r.provider = p
+	})
+}
+
+// WithIgnoreDuplicateIndex makes the Router keep the first of several
+// interfaces reporting the same index, and log the others, instead of
+// failing to load.
+func WithIgnoreDuplicateIndex() Option {
+	return optionFunc(func(r *router) {
+		r.ignoreDuplicateIndex = true
+	})
+}
+
+// WithNetlinkBufferSize sets the receive buffer size, in bytes, of the
+// netlink socket the Linux routing table is dumped from.  A buffer larger
+// than the system default helps load very large tables, such as full BGP
+// feeds, without dropping messages; the kernel may cap it (see
+// net.core.rmem_max).  It has no effect on other platforms or with
+// WithProvider.
+func WithNetlinkBufferSize(n int) Option {
+	return optionFunc(func(r *router) {
+		r.netlinkBufferSize = n
+	})
+}
+
+// WithLoadTimeout makes New and Refresh fail with an error wrapping
+// ErrLoadTimeout when reading the table takes longer than d, rather than
+// blocking the caller until the system, or the provider, answers.  On Linux
+// the netlink sockets also stop waiting for a reply after d.  Other
+// providers can't be interrupted: the next Refresh waits for the load given
+// up on, and uses its table, rather than starting another one.
+func WithLoadTimeout(d time.Duration) Option {
+	return optionFunc(func(r *router) {
+		r.loadTimeout = d
+	})
+}
+
+// WithConnectFallback makes lookups that find no route in the loaded table
+// fall back to asking the operating system, by connecting a UDP socket to
+// the destination, which sends no packet, and reading the source address
+// it was given.  This helps on platforms where the table can only be read
+// in part.  The interface and source of the result are then known, but its
+// Gateway is nil.
+func WithConnectFallback() Option {
+	return optionFunc(func(r *router) {
+		r.connectFallback = true
+	})
+}
+
+// WithStats makes the Router count its lookups and refreshes, as reported
+// by Stats.
+func WithStats() Option {
+	return optionFunc(func(r *router) {
+		r.stats = &routerStats{}
+	})
+}
+
+// WithMetricOverride makes the Router select routes by the priority f
+// returns for each of them instead of their own, to bias the selection
+// without changing the system table, for instance to prefer an uplink.  f
+// is called on every route as the table is loaded, by New and Refresh, and
+// may return rt.Priority to keep it; lower is better.  The routes reported
+// by Routes carry the priority f returned.
+func WithMetricOverride(f func(rt RouteEntry) int) Option {
+	return optionFunc(func(r *router) {
+		r.metricOverride = f
+	})
+}
+
+// WithSkipExpired makes the Router skip the routes whose ValidLifetime has
+// elapsed, such as IPv6 routes from router advertisements that were not
+// renewed, as the kernel would have removed them by now.  Routes are
+// still reported by Routes until the next Refresh.
+func WithSkipExpired() Option {
+	return optionFunc(func(r *router) {
+		r.skipExpired = true
+	})
+}
+
+// WithIncludeDownInterfaces makes the Router flag the routes whose output
+// interface is not up with RouteIfaceDown, to tell where packets would go
+// once the interface is up.  Lookups prefer the routes through interfaces
+// that are up, and only select a flagged route when no other one applies.
+// Without it, such routes are selected like any other, as the tables given
+// to NewFromRoutes often leave the interface flags out.
+func WithIncludeDownInterfaces() Option {
+	return optionFunc(func(r *router) {
+		r.includeDown = true
+	})
+}
+
+// WithAllowedMartians makes IsMartian accept the destinations of the given
+// prefixes, for networks that do route some special-purpose addresses
+// without a route specific to them.
+func WithAllowedMartians(prefixes ...net.IPNet) Option {
+	return optionFunc(func(r *router) {
+		r.allowedMartians = append(r.allowedMartians, prefixes...)
+	})
+}
+
+// WithUnspecifiedDestination makes the Router route the unspecified address,
+// 0.0.0.0 or ::, as any other destination, which only the default routes
+// apply to, instead of failing with ErrUnspecifiedDestination.
+func WithUnspecifiedDestination() Option {
+	return optionFunc(func(r *router) {
+		r.unspecifiedDst = true
+	})
+}
+
+// WithMulticastRoutes makes the Router also load the multicast forwarding
+// routes, as reported by MulticastRoute, from providers implementing
+// MulticastProvider.  The system provider reads them on Linux only, where
+// they are set up by multicast routing daemons.
+func WithMulticastRoutes() Option {
+	return optionFunc(func(r *router) {
+		r.multicastRoutes = true
+	})
+}
+
+// WithPreferIPv6 makes PrimaryInterface prefer the IPv6 default route to
+// the IPv4 one when there are both.
+func WithPreferIPv6() Option {
+	return optionFunc(func(r *router) {
+		r.preferIPv6 = true
+	})
+}
+
+// WithProtocolFilter makes the Router ignore the routes installed by the
+// given protocols, as if they were not in the table, for instance the
+// routes learned from DHCP.  Protocols are compared by RouteEntry.Protocol,
+// which Windows routes also have, so the filter works the same there.
+func WithProtocolFilter(ignore ...RouteProtocol) Option {
+	return optionFunc(func(r *router) {
+		if r.ignoredProtocols == nil {
+			r.ignoredProtocols = make(map[RouteProtocol]bool)
+		}
+		for _, p := range ignore {
+			r.ignoredProtocols[p] = true
+		}
+	})
+}
+
+// WithStableSourceAddresses makes the Router select temporary IPv6
+// addresses (AddrTemporary) as source only when the output interface has no
+// stable address for the destination, for applications whose peers must
+// see the same address over time.
+func WithStableSourceAddresses() Option {
+	return optionFunc(func(r *router) {
+		r.stableSources = true
+	})
+}
+
+// WithLocalSourceAddresses makes SourceAddresses also list the loopback and
+// link-local addresses, which only reach the machine itself or its link.
+func WithLocalSourceAddresses() Option {
+	return optionFunc(func(r *router) {
+		r.localSources = true
+	})
+}
+
+// WithSlaveInterfaces makes lookups return the interface of the route even
+// when it is enslaved to a bond, team or bridge, rather than that master,
+// which the traffic logically leaves through.  Masters are only known on
+// Linux and from providers implementing MasterProvider.
+func WithSlaveInterfaces() Option {
+	return optionFunc(func(r *router) {
+		r.slaveIfaces = true
+	})
+}
+
+// WithSubnetCache makes RouteGet, and Route, cache their results by the /24
+// network of IPv4 destinations and the /64 of IPv6 ones, for much higher hit
+// rates than a cache by destination when scanning ranges, since the hosts
+// of a network are usually routed alike.  The cache is emptied as the table
+// is reloaded, as told by Generation, and lookups given an input interface
+// or a source are not cached.
+//
+// The cache trades a little exactness for speed.  A network holding a more
+// specific route of any table, such as a host route, is never cached, nor
+// are local results, but a destination is otherwise given the result of
+// another of its network: policy rules matching more specific destinations,
+// and the source addresses of networks holding several subnets of the
+// machine's addresses, are not told apart.
+func WithSubnetCache() Option {
+	return optionFunc(func(r *router) {
+		r.cache = &subnetCache{}
+	})
+}
+
+// familyEnabled reports whether routes of the given family are loaded with
+// the family of WithFamily.
+func familyEnabled(family AddressFamily, ipv6 bool) bool {
+	switch family {
+	case FamilyV4:
+		return !ipv6
+	case FamilyV6:
+		return ipv6
+	}
+	return true
+}
@@ -4,13 +4,64 @@
 // that can be found in the LICENSE file in the root of the source
 // tree.
 
-//go:build !(linux || windows)
-// +build !linux,!windows
+//go:build !(linux || windows || js)
+// +build !linux,!windows,!js
 
 // Package routing is currently only supported in Linux and Windows, but the build system requires a valid go file for all architectures.
+//
+// This includes Solaris and illumos.  Should their routing sockets be read
+// some day, only the default routing instance would be at first; reading
+// another one would take a field of systemProvider naming it, passed down to
+// systemRoutes like its netlink settings.
 
 package routing
 
-func (r *router) setupRouteTable() error {
+import (
+	"net"
+)
+
+func systemRoutes(family int, nl netlinkConfig) ([]RouteEntry, string, error) {
 	panic("router only implemented in linux and windows")
 }
+
+func systemInterfaces(nl netlinkConfig) ([]net.Interface, error) {
+	return net.Interfaces()
+}
+
+func systemAddrs(iface *net.Interface, nl netlinkConfig) ([]net.Addr, error) {
+	return iface.Addrs()
+}
+
+// systemAltNames returns no names: interfaces only have alternative names
+// on Linux.
+func systemAltNames(nl netlinkConfig) (map[int][]string, error) {
+	return nil, nil
+}
+
+// systemMasters returns no masters: they are only read on Linux.
+func systemMasters(nl netlinkConfig) (map[int]int, error) {
+	return nil, nil
+}
+
+// systemMulticastRoutes returns no routes: multicast routes are only read
+// on Linux.
+func systemMulticastRoutes(family int, nl netlinkConfig) ([]MulticastEntry, error) {
+	return nil, nil
+}
+
+// systemRules returns no rules: policy routing is only read on Linux.
+func systemRules(family int, nl netlinkConfig) ([]Rule, error) {
+	return nil, nil
+}
+
+func systemRouteGet(dst net.IP) (RouteResult, error) {
+	return RouteResult{}, ErrUnsupportedPlatform
+}
+
+func systemNeighbor(ip net.IP, ifindex int, nl netlinkConfig) (net.HardwareAddr, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func systemSocketInfo(fd int) (local, peer net.IP, device string, err error) {
+	return nil, nil, "", ErrUnsupportedPlatform
+}
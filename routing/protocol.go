@@ -0,0 +1,146 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// RouteProtocol tells what installed a route.  The values are those of
+// RTPROT_* on Linux; the origins of Windows routes are mapped to the
+// closest of them.
+type RouteProtocol uint8
+
+const (
+	ProtocolUnspec   RouteProtocol = 0
+	ProtocolRedirect RouteProtocol = 1 // ICMP redirect
+	ProtocolKernel   RouteProtocol = 2 // the kernel, or well known on Windows
+	ProtocolBoot     RouteProtocol = 3 // at boot, or by ip route without proto
+	ProtocolStatic   RouteProtocol = 4 // the administrator, manual on Windows
+	ProtocolRA       RouteProtocol = 9 // IPv6 router advertisements
+	ProtocolDHCP     RouteProtocol = 16
+)
+
+var protocolNames = map[RouteProtocol]string{
+	ProtocolUnspec:   "unspec",
+	ProtocolRedirect: "redirect",
+	ProtocolKernel:   "kernel",
+	ProtocolBoot:     "boot",
+	ProtocolStatic:   "static",
+	ProtocolRA:       "ra",
+	ProtocolDHCP:     "dhcp",
+}
+
+// String returns the name iproute2 gives p, or its number.
+func (p RouteProtocol) String() string {
+	if name, ok := protocolNames[p]; ok {
+		return name
+	}
+	return strconv.Itoa(int(p))
+}
+
+// parseProtocol parses a protocol number or one of the names iproute2
+// knows without rt_protos.
+func parseProtocol(s string) (RouteProtocol, error) {
+	for p, name := range protocolNames {
+		if s == name {
+			return p, nil
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol %q", s)
+	}
+	return RouteProtocol(n), nil
+}
+
+// RouteType is the kind of a route.  The values are those of RTN_* on
+// Linux.
+type RouteType uint8
+
+const (
+	TypeUnspec      RouteType = 0
+	TypeUnicast     RouteType = 1  // a gateway or directly connected network
+	TypeLocal       RouteType = 2  // an address of the local machine
+	TypeBroadcast   RouteType = 3  // a broadcast address, sent as broadcast
+	TypeAnycast     RouteType = 4  // a local anycast address
+	TypeMulticast   RouteType = 5  // a multicast route
+	TypeBlackhole   RouteType = 6  // packets are silently dropped
+	TypeUnreachable RouteType = 7  // packets are rejected as unreachable
+	TypeProhibit    RouteType = 8  // packets are rejected as prohibited
+	TypeThrow       RouteType = 9  // the lookup goes on with the next rule
+	TypeNAT         RouteType = 10 // obsolete stateless NAT
+)
+
+var typeNames = map[RouteType]string{
+	TypeUnspec:      "none",
+	TypeUnicast:     "unicast",
+	TypeLocal:       "local",
+	TypeBroadcast:   "broadcast",
+	TypeAnycast:     "anycast",
+	TypeMulticast:   "multicast",
+	TypeBlackhole:   "blackhole",
+	TypeUnreachable: "unreachable",
+	TypeProhibit:    "prohibit",
+	TypeThrow:       "throw",
+	TypeNAT:         "nat",
+}
+
+// String returns the name iproute2 gives t, or its number.
+func (t RouteType) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return strconv.Itoa(int(t))
+}
+
+// parseType parses a route type as printed by iproute2.
+func parseType(s string) (RouteType, error) {
+	for t, name := range typeNames {
+		if s == name && t != TypeUnspec {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid route type %q", s)
+}
+
+// RoutePreference is the preference of an IPv6 route learned from a router
+// advertisement (RFC 4191), which ranks it among the routes of the same
+// prefix length and priority.  The zero value is PreferenceMedium, the
+// preference of every other route.
+type RoutePreference int8
+
+const (
+	PreferenceLow    RoutePreference = -1
+	PreferenceMedium RoutePreference = 0
+	PreferenceHigh   RoutePreference = 1
+)
+
+var preferenceNames = map[RoutePreference]string{
+	PreferenceLow:    "low",
+	PreferenceMedium: "medium",
+	PreferenceHigh:   "high",
+}
+
+// String returns the name iproute2 gives p.
+func (p RoutePreference) String() string {
+	if name, ok := preferenceNames[p]; ok {
+		return name
+	}
+	return strconv.Itoa(int(p))
+}
+
+// parsePreference parses a preference as printed by iproute2.
+func parsePreference(s string) (RoutePreference, error) {
+	for p, name := range preferenceNames {
+		if s == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid preference %q", s)
+}
@@ -0,0 +1,296 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"math"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// RouteProvider supplies the interfaces, addresses and routes a Router
+// selects from.  The default provider reads them from the operating system;
+// a custom provider given to New with WithProvider lets the selection logic
+// run on routes from any other source, such as a configuration file or a
+// captured table.
+//
+// Userspace network stacks plug in the same way, as the gVisor netstack
+// does with the provider of the routing/netstack package.
+type RouteProvider interface {
+	// Interfaces returns the network interfaces routes may refer to.
+	Interfaces() ([]net.Interface, error)
+
+	// Addrs returns the addresses assigned to iface.  A *net.IPAddr is
+	// taken as a host address, with a /32 or /128 prefix.  Addresses other
+	// than *net.IPNet, *net.IPAddr and *InterfaceAddr are ignored.
+	Addrs(iface *net.Interface) ([]net.Addr, error)
+
+	// Routes returns the routes of the given address family, FamilyV4,
+	// FamilyV6, or FamilyAll for both.  The routes need not be sorted.
+	Routes(family AddressFamily) ([]RouteEntry, error)
+}
+
+// allAddrsProvider is implemented by the providers reading the addresses of
+// every interface at once more cheaply than those of each in turn, as the
+// system provider does on Linux with a single netlink dump.
+type allAddrsProvider interface {
+	// allAddrs returns the addresses of every interface, keyed by index.
+	allAddrs() (map[int][]net.Addr, error)
+}
+
+// RuleProvider is implemented by a RouteProvider that also knows the policy
+// routing rules choosing between route tables.  Without it, lookups only
+// use TableMain.
+type RuleProvider interface {
+	// Rules returns the rules of the given address family, in the same
+	// form as Routes.  The rules need not be sorted.
+	Rules(family AddressFamily) ([]Rule, error)
+}
+
+// AltNameProvider is implemented by a RouteProvider that also knows the
+// alternative names of interfaces, such as those Linux gives with
+// "ip link property add ... altname".
+type AltNameProvider interface {
+	// AltNames returns the alternative names of the interfaces that have
+	// some, keyed by interface index.
+	AltNames() (map[int][]string, error)
+}
+
+// MasterProvider is implemented by a RouteProvider that also knows which
+// interfaces are enslaved to an aggregate interface, a bond, team or
+// bridge, which the traffic routed to them logically leaves through.
+type MasterProvider interface {
+	// Masters returns the index of the master of the enslaved interfaces,
+	// keyed by their own index.  Interfaces enslaved to other kinds of
+	// masters, such as VRF devices, are left out.
+	Masters() (map[int]int, error)
+}
+
+// SystemProvider returns the RouteProvider that reads the kernel's routing
+// table.  It is the provider New uses unless WithProvider is given.
+func SystemProvider() RouteProvider {
+	return systemProvider{}
+}
+
+// The backends a table may be read from, as reported by RouteTable.Source.
+const (
+	// SourceNetlink is the Linux netlink route dump.
+	SourceNetlink = "netlink"
+	// SourceIPHelper is GetIpForwardTable2 of the Windows IP Helper API.
+	SourceIPHelper = "GetIpForwardTable2"
+	// SourceWMI is the Win32_IP4RouteTable class of WMI, which the IPv4
+	// routes are queried from on Windows when GetIpForwardTable2 is missing
+	// or fails; the IPv6 routes are still read from GetIpForwardTable2.
+	SourceWMI = "Win32_IP4RouteTable"
+	// SourceProvider is a RouteProvider given with WithProvider, or the
+	// routes given to DynamicRouter.SetTable.
+	SourceProvider = "provider"
+)
+
+type systemProvider struct {
+	netlink netlinkConfig
+}
+
+// netlinkConfig configures the netlink sockets the Linux tables are dumped
+// from.
+type netlinkConfig struct {
+	// bufferSize is the receive buffer size, or 0 for the system default.
+	bufferSize int
+	// timeout is how long to wait for a reply, or 0 for ever.
+	timeout time.Duration
+	// netns is the network namespace to read, or nil for that of the
+	// caller.  Namespaces are only entered on Linux.
+	netns *os.File
+}
+
+func (p systemProvider) Interfaces() ([]net.Interface, error) {
+	return systemInterfaces(p.netlink)
+}
+
+func (p systemProvider) Addrs(iface *net.Interface) ([]net.Addr, error) {
+	return systemAddrs(iface, p.netlink)
+}
+
+func (p systemProvider) Routes(family AddressFamily) ([]RouteEntry, error) {
+	routes, _, err := systemRoutes(family.sysFamily(), p.netlink)
+	return routes, err
+}
+
+func (p systemProvider) Rules(family AddressFamily) ([]Rule, error) {
+	return systemRules(family.sysFamily(), p.netlink)
+}
+
+func (p systemProvider) AltNames() (map[int][]string, error) {
+	return systemAltNames(p.netlink)
+}
+
+func (p systemProvider) Masters() (map[int]int, error) {
+	return systemMasters(p.netlink)
+}
+
+// NewFromRoutes creates a router selecting from the given routes instead of
+// the operating system's table.  addrs holds the addresses of each of ifaces,
+// keyed by interface index, as *net.IPNet, *net.IPAddr or *InterfaceAddr
+// values.  This is mostly useful for tests and for the analysis of captured
+// tables.
+func NewFromRoutes(routes []RouteEntry, ifaces []net.Interface, addrs map[int][]net.Addr, opts ...Option) (Router, error) {
+	p := &staticProvider{ifaces: ifaces, addrs: addrs, routes: routes}
+	return New(append(opts, WithProvider(p))...)
+}
+
+// staticProvider serves a fixed table.
+type staticProvider struct {
+	ifaces []net.Interface
+	addrs  map[int][]net.Addr
+	routes []RouteEntry
+}
+
+func (p *staticProvider) Interfaces() ([]net.Interface, error) {
+	return p.ifaces, nil
+}
+
+func (p *staticProvider) Addrs(iface *net.Interface) ([]net.Addr, error) {
+	return p.addrs[iface.Index], nil
+}
+
+func (p *staticProvider) Routes(family AddressFamily) ([]RouteEntry, error) {
+	return p.routes, nil
+}
+
+// ipv6 reports whether rt is an IPv6 route.  The destination mask length is
+// authoritative; a route without one is judged by its addresses.
+func (rt *RouteEntry) ipv6() bool {
+	switch len(rt.Dst.Mask) {
+	case net.IPv4len:
+		return false
+	case net.IPv6len:
+		return true
+	}
+	for _, ip := range []net.IP{rt.Dst.IP, rt.Gateway, rt.PrefSrc} {
+		if ip != nil {
+			return FamilyOf(ip) == FamilyV6
+		}
+	}
+	return false
+}
+
+// normalize puts the addresses of rt in canonical form, 4 bytes for IPv4
+// and 16 for IPv6, and replaces a zero Dst or Src by the unspecified prefix
+// of the family.
+func (rt *RouteEntry) normalize(ipv6 bool) {
+	rt.Dst = canonicalPrefix(rt.Dst, ipv6)
+	rt.Src = canonicalPrefix(rt.Src, ipv6)
+	rt.Gateway = canonicalIP(rt.Gateway, ipv6)
+	rt.PrefSrc = canonicalIP(rt.PrefSrc, ipv6)
+	if rt.Table == 0 {
+		rt.Table = TableMain
+	}
+}
+
+// clampPriority converts p to a route priority, saturating at the bounds
+// of uint32.
+func clampPriority(p int) uint32 {
+	switch {
+	case p < 0:
+		return 0
+	case uint64(p) > math.MaxUint32:
+		return math.MaxUint32
+	}
+	return uint32(p)
+}
+
+func canonicalIP(ip net.IP, ipv6 bool) net.IP {
+	if ipv6 {
+		if ip16 := ip.To16(); ip16 != nil {
+			return ip16
+		}
+	} else if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func canonicalPrefix(n net.IPNet, ipv6 bool) net.IPNet {
+	if n.IP == nil {
+		bits := 8 * net.IPv4len
+		if ipv6 {
+			bits = 8 * net.IPv6len
+		}
+		return net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(0, bits)}
+	}
+	return net.IPNet{IP: canonicalIP(n.IP, ipv6), Mask: canonicalMask(n)}
+}
+
+// readRoutes reads the routes of the provider, and names the backend they
+// were read from as RouteTable.Source does.
+func (r *router) readRoutes() ([]RouteEntry, string, error) {
+	if p, ok := r.provider.(systemProvider); ok {
+		return systemRoutes(r.family.sysFamily(), p.netlink)
+	}
+	routes, err := r.provider.Routes(r.family)
+	return routes, SourceProvider, err
+}
+
+// loadRoutes reads the routes of the provider, sorted in selection order,
+// those of TableMain apart from the others, and the backend they were read
+// from.  The input interfaces of the routes are named after ifaces.
+func (r *router) loadRoutes(ifaces map[int]*net.Interface) (v4, v6 routeSlice, tables map[uint32]tableRoutes, source string, err error) {
+	routes, source, err := r.readRoutes()
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+	v4, v6, tables = r.sortRoutes(routes, ifaces)
+	return v4, v6, tables, source, nil
+}
+
+// sortRoutes filters and normalizes routes as the options of r require, and
+// sorts them in selection order, those of TableMain apart from the others.
+func (r *router) sortRoutes(routes []RouteEntry, ifaces map[int]*net.Interface) (v4, v6 routeSlice, tables map[uint32]tableRoutes) {
+	tables = make(map[uint32]tableRoutes)
+	for _, rt := range routes {
+		ipv6 := rt.ipv6()
+		if !familyEnabled(r.family, ipv6) {
+			continue
+		}
+		if r.ignoredProtocols[rt.Protocol] {
+			continue
+		}
+		rt.normalize(ipv6)
+		if r.metricOverride != nil {
+			rt.Priority = clampPriority(r.metricOverride(rt))
+		}
+		if iface, ok := ifaces[rt.InputIface]; ok && rt.InputIface != 0 {
+			rt.InputIfaceName = iface.Name
+		}
+		if iface, ok := ifaces[rt.OutputIface]; ok && r.includeDown && iface.Flags&net.FlagUp == 0 {
+			rt.Flags |= RouteIfaceDown
+		}
+		switch {
+		case rt.Table != TableMain:
+			t := tables[rt.Table]
+			if ipv6 {
+				t.v6 = append(t.v6, rt)
+			} else {
+				t.v4 = append(t.v4, rt)
+			}
+			tables[rt.Table] = t
+		case ipv6:
+			v6 = append(v6, rt)
+		default:
+			v4 = append(v4, rt)
+		}
+	}
+	sort.Sort(v4)
+	sort.Sort(v6)
+	for _, t := range tables {
+		sort.Sort(t.v4)
+		sort.Sort(t.v6)
+	}
+	return v4, v6, tables
+}
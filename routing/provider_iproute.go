@@ -0,0 +1,813 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ipRouteProvider serves a routing table parsed from iproute2 output.
+type ipRouteProvider struct {
+	ifaces []net.Interface
+	addrs  map[int][]net.Addr
+	routes []RouteEntry
+}
+
+// NewIPRouteProvider returns a RouteProvider serving the table read from r,
+// which holds the output of `ip route show` or `ip -json route show`.
+// Several dumps may be concatenated, such as those of `ip -4 route` and
+// `ip -6 route`.
+//
+// A dump carries no interface information, so interfaces are synthesized
+// from the dev names, numbered from 1 in order of appearance, and their
+// addresses are taken from the src of each route and from local routes.  The
+// family of a "default" destination is guessed from the rest of its route and
+// is IPv4 if nothing hints at IPv6.
+func NewIPRouteProvider(r io.Reader) (RouteProvider, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var routes []ipRoute
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		routes, err = parseIPRouteJSON(trimmed)
+	} else {
+		routes, err = parseIPRouteText(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newIPRouteProvider(routes)
+}
+
+// NewIPRouteFileProvider is like NewIPRouteProvider, but reads the dump from
+// the named file.
+func NewIPRouteFileProvider(name string) (RouteProvider, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewIPRouteProvider(f)
+}
+
+// ParseRoute parses a route in the syntax of "ip route", such as
+// "10.0.0.0/8 via 192.0.2.1 dev eth0 metric 100", to build tables for
+// NewFromRoutes.  The words of the route may be given as separate arguments
+// or together.  The interface named by dev is looked up in ifaces.  The
+// family of the route is that of its first address, and the others must be
+// of the same family.
+func ParseRoute(ifaces []net.Interface, route ...string) (RouteEntry, error) {
+	fields := strings.Fields(strings.Join(route, " "))
+	var ipr ipRoute
+	if len(fields) > 0 && isRouteType(fields[0]) {
+		ipr.typ, fields = fields[0], fields[1:]
+	}
+	if len(fields) == 0 {
+		return RouteEntry{}, fmt.Errorf("missing destination")
+	}
+	ipr.dst = fields[0]
+	if err := ipr.parseFields(fields[1:]); err != nil {
+		return RouteEntry{}, err
+	}
+	routes, err := ipr.routes(func(dev string) (int, error) {
+		if dev == "" {
+			return 0, nil
+		}
+		for _, iface := range ifaces {
+			if iface.Name == dev {
+				return iface.Index, nil
+			}
+		}
+		return 0, fmt.Errorf("no interface named %q", dev)
+	})
+	if err != nil {
+		return RouteEntry{}, err
+	}
+	return routes[0], nil
+}
+
+// MustRoute is like ParseRoute but panics if the route can't be parsed.
+func MustRoute(ifaces []net.Interface, route ...string) RouteEntry {
+	rt, err := ParseRoute(ifaces, route...)
+	if err != nil {
+		panic(`routing: ParseRoute(` + strconv.Quote(strings.Join(route, " ")) + `): ` + err.Error())
+	}
+	return rt
+}
+
+func (p *ipRouteProvider) Interfaces() ([]net.Interface, error) {
+	return p.ifaces, nil
+}
+
+func (p *ipRouteProvider) Addrs(iface *net.Interface) ([]net.Addr, error) {
+	return p.addrs[iface.Index], nil
+}
+
+func (p *ipRouteProvider) Routes(family AddressFamily) ([]RouteEntry, error) {
+	var routes []RouteEntry
+	for _, rt := range p.routes {
+		if !familyEnabled(family, rt.ipv6()) {
+			continue
+		}
+		routes = append(routes, rt)
+	}
+	return routes, nil
+}
+
+// ipRoute is a route as described by iproute2, before its addresses and
+// interfaces are resolved.
+type ipRoute struct {
+	typ      string
+	dst      string
+	src      string
+	prefSrc  string
+	scope    uint8
+	protocol RouteProtocol
+	metric   uint32
+	pref     RoutePreference
+	realm    uint32
+	tos      uint8
+	table    uint32
+	metrics  map[int]uint32
+	v6Hint   bool
+	nexthops []ipNexthop
+}
+
+type ipNexthop struct {
+	gateway string
+	dev     string
+	weight  int
+	flags   RouteFlags
+}
+
+// isRouteType reports whether s is a route type, which iproute2 prints in
+// front of the destination.
+func isRouteType(s string) bool {
+	_, err := parseType(s)
+	return err == nil
+}
+
+// RTA_METRICS attributes by their iproute2 name, numbered as RTAX_*.
+var ipRouteMetrics = map[string]int{
+	"mtu": rtaxMTU, "window": 3, "rtt": 4, "rttvar": 5, "ssthresh": 6, "cwnd": 7,
+	"advmss": 8, "reordering": 9, "hoplimit": 10, "initcwnd": 11,
+	"features": 12, "rto_min": 13, "initrwnd": 14, "quickack": 15,
+	"fastopen_no_cookie": 17,
+}
+
+// Nexthop flags printed by iproute2 as bare keywords.
+var ipRouteFlags = map[string]RouteFlags{
+	"dead": RouteDead, "onlink": RouteOnLink, "linkdown": RouteLinkDown,
+}
+
+// Keywords that are followed by a value we don't need.
+var ipRouteSkipped = map[string]bool{
+	"expires": true, "error": true, "nhid": true, "congctl": true,
+}
+
+func parseIPRouteText(data []byte) ([]ipRoute, error) {
+	var routes []ipRoute
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "nexthop" {
+			if len(routes) == 0 {
+				return nil, fmt.Errorf("line %d: nexthop without a route", lineno)
+			}
+			rt := &routes[len(routes)-1]
+			if err := rt.parseFields(fields[1:]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			continue
+		}
+		var rt ipRoute
+		if isRouteType(fields[0]) {
+			rt.typ, fields = fields[0], fields[1:]
+		}
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("line %d: missing destination", lineno)
+		}
+		rt.dst = fields[0]
+		if err := rt.parseFields(fields[1:]); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		routes = append(routes, rt)
+	}
+	return routes, scanner.Err()
+}
+
+// parseFields parses the keyword/value pairs following the destination of a
+// route, or following the nexthop keyword of a multipath route.
+func (rt *ipRoute) parseFields(fields []string) error {
+	var nh ipNexthop
+	for i := 0; i < len(fields); i++ {
+		key := fields[i]
+		value := func() (string, error) {
+			i++
+			if i >= len(fields) {
+				return "", fmt.Errorf("missing value for %q", key)
+			}
+			return fields[i], nil
+		}
+		var err error
+		switch {
+		case key == "via":
+			if nh.gateway, err = value(); err == nil && (nh.gateway == "inet" || nh.gateway == "inet6") {
+				nh.gateway, err = value()
+			}
+		case key == "dev":
+			nh.dev, err = value()
+		case key == "weight":
+			var v string
+			if v, err = value(); err == nil {
+				nh.weight, err = strconv.Atoi(v)
+			}
+		case key == "src":
+			rt.prefSrc, err = value()
+		case key == "from":
+			rt.src, err = value()
+		case key == "scope":
+			var v string
+			if v, err = value(); err == nil {
+				rt.scope, err = parseScope(v)
+			}
+		case key == "proto":
+			var v string
+			if v, err = value(); err == nil {
+				rt.protocol, err = parseProtocol(v)
+			}
+		case key == "pref":
+			rt.v6Hint = true
+			var v string
+			if v, err = value(); err == nil {
+				rt.pref, err = parsePreference(v)
+			}
+		case key == "table":
+			var v string
+			if v, err = value(); err == nil {
+				rt.table, err = parseTable(v)
+			}
+		case key == "realm" || key == "realms":
+			var v string
+			if v, err = value(); err == nil {
+				rt.realm, err = parseRealms(v)
+			}
+		case key == "tos" || key == "dsfield":
+			var v string
+			if v, err = value(); err == nil {
+				rt.tos, err = parseDSField(v)
+			}
+		case key == "metric" || key == "priority" || key == "preference":
+			var v string
+			if v, err = value(); err == nil {
+				rt.metric, err = parseUint32(v)
+			}
+		case ipRouteMetrics[key] != 0:
+			var v string
+			if v, err = value(); err == nil && v == "lock" {
+				v, err = value()
+			}
+			if n, perr := parseUint32(v); err == nil && perr == nil {
+				if rt.metrics == nil {
+					rt.metrics = make(map[int]uint32)
+				}
+				rt.metrics[ipRouteMetrics[key]] = n
+			}
+		case ipRouteFlags[key] != 0:
+			nh.flags |= ipRouteFlags[key]
+		case key == "encap":
+			// Lightweight tunnel encapsulations have a variable number of
+			// arguments; nothing after them is needed.
+			i = len(fields)
+		case ipRouteSkipped[key]:
+			_, err = value()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if nh != (ipNexthop{}) {
+		rt.nexthops = append(rt.nexthops, nh)
+	}
+	return nil
+}
+
+func parseUint32(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err
+}
+
+func parseIPRouteFlags(names []string) RouteFlags {
+	var flags RouteFlags
+	for _, name := range names {
+		flags |= ipRouteFlags[name]
+	}
+	return flags
+}
+
+// parseTable parses a table number or one of the names iproute2 knows
+// without rt_tables.
+func parseTable(s string) (uint32, error) {
+	switch s {
+	case "main":
+		return TableMain, nil
+	case "local":
+		return TableLocal, nil
+	case "default":
+		return TableDefault, nil
+	}
+	n, err := parseUint32(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid table %q", s)
+	}
+	return n, nil
+}
+
+// parseScope parses a scope number or one of the names iproute2 knows
+// without rt_scopes.
+func parseScope(s string) (uint8, error) {
+	switch s {
+	case "global", "universe":
+		return ScopeUniverse, nil
+	case "site":
+		return ScopeSite, nil
+	case "link":
+		return ScopeLink, nil
+	case "host":
+		return ScopeHost, nil
+	case "nowhere":
+		return ScopeNowhere, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid scope %q", s)
+	}
+	return uint8(n), nil
+}
+
+// parseRealms parses "TO" or "FROM/TO" into an RTA_FLOW value.
+func parseRealms(s string) (uint32, error) {
+	var from uint32
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		var err error
+		if from, err = parseRealm(s[:i]); err != nil {
+			return 0, err
+		}
+		s = s[i+1:]
+	}
+	to, err := parseRealm(s)
+	return from<<16 | to, err
+}
+
+// parseRealm parses a numeric realm.  Names from rt_realms are not known,
+// except for iproute2's built-in name of realm 0.
+func parseRealm(s string) (uint32, error) {
+	if s == "cosmos" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid realm %q", s)
+	}
+	return uint32(n), nil
+}
+
+// parseDSField parses a TOS byte, in hexadecimal with or without 0x as
+// iproute2 reads it.  Names from rt_dsfield are not known.
+func parseDSField(s string) (uint8, error) {
+	n, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid TOS %q", s)
+	}
+	return uint8(n), nil
+}
+
+// ipRouteJSON is a route as printed by `ip -json route show`.
+type ipRouteJSON struct {
+	Type    string                   `json:"type"`
+	Dst     string                   `json:"dst"`
+	Src     string                   `json:"src"`
+	Gateway string                   `json:"gateway"`
+	Dev     string                   `json:"dev"`
+	Scope   string                   `json:"scope"`
+	Proto   string                   `json:"protocol"`
+	PrefSrc string                   `json:"prefsrc"`
+	Metric  uint32                   `json:"metric"`
+	Pref    string                   `json:"pref"`
+	DSField string                   `json:"dsfield"`
+	Table   string                   `json:"table"`
+	Metrics []map[string]interface{} `json:"metrics"`
+	Flow    *struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	} `json:"flow"`
+	Flags    []string `json:"flags"`
+	Nexthops []struct {
+		Gateway string   `json:"gateway"`
+		Dev     string   `json:"dev"`
+		Weight  int      `json:"weight"`
+		Flags   []string `json:"flags"`
+	} `json:"nexthops"`
+}
+
+func parseIPRouteJSON(data []byte) ([]ipRoute, error) {
+	var routes []ipRoute
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var dump []ipRouteJSON
+		if err := dec.Decode(&dump); err == io.EOF {
+			return routes, nil
+		} else if err != nil {
+			return nil, err
+		}
+		for _, j := range dump {
+			rt := ipRoute{
+				typ:     j.Type,
+				dst:     j.Dst,
+				src:     j.Src,
+				prefSrc: j.PrefSrc,
+				metric:  j.Metric,
+				v6Hint:  j.Pref != "",
+			}
+			if j.Gateway != "" || j.Dev != "" {
+				rt.nexthops = append(rt.nexthops, ipNexthop{gateway: j.Gateway, dev: j.Dev, flags: parseIPRouteFlags(j.Flags)})
+			}
+			for _, nh := range j.Nexthops {
+				rt.nexthops = append(rt.nexthops, ipNexthop{gateway: nh.Gateway, dev: nh.Dev, weight: nh.Weight, flags: parseIPRouteFlags(nh.Flags)})
+			}
+			if j.Table != "" {
+				var err error
+				if rt.table, err = parseTable(j.Table); err != nil {
+					return nil, err
+				}
+			}
+			if j.Scope != "" {
+				var err error
+				if rt.scope, err = parseScope(j.Scope); err != nil {
+					return nil, err
+				}
+			}
+			if j.Proto != "" {
+				var err error
+				if rt.protocol, err = parseProtocol(j.Proto); err != nil {
+					return nil, err
+				}
+			}
+			if j.Pref != "" {
+				var err error
+				if rt.pref, err = parsePreference(j.Pref); err != nil {
+					return nil, err
+				}
+			}
+			if j.DSField != "" {
+				var err error
+				if rt.tos, err = parseDSField(j.DSField); err != nil {
+					return nil, err
+				}
+			}
+			if j.Flow != nil {
+				realms := j.Flow.To
+				if j.Flow.From != "" {
+					realms = j.Flow.From + "/" + realms
+				}
+				var err error
+				if rt.realm, err = parseRealms(realms); err != nil {
+					return nil, err
+				}
+			}
+			for _, m := range j.Metrics {
+				for name, v := range m {
+					n, ok := v.(float64)
+					if typ := ipRouteMetrics[name]; ok && typ != 0 {
+						if rt.metrics == nil {
+							rt.metrics = make(map[int]uint32)
+						}
+						rt.metrics[typ] = uint32(n)
+					}
+				}
+			}
+			routes = append(routes, rt)
+		}
+	}
+}
+
+// ipv6 guesses the family of the route from any address it carries.
+func (rt *ipRoute) ipv6() bool {
+	candidates := []string{rt.dst, rt.src, rt.prefSrc}
+	for _, nh := range rt.nexthops {
+		candidates = append(candidates, nh.gateway)
+	}
+	for _, s := range candidates {
+		if i := strings.IndexByte(s, '/'); i >= 0 {
+			s = s[:i]
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			return ip.To4() == nil
+		}
+	}
+	return rt.v6Hint
+}
+
+// routes converts ipr to a route for each of its nexthops, whose interface
+// index returns the index of.
+func (ipr *ipRoute) routes(index func(dev string) (int, error)) ([]RouteEntry, error) {
+	ipv6 := ipr.ipv6()
+	dst, err := parsePrefix(ipr.dst, ipv6)
+	if err != nil {
+		return nil, err
+	}
+	src, err := parsePrefix(ipr.src, ipv6)
+	if err != nil {
+		return nil, err
+	}
+	rt := RouteEntry{Dst: dst, Src: src, Priority: ipr.metric, Preference: ipr.pref, Realm: ipr.realm, TOS: ipr.tos, Table: ipr.table, Scope: ipr.scope, Protocol: ipr.protocol, Metrics: ipr.metrics}
+	if ipr.typ != "" {
+		if rt.Type, err = parseType(ipr.typ); err != nil {
+			return nil, err
+		}
+	}
+	if ipr.prefSrc != "" {
+		if rt.PrefSrc = parseAddr(ipr.prefSrc, ipv6); rt.PrefSrc == nil {
+			return nil, addrError("src", ipr.prefSrc)
+		}
+	}
+	nexthops := ipr.nexthops
+	if len(nexthops) == 0 {
+		nexthops = []ipNexthop{{}}
+	}
+	var routes []RouteEntry
+	for _, nh := range nexthops {
+		rt := rt
+		if rt.OutputIface, err = index(nh.dev); err != nil {
+			return nil, err
+		}
+		rt.Flags = nh.flags
+		rt.Weight = nh.weight
+		if nh.gateway != "" {
+			if rt.Gateway = parseAddr(nh.gateway, ipv6); rt.Gateway == nil {
+				return nil, addrError("gateway", nh.gateway)
+			}
+		}
+		routes = append(routes, rt)
+	}
+	return routes, nil
+}
+
+// addrError describes why s, an address of a route, is invalid for the
+// family of the route.
+func addrError(what, s string) error {
+	if net.ParseIP(s) != nil {
+		return fmt.Errorf("%s %q is not of the family of the route", what, s)
+	}
+	return fmt.Errorf("invalid %s %q", what, s)
+}
+
+// parsePrefix parses a destination or source selector as printed by
+// iproute2: "default", an address, or a CIDR prefix.
+func parsePrefix(s string, ipv6 bool) (net.IPNet, error) {
+	bits := 8 * net.IPv4len
+	if ipv6 {
+		bits = 8 * net.IPv6len
+	}
+	if s == "" || s == "default" || s == "all" {
+		return net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(0, bits)}, nil
+	}
+	ones := bits
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n < 0 || n > bits {
+			return net.IPNet{}, fmt.Errorf("invalid prefix %q", s)
+		}
+		s, ones = s[:i], n
+	}
+	ip := parseAddr(s, ipv6)
+	if ip == nil {
+		return net.IPNet{}, fmt.Errorf("invalid address %q", s)
+	}
+	mask := net.CIDRMask(ones, bits)
+	return net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+// parseAddr parses s as an address of the given family, returning it in
+// its 4 or 16 byte form, or nil.
+func parseAddr(s string, ipv6 bool) net.IP {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil
+	}
+	if ipv6 {
+		if ip.To4() != nil && !strings.Contains(s, ":") {
+			return nil
+		}
+		return ip.To16()
+	}
+	return ip.To4()
+}
+
+func newIPRouteProvider(ipRoutes []ipRoute) (*ipRouteProvider, error) {
+	p := &ipRouteProvider{addrs: make(map[int][]net.Addr)}
+	devIndex := make(map[string]int)
+	index := func(dev string) (int, error) {
+		if dev == "" {
+			return 0, nil
+		}
+		i, ok := devIndex[dev]
+		if !ok {
+			i = len(p.ifaces) + 1
+			devIndex[dev] = i
+			iface := net.Interface{Index: i, Name: dev, Flags: net.FlagUp}
+			if dev == "lo" {
+				iface.Flags |= net.FlagLoopback
+			}
+			p.ifaces = append(p.ifaces, iface)
+		}
+		return i, nil
+	}
+
+	// local holds the addresses found for each interface, in order.
+	type local struct {
+		ifindex int
+		ip      net.IP
+	}
+	var locals []local
+	for _, ipr := range ipRoutes {
+		routes, err := ipr.routes(index)
+		if err != nil {
+			return nil, err
+		}
+		for _, rt := range routes {
+			p.routes = append(p.routes, rt)
+			if rt.OutputIface == 0 {
+				continue
+			}
+			if rt.PrefSrc != nil {
+				locals = append(locals, local{rt.OutputIface, rt.PrefSrc})
+			}
+			if ipr.typ == "local" {
+				locals = append(locals, local{rt.OutputIface, rt.Dst.IP})
+			}
+		}
+	}
+
+	// Each address gets the mask of the most specific directly connected
+	// route on its interface that isn't a host route, or a host mask if
+	// there is none.
+	seen := make(map[string]bool)
+	for _, l := range locals {
+		key := fmt.Sprintf("%d/%v", l.ifindex, l.ip)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		bits := 8 * len(l.ip)
+		addr := &net.IPNet{IP: l.ip, Mask: net.CIDRMask(bits, bits)}
+		best := -1
+		for _, rt := range p.routes {
+			if rt.OutputIface != l.ifindex || rt.Gateway != nil || len(rt.Dst.IP) != len(l.ip) || !rt.Dst.Contains(l.ip) {
+				continue
+			}
+			if ones, _ := rt.Dst.Mask.Size(); ones > best && ones < bits {
+				best = ones
+				addr.Mask = rt.Dst.Mask
+			}
+		}
+		p.addrs[int(l.ifindex)] = append(p.addrs[int(l.ifindex)], addr)
+	}
+	return p, nil
+}
+
+// WriteIPRoute writes the routes of the table to w, in the order of Routes,
+// as `ip route show table all` prints them, to be compared with the table
+// of the kernel or read back with NewIPRouteProvider.  Each nexthop of a
+// multipath route is on a line of its own.
+func (tab *RouteTable) WriteIPRoute(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, rt := range tab.Routes() {
+		bw.WriteString(tab.formatIPRoute(&rt))
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// formatIPRoute formats rt as a line of `ip route show`, without the
+// keywords whose value is the default.
+func (tab *RouteTable) formatIPRoute(rt *RouteEntry) string {
+	var b strings.Builder
+	switch {
+	case rt.Type != TypeUnspec && rt.Type != TypeUnicast:
+		b.WriteString(rt.Type.String() + " ")
+	case rt.Table == TableLocal && rt.Scope == ScopeHost:
+		b.WriteString("local ")
+	}
+	if ones, bits := rt.Dst.Mask.Size(); ones == 0 {
+		b.WriteString("default")
+	} else if ones == bits {
+		b.WriteString(rt.Dst.IP.String())
+	} else {
+		b.WriteString(rt.Dst.String())
+	}
+	if ones, _ := rt.Src.Mask.Size(); ones > 0 {
+		fmt.Fprintf(&b, " from %v", &rt.Src)
+	}
+	if rt.TOS != 0 {
+		fmt.Fprintf(&b, " tos 0x%02x", rt.TOS)
+	}
+	if rt.Gateway != nil && !rt.Gateway.IsUnspecified() {
+		fmt.Fprintf(&b, " via %v", rt.Gateway)
+	}
+	if rt.OutputIface != 0 {
+		fmt.Fprintf(&b, " dev %s", tab.ifaceName(rt.OutputIface))
+	}
+	if rt.Weight != 0 {
+		fmt.Fprintf(&b, " weight %d", rt.Weight)
+	}
+	if rt.Table != TableMain {
+		fmt.Fprintf(&b, " table %s", formatTable(rt.Table))
+	}
+	if rt.Protocol != ProtocolBoot {
+		fmt.Fprintf(&b, " proto %v", rt.Protocol)
+	}
+	if rt.Scope != ScopeUniverse {
+		fmt.Fprintf(&b, " scope %s", formatScope(rt.Scope))
+	}
+	if rt.PrefSrc != nil {
+		fmt.Fprintf(&b, " src %v", rt.PrefSrc)
+	}
+	if rt.Priority != 0 || rt.ipv6() {
+		fmt.Fprintf(&b, " metric %d", rt.Priority)
+	}
+	for _, flag := range []string{"dead", "onlink", "linkdown"} {
+		if rt.Flags&ipRouteFlags[flag] != 0 {
+			b.WriteString(" " + flag)
+		}
+	}
+	if rt.Realm>>16 != 0 {
+		fmt.Fprintf(&b, " realms %d/%d", rt.Realm>>16, rt.Realm&0xffff)
+	} else if rt.Realm != 0 {
+		fmt.Fprintf(&b, " realm %d", rt.Realm)
+	}
+	keys := make([]int, 0, len(rt.Metrics))
+	for key := range rt.Metrics {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	for _, key := range keys {
+		for name, k := range ipRouteMetrics {
+			if k == key {
+				fmt.Fprintf(&b, " %s %d", name, rt.Metrics[key])
+			}
+		}
+	}
+	if rt.ipv6() {
+		fmt.Fprintf(&b, " pref %v", rt.Preference)
+	}
+	return b.String()
+}
+
+// formatTable returns the name iproute2 gives table without rt_tables.
+func formatTable(table uint32) string {
+	switch table {
+	case TableMain:
+		return "main"
+	case TableLocal:
+		return "local"
+	case TableDefault:
+		return "default"
+	}
+	return strconv.FormatUint(uint64(table), 10)
+}
+
+// formatScope returns the name iproute2 gives scope without rt_scopes.
+func formatScope(scope uint8) string {
+	switch scope {
+	case ScopeUniverse:
+		return "global"
+	case ScopeSite:
+		return "site"
+	case ScopeLink:
+		return "link"
+	case ScopeHost:
+		return "host"
+	case ScopeNowhere:
+		return "nowhere"
+	}
+	return strconv.Itoa(int(scope))
+}
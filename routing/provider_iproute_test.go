@@ -0,0 +1,253 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func openIPRouteDumps(t *testing.T, names ...string) RouteProvider {
+	var readers []io.Reader
+	for _, name := range names {
+		f, err := os.Open("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+	p, err := NewIPRouteProvider(io.MultiReader(readers...))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	return p
+}
+
+func TestIPRouteProvider(t *testing.T) {
+	for _, format := range []string{"txt", "json"} {
+		t.Run(format, func(t *testing.T) {
+			p := openIPRouteDumps(t, "iproute-v4."+format, "iproute-v6."+format)
+
+			ifaces, _ := p.Interfaces()
+			if len(ifaces) != 2 || ifaces[0].Name != "eth0" || ifaces[1].Name != "wlan0" {
+				t.Errorf("\ngot:	%+v\nwant:	eth0 and wlan0\n\n", ifaces)
+			}
+
+			v4, _ := p.Routes(FamilyV4)
+			if len(v4) != 7 {
+				t.Errorf("\ngot:	%d IPv4 routes\nwant:	7\n\n", len(v4))
+			}
+			v6, _ := p.Routes(FamilyV6)
+			if len(v6) != 4 {
+				t.Errorf("\ngot:	%d IPv6 routes\nwant:	4\n\n", len(v6))
+			}
+			for _, rt := range v4 {
+				if rt.Dst.String() == "172.16.0.0/12" && (rt.Priority != 50 || rt.Realm != 2<<16|5 || rt.Metrics[2] != 1400 || rt.Protocol != ProtocolStatic) {
+					t.Errorf("\ngot:	%+v\nwant:	metric 50, realms 2/5, mtu 1400, proto static\n\n", rt)
+				}
+				if rt.Dst.String() == "203.0.113.0/24" && rt.TOS != 0x10 {
+					t.Errorf("\ngot:	%#x\nwant:	0x10\n\n", rt.TOS)
+				}
+				if rt.Dst.String() == "0.0.0.0/0" && rt.Protocol != ProtocolDHCP {
+					t.Errorf("\ngot:	%v\nwant:	%v\n\n", rt.Protocol, ProtocolDHCP)
+				}
+			}
+
+			r, err := New(WithProvider(p))
+			if err != nil {
+				t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+			}
+			tests := []struct {
+				dst                 string
+				iface, gateway, src string
+			}{
+				{"8.8.8.8", "eth0", "192.168.1.1", "192.168.1.20"},
+				{"172.20.0.1", "eth0", "192.168.1.254", "192.168.1.20"},
+				{"10.8.3.3", "wlan0", "10.8.3.3", "10.8.0.42"},
+				{"2001:db8:1::5", "eth0", "2001:db8:1::5", "2001:db8:1::20"},
+				{"2001:4860:4860::8888", "eth0", "fe80::1", "2001:db8:1::20"},
+			}
+			for _, tt := range tests {
+				iface, gateway, src, err := r.Route(net.ParseIP(tt.dst))
+				if err != nil {
+					t.Errorf("%s\ngot:	%#v\nwant:	nil\n\n", tt.dst, err)
+					continue
+				}
+				if iface.Name != tt.iface || !gateway.Equal(net.ParseIP(tt.gateway)) || !src.Equal(net.ParseIP(tt.src)) {
+					t.Errorf("%s\ngot:	%s %v %v\nwant:	%s %s %s\n\n", tt.dst, iface.Name, gateway, src, tt.iface, tt.gateway, tt.src)
+				}
+			}
+
+			if _, _, _, err := r.Route(net.ParseIP("198.51.100.7")); !errors.Is(err, ErrRouteRejected) {
+				t.Errorf("\ngot:	%v\nwant:	%v for the blackhole route\n\n", err, ErrRouteRejected)
+			}
+
+			res, err := r.(PolicyRouter).RouteWithRealm(net.ParseIP("172.20.0.1"), 2<<16|5)
+			if err != nil || !res.Gateway.Equal(net.ParseIP("192.168.1.254")) {
+				t.Errorf("\ngot:	%+v %v\nwant:	via 192.168.1.254\n\n", res, err)
+			}
+			if _, err := r.(PolicyRouter).RouteWithRealm(net.ParseIP("8.8.8.8"), 2<<16|5); err == nil {
+				t.Errorf("\ngot:	nil\nwant:	error for a destination outside realm 2/5\n\n")
+			}
+		})
+	}
+}
+
+func TestIPRouteProviderMultipath(t *testing.T) {
+	dump := "default proto static metric 10\n" +
+		"\tnexthop via 192.0.2.1 dev eth0 weight 1\n" +
+		"\tnexthop via 198.51.100.1 dev eth1 weight 2 dead linkdown\n"
+	p, err := NewIPRouteProvider(strings.NewReader(dump))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	routes, _ := p.Routes(FamilyAll)
+	if len(routes) != 2 || !routes[0].Gateway.Equal(net.IPv4(192, 0, 2, 1)) || routes[1].OutputIface != 2 {
+		t.Fatalf("\ngot:	%+v\nwant:	one route per nexthop\n\n", routes)
+	}
+	if routes[0].Flags != 0 || routes[1].Flags != RouteDead|RouteLinkDown {
+		t.Errorf("\ngot:	%v %v\nwant:	0 %v\n\n", routes[0].Flags, routes[1].Flags, RouteDead|RouteLinkDown)
+	}
+	if routes[0].Weight != 1 || routes[1].Weight != 2 {
+		t.Errorf("\ngot:	%d %d\nwant:	1 2\n\n", routes[0].Weight, routes[1].Weight)
+	}
+}
+
+func TestIPRouteProviderInvalid(t *testing.T) {
+	for _, dump := range []string{
+		"10.0.0.0/33 dev eth0\n",
+		"default via 300.0.0.1 dev eth0\n",
+		"\tnexthop via 192.0.2.1 dev eth0\n",
+		"10.0.0.0/8 dev\n",
+		"10.0.0.0/8 dev eth0 realms 1/70000\n",
+		"10.0.0.0/8 tos lowdelay dev eth0\n",
+	} {
+		if _, err := NewIPRouteProvider(strings.NewReader(dump)); err == nil {
+			t.Errorf("%q\ngot:	nil\nwant:	error\n\n", dump)
+		}
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	ifaces := []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		{Index: 2, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+	}
+	for _, test := range []struct {
+		route        []string
+		dst, gateway string
+		iface        int
+	}{
+		{[]string{"0.0.0.0/0", "via", "192.0.2.1", "dev", "eth0"}, "0.0.0.0/0", "192.0.2.1", 1},
+		{[]string{"10.0.0.0/8 dev eth1"}, "10.0.0.0/8", "<nil>", 2},
+		{[]string{"default", "via", "fe80::1", "dev eth0"}, "::/0", "fe80::1", 1},
+	} {
+		rt, err := ParseRoute(ifaces, test.route...)
+		if err != nil {
+			t.Fatalf("%q\ngot:	%v\nwant:	nil\n\n", test.route, err)
+		}
+		if rt.Dst.String() != test.dst || rt.Gateway.String() != test.gateway || rt.OutputIface != test.iface {
+			t.Errorf("%q\ngot:	%v via %v dev %d\nwant:	%s via %s dev %d\n\n", test.route, rt.Dst.String(), rt.Gateway, rt.OutputIface, test.dst, test.gateway, test.iface)
+		}
+	}
+	rt := MustRoute(ifaces, "10.0.0.0/8 dev eth1 proto static metric 100 src 10.0.0.2")
+	if rt.Protocol != ProtocolStatic || rt.Priority != 100 || !rt.PrefSrc.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("\ngot:	%+v\nwant:	proto static metric 100 src 10.0.0.2\n\n", rt)
+	}
+	if rt := MustRoute(ifaces, "2001:db8::/64 dev eth0 pref high"); rt.Preference != PreferenceHigh {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", rt.Preference, PreferenceHigh)
+	}
+	// iproute2 reads the TOS in hexadecimal.
+	for _, route := range []string{"10.0.0.0/8 tos 0x10 dev eth1", "10.0.0.0/8 dsfield 10 dev eth1"} {
+		if rt := MustRoute(ifaces, route); rt.TOS != 0x10 {
+			t.Errorf("%q\ngot:	%#x\nwant:	0x10\n\n", route, rt.TOS)
+		}
+	}
+
+	for _, route := range []string{
+		"",
+		"::/0 via 192.0.2.1 dev eth0",
+		"0.0.0.0/0 via 2001:db8::1 dev eth0",
+		"10.0.0.0/8 dev eth9",
+		"10.0.0.0/8 dev eth0 src 2001:db8::2",
+	} {
+		if _, err := ParseRoute(ifaces, route); err == nil {
+			t.Errorf("%q\ngot:	nil\nwant:	error\n\n", route)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("\ngot:	no panic\nwant:	panic for an unknown interface\n\n")
+		}
+	}()
+	MustRoute(ifaces, "10.0.0.0/8 dev eth9")
+}
+
+func TestIPRouteProviderTables(t *testing.T) {
+	dump := "10.0.0.0/8 via 192.0.2.1 dev eth0 table 100\n" +
+		"local 192.0.2.2 dev eth0 table local proto kernel scope host src 192.0.2.2\n" +
+		"192.0.2.0/24 dev eth0 proto kernel scope link src 192.0.2.2\n"
+	p, err := NewIPRouteProvider(strings.NewReader(dump))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	routes, _ := p.Routes(FamilyAll)
+	if len(routes) != 3 || routes[0].Table != 100 || routes[1].Table != TableLocal || routes[2].Table != 0 {
+		t.Errorf("\ngot:	%+v\nwant:	tables 100, local and unset\n\n", routes)
+	}
+	if routes[0].Scope != ScopeUniverse || routes[1].Scope != ScopeHost || routes[2].Scope != ScopeLink {
+		t.Errorf("\ngot:	%+v\nwant:	scopes universe, host and link\n\n", routes)
+	}
+
+	if _, err := NewIPRouteProvider(strings.NewReader("10.0.0.0/8 dev eth0 table vpn\n")); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for a table name\n\n")
+	}
+}
+
+func TestWriteIPRoute(t *testing.T) {
+	r, err := New(WithProvider(openIPRouteDumps(t, "iproute-v4.txt", "iproute-v6.txt")))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	var b strings.Builder
+	if err := r.(DynamicRouter).Table().WriteIPRoute(&b); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	out := b.String()
+	for _, want := range []string{
+		"default via 192.168.1.1 dev eth0 proto dhcp src 192.168.1.20 metric 100\n",
+		"10.8.0.0/16 dev wlan0 proto kernel scope link src 10.8.0.42 metric 600\n",
+		"172.16.0.0/12 via 192.168.1.254 dev eth0 proto static metric 50 realms 2/5 mtu 1400\n",
+		"203.0.113.0/24 tos 0x10 via 192.168.1.254 dev eth0 proto static metric 50\n",
+		"2001:db8:1::20 dev eth0 table local proto kernel metric 0 pref medium\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("\ngot:	%s\nwant:	a line %q\n\n", out, want)
+		}
+	}
+
+	// The output reads back as the same table.
+	p, err := NewIPRouteProvider(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	r2, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	var b2 strings.Builder
+	r2.(DynamicRouter).Table().WriteIPRoute(&b2)
+	if b2.String() != out {
+		t.Errorf("\ngot:	%s\nwant:	%s\n\n", b2.String(), out)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+func (r *router) RouteForAddr(addr string) (RouteResult, error) {
+	host := addrHost(addr)
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		var err error
+		if ips, err = net.DefaultResolver.LookupIP(context.Background(), "ip", host); err != nil {
+			return RouteResult{}, fmt.Errorf("resolving %s: %w", host, err)
+		}
+	}
+
+	return routeFirst(r, host, ips)
+}
+
+// routeFirst returns the route to the first of the addresses of host that
+// can be routed, in the order of OrderDestinations if r is an EgressRouter
+// and in their own order otherwise, or the error of the last one.
+func routeFirst(r Router, host string, ips []net.IP) (RouteResult, error) {
+	err := fmt.Errorf("%w for %s", ErrNoRoute, host)
+	if er, ok := r.(EgressRouter); ok {
+		for _, c := range er.OrderDestinations(ips) {
+			if c.Err == nil {
+				return c.Route, nil
+			}
+			err = c.Err
+		}
+		return RouteResult{}, err
+	}
+	for _, ip := range ips {
+		res, ipErr := routeResult(r, ip)
+		if ipErr == nil {
+			return res, nil
+		}
+		err = ipErr
+	}
+	return RouteResult{}, err
+}
+
+// routeResult returns the route r selects for dst as a RouteResult, that
+// of RouteGet if r is an EgressRouter and the answer of Route otherwise.
+func routeResult(r Router, dst net.IP) (RouteResult, error) {
+	if er, ok := r.(EgressRouter); ok {
+		return er.RouteGet(nil, nil, dst)
+	}
+	iface, gateway, preferredSrc, err := r.Route(dst)
+	if err != nil {
+		return RouteResult{}, err
+	}
+	return RouteResult{Iface: iface, Gateway: gateway, PreferredSrc: preferredSrc}, nil
+}
+
+// addrHost extracts the host from an address that may carry a port or be a
+// URL.
+func addrHost(addr string) string {
+	if strings.Contains(addr, "://") {
+		if u, err := url.Parse(addr); err == nil {
+			return u.Hostname()
+		}
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
@@ -0,0 +1,106 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAddrHost(t *testing.T) {
+	for addr, want := range map[string]string{
+		"192.0.2.1":                  "192.0.2.1",
+		"192.0.2.1:80":               "192.0.2.1",
+		"2001:db8::1":                "2001:db8::1",
+		"[2001:db8::1]":              "2001:db8::1",
+		"[2001:db8::1]:443":          "2001:db8::1",
+		"example.com":                "example.com",
+		"example.com:22":             "example.com",
+		"https://example.com:8443/x": "example.com",
+		"http://[2001:db8::1]/index": "2001:db8::1",
+	} {
+		if got := addrHost(addr); got != want {
+			t.Errorf("%s\ngot:	%s\nwant:	%s\n\n", addr, got, want)
+		}
+	}
+}
+
+func TestRouteForAddr(t *testing.T) {
+	lo := &net.IPNet{IP: net.IPv4(127, 0, 0, 1).To4(), Mask: net.CIDRMask(8, 32)}
+	eth0 := &net.IPNet{IP: net.IPv4(192, 0, 2, 2).To4(), Mask: net.CIDRMask(24, 32)}
+	r, err := NewFromRoutes(
+		[]RouteEntry{
+			{Dst: net.IPNet{IP: net.IPv4(127, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}, OutputIface: 1},
+			{Dst: net.IPNet{IP: net.IPv4(192, 0, 2, 0).To4(), Mask: net.CIDRMask(24, 32)}, OutputIface: 2},
+		},
+		[]net.Interface{
+			{Index: 1, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			{Index: 2, Name: "eth0", Flags: net.FlagUp},
+		},
+		map[int][]net.Addr{1: {lo}, 2: {eth0}},
+	)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, addr := range []string{"192.0.2.7", "192.0.2.7:80", "tcp://192.0.2.7:80", "localhost:8080"} {
+		if _, err := r.(EgressRouter).RouteForAddr(addr); err != nil {
+			t.Errorf("%s\ngot:	%#v\nwant:	nil\n\n", addr, err)
+		}
+	}
+	if _, err := r.(EgressRouter).RouteForAddr("[2001:db8::1]:80"); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("\ngot:	%#v\nwant:	%#v\n\n", err, ErrNoRoute)
+	}
+}
+
+func TestOrderDestinations(t *testing.T) {
+	r, err := NewFromRoutes(
+		[]RouteEntry{
+			{Dst: net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, Gateway: net.IPv4(192, 0, 2, 1), OutputIface: 1},
+			{Dst: net.IPNet{IP: net.IPv4(192, 0, 2, 0).To4(), Mask: net.CIDRMask(24, 32)}, OutputIface: 1},
+			{Dst: net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(64, 128)}, OutputIface: 1},
+			{Dst: net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(32, 128)}, Gateway: net.ParseIP("2001:db8::1"), OutputIface: 1},
+			{Dst: net.IPNet{IP: net.ParseIP("fe80::"), Mask: net.CIDRMask(64, 128)}, OutputIface: 1},
+		},
+		[]net.Interface{{Index: 1, Name: "eth0", Flags: net.FlagUp}},
+		map[int][]net.Addr{1: {
+			&net.IPNet{IP: net.IPv4(192, 0, 2, 2).To4(), Mask: net.CIDRMask(24, 32)},
+			&net.IPNet{IP: net.ParseIP("2001:db8::2"), Mask: net.CIDRMask(64, 128)},
+			&net.IPNet{IP: net.ParseIP("fe80::2"), Mask: net.CIDRMask(64, 128)},
+		}},
+	)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	var dsts []net.IP
+	for _, s := range []string{"2600::1", "169.254.1.1", "198.51.100.1", "2001:db8:1::1", "2001:db8::9", "fe80::1"} {
+		dsts = append(dsts, net.ParseIP(s))
+	}
+	// 2600::1 has no route (rule 1), 169.254.1.1 is link-local but has a
+	// global source (rule 2), the IPv6 destinations precede the IPv4 ones
+	// (rule 6), fe80::1 has the smallest scope (rule 8), and 2001:db8::9
+	// has a longer prefix in common with its source than 2001:db8:1::1
+	// (rule 9).
+	want := []string{"fe80::1", "2001:db8::9", "2001:db8:1::1", "198.51.100.1", "169.254.1.1", "2600::1"}
+	cands := r.(EgressRouter).OrderDestinations(dsts)
+	var got []string
+	for _, c := range cands {
+		got = append(got, c.IP.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", got, want)
+	}
+	if last := cands[len(cands)-1]; !errors.Is(last.Err, ErrNoRoute) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", last.Err, ErrNoRoute)
+	}
+	if first := cands[0]; first.Err != nil || !first.Route.PreferredSrc.Equal(net.ParseIP("fe80::2")) {
+		t.Errorf("\ngot:	%+v\nwant:	a route from fe80::2\n\n", first)
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"net"
+)
+
+// RouteResult describes where to send a packet, as returned by RouteGet.
+type RouteResult struct {
+	// Iface is the interface on which to send the packet: the bond, team
+	// or bridge that of the route is enslaved to, if any, unless the
+	// Router was created with WithSlaveInterfaces.
+	Iface *net.Interface
+	// Gateway is the IP to send the packet to.
+	Gateway net.IP
+	// GatewayZone is the zone of Gateway when it is an IPv6 link-local
+	// address, which is only meaningful on Iface: the name of Iface, as
+	// net.IPAddr expects it.  It is empty otherwise.
+	GatewayZone string
+	// PreferredSrc is the source IP to use.
+	PreferredSrc net.IP
+	// MTU is the largest packet that can be sent along the route: the MTU
+	// of the route if it sets one (RTAX_MTU on Linux), else that of Iface.
+	MTU int
+
+	// SourceAmbiguous is set when several addresses were equally good
+	// candidates for PreferredSrc: they contain the gateway with the same
+	// prefix length and scope, and the route names none of them as its
+	// preferred source.  The choice between them is arbitrary and may
+	// change from one lookup or Refresh to the next.
+	SourceAmbiguous bool
+
+	// IsLocal is set when dst is the local machine, as routed by a route
+	// of ScopeHost.  Gateway is then nil and Iface is the loopback
+	// interface.
+	IsLocal bool
+
+	ifindex int
+}
+
+// IfaceIndex returns the index of the output interface, as in
+// net.Interface.Index.  Unlike Iface, it is set even when the interface is
+// not among those the Router loaded.
+func (res *RouteResult) IfaceIndex() int {
+	return res.ifindex
+}
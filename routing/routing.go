@@ -18,20 +18,232 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"log"
 	"net"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-// rtInfo contains information on a single route.
-type rtInfo struct {
+// ErrFamilyDisabled is returned when routing a destination whose address
+// family was excluded with WithFamily.
+var ErrFamilyDisabled = errors.New("address family disabled for this router")
+
+// ErrUnsupportedPlatform is returned by New when the routing table of the
+// operating system can't be read on this platform.
+var ErrUnsupportedPlatform = errors.New("routing table not available on this platform")
+
+// ErrNoRoute is wrapped by the error returned when no route matches a
+// destination.
+var ErrNoRoute = errors.New("no route found")
+
+// ErrInputNotFound is wrapped by the error returned when the input hardware
+// address given to RouteWithSrc or RouteGet is not that of any interface.
+var ErrInputNotFound = errors.New("input interface not found")
+
+// ErrNoSourceOnInterface is wrapped by the error returned when the output
+// interface of the route selected has no address of the family of the
+// destination to use as source, and the route gives no preferred source.
+// This happens with interfaces that were just created, or that only have
+// addresses of the other family.
+var ErrNoSourceOnInterface = errors.New("no source address on interface")
+
+// ErrOutputNotFound is wrapped by the error returned when the output
+// interface of the route selected is not a known interface.
+var ErrOutputNotFound = errors.New("output interface not found")
+
+// ErrNoSourceForGateway is wrapped by the error returned when no address of
+// the output interface, or of any interface for routes without one, is on
+// the network of the gateway of the route selected.
+var ErrNoSourceForGateway = errors.New("no source address on the network of gateway")
+
+// ErrPrefSrcNotFound is wrapped by the error returned when the preferred
+// source of a route without an output interface is not on the network of
+// its gateway, so the interface can't be told.
+var ErrPrefSrcNotFound = errors.New("preferred source of the route not on the network of gateway")
+
+// ErrUnspecifiedDestination is returned when routing the unspecified address,
+// 0.0.0.0 or ::, which is not a destination packets can be sent to, unless
+// the Router was created with WithUnspecifiedDestination.
+var ErrUnspecifiedDestination = errors.New("unspecified address is not a destination")
+
+// ErrPrefixSplit is wrapped by the error returned by RouteForPrefix when
+// more specific routes send parts of the prefix to other next hops.
+var ErrPrefixSplit = errors.New("prefix split by a more specific route")
+
+// ErrRouteLoop is returned when resolving a gateway through the routing table
+// leads back to a gateway already visited, so the table never reaches an
+// on-link hop.
+var ErrRouteLoop = errors.New("routing loop in gateway resolution")
+
+// ErrRouteRejected is wrapped by the error returned when the route selected
+// for a destination is of a type that drops the packets, TypeBlackhole,
+// TypeUnreachable or TypeProhibit, which have no output interface.
+var ErrRouteRejected = errors.New("rejected by route")
+
+// ErrLoadTimeout is wrapped by the error returned by New and Refresh when
+// the table could not be read within the time given with WithLoadTimeout.
+var ErrLoadTimeout = errors.New("timed out loading the routing table")
+
+// NextHop is a neighbor whose link-layer address must be resolved to send
+// packets through it, as returned by LinkRouter.NextHopTargets.
+type NextHop struct {
+	// IP is the address to resolve by ARP or neighbor discovery: a
+	// gateway, or an on-link destination.
+	IP net.IP
+	// Iface is the interface the neighbor is reached on.
+	Iface *net.Interface
+}
+
+// RouteEntry contains information on a single route.
+type RouteEntry struct {
+	// Dst and Src are the destination and source prefixes the route
+	// applies to.  A zero value is the unspecified prefix of the family.
 	Dst, Src net.IPNet
-	InputIface, OutputIface int64
-	Gateway  net.IP
-	Priority int32
-	PrefSrc  net.IP
-	Metrics  int64
+	// InputIface and OutputIface are the indices of the interfaces the
+	// route applies to, as in net.Interface.Index.  Zero is any interface.
+	InputIface, OutputIface int
+	Gateway                 net.IP
+	PrefSrc                 net.IP
+
+	// InputIfaceName is the name of InputIface, for routes that only apply
+	// to packets received on that interface ("ip route ... iif").  It is
+	// empty when InputIface is zero or not a known interface.
+	InputIfaceName string
+
+	// Priority is the preference of the route among routes with the same
+	// prefix length; lower is better.  With Preference, which only breaks
+	// ties, these are the only values, besides the prefix length, that
+	// drive route selection.  On
+	// Linux it is the RTA_PRIORITY attribute (the "metric" shown by ip
+	// route), on Windows it is the Metric of the forwarding row.
+	Priority uint32
+
+	// Preference is the RFC 4191 preference of the route (RTA_PREF on
+	// Linux), which is selected before the routes of the same prefix
+	// length and Priority with a lower preference, as Linux only weighs
+	// it between routes of the same metric.  It is PreferenceMedium on
+	// other platforms.
+	Preference RoutePreference
+
+	// Weight is the relative weight of the nexthop among those of a
+	// multipath route, which providers return as one route per nexthop:
+	// the rtnh_hops of its struct rtnexthop plus one on Linux, as "ip
+	// route" prints it.  It is zero for routes with a single nexthop, and
+	// on other platforms, which weigh as one.  Weights are informational,
+	// for callers spreading flows over the nexthops themselves: lookups
+	// select the first usable nexthop in Priority order, whatever its
+	// weight.
+	Weight int
+
+	// Realm is the Linux RTA_FLOW attribute: the destination realm in the
+	// low 16 bits and the source realm in the high 16 bits, as set with
+	// "ip route ... realms".  It is zero on other platforms.
+	Realm uint32
+
+	// Table is the route table holding the route (RTA_TABLE on Linux).
+	// Providers with a single table may leave it zero, which New
+	// replaces by TableMain.
+	Table uint32
+
+	// Scope is the distance to the destination, one of the Scope*
+	// constants (rtm_scope on Linux).  Routes with ScopeHost lead to the
+	// local machine.  It is ScopeUniverse on other platforms.
+	Scope uint8
+
+	// Protocol tells what installed the route (rtm_protocol on Linux, the
+	// Origin of the forwarding row on Windows).  See WithProtocolFilter.
+	Protocol RouteProtocol
+
+	// TOS is the type of service of the packets the route is restricted
+	// to ("ip route ... tos" on Linux), or zero for any.  Lookups are for
+	// packets of TOS zero, which such routes are skipped for, but those
+	// of RouteWithTOS.
+	TOS uint8
+
+	// ValidLifetime and PreferredLifetime are how long after it was added
+	// the route may be used, and is preferred, as for routes learned from
+	// IPv6 router advertisements; zero is forever.  Age is how long ago the
+	// route was added, as of the Refresh that loaded it.  On Windows they
+	// are those of the forwarding row.  On Linux only the remaining valid
+	// lifetime is known (RTA_CACHEINFO), so Age is zero.  See
+	// WithSkipExpired.
+	ValidLifetime, PreferredLifetime, Age time.Duration
+
+	// Type is the kind of the route (rtm_type on Linux).  Routes of
+	// TypeBlackhole, TypeUnreachable and TypeProhibit fail the lookups
+	// they are selected for with an error wrapping ErrRouteRejected, and
+	// those of TypeThrow with one wrapping ErrNoRoute, rather than being
+	// sent out of any interface.  TypeUnspec, on platforms without route
+	// types, is a unicast route.
+	Type RouteType
+
+	// Flags describes the state of the route.  Routes marked RouteDead are
+	// never selected.
+	Flags RouteFlags
+
+	// Metrics holds the per-route RTAX_* values of the Linux RTA_METRICS
+	// attribute (such as RTAX_MTU or RTAX_HOPLIMIT), keyed by attribute
+	// type.  They are informational only and do not affect selection.  It
+	// is nil on other platforms.
+	Metrics map[int]uint32
 }
 
+// Well-known route tables, numbered as on Linux.
+const (
+	TableDefault uint32 = 253
+	TableMain    uint32 = 254
+	TableLocal   uint32 = 255
+)
+
+// defaultTables stands for a table in the lookups that name none: as with
+// the kernel's default rules, TableLocal is looked up first, for the local
+// addresses, and then TableMain.
+const defaultTables uint32 = 0
+
+// Route scopes, numbered as on Linux.
+const (
+	ScopeUniverse uint8 = 0
+	ScopeSite     uint8 = 200
+	ScopeLink     uint8 = 253
+	ScopeHost     uint8 = 254
+	ScopeNowhere  uint8 = 255
+)
+
+// rtaxMTU is the key of the route MTU in RouteEntry.Metrics (RTAX_MTU).
+const rtaxMTU = 2
+
+// RouteFlags describes the state of a route.
+type RouteFlags uint32
+
+const (
+	// RouteDead marks a route whose nexthop is dead (RTNH_F_DEAD on
+	// Linux).
+	RouteDead RouteFlags = 1 << iota
+	// RouteOnLink marks a gateway that is on-link even though no prefix
+	// of the output interface contains it (RTNH_F_ONLINK on Linux).
+	RouteOnLink
+	// RouteLinkDown marks a route whose output interface has no carrier
+	// (RTNH_F_LINKDOWN on Linux).
+	RouteLinkDown
+	// RouteCloned marks a route cache entry cloned from another route,
+	// such as a path MTU exception (RTM_F_CLONED on Linux).
+	RouteCloned
+	// RoutePersistent marks a route configured to be restored when the
+	// system restarts, as opposed to one learned or added at run time.  It
+	// is only known for the IPv4 routes added with "route -p" on Windows;
+	// Linux keeps no routes across restarts.
+	RoutePersistent
+	// RouteIfaceDown marks a route whose output interface is not up.
+	// Routes are only flagged with WithIncludeDownInterfaces, and are then
+	// only selected when no route through an up interface applies.
+	RouteIfaceDown
+)
+
 func countMaskOnes(mask net.IPMask) (cnt int) {
 	for _, each := range mask {
 		for each != 0 {
@@ -42,7 +254,7 @@ func countMaskOnes(mask net.IPMask) (cnt int) {
 	return
 }
 
-type routeSlice []rtInfo
+type routeSlice []RouteEntry
 
 // routeSlice implements sort.Interface to sort.
 func (r routeSlice) Len() int {
@@ -53,10 +265,10 @@ func (r routeSlice) Less(i, j int) bool {
 	onesI = countMaskOnes(r[i].Dst.Mask)
 	onesJ = countMaskOnes(r[j].Dst.Mask)
 	if onesI == onesJ {
-		if r[i].Priority == r[j].Priority {
-			return r[i].Metrics < r[j].Metrics
+		if r[i].Priority != r[j].Priority {
+			return r[i].Priority < r[j].Priority
 		}
-		return r[i].Priority < r[j].Priority
+		return r[i].Preference > r[j].Preference
 	}
 	return onesI > onesJ
 }
@@ -65,12 +277,44 @@ func (r routeSlice) Swap(i, j int) {
 }
 
 type router struct {
-	ifaces map[int64]*net.Interface
-	addrs  map[int64]ipAddrs
-	v4, v6 routeSlice
+	provider             RouteProvider
+	family               AddressFamily
+	ignoreDuplicateIndex bool
+	netlinkBufferSize    int
+	loadTimeout          time.Duration
+	netns                *os.File
+	connectFallback      bool
+	stats                *routerStats
+	metricOverride       func(RouteEntry) int
+	skipExpired          bool
+	preferIPv6           bool
+	stableSources        bool
+	localSources         bool
+	slaveIfaces          bool
+	ignoredProtocols     map[RouteProtocol]bool
+	includeDown          bool
+	allowedMartians      []net.IPNet
+	unspecifiedDst       bool
+	multicastRoutes      bool
+	cache                *subnetCache
+
+	// mu guards the table, which is replaced as a whole by Refresh and
+	// RefreshAddrs.
+	mu sync.RWMutex
+	// refreshMu serializes the replacements of the table, so that one
+	// loaded from the provider never overwrites a newer one.
+	refreshMu sync.Mutex
+	// pendingLoad receives the outcome of the load loadWithTimeout last
+	// gave up on, if it was not received since.  It is guarded by
+	// refreshMu.
+	pendingLoad chan loadResult
+	*RouteTable
+	generation atomic.Uint64 // incremented as the table is replaced
 }
 
 func (r *router) String() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	strs := []string{"ROUTER", "--- V4 ---"}
 	for _, route := range r.v4 {
 		strs = append(strs, fmt.Sprintf("%+v", route))
@@ -79,11 +323,23 @@ func (r *router) String() string {
 	for _, route := range r.v6 {
 		strs = append(strs, fmt.Sprintf("%+v", route))
 	}
+	for _, id := range r.tableIDs() {
+		strs = append(strs, fmt.Sprintf("--- TABLE %d V4 ---", id))
+		for _, route := range r.tables[id].v4 {
+			strs = append(strs, fmt.Sprintf("%+v", route))
+		}
+		strs = append(strs, fmt.Sprintf("--- TABLE %d V6 ---", id))
+		for _, route := range r.tables[id].v6 {
+			strs = append(strs, fmt.Sprintf("%+v", route))
+		}
+	}
 	return strings.Join(strs, "\n")
 }
 
-type ipAddrs struct {
-	v4, v6 []net.IPNet
+func (r *router) Table() *RouteTable {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.RouteTable
 }
 
 func (r *router) Route(dst net.IP) (iface *net.Interface, gateway, preferredSrc net.IP, err error) {
@@ -91,174 +347,1084 @@ func (r *router) Route(dst net.IP) (iface *net.Interface, gateway, preferredSrc
 }
 
 func (r *router) RouteWithSrc(input net.HardwareAddr, src, dst net.IP) (iface *net.Interface, gateway, preferredSrc net.IP, err error) {
-	var inputIndex int64
-	if input != nil {
-		inputIndex = -1
-		for i, iface := range r.ifaces {
-			if bytes.Equal(input, iface.HardwareAddr) {
-				inputIndex = i
-				break
-			}
+	res, err := r.RouteGet(input, src, dst)
+	if err != nil {
+		return
+	}
+	return res.Iface, res.Gateway, res.PreferredSrc, nil
+}
+
+func (r *router) RouteGet(input net.HardwareAddr, src, dst net.IP) (RouteResult, error) {
+	return r.routeGet(input, src, dst, 0, defaultTables, nil)
+}
+
+func (r *router) PreferredSource(dst net.IP) (net.IP, error) {
+	family := FamilyOf(dst)
+	if family == FamilyInvalid {
+		return nil, errInvalidIP
+	}
+	ipv6 := family == FamilyV6
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if !familyEnabled(r.family, ipv6) {
+		return nil, ErrFamilyDisabled
+	}
+	if err := r.checkUnspecified(dst); err != nil {
+		return nil, err
+	}
+	_, _, src, err := r.route(0, nil, canonicalIP(dst, ipv6), ipv6)
+	if errors.Is(err, ErrNoRoute) && r.connectFallback {
+		if cres, cerr := r.connectRoute(dst); cerr == nil {
+			src, err = cres.PreferredSrc, nil
 		}
 	}
-	
-	var ifaceIndex int64
+	r.stats.lookup(err)
+	return src, err
+}
+
+func (r *router) RouteWithRealm(dst net.IP, realm uint32) (RouteResult, error) {
+	return r.routeGet(nil, nil, dst, 0, defaultTables, func(rt *RouteEntry) bool {
+		return rt.Realm == realm
+	})
+}
+
+func (r *router) RouteWithTOS(tos byte, src, dst net.IP) (RouteResult, error) {
+	return r.routeGet(nil, src, dst, tos, defaultTables, nil)
+}
+
+func (r *router) NextHopTargets(dsts []net.IP) ([]NextHop, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var (
+		targets []NextHop
+		errs    []error
+	)
+	seen := make(map[string]bool)
+	for _, dst := range dsts {
+		res, err := r.resolve(0, nil, dst, 0, defaultTables, nil, nil)
+		r.stats.lookup(err)
+		switch {
+		case err != nil:
+			errs = append(errs, err)
+			continue
+		case res.IsLocal:
+			continue
+		}
+		key := strconv.Itoa(res.ifindex) + "/" + string(res.Gateway.To16())
+		if !seen[key] {
+			seen[key] = true
+			targets = append(targets, NextHop{IP: res.Gateway, Iface: res.Iface})
+		}
+	}
+	return targets, errors.Join(errs...)
+}
+
+func (r *router) RouteVia(iface *net.Interface, dst net.IP) (RouteResult, error) {
+	if iface == nil {
+		return RouteResult{}, fmt.Errorf("no interface to route %v via", dst)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res, err := r.lookupRoute(nil, nil, dst, 0, defaultTables, func(rt *RouteEntry) bool {
+		return rt.OutputIface == iface.Index
+	})
+	// Local destinations, and those of WithConnectFallback, may still be
+	// reached through another interface.  That of a route via an enslaved
+	// iface is its master.
+	want := r.upper(iface.Index)
+	if errors.Is(err, ErrNoRoute) || err == nil && (res.Iface == nil || res.Iface.Index != want) {
+		return RouteResult{}, fmt.Errorf("%w via %s for %v", ErrNoRoute, iface.Name, dst)
+	}
+	return res, err
+}
+
+func (r *router) L2Target(dst net.IP) (net.IP, *net.Interface, error) {
+	res, err := r.RouteGet(nil, nil, dst)
 	switch {
-	case dst.To4() != nil:
-		ifaceIndex, gateway, preferredSrc, err = r.route(inputIndex, src, dst, false)
-	case dst.To16() != nil:
-		ifaceIndex, gateway, preferredSrc, err = r.route(inputIndex, src, dst, true)
-	default:
-		err = errors.New("IP is not valid as IPv4 or IPv6")
+	case err != nil:
+		return nil, nil, err
+	case res.IsLocal:
+		return nil, nil, fmt.Errorf("%v is a local address", dst)
+	case res.Gateway == nil:
+		// Results of WithConnectFallback don't tell the gateway.
+		return nil, nil, fmt.Errorf("next hop for %v unknown", dst)
 	}
+	return res.Gateway, res.Iface, nil
+}
+
+func (r *router) RouteSockaddr(dst net.IP) (syscall.Sockaddr, *net.Interface, error) {
+	res, err := r.RouteGet(nil, nil, dst)
 	if err != nil {
-		return
+		return nil, nil, err
+	}
+	if ip4 := dst.To4(); ip4 != nil {
+		sa := &syscall.SockaddrInet4{}
+		copy(sa.Addr[:], ip4)
+		return sa, res.Iface, nil
 	}
+	sa := &syscall.SockaddrInet6{}
+	copy(sa.Addr[:], dst)
+	if dst.IsLinkLocalUnicast() || dst.IsLinkLocalMulticast() || res.Gateway.IsLinkLocalUnicast() {
+		if res.Iface == nil {
+			return nil, nil, fmt.Errorf("%w for %v", ErrOutputNotFound, dst)
+		}
+		sa.ZoneId = uint32(res.Iface.Index)
+	}
+	return sa, res.Iface, nil
+}
 
-	iface = r.ifaces[ifaceIndex]
-	return
+func (r *router) SameEgress(a, b net.IP) (bool, error) {
+	ifaceA, gatewayA, _, err := r.Route(a)
+	if err != nil {
+		return false, err
+	}
+	ifaceB, gatewayB, _, err := r.Route(b)
+	if err != nil {
+		return false, err
+	}
+	return ifaceIndex(ifaceA) == ifaceIndex(ifaceB) && gatewayA.Equal(gatewayB), nil
+}
+
+// ifaceIndex returns the index of iface, or 0 for the results of local
+// routes that have no output interface.
+func ifaceIndex(iface *net.Interface) int {
+	if iface == nil {
+		return 0
+	}
+	return iface.Index
 }
 
-func (r *router) route(input int64, src, dst net.IP, ipv6 bool) (iface int64, gateway, preferredSrc net.IP, err error) {
-	var rs routeSlice
-	if ipv6 {
-		rs = r.v6
+func (r *router) RouteFromSource(src, dst net.IP) (RouteResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	res, err := r.resolve(0, src, dst, 0, defaultTables, nil, nil)
+	r.stats.lookup(err)
+	if err != nil {
+		return RouteResult{}, err
+	}
+	ipv6 := FamilyOf(dst) == FamilyV6
+	src = canonicalIP(src, ipv6)
+	for _, addr := range r.addrs[res.ifindex].family(ipv6) {
+		if addr.IP.Equal(src) {
+			res.PreferredSrc = src
+			res.SourceAmbiguous = false
+			return res, nil
+		}
+	}
+	return RouteResult{}, fmt.Errorf("%v is not an address of %s, the output interface for %v", src, r.ifaceName(res.ifindex), dst)
+}
+
+func (r *router) RouteInTable(tableID int, dst net.IP) (RouteResult, error) {
+	return r.routeGet(nil, nil, dst, 0, uint32(tableID), nil)
+}
+
+func (r *router) PrimaryInterface() (*net.Interface, net.IP, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	families := []net.IP{net.IPv4zero, net.IPv6unspecified}
+	if r.preferIPv6 {
+		families[0], families[1] = families[1], families[0]
+	}
+	var res RouteResult
+	var err error
+	for _, dst := range families {
+		res, err = r.resolveAny(0, nil, dst, 0, TableMain, isDefaultRoute, nil)
+		if !errors.Is(err, ErrNoRoute) && !errors.Is(err, ErrFamilyDisabled) {
+			break
+		}
+		err = fmt.Errorf("%w: no default route", ErrNoRoute)
+	}
+	r.stats.lookup(err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.Iface, res.PreferredSrc, nil
+}
+
+// isDefaultRoute reports whether rt is a default route, applying to every
+// destination of its family.
+func isDefaultRoute(rt *RouteEntry) bool {
+	ones, _ := rt.Dst.Mask.Size()
+	return ones == 0
+}
+
+// routeGet implements RouteGet for a packet with the given TOS in the given
+// table, considering only the routes for which match returns true, or all
+// of them if match is nil.
+func (r *router) routeGet(input net.HardwareAddr, src, dst net.IP, tos uint8, table uint32, match func(*RouteEntry) bool) (RouteResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lookupRoute(input, src, dst, tos, table, match)
+}
+
+// lookupRoute is routeGet for a caller that holds r.mu.
+func (r *router) lookupRoute(input net.HardwareAddr, src, dst net.IP, tos uint8, table uint32, match func(*RouteEntry) bool) (RouteResult, error) {
+	index, err := r.inputIndex(input)
+	if err != nil {
+		return RouteResult{}, err
+	}
+	var res RouteResult
+	if r.cache != nil && index == 0 && src == nil && tos == 0 && table == defaultTables && match == nil {
+		res, err = r.cachedRouteGet(dst)
 	} else {
-		rs = r.v4
+		res, err = r.resolve(index, src, dst, tos, table, match, nil)
+	}
+	if errors.Is(err, ErrNoRoute) && r.connectFallback {
+		if cres, cerr := r.connectRoute(dst); cerr == nil {
+			res, err = cres, nil
+		}
+	}
+	r.stats.lookup(err)
+	return res, err
+}
+
+// connectRoute asks the operating system for the source address it would
+// use for dst by connecting a UDP socket to it, which sends nothing, and
+// finds the interface holding that address.  The gateway stays unknown.
+// The caller must hold r.mu.
+func (r *router) connectRoute(dst net.IP) (RouteResult, error) {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return RouteResult{}, err
+	}
+	defer conn.Close()
+	src := conn.LocalAddr().(*net.UDPAddr).IP
+	ipv6 := FamilyOf(dst) == FamilyV6
+	src = canonicalIP(src, ipv6)
+	for index, addrs := range r.addrs {
+		for _, addr := range addrs.family(ipv6) {
+			if addr.IP.Equal(src) {
+				res := RouteResult{Iface: r.ifaces[index], PreferredSrc: src, ifindex: index}
+				if res.Iface != nil {
+					res.MTU = res.Iface.MTU
+				}
+				return res, nil
+			}
+		}
+	}
+	return RouteResult{}, fmt.Errorf("no interface has the address %v", src)
+}
+
+// inputIndex returns the index of the interface whose hardware address is
+// input, or 0 if input is empty.  Interfaces without a hardware address,
+// such as tunnels, can't be named by input.
+func (tab *RouteTable) inputIndex(input net.HardwareAddr) (int, error) {
+	if len(input) == 0 {
+		return 0, nil
+	}
+	for i, iface := range tab.ifaces {
+		if bytes.Equal(input, iface.HardwareAddr) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %v", ErrInputNotFound, input)
+}
+
+// resolve looks dst up in the family it belongs to and fills in the
+// interface of the result, recording the route matched in t.
+func (tab *RouteTable) resolve(input int, src, dst net.IP, tos uint8, table uint32, match func(*RouteEntry) bool, t *routeTrace) (RouteResult, error) {
+	if err := tab.checkUnspecified(dst); err != nil {
+		return RouteResult{}, err
+	}
+	return tab.resolveAny(input, src, dst, tos, table, match, t)
+}
+
+// checkUnspecified fails with ErrUnspecifiedDestination if dst is the
+// unspecified address and the table was not built with
+// WithUnspecifiedDestination.
+func (tab *RouteTable) checkUnspecified(dst net.IP) error {
+	if dst.IsUnspecified() && !tab.unspecifiedDst {
+		return ErrUnspecifiedDestination
+	}
+	return nil
+}
+
+// resolveAny is resolve without checkUnspecified, for the lookups of the
+// default routes themselves.
+func (tab *RouteTable) resolveAny(input int, src, dst net.IP, tos uint8, table uint32, match func(*RouteEntry) bool, t *routeTrace) (res RouteResult, err error) {
+	switch FamilyOf(dst) {
+	case FamilyV4:
+		if !familyEnabled(tab.family, false) {
+			return RouteResult{}, ErrFamilyDisabled
+		}
+		res, err = tab.lookup(input, canonicalIP(src, false), dst.To4(), false, tos, table, match, t)
+	case FamilyV6:
+		if !familyEnabled(tab.family, true) {
+			return RouteResult{}, ErrFamilyDisabled
+		}
+		res, err = tab.lookup(input, canonicalIP(src, true), dst, true, tos, table, match, t)
+	default:
+		err = errInvalidIP
 	}
-	var matchedRtInfo *rtInfo
-	for _, rt := range rs {
-		if !rt.Dst.Contains(dst) {
+	if err != nil {
+		return RouteResult{}, err
+	}
+
+	res.ifindex = tab.upper(res.ifindex)
+	res.Iface = tab.ifaces[res.ifindex]
+	if res.MTU == 0 && res.Iface != nil {
+		res.MTU = res.Iface.MTU
+	}
+	if res.Iface != nil && FamilyOf(res.Gateway) == FamilyV6 && res.Gateway.IsLinkLocalUnicast() {
+		res.GatewayZone = res.Iface.Name
+	}
+	return res, nil
+}
+
+// upper returns the index of the bond or bridge the interface of the given
+// index is enslaved to, which its traffic leaves through, or the index
+// itself if it has none or the table was built with WithSlaveInterfaces.
+func (tab *RouteTable) upper(index int) int {
+	if master, ok := tab.masters[index]; ok && !tab.slaveIfaces {
+		return master
+	}
+	return index
+}
+
+// sourceIface returns the index of the interface holding the source
+// addresses of the routes out of the interface of the given index: its bond
+// or bridge master when it has none of its own, as is usual for enslaved
+// interfaces, or else the index itself.
+func (tab *RouteTable) sourceIface(index int, ipv6 bool) int {
+	if master, ok := tab.masters[index]; ok && len(tab.addrs[index].family(ipv6)) == 0 {
+		return master
+	}
+	return index
+}
+
+func (tab *RouteTable) route(input int, src, dst net.IP, ipv6 bool) (iface int, gateway, preferredSrc net.IP, err error) {
+	res, err := tab.lookup(input, src, dst, ipv6, 0, defaultTables, nil, nil)
+	return res.ifindex, res.Gateway, res.PreferredSrc, err
+}
+
+// matchRoute returns the first route of table, in selection order, that
+// applies to a packet from input and src to dst with the given TOS and is
+// accepted by match if it is not nil, preferring those through interfaces
+// that are up.  The routes for dst it skips or
+// matches are recorded in t.
+func (tab *RouteTable) matchRoute(input int, src, dst net.IP, ipv6 bool, tos uint8, table uint32, match func(*RouteEntry) bool, t *routeTrace) *RouteEntry {
+	var down *RouteEntry
+	rs := tab.routes(table, ipv6)
+	for i := range rs {
+		rt := &rs[i]
+		if !prefixContains(rt.Dst, dst) {
 			continue
 		}
-		if src != nil && !rt.Src.Contains(src) {
+		if src != nil && !prefixContains(rt.Src, src) {
+			t.skip(rt, "source mismatch")
 			continue
 		}
 		if rt.InputIface != 0 && input != 0 && rt.InputIface != input {
+			t.skip(rt, "iif-bound")
+			continue
+		}
+		if rt.TOS != 0 && rt.TOS != tos {
+			t.skip(rt, "TOS mismatch")
+			continue
+		}
+		if rt.Flags&RouteDead != 0 {
+			t.skip(rt, "dead")
+			continue
+		}
+		if tab.skipExpired && tab.expired(rt) {
+			t.skip(rt, "expired")
+			continue
+		}
+		if match != nil && !match(rt) {
+			t.skip(rt, "filtered")
 			continue
 		}
-		matchedRtInfo = &rt
-		break
+		if rt.Flags&RouteIfaceDown != 0 {
+			// Only fall back on the routes through down interfaces when
+			// no route through an up one applies.
+			t.skip(rt, "interface down")
+			if down == nil {
+				down = rt
+			}
+			continue
+		}
+		t.match(rt)
+		return rt
+	}
+	if down != nil {
+		t.match(down)
+	}
+	return down
+}
+
+// expired reports whether the valid lifetime of rt has elapsed, counting
+// from the Refresh that loaded it.
+func (tab *RouteTable) expired(rt *RouteEntry) bool {
+	return rt.ValidLifetime != 0 && rt.Age+time.Since(tab.loaded) >= rt.ValidLifetime
+}
+
+// prefixContains is n.Contains(ip), except that a zero n, which routes
+// loaded by New never have, contains every address.
+func prefixContains(n net.IPNet, ip net.IP) bool {
+	return n.IP == nil || n.Contains(ip)
+}
+
+func (r *router) NextHopChain(dst net.IP) ([]net.IP, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	family := FamilyOf(dst)
+	if family == FamilyInvalid {
+		return nil, errInvalidIP
+	}
+	ipv6 := family == FamilyV6
+	if !familyEnabled(r.family, ipv6) {
+		return nil, ErrFamilyDisabled
+	}
+
+	var chain []net.IP
+	visited := make(map[string]bool)
+	for hop := dst; ; {
+		rt := r.matchRoute(0, nil, hop, ipv6, 0, TableMain, nil, nil)
+		if rt == nil {
+			return nil, fmt.Errorf("%w for %v", ErrNoRoute, hop)
+		}
+		if rt.Gateway == nil || rt.Gateway.IsUnspecified() {
+			return chain, nil
+		}
+		key := string(rt.Gateway.To16())
+		if visited[key] {
+			return nil, ErrRouteLoop
+		}
+		visited[key] = true
+		chain = append(chain, rt.Gateway)
+		if ipv6 && rt.Gateway.IsLinkLocalUnicast() || rt.Flags&RouteOnLink != 0 {
+			// Link-local gateways are on-link by definition, and those
+			// of onlink routes are by the route's word, whatever route
+			// the table has to them.
+			return chain, nil
+		}
+		hop = rt.Gateway
+	}
+}
+
+func (r *router) BroadcastFor(dst net.IP) (net.IP, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if FamilyOf(dst) != FamilyV4 {
+		return nil, fmt.Errorf("no broadcast address for %v", dst)
+	}
+	dst4 := dst.To4()
+	rt := r.matchRoute(0, nil, dst4, false, 0, TableMain, nil, nil)
+	if rt == nil {
+		return nil, fmt.Errorf("%w for %v", ErrNoRoute, dst)
+	}
+	if rt.Gateway != nil && !rt.Gateway.IsUnspecified() {
+		return nil, fmt.Errorf("%v is not on-link, it is routed via %v", dst, rt.Gateway)
+	}
+	// Point-to-point /31 and host /32 routes have no broadcast address,
+	// nor has a default route without a gateway.
+	if ones, _ := rt.Dst.Mask.Size(); ones == 0 || ones >= 31 {
+		return nil, fmt.Errorf("no broadcast address for %v in %v", dst, &rt.Dst)
+	}
+	bcast := make(net.IP, net.IPv4len)
+	for i := range bcast {
+		bcast[i] = dst4[i] | ^rt.Dst.Mask[i]
+	}
+	return bcast, nil
+}
+
+func (r *router) InterfaceMTU(index int) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	iface, ok := r.ifaces[index]
+	if !ok {
+		return 0, fmt.Errorf("no interface with index %d", index)
+	}
+	return iface.MTU, nil
+}
+
+// ifaceName returns the name of the interface with the given index, or the
+// index itself if it is unknown.
+func (tab *RouteTable) ifaceName(index int) string {
+	if iface, ok := tab.ifaces[index]; ok {
+		return iface.Name
+	}
+	return strconv.Itoa(index)
+}
+
+// srcCandidate is an interface address usable as the source of a route.
+type srcCandidate struct {
+	ifindex int
+	addr    net.IPNet
+}
+
+// lookup finds the route for dst and selects the output interface and the
+// source address for it, skipping the routes rejected by match if it is not
+// nil.  It leaves res.Iface for the caller to resolve.
+func (tab *RouteTable) lookup(input int, src, dst net.IP, ipv6 bool, tos uint8, table uint32, match func(*RouteEntry) bool, t *routeTrace) (res RouteResult, err error) {
+	var matchedRtInfo *RouteEntry
+	if table == defaultTables {
+		matchedRtInfo = tab.matchRoute(input, src, dst, ipv6, tos, TableLocal, match, t)
+		table = TableMain
+	}
+	if matchedRtInfo == nil {
+		matchedRtInfo = tab.matchRoute(input, src, dst, ipv6, tos, table, match, t)
 	}
 	if matchedRtInfo == nil {
-		err = fmt.Errorf("no route found for %v", dst)
+		err = fmt.Errorf("%w for %v", ErrNoRoute, dst)
 		return
 	}
+	switch matchedRtInfo.Type {
+	case TypeBlackhole, TypeUnreachable, TypeProhibit:
+		err = fmt.Errorf("%w %v (%v) for %v", ErrRouteRejected, &matchedRtInfo.Dst, matchedRtInfo.Type, dst)
+		return
+	case TypeThrow:
+		// As in the kernel, the lookup goes on with the next rule.
+		err = fmt.Errorf("%w for %v (thrown by %v)", ErrNoRoute, dst, &matchedRtInfo.Dst)
+		return
+	}
+	if matchedRtInfo.Scope == ScopeHost || matchedRtInfo.Type == TypeLocal {
+		return tab.localResult(dst, matchedRtInfo), nil
+	}
 
-	if matchedRtInfo.Gateway == nil || matchedRtInfo.Gateway.IsUnspecified(){
+	var gateway net.IP
+	if matchedRtInfo.Gateway == nil || matchedRtInfo.Gateway.IsUnspecified() {
 		gateway = dst
 	} else {
 		gateway = matchedRtInfo.Gateway
 	}
-	if matchedRtInfo.OutputIface == 0 {
-		if matchedRtInfo.PrefSrc != nil {
-			for i, ifaceAddrs := range r.addrs {
-				var addrs []net.IPNet
-				if ipv6 {
-					addrs = ifaceAddrs.v6
-				} else {
-					addrs = ifaceAddrs.v4
-				}
-				for _, each := range addrs {
-					if each.Contains(gateway) && each.IP.Equal(matchedRtInfo.PrefSrc) {
-						iface = i
-						preferredSrc = each.IP
-					}
-				}
-			}
+
+	// Every address containing the gateway is a candidate, and those equal
+	// to the route's PrefSrc are preferred.  Of either, the one with the
+	// longest prefix is used, and the last one found of those.  Secondary
+	// and anycast addresses, and temporary ones with
+	// WithStableSourceAddresses, are only candidates when no primary
+	// address is.
+	var candidates, preferred, demoted []srcCandidate
+	offer := func(ifindex int, addr net.IPNet, flags AddrFlags) {
+		c := srcCandidate{ifindex, addr}
+		if matchedRtInfo.PrefSrc != nil && addr.IP.Equal(matchedRtInfo.PrefSrc) {
+			preferred = append(preferred, c)
 		}
-		if preferredSrc == nil {
-			for i, ifaceAddrs := range r.addrs {
-				var addrs []net.IPNet
-				if ipv6 {
-					addrs = ifaceAddrs.v6
-				} else {
-					addrs = ifaceAddrs.v4
-				}
-				for _, each := range addrs {
-					if each.Contains(gateway) {
-						iface = i
-						preferredSrc = each.IP
-					}
-				}
-			}
+		if flags&notPrimary != 0 || tab.stableSources && flags&AddrTemporary != 0 {
+			demoted = append(demoted, c)
+		} else {
+			candidates = append(candidates, c)
 		}
+	}
+	if matchedRtInfo.OutputIface == 0 {
+		tab.addrsContaining(gateway, ipv6, func(ifindex, j int, addr net.IPNet) {
+			offer(ifindex, addr, tab.addrs[ifindex].flags(ipv6, j))
+		})
 	} else {
-		iface = matchedRtInfo.OutputIface
-		ifaceAddrs, ok := r.addrs[iface]
+		ifaceAddrs, ok := tab.addrs[tab.sourceIface(matchedRtInfo.OutputIface, ipv6)]
 		if !ok {
-			err = fmt.Errorf("no output interface found for %v", dst)
+			err = fmt.Errorf("%w: %s for %v", ErrOutputNotFound, tab.ifaceName(matchedRtInfo.OutputIface), dst)
 			return
 		}
-		var addrs []net.IPNet
-		if ipv6 {
-			addrs = ifaceAddrs.v6
-		} else {
-			addrs = ifaceAddrs.v4
-		}
-		if matchedRtInfo.PrefSrc != nil {
-			for _, each := range addrs {
-				if each.Contains(gateway) && each.IP.Equal(matchedRtInfo.PrefSrc) {
-					preferredSrc = each.IP
+		// Everything is on-link through a point-to-point interface, as
+		// with the default route of a PPP or tun device, while its
+		// addresses hardly contain any destination.
+		iface := tab.ifaces[matchedRtInfo.OutputIface]
+		pointToPoint := gateway.Equal(dst) && iface != nil && iface.Flags&net.FlagPointToPoint != 0
+		// Nor do they contain multicast groups, such as those the ff00::/8
+		// routes of TableLocal send out of each interface.
+		multicast := matchedRtInfo.Type == TypeMulticast
+		for j, each := range ifaceAddrs.family(ipv6) {
+			switch {
+			case ipv6 && gateway.IsLinkLocalUnicast() && !dst.IsLinkLocalUnicast(), pointToPoint, multicast:
+				// A link-local gateway is only meaningful on the output
+				// interface and no global address contains it, so any
+				// global address of the interface may be the source.
+				if !ipv6 || !each.IP.IsLinkLocalUnicast() || dst.IsLinkLocalUnicast() || dst.IsLinkLocalMulticast() {
+					offer(matchedRtInfo.OutputIface, each, ifaceAddrs.flags(ipv6, j))
 				}
+			case each.Contains(gateway):
+				offer(matchedRtInfo.OutputIface, each, ifaceAddrs.flags(ipv6, j))
 			}
 		}
-		if preferredSrc == nil {
-			for _, each := range addrs {
-				if each.Contains(gateway) {
-					preferredSrc = each.IP
+		if len(candidates) == 0 && len(demoted) == 0 && matchedRtInfo.Flags&RouteOnLink != 0 {
+			// The gateway of an onlink route is in none of the networks
+			// of the interface, so any of its addresses may be the source.
+			for j, each := range ifaceAddrs.family(ipv6) {
+				if !ipv6 || !each.IP.IsLinkLocalUnicast() || dst.IsLinkLocalUnicast() {
+					offer(matchedRtInfo.OutputIface, each, ifaceAddrs.flags(ipv6, j))
 				}
 			}
 		}
 	}
-	if preferredSrc == nil {
-		err = fmt.Errorf("no src found for %v", dst)
+	if len(candidates) == 0 {
+		candidates = demoted
+	}
+
+	var chosen srcCandidate
+	switch {
+	case len(preferred) > 0:
+		chosen = preferred[len(preferred)-1]
+	case len(candidates) > 0:
+		chosen = longestPrefix(candidates)
+		res.SourceAmbiguous = sourceAmbiguous(chosen, candidates)
+	case matchedRtInfo.PrefSrc != nil && matchedRtInfo.OutputIface != 0:
+		// The route names its source, which the interface does not hold
+		// (yet): trust the route, as the kernel does.
+		chosen = srcCandidate{addr: net.IPNet{IP: matchedRtInfo.PrefSrc}}
+	case matchedRtInfo.OutputIface != 0 && len(tab.addrs[tab.sourceIface(matchedRtInfo.OutputIface, ipv6)].family(ipv6)) == 0:
+		err = fmt.Errorf("%w %s for %v", ErrNoSourceOnInterface, tab.ifaceName(matchedRtInfo.OutputIface), dst)
+		return
+	case matchedRtInfo.PrefSrc != nil:
+		err = fmt.Errorf("%w %v: %v for %v", ErrPrefSrcNotFound, gateway, matchedRtInfo.PrefSrc, dst)
+		return
+	default:
+		err = fmt.Errorf("%w %v for %v", ErrNoSourceForGateway, gateway, dst)
 		return
 	}
+	if matchedRtInfo.OutputIface == 0 {
+		res.ifindex = chosen.ifindex
+	} else {
+		res.ifindex = matchedRtInfo.OutputIface
+	}
+	res.Gateway = gateway
+	res.PreferredSrc = chosen.addr.IP
+	res.MTU = int(matchedRtInfo.Metrics[rtaxMTU])
 	return
 }
 
-// New creates a new router object.  The router returned by New currently does
-// not update its routes after construction... care should be taken for
-// long-running programs to call New() regularly to take into account any
-// changes to the routing table which have occurred since the last New() call.
-func New() (Router, error) {
-	rtr := &router{}
-	ifaces, err := net.Interfaces()
+// localResult returns the result for dst routed by a host-scope route rt:
+// it is delivered through the loopback interface, if there is one, with
+// the preferred source of the route or else dst itself as source.
+func (tab *RouteTable) localResult(dst net.IP, rt *RouteEntry) RouteResult {
+	res := RouteResult{
+		PreferredSrc: rt.PrefSrc,
+		MTU:          int(rt.Metrics[rtaxMTU]),
+		IsLocal:      true,
+		ifindex:      rt.OutputIface,
+	}
+	if res.PreferredSrc == nil {
+		res.PreferredSrc = dst
+	}
+	var loopback int
+	for index, iface := range tab.ifaces {
+		if iface.Flags&net.FlagLoopback != 0 && (loopback == 0 || index < loopback) {
+			loopback = index
+		}
+	}
+	if loopback != 0 {
+		res.ifindex = loopback
+	}
+	return res
+}
+
+// longestPrefix returns the candidate whose prefix is the most specific,
+// as a /24 address is a better source for a gateway than a /16 one of the
+// same interface, or the last of them if several are as specific.
+func longestPrefix(candidates []srcCandidate) srcCandidate {
+	chosen, most := candidates[0], -1
+	for _, c := range candidates {
+		if ones, _ := c.addr.Mask.Size(); ones >= most {
+			chosen, most = c, ones
+		}
+	}
+	return chosen
+}
+
+// sourceAmbiguous reports whether another candidate than chosen has the same
+// prefix length and scope, and so would have been an equally good source.
+func sourceAmbiguous(chosen srcCandidate, candidates []srcCandidate) bool {
+	ones, _ := chosen.addr.Mask.Size()
+	for _, c := range candidates {
+		if c.addr.IP.Equal(chosen.addr.IP) {
+			continue
+		}
+		if cOnes, _ := c.addr.Mask.Size(); cOnes == ones && sameScope(c.addr.IP, chosen.addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameScope reports whether a and b are both loopback, both link-local or
+// both global addresses.
+func sameScope(a, b net.IP) bool {
+	return a.IsLoopback() == b.IsLoopback() && a.IsLinkLocalUnicast() == b.IsLinkLocalUnicast()
+}
+
+// New creates a new router object.  The router returned by New does not
+// update its routes by itself; long-running programs should call Refresh
+// regularly to take into account any changes to the routing table which
+// have occurred since the router was created.
+//
+// The returned router may be tuned with options such as WithFamily, and
+// WithProvider replaces the operating system as the source of the table.
+func New(opts ...Option) (Router, error) {
+	rtr, err := newRouter(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := rtr.Refresh(); err != nil {
+		return nil, err
+	}
+	return rtr, nil
+}
+
+// newRouter returns a router configured by opts, without a table.
+func newRouter(opts []Option) (*router, error) {
+	rtr := &router{family: FamilyAll}
+	for _, opt := range opts {
+		opt.apply(rtr)
+	}
+	if rtr.provider == nil {
+		rtr.provider = systemProvider{netlink: netlinkConfig{
+			bufferSize: rtr.netlinkBufferSize,
+			timeout:    rtr.loadTimeout,
+			netns:      rtr.netns,
+		}}
+	}
+	switch rtr.family {
+	case FamilyAll, FamilyV4, FamilyV6:
+	default:
+		return nil, fmt.Errorf("unsupported address family %v", rtr.family)
+	}
+	return rtr, nil
+}
+
+// KernelRouteGet asks the operating system for the route it would use to
+// send a packet to dst, as "ip route get" does, instead of looking dst up
+// in a copy of the table.  The answer is authoritative, accounting for
+// policy rules and every other part of the kernel's lookup, and a single
+// query is much cheaper than loading the whole table.  It is only
+// supported on Linux, and fails with ErrUnsupportedPlatform elsewhere.
+func KernelRouteGet(dst net.IP) (RouteResult, error) {
+	if FamilyOf(dst) == FamilyInvalid {
+		return RouteResult{}, errInvalidIP
+	}
+	return systemRouteGet(dst)
+}
+
+func (r *router) Refresh() error {
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+	start := time.Now()
+	tab, err := r.loadWithTimeout()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.setTable(tab)
+	r.stats.refresh(tab.loaded.Sub(start))
+	return nil
+}
+
+func (r *router) SetTable(entries []RouteEntry, ifaces []*net.Interface) error {
+	copies := make([]net.Interface, len(ifaces))
+	for i, iface := range ifaces {
+		if iface == nil {
+			return fmt.Errorf("nil interface at %d", i)
+		}
+		copies[i] = *iface
+	}
+	byIndex, err := r.indexInterfaces(copies)
+	if err != nil {
+		return err
+	}
+	v4, v6, tables := r.sortRoutes(entries, byIndex)
+
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	addrs := make(map[int]ipAddrs)
+	altNames := make(map[string]int)
+	for index := range byIndex {
+		if a, ok := r.addrs[index]; ok {
+			addrs[index] = a
+		}
+	}
+	for name, index := range r.altNames {
+		if _, ok := byIndex[index]; ok {
+			altNames[name] = index
+		}
+	}
+	tab := &RouteTable{
+		family:         r.family,
+		skipExpired:    r.skipExpired,
+		unspecifiedDst: r.unspecifiedDst,
+		stableSources:  r.stableSources,
+		localSources:   r.localSources,
+		slaveIfaces:    r.slaveIfaces,
+		ifaces:         byIndex,
+		addrs:          addrs,
+		v4:             v4,
+		v6:             v6,
+		tables:         tables,
+		rules:          r.rules,
+		multicast:      r.multicast,
+		altNames:       altNames,
+		masters:        keepMasters(r.masters, byIndex),
+		source:         SourceProvider,
+		loaded:         time.Now(),
+	}
+	tab.indexGateways()
+	tab.indexAddrs()
+	r.setTable(tab)
+	return nil
+}
+
+// setTable replaces the table of r with tab, which lookups see whole from
+// then on.  r.mu must be held for writing.
+func (r *router) setTable(tab *RouteTable) {
+	r.RouteTable = tab
+	r.generation.Add(1)
+}
+
+// loadAltNames maps the alternative names of ifaces to their index, if the
+// provider knows any.
+func (r *router) loadAltNames(ifaces map[int]*net.Interface) (map[string]int, error) {
+	p, ok := r.provider.(AltNameProvider)
+	if !ok {
+		return nil, nil
+	}
+	all, err := p.AltNames()
+	if err != nil {
+		return nil, err
+	}
+	altNames := make(map[string]int)
+	for index, names := range all {
+		if _, ok := ifaces[index]; !ok {
+			continue
+		}
+		for _, name := range names {
+			altNames[name] = index
+		}
+	}
+	return altNames, nil
+}
+
+// loadMasters reads the masters of the enslaved ifaces, if the provider
+// knows them, keeping those whose master is also in ifaces.
+func (r *router) loadMasters(ifaces map[int]*net.Interface) (map[int]int, error) {
+	p, ok := r.provider.(MasterProvider)
+	if !ok {
+		return nil, nil
+	}
+	all, err := p.Masters()
+	if err != nil {
+		return nil, err
+	}
+	return keepMasters(all, ifaces), nil
+}
+
+// keepMasters returns the masters whose interface and master are both in
+// ifaces.
+func keepMasters(masters map[int]int, ifaces map[int]*net.Interface) map[int]int {
+	kept := make(map[int]int)
+	for index, master := range masters {
+		_, ok := ifaces[index]
+		_, masterOK := ifaces[master]
+		if ok && masterOK {
+			kept[index] = master
+		}
+	}
+	return kept
+}
+
+// loadResult is the outcome of a load run by loadWithTimeout.
+type loadResult struct {
+	tab *RouteTable
+	err error
+}
+
+// loadWithTimeout is load, giving up after the time of WithLoadTimeout.
+// A load given up on is left running, as providers can't be interrupted,
+// and the next call waits for it and returns its table rather than
+// starting another one, so that at most one load is in flight.  The
+// caller must hold r.refreshMu, or be New.
+func (r *router) loadWithTimeout() (*RouteTable, error) {
+	if r.loadTimeout <= 0 {
+		return r.load()
+	}
+	done := r.pendingLoad
+	if done == nil {
+		done = make(chan loadResult, 1)
+		go func() {
+			tab, err := r.load()
+			done <- loadResult{tab, err}
+		}()
+	}
+	timer := time.NewTimer(r.loadTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		r.pendingLoad = nil
+		return res.tab, res.err
+	case <-timer.C:
+		r.pendingLoad = done
+		return nil, fmt.Errorf("%w after %v", ErrLoadTimeout, r.loadTimeout)
+	}
+}
+
+// load reads a new table from the provider.
+func (r *router) load() (*RouteTable, error) {
+	ifaces, err := r.loadInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := r.loadAddrs(ifaces)
+	if err != nil {
+		return nil, err
+	}
+	v4, v6, tables, source, err := r.loadRoutes(ifaces)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := r.loadRules()
+	if err != nil {
+		return nil, err
+	}
+	altNames, err := r.loadAltNames(ifaces)
+	if err != nil {
+		return nil, err
+	}
+	masters, err := r.loadMasters(ifaces)
+	if err != nil {
+		return nil, err
+	}
+	multicast, err := r.loadMulticast()
+	if err != nil {
+		return nil, err
+	}
+	tab := &RouteTable{
+		family:         r.family,
+		skipExpired:    r.skipExpired,
+		unspecifiedDst: r.unspecifiedDst,
+		stableSources:  r.stableSources,
+		localSources:   r.localSources,
+		slaveIfaces:    r.slaveIfaces,
+		ifaces:         ifaces,
+		addrs:          addrs,
+		v4:             v4,
+		v6:             v6,
+		tables:         tables,
+		rules:          rules,
+		multicast:      multicast,
+		altNames:       altNames,
+		masters:        masters,
+		source:         source,
+		loaded:         time.Now(),
+	}
+	tab.indexGateways()
+	tab.indexAddrs()
+	return tab, nil
+}
+
+func (r *router) Generation() uint64 {
+	return r.generation.Load()
+}
+
+func (r *router) RefreshAddrs() error {
+	// The table can't change while the addresses load, so they are those
+	// of its interfaces when they are swapped in.
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+	r.mu.RLock()
+	ifaces := r.ifaces
+	r.mu.RUnlock()
+
+	addrs, err := r.loadAddrs(ifaces)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tab := *r.RouteTable
+	tab.addrs = addrs
+	tab.indexAddrs()
+	r.setTable(&tab)
+	return nil
+}
+
+// loadInterfaces enumerates the interfaces of the provider by index.
+func (r *router) loadInterfaces() (map[int]*net.Interface, error) {
+	ifaces, err := r.provider.Interfaces()
 	if err != nil {
 		return nil, err
 	}
-	rtr.ifaces = make(map[int64]*net.Interface)
-	rtr.addrs = make(map[int64]ipAddrs)
-	for i, _ := range ifaces {
+	return r.indexInterfaces(ifaces)
+}
+
+// indexInterfaces maps ifaces by index.
+func (r *router) indexInterfaces(ifaces []net.Interface) (map[int]*net.Interface, error) {
+	byIndex := make(map[int]*net.Interface)
+	for i := range ifaces {
 		iface := &ifaces[i]
-		if duplicated_iface, ok := rtr.ifaces[int64(iface.Index)]; ok {
+		if duplicated_iface, ok := byIndex[iface.Index]; ok {
+			if r.ignoreDuplicateIndex {
+				log.Printf("routing: ignoring iface %v with duplicated index %v of %v", iface.Name, iface.Index, duplicated_iface.Name)
+				continue
+			}
 			return nil, fmt.Errorf("duplicated index iface %v = %v = %v", iface.Index, iface, duplicated_iface)
 		}
-		rtr.ifaces[int64(iface.Index)] = iface
-		var addrs ipAddrs
-		ifaceAddrs, err := iface.Addrs()
-		if err != nil {
+		byIndex[iface.Index] = iface
+	}
+	return byIndex, nil
+}
+
+// loadAddrs reads the addresses of each of the given interfaces.
+func (r *router) loadAddrs(ifaces map[int]*net.Interface) (map[int]ipAddrs, error) {
+	var all map[int][]net.Addr
+	if p, ok := r.provider.(allAddrsProvider); ok {
+		var err error
+		if all, err = p.allAddrs(); err != nil {
 			return nil, err
 		}
+	}
+	byIndex := make(map[int]ipAddrs)
+	for index, iface := range ifaces {
+		var addrs ipAddrs
+		ifaceAddrs := all[index]
+		if all == nil {
+			var err error
+			if ifaceAddrs, err = r.provider.Addrs(iface); err != nil {
+				return nil, err
+			}
+		}
 		for _, addr := range ifaceAddrs {
-			if inet, ok := addr.(*net.IPNet); ok {
-				if v4 := inet.IP.To4(); v4 != nil {
-					addrs.v4 = append(addrs.v4, net.IPNet{
-						IP: v4,
-						Mask: inet.Mask,
-					})
-				} else {
-					addrs.v6 = append(addrs.v6, *inet)
+			var inet *net.IPNet
+			var flags AddrFlags
+			switch addr := addr.(type) {
+			case *net.IPNet:
+				inet = addr
+			case *InterfaceAddr:
+				inet, flags = &addr.IPNet, addr.Flags
+			case *net.IPAddr:
+				// An address without a prefix is taken as a host address,
+				// only used as the source of routes leading to it.
+				bits := 8 * net.IPv6len
+				if FamilyOf(addr.IP) == FamilyV4 {
+					bits = 8 * net.IPv4len
+				}
+				inet = &net.IPNet{IP: addr.IP, Mask: net.CIDRMask(bits, bits)}
+			default:
+				continue
+			}
+			switch FamilyOf(inet.IP) {
+			case FamilyV4:
+				if !familyEnabled(r.family, false) {
+					continue
+				}
+				addrs.add(net.IPNet{
+					IP:   inet.IP.To4(),
+					Mask: inet.Mask,
+				}, flags, false)
+			case FamilyV6:
+				if !familyEnabled(r.family, true) {
+					continue
 				}
+				addrs.add(*inet, flags, true)
 			}
 		}
-		rtr.addrs[int64(iface.Index)] = addrs
+		byIndex[index] = addrs
 	}
-
-	err = rtr.setupRouteTable()
-	if err != nil {
-		return nil, err
-	}
-	return rtr, nil
-}
\ No newline at end of file
+	return byIndex, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"net"
+)
+
+// There is no routing table to read in the browser, so New fails unless a
+// RouteProvider is given with WithProvider.
+func systemRoutes(family int, nl netlinkConfig) ([]RouteEntry, string, error) {
+	return nil, "", ErrUnsupportedPlatform
+}
+
+func systemInterfaces(nl netlinkConfig) ([]net.Interface, error) {
+	return net.Interfaces()
+}
+
+func systemAddrs(iface *net.Interface, nl netlinkConfig) ([]net.Addr, error) {
+	return iface.Addrs()
+}
+
+// systemAltNames returns no names: interfaces only have alternative names
+// on Linux.
+func systemAltNames(nl netlinkConfig) (map[int][]string, error) {
+	return nil, nil
+}
+
+// systemMasters returns no masters: they are only read on Linux.
+func systemMasters(nl netlinkConfig) (map[int]int, error) {
+	return nil, nil
+}
+
+// systemMulticastRoutes returns no routes: multicast routes are only read
+// on Linux.
+func systemMulticastRoutes(family int, nl netlinkConfig) ([]MulticastEntry, error) {
+	return nil, nil
+}
+
+// systemRules returns no rules: policy routing is only read on Linux.
+func systemRules(family int, nl netlinkConfig) ([]Rule, error) {
+	return nil, nil
+}
+
+func systemRouteGet(dst net.IP) (RouteResult, error) {
+	return RouteResult{}, ErrUnsupportedPlatform
+}
+
+func systemNeighbor(ip net.IP, ifindex int, nl netlinkConfig) (net.HardwareAddr, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func systemSocketInfo(fd int) (local, peer net.IP, device string, err error) {
+	return nil, nil, "", ErrUnsupportedPlatform
+}
@@ -7,10 +7,16 @@
 package routing
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"net"
-	"sort"
+	"os"
 	"syscall"
+	"time"
 	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 // Pulled from http://man7.org/linux/man-pages/man7/rtnetlink.7.html
@@ -29,83 +35,1096 @@ type routeInfoInMemory struct {
 	Flags uint32
 }
 
-func (r *router) setupRouteTable() error {
-	tab, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_UNSPEC)
+func systemRoutes(family int, nl netlinkConfig) (routes []RouteEntry, source string, err error) {
+	err = netlinkDump(syscall.RTM_GETROUTE, family, nl, func(m *syscall.NetlinkMessage) error {
+		rts, err := parseRouteMessage(m)
+		routes = append(routes, rts...)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return routes, SourceNetlink, nil
+}
+
+// netlinkRecvSize is the size of the buffer dump replies are read into.  The
+// kernel fills replies up to the size of the reads, at most 32 KiB, so that
+// larger dumps take fewer system calls than with page-sized reads.
+const netlinkRecvSize = 32 << 10
+
+// netlinkDump is like syscall.NetlinkRIB, but sets the receive buffer and
+// timeout of the socket as nl tells, and hands each message of the
+// reply to fn as it is read instead of buffering the whole dump.  The
+// message is only valid during the call.  An error from fn stops the dump.
+func netlinkDump(proto, family int, nl netlinkConfig, fn func(m *syscall.NetlinkMessage) error) error {
+	return netlinkRequest(proto, unix.NLM_F_DUMP, []byte{byte(family)}, nl, fn)
+}
+
+// netlinkRequest sends a request of the given type, with the given flags
+// besides NLM_F_REQUEST and the given payload, on a new NETLINK_ROUTE
+// socket, and hands each message of the reply to fn as netlinkDump does.
+// Strict checking is enabled for requests other than dumps, whose short
+// rtgenmsg payload it doesn't accept, where the kernel supports it.
+func netlinkRequest(typ int, flags uint16, payload []byte, nl netlinkConfig, fn func(m *syscall.NetlinkMessage) error) error {
+	fd, err := nl.socket(0)
 	if err != nil {
 		return err
 	}
-	msgs, err := syscall.ParseNetlinkMessage(tab)
+	defer unix.Close(fd)
+	if nl.bufferSize > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, nl.bufferSize); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if nl.timeout > 0 {
+		tv := unix.NsecToTimeval(nl.timeout.Nanoseconds())
+		if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	// NETLINK_GET_STRICT_CHK appeared in Linux 4.20; older kernels check
+	// requests loosely, which is fine for the requests made here.
+	if flags&unix.NLM_F_DUMP == 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_NETLINK, unix.NETLINK_GET_STRICT_CHK, 1); err != nil && err != unix.ENOPROTOOPT {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	const seq = 1
+	req := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(payload))
+	*(*unix.NlMsghdr)(unsafe.Pointer(&req[0])) = unix.NlMsghdr{
+		Len:   uint32(unix.NLMSG_HDRLEN + len(payload)),
+		Type:  uint16(typ),
+		Flags: flags | unix.NLM_F_REQUEST,
+		Seq:   seq,
+	}
+	req = append(req, payload...)
+	if err := unix.Sendto(fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return os.NewSyscallError("getsockname", err)
+	}
+	pid := sa.(*unix.SockaddrNetlink).Pid
+
+	buf := make([]byte, netlinkRecvSize)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err == unix.EAGAIN && nl.timeout > 0 {
+			return fmt.Errorf("%w: no netlink reply in %v", ErrLoadTimeout, nl.timeout)
+		}
+		if err != nil {
+			return os.NewSyscallError("recvfrom", err)
+		}
+		if n < unix.NLMSG_HDRLEN {
+			return syscall.EINVAL
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for i := range msgs {
+			m := &msgs[i]
+			if m.Header.Seq != seq || m.Header.Pid != pid {
+				return syscall.EINVAL
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				return netlinkError(m.Data)
+			}
+			if err := fn(m); err != nil {
+				return err
+			}
+			// Only the messages of a dump are followed by others.
+			if m.Header.Flags&unix.NLM_F_MULTI == 0 {
+				return nil
+			}
+		}
+	}
+}
+
+// systemAltNames dumps the links for their alternative names.
+func systemAltNames(nl netlinkConfig) (map[int][]string, error) {
+	names := make(map[int][]string)
+	err := netlinkDump(syscall.RTM_GETLINK, syscall.AF_UNSPEC, nl, func(m *syscall.NetlinkMessage) error {
+		index, alt, err := parseLinkAltNames(m)
+		if len(alt) > 0 {
+			names[index] = alt
+		}
+		return err
+	})
 	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// aggregateKinds are the IFLA_INFO_KIND of the masters that enslaved
+// interfaces send their traffic through.
+var aggregateKinds = map[string]bool{"bond": true, "team": true, "bridge": true}
+
+// systemMasters dumps the links for the masters of enslaved interfaces,
+// keeping those whose master is a bond, team or bridge.
+func systemMasters(nl netlinkConfig) (map[int]int, error) {
+	masters := make(map[int]int)
+	kinds := make(map[int]string)
+	err := netlinkDump(syscall.RTM_GETLINK, syscall.AF_UNSPEC, nl, func(m *syscall.NetlinkMessage) error {
+		index, master, kind, err := parseLinkMaster(m)
+		if master != 0 {
+			masters[index] = master
+		}
+		kinds[index] = kind
 		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for index, master := range masters {
+		if !aggregateKinds[kinds[master]] {
+			delete(masters, index)
+		}
+	}
+	return masters, nil
+}
+
+// parseLinkMaster decodes the index, the IFLA_MASTER attribute and the
+// IFLA_INFO_KIND, nested in IFLA_LINKINFO, of an RTM_NEWLINK message.
+func parseLinkMaster(m *syscall.NetlinkMessage) (index, master int, kind string, err error) {
+	if m.Header.Type != syscall.RTM_NEWLINK {
+		return 0, 0, "", nil
+	}
+	if len(m.Data) < syscall.SizeofIfInfomsg {
+		return 0, 0, "", errors.New("truncated link message")
+	}
+	ifim := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+	attrs, err := parseAttrs(m.Data[syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return 0, 0, "", err
 	}
-loop:
-	for _, m := range msgs {
-		switch m.Header.Type {
-		case syscall.NLMSG_DONE:
-			break loop
-		case syscall.RTM_NEWROUTE:
-			rt := (*routeInfoInMemory)(unsafe.Pointer(&m.Data[0]))
-			routeInfo := rtInfo{}
-			attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+	for _, attr := range attrs {
+		switch attr.Attr.Type &^ unix.NLA_F_NESTED {
+		case syscall.IFLA_MASTER:
+			if len(attr.Value) < 4 {
+				return 0, 0, "", errors.New("truncated IFLA_MASTER attribute")
+			}
+			master = int(*(*uint32)(unsafe.Pointer(&attr.Value[0])))
+		case syscall.IFLA_LINKINFO:
+			infos, err := parseAttrs(attr.Value)
+			if err != nil {
+				return 0, 0, "", err
+			}
+			for _, info := range infos {
+				if info.Attr.Type == unix.IFLA_INFO_KIND {
+					kind = nulTerminated(info.Value)
+				}
+			}
+		}
+	}
+	return int(ifim.Index), master, kind, nil
+}
+
+// parseLinkAltNames decodes the index and the IFLA_ALT_IFNAME attributes,
+// nested in IFLA_PROP_LIST, of an RTM_NEWLINK message.
+func parseLinkAltNames(m *syscall.NetlinkMessage) (int, []string, error) {
+	if m.Header.Type != syscall.RTM_NEWLINK {
+		return 0, nil, nil
+	}
+	if len(m.Data) < syscall.SizeofIfInfomsg {
+		return 0, nil, errors.New("truncated link message")
+	}
+	ifim := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+	attrs, err := parseAttrs(m.Data[syscall.SizeofIfInfomsg:])
+	if err != nil {
+		return 0, nil, err
+	}
+	var names []string
+	for _, attr := range attrs {
+		if attr.Attr.Type&^unix.NLA_F_NESTED != unix.IFLA_PROP_LIST {
+			continue
+		}
+		props, err := parseAttrs(attr.Value)
+		if err != nil {
+			return 0, nil, err
+		}
+		for _, prop := range props {
+			if prop.Attr.Type == unix.IFLA_ALT_IFNAME {
+				names = append(names, nulTerminated(prop.Value))
+			}
+		}
+	}
+	return int(ifim.Index), names, nil
+}
+
+// systemSocketInfo returns the addresses of the connected socket fd, and
+// the device it is bound to.
+func systemSocketInfo(fd int) (local, peer net.IP, device string, err error) {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, nil, "", os.NewSyscallError("getsockname", err)
+	}
+	local = sockaddrIP(sa)
+	if sa, err = unix.Getpeername(fd); err != nil {
+		return nil, nil, "", os.NewSyscallError("getpeername", err)
+	}
+	peer = sockaddrIP(sa)
+	if local == nil || peer == nil {
+		return nil, nil, "", fmt.Errorf("socket %d is not an IP socket", fd)
+	}
+	device, err = unix.GetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+	if err != nil {
+		return nil, nil, "", os.NewSyscallError("getsockopt", err)
+	}
+	return local, peer, device, nil
+}
+
+// sockaddrIP returns the address of sa, or nil if it is not an IP one.
+func sockaddrIP(sa unix.Sockaddr) net.IP {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(sa.Addr[:]).To16()
+	case *unix.SockaddrInet6:
+		return net.IP(sa.Addr[:])
+	}
+	return nil
+}
+
+// systemRouteGet asks the kernel for the route it would use for dst, as
+// "ip route get" does.
+func systemRouteGet(dst net.IP) (RouteResult, error) {
+	family, ipv6 := byte(syscall.AF_INET), false
+	if FamilyOf(dst) == FamilyV6 {
+		family, ipv6 = syscall.AF_INET6, true
+	}
+	dst = canonicalIP(dst, ipv6)
+	payload := make([]byte, syscall.SizeofRtMsg, syscall.SizeofRtMsg+syscall.SizeofRtAttr+len(dst))
+	payload[0] = family
+	payload[1] = byte(8 * len(dst))
+	attr := make([]byte, syscall.SizeofRtAttr)
+	*(*syscall.RtAttr)(unsafe.Pointer(&attr[0])) = syscall.RtAttr{
+		Len:  uint16(syscall.SizeofRtAttr + len(dst)),
+		Type: syscall.RTA_DST,
+	}
+	payload = append(append(payload, attr...), dst...)
+
+	var (
+		rt    RouteEntry
+		found bool
+		local bool
+	)
+	err := netlinkRequest(syscall.RTM_GETROUTE, 0, payload, netlinkConfig{}, func(m *syscall.NetlinkMessage) (err error) {
+		var rts []RouteEntry
+		rts, err = parseRouteMessage(m)
+		if len(rts) > 0 {
+			rt, found = rts[0], true
+			local = rt.Type == TypeLocal
+		}
+		return err
+	})
+	if err != nil {
+		return RouteResult{}, err
+	}
+	if !found {
+		return RouteResult{}, fmt.Errorf("%w for %v", ErrNoRoute, dst)
+	}
+
+	res := RouteResult{
+		Gateway:      rt.Gateway,
+		PreferredSrc: rt.PrefSrc,
+		MTU:          int(rt.Metrics[rtaxMTU]),
+		IsLocal:      local,
+		ifindex:      rt.OutputIface,
+	}
+	if res.Gateway == nil && !local {
+		res.Gateway = dst
+	}
+	if res.Iface, err = net.InterfaceByIndex(rt.OutputIface); err != nil {
+		return RouteResult{}, err
+	}
+	if res.MTU == 0 {
+		res.MTU = res.Iface.MTU
+	}
+	if ipv6 && res.Gateway.IsLinkLocalUnicast() {
+		res.GatewayZone = res.Iface.Name
+	}
+	return res, nil
+}
+
+// netlinkError decodes the errno of an NLMSG_ERROR message.
+func netlinkError(b []byte) error {
+	if len(b) < 4 {
+		return syscall.EINVAL
+	}
+	errno := -*(*int32)(unsafe.Pointer(&b[0]))
+	if errno == 0 {
+		return nil
+	}
+	return os.NewSyscallError("netlink", syscall.Errno(errno))
+}
+
+// parseRouteMessages decodes an RTM_GETROUTE dump.  Messages too short to
+// hold a struct rtmsg and fixed-size attributes with short values are
+// rejected rather than read past their end.
+func parseRouteMessages(tab []byte) (routes []RouteEntry, err error) {
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		if msgs[i].Header.Type == syscall.NLMSG_DONE {
+			break
+		}
+		rts, err := parseRouteMessage(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, rts...)
+	}
+	return routes, nil
+}
+
+// Values of RTA_PREF (ICMPV6_ROUTER_PREF_*).
+const (
+	routerPrefMedium = 0
+	routerPrefHigh   = 1
+	routerPrefLow    = 3
+)
+
+// userHZ is the frequency of the clock ticks the kernel reports times in.
+const userHZ = 100
+
+// rtaNHID is the attribute of a route using a nexthop object, which unix
+// lacks (RTA_NH_ID).
+const rtaNHID = 30
+
+// parseRouteMessage decodes a message of an RTM_GETROUTE dump into a route
+// for each of its nexthops.  It returns none for messages other than IPv4
+// and IPv6 routes, and for routes using a nexthop object that the kernel
+// doesn't describe inline, as it does unless the nexthop_compat_mode sysctl
+// is off.  The routes do not refer to the memory of m.
+func parseRouteMessage(m *syscall.NetlinkMessage) ([]RouteEntry, error) {
+	if m.Header.Type != syscall.RTM_NEWROUTE {
+		return nil, nil
+	}
+	if len(m.Data) < syscall.SizeofRtMsg {
+		return nil, errors.New("truncated route message")
+	}
+	rt := (*routeInfoInMemory)(unsafe.Pointer(&m.Data[0]))
+	routeInfo := RouteEntry{}
+	attrs, err := parseAttrs(m.Data[syscall.SizeofRtMsg:])
+	if err != nil {
+		return nil, err
+	}
+	if rt.Family != syscall.AF_INET && rt.Family != syscall.AF_INET6 {
+		return nil, nil
+	}
+	if rt.Family == syscall.AF_INET {
+		routeInfo.Src = net.IPNet{
+			IP:   make([]byte, 4),
+			Mask: make([]byte, 4),
+		}
+		routeInfo.Dst = net.IPNet{
+			IP:   make([]byte, 4),
+			Mask: make([]byte, 4),
+		}
+	} else {
+		routeInfo.Src = net.IPNet{
+			IP:   make([]byte, 16),
+			Mask: make([]byte, 16),
+		}
+		routeInfo.Dst = net.IPNet{
+			IP:   make([]byte, 16),
+			Mask: make([]byte, 16),
+		}
+	}
+	routeInfo.Flags = routeFlags(rt.Flags)
+	routeInfo.Table = uint32(rt.Table)
+	routeInfo.Scope = rt.Scope
+	routeInfo.TOS = rt.TOS
+	routeInfo.Protocol = RouteProtocol(rt.Protocol)
+	routeInfo.Type = RouteType(rt.Type)
+	var multipath []byte
+	var nhObject, nhInline bool
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case syscall.RTA_MULTIPATH:
+			multipath = attr.Value
+			nhInline = true
+		case rtaNHID:
+			nhObject = true
+		case unix.RTA_VIA:
+			if routeInfo.Gateway, err = attrVia(attr); err != nil {
+				return nil, err
+			}
+			nhInline = true
+		case syscall.RTA_DST, syscall.RTA_SRC, syscall.RTA_GATEWAY, syscall.RTA_PREFSRC:
+			ip, err := attrIP(attr, rt.Family)
+			if err != nil {
+				return nil, err
+			}
+			switch attr.Attr.Type {
+			case syscall.RTA_DST:
+				routeInfo.Dst = net.IPNet{IP: ip, Mask: net.CIDRMask(int(rt.DstLen), len(ip)*8)}
+			case syscall.RTA_SRC:
+				routeInfo.Src = net.IPNet{IP: ip, Mask: net.CIDRMask(int(rt.SrcLen), len(ip)*8)}
+			case syscall.RTA_GATEWAY:
+				routeInfo.Gateway = ip
+				nhInline = true
+			case syscall.RTA_PREFSRC:
+				routeInfo.PrefSrc = ip
+			}
+		case syscall.RTA_IIF:
+			if len(attr.Value) < 4 {
+				return nil, errors.New("truncated RTA_IIF attribute")
+			}
+			routeInfo.InputIface = int(*(*int32)(unsafe.Pointer(&attr.Value[0])))
+		case syscall.RTA_OIF:
+			if len(attr.Value) < 4 {
+				return nil, errors.New("truncated RTA_OIF attribute")
+			}
+			routeInfo.OutputIface = int(*(*int32)(unsafe.Pointer(&attr.Value[0])))
+			nhInline = true
+		case syscall.RTA_PRIORITY:
+			if len(attr.Value) < 4 {
+				return nil, errors.New("truncated RTA_PRIORITY attribute")
+			}
+			routeInfo.Priority = *(*uint32)(unsafe.Pointer(&attr.Value[0]))
+		case syscall.RTA_TABLE:
+			if len(attr.Value) < 4 {
+				return nil, errors.New("truncated RTA_TABLE attribute")
+			}
+			routeInfo.Table = *(*uint32)(unsafe.Pointer(&attr.Value[0]))
+		case syscall.RTA_FLOW:
+			if len(attr.Value) < 4 {
+				return nil, errors.New("truncated RTA_FLOW attribute")
+			}
+			routeInfo.Realm = *(*uint32)(unsafe.Pointer(&attr.Value[0]))
+		case syscall.RTA_METRICS:
+			routeInfo.Metrics = parseRouteMetrics(attr.Value)
+		case unix.RTA_PREF:
+			if len(attr.Value) < 1 {
+				return nil, errors.New("truncated RTA_PREF attribute")
+			}
+			switch attr.Value[0] {
+			case routerPrefHigh:
+				routeInfo.Preference = PreferenceHigh
+			case routerPrefLow:
+				routeInfo.Preference = PreferenceLow
+			}
+		case syscall.RTA_CACHEINFO:
+			if len(attr.Value) < 12 {
+				return nil, errors.New("truncated RTA_CACHEINFO attribute")
+			}
+			// rta_expires, the third field of struct rta_cacheinfo, is the
+			// remaining lifetime in clock ticks, or zero if it never expires.
+			if expires := *(*int32)(unsafe.Pointer(&attr.Value[8])); expires > 0 {
+				routeInfo.ValidLifetime = time.Duration(expires) * time.Second / userHZ
+			}
+		}
+	}
+	if nhObject && !nhInline {
+		return nil, nil
+	}
+	if multipath != nil {
+		return parseRouteNexthops(routeInfo, multipath, rt.Family)
+	}
+	return []RouteEntry{routeInfo}, nil
+}
+
+// parseRouteNexthops returns a copy of rt for each struct rtnexthop of the
+// RTA_MULTIPATH attribute b of a multipath route, with the interface,
+// gateway, flags and weight of the nexthop.
+func parseRouteNexthops(rt RouteEntry, b []byte, family byte) ([]RouteEntry, error) {
+	var routes []RouteEntry
+	err := eachNexthop(b, func(nh *unix.RtNexthop, b []byte) error {
+		route := rt
+		route.OutputIface = int(nh.Ifindex)
+		route.Flags |= routeFlags(uint32(nh.Flags))
+		route.Weight = int(nh.Hops) + 1
+		attrs, err := parseAttrs(b)
+		if err != nil {
+			return err
+		}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case syscall.RTA_GATEWAY:
+				route.Gateway, err = attrIP(attr, family)
+			case unix.RTA_VIA:
+				route.Gateway, err = attrVia(attr)
+			}
 			if err != nil {
 				return err
 			}
-			if rt.Family != syscall.AF_INET && rt.Family != syscall.AF_INET6 {
-				continue loop
+		}
+		routes = append(routes, route)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// Pulled from http://man7.org/linux/man-pages/man7/rtnetlink.7.html
+// See the section on RTM_NEWRULE, specifically 'struct fib_rule_hdr'.
+type ruleInfoInMemory struct {
+	Family byte
+	DstLen byte
+	SrcLen byte
+	TOS    byte
+
+	Table  byte
+	_      byte
+	_      byte
+	Action byte
+
+	Flags uint32
+}
+
+const sizeofRuleInfo = 12
+
+func systemRules(family int, nl netlinkConfig) (rules []Rule, err error) {
+	err = netlinkDump(unix.RTM_GETRULE, family, nl, func(m *syscall.NetlinkMessage) error {
+		rule, ok, err := parseRuleMessage(m)
+		if ok {
+			rules = append(rules, rule)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// neighborValid are the neighbor states whose link-layer address may be
+// used.
+const neighborValid = unix.NUD_REACHABLE | unix.NUD_STALE | unix.NUD_DELAY | unix.NUD_PROBE | unix.NUD_PERMANENT | unix.NUD_NOARP
+
+func systemNeighbor(ip net.IP, ifindex int, nl netlinkConfig) (mac net.HardwareAddr, err error) {
+	family := syscall.AF_INET
+	if FamilyOf(ip) == FamilyV6 {
+		family = syscall.AF_INET6
+	}
+	found := false
+	err = netlinkDump(unix.RTM_GETNEIGH, family, nl, func(m *syscall.NetlinkMessage) error {
+		index, dst, lladdr, state, ok, err := parseNeighborMessage(m)
+		if ok && !found && index == ifindex && dst.Equal(ip) {
+			found = true
+			if state&neighborValid != 0 && len(lladdr) > 0 {
+				mac = lladdr
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if mac == nil {
+		return nil, fmt.Errorf("%w for %v", ErrNeighborUnresolved, ip)
+	}
+	return mac, nil
+}
+
+// parseNeighborMessage decodes the interface index, NDA_DST, NDA_LLADDR and
+// state of an RTM_NEWNEIGH message.  It reports false for other messages.
+func parseNeighborMessage(m *syscall.NetlinkMessage) (index int, dst net.IP, lladdr net.HardwareAddr, state uint16, ok bool, err error) {
+	if m.Header.Type != unix.RTM_NEWNEIGH {
+		return 0, nil, nil, 0, false, nil
+	}
+	if len(m.Data) < unix.SizeofNdMsg {
+		return 0, nil, nil, 0, false, errors.New("truncated neighbor message")
+	}
+	nd := (*unix.NdMsg)(unsafe.Pointer(&m.Data[0]))
+	if nd.Family != syscall.AF_INET && nd.Family != syscall.AF_INET6 {
+		return 0, nil, nil, 0, false, nil
+	}
+	attrs, err := parseAttrs(m.Data[unix.SizeofNdMsg:])
+	if err != nil {
+		return 0, nil, nil, 0, false, err
+	}
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case unix.NDA_DST:
+			if dst, err = attrIP(attr, nd.Family); err != nil {
+				return 0, nil, nil, 0, false, err
 			}
-			if rt.Family == syscall.AF_INET {
-				routeInfo.Src = net.IPNet{
-					IP: make([]byte, 4),
-					Mask: make([]byte, 4),
-				}
-				routeInfo.Dst = net.IPNet{
-					IP: make([]byte, 4),
-					Mask: make([]byte, 4),
-				}
-			} else {
-				routeInfo.Src = net.IPNet{
-					IP: make([]byte, 16),
-					Mask: make([]byte, 16),
-				}
-				routeInfo.Dst = net.IPNet{
-					IP: make([]byte, 16),
-					Mask: make([]byte, 16),
-				}
+		case unix.NDA_LLADDR:
+			lladdr = cloneBytes(attr.Value)
+		}
+	}
+	return int(nd.Ifindex), dst, lladdr, nd.State, true, nil
+}
+
+// Address families of the multicast routes of RTM_GETROUTE, which syscall
+// lacks (RTNL_FAMILY_IPMR and RTNL_FAMILY_IP6MR).
+const (
+	rtnlFamilyIPMR  = 128
+	rtnlFamilyIP6MR = 129
+)
+
+func systemMulticastRoutes(family int, nl netlinkConfig) (routes []MulticastEntry, err error) {
+	for _, f := range []struct{ family, mrFamily int }{
+		{syscall.AF_INET, rtnlFamilyIPMR},
+		{syscall.AF_INET6, rtnlFamilyIP6MR},
+	} {
+		if family != syscall.AF_UNSPEC && family != f.family {
+			continue
+		}
+		err = netlinkDump(syscall.RTM_GETROUTE, f.mrFamily, nl, func(m *syscall.NetlinkMessage) error {
+			mr, ok, err := parseMulticastMessage(m)
+			if ok {
+				routes = append(routes, mr)
 			}
-			for _, attr := range attrs {
-				switch attr.Attr.Type {
-				case syscall.RTA_DST:
-					routeInfo.Dst = net.IPNet{
-						IP:   net.IP(attr.Value),
-						Mask: net.CIDRMask(int(rt.DstLen), len(attr.Value)*8),
-					}
-				case syscall.RTA_SRC:
-					routeInfo.Src = net.IPNet{
-						IP:   net.IP(attr.Value),
-						Mask: net.CIDRMask(int(rt.SrcLen), len(attr.Value)*8),
-					}
-				case syscall.RTA_IIF:
-					routeInfo.InputIface = int64(*(*int32)(unsafe.Pointer(&attr.Value[0])))
-				case syscall.RTA_OIF:
-					routeInfo.OutputIface = int64(*(*int32)(unsafe.Pointer(&attr.Value[0])))
-				case syscall.RTA_GATEWAY:
-					routeInfo.Gateway = net.IP(attr.Value)
-				case syscall.RTA_PRIORITY:
-					routeInfo.Priority = *(*int32)(unsafe.Pointer(&attr.Value[0]))
-				case syscall.RTA_PREFSRC:
-					routeInfo.PrefSrc = net.IP(attr.Value)
-				case syscall.RTA_METRICS:
-					routeInfo.Metrics = int64(*(*int32)(unsafe.Pointer(&attr.Value[0])))
-				}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return routes, nil
+}
+
+// parseMulticastMessages decodes an RTM_GETROUTE dump of multicast routes,
+// as carefully as parseRouteMessages.
+func parseMulticastMessages(tab []byte) (routes []MulticastEntry, err error) {
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		if msgs[i].Header.Type == syscall.NLMSG_DONE {
+			break
+		}
+		mr, ok, err := parseMulticastMessage(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			routes = append(routes, mr)
+		}
+	}
+	return routes, nil
+}
+
+// parseMulticastMessage decodes a message of an RTM_GETROUTE dump of
+// multicast routes, like parseRouteMessage.  Kernels without multicast
+// routing answer such dumps with the unicast routes, which are skipped.
+func parseMulticastMessage(m *syscall.NetlinkMessage) (MulticastEntry, bool, error) {
+	if m.Header.Type != syscall.RTM_NEWROUTE {
+		return MulticastEntry{}, false, nil
+	}
+	if len(m.Data) < syscall.SizeofRtMsg {
+		return MulticastEntry{}, false, errors.New("truncated route message")
+	}
+	rt := (*routeInfoInMemory)(unsafe.Pointer(&m.Data[0]))
+	var family byte
+	switch rt.Family {
+	case rtnlFamilyIPMR:
+		family = syscall.AF_INET
+	case rtnlFamilyIP6MR:
+		family = syscall.AF_INET6
+	default:
+		return MulticastEntry{}, false, nil
+	}
+	attrs, err := parseAttrs(m.Data[syscall.SizeofRtMsg:])
+	if err != nil {
+		return MulticastEntry{}, false, err
+	}
+	size := net.IPv4len
+	if family == syscall.AF_INET6 {
+		size = net.IPv6len
+	}
+	mr := MulticastEntry{Source: make(net.IP, size), Group: make(net.IP, size)}
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case syscall.RTA_SRC:
+			mr.Source, err = attrIP(attr, family)
+		case syscall.RTA_DST:
+			mr.Group, err = attrIP(attr, family)
+		case syscall.RTA_IIF:
+			var index uint32
+			index, err = attrUint32(attr)
+			mr.InputIface = int(index)
+		case syscall.RTA_MULTIPATH:
+			mr.OutputIfaces, err = parseMulticastOutputs(attr.Value)
+		case unix.RTA_MFC_STATS:
+			// struct rta_mfc_stats: packets, bytes and wrong_if.
+			if len(attr.Value) < 24 {
+				return MulticastEntry{}, false, errors.New("truncated RTA_MFC_STATS attribute")
 			}
-			if rt.Family == syscall.AF_INET {
-				r.v4 = append(r.v4, routeInfo)
+			mr.Packets = *(*uint64)(unsafe.Pointer(&attr.Value[0]))
+			mr.Bytes = *(*uint64)(unsafe.Pointer(&attr.Value[8]))
+			mr.WrongIface = *(*uint64)(unsafe.Pointer(&attr.Value[16]))
+		}
+		if err != nil {
+			return MulticastEntry{}, false, err
+		}
+	}
+	return mr, true, nil
+}
+
+// parseMulticastOutputs returns the interfaces of the struct rtnexthop
+// list of the RTA_MULTIPATH attribute of a multicast route.
+func parseMulticastOutputs(b []byte) ([]int, error) {
+	var ifaces []int
+	err := eachNexthop(b, func(nh *unix.RtNexthop, attrs []byte) error {
+		ifaces = append(ifaces, int(nh.Ifindex))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ifaces, nil
+}
+
+// eachNexthop calls fn with each struct rtnexthop of the RTA_MULTIPATH
+// attribute b, and the attributes following it.
+func eachNexthop(b []byte, fn func(nh *unix.RtNexthop, attrs []byte) error) error {
+	for len(b) > 0 {
+		if len(b) < unix.SizeofRtNexthop {
+			return errors.New("truncated RTA_MULTIPATH attribute")
+		}
+		nh := (*unix.RtNexthop)(unsafe.Pointer(&b[0]))
+		if int(nh.Len) < unix.SizeofRtNexthop || int(nh.Len) > len(b) {
+			return fmt.Errorf("invalid nexthop length %d", nh.Len)
+		}
+		if err := fn(nh, b[unix.SizeofRtNexthop:nh.Len]); err != nil {
+			return err
+		}
+		next := (int(nh.Len) + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+		if next > len(b) {
+			break
+		}
+		b = b[next:]
+	}
+	return nil
+}
+
+// parseRuleMessages decodes an RTM_GETRULE dump, as carefully as
+// parseRouteMessages.
+func parseRuleMessages(tab []byte) (rules []Rule, err error) {
+	msgs, err := syscall.ParseNetlinkMessage(tab)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		if msgs[i].Header.Type == syscall.NLMSG_DONE {
+			break
+		}
+		rule, ok, err := parseRuleMessage(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// parseRuleMessage decodes a message of an RTM_GETRULE dump, like
+// parseRouteMessage.
+func parseRuleMessage(m *syscall.NetlinkMessage) (Rule, bool, error) {
+	if m.Header.Type != unix.RTM_NEWRULE {
+		return Rule{}, false, nil
+	}
+	if len(m.Data) < sizeofRuleInfo {
+		return Rule{}, false, errors.New("truncated rule message")
+	}
+	hdr := (*ruleInfoInMemory)(unsafe.Pointer(&m.Data[0]))
+	if hdr.Family != syscall.AF_INET && hdr.Family != syscall.AF_INET6 {
+		return Rule{}, false, nil
+	}
+	attrs, err := parseAttrs(m.Data[sizeofRuleInfo:])
+	if err != nil {
+		return Rule{}, false, err
+	}
+	rule := Rule{
+		Family: FamilyV4,
+		Invert: hdr.Flags&unix.FIB_RULE_INVERT != 0,
+		Action: RuleAction(hdr.Action),
+		Table:  uint32(hdr.Table),
+	}
+	if hdr.Family == syscall.AF_INET6 {
+		rule.Family = FamilyV6
+	}
+	hasMask := false
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case unix.FRA_DST, unix.FRA_SRC:
+			ip, err := attrIP(attr, hdr.Family)
+			if err != nil {
+				return Rule{}, false, err
+			}
+			if attr.Attr.Type == unix.FRA_DST {
+				rule.Dst = net.IPNet{IP: ip, Mask: net.CIDRMask(int(hdr.DstLen), len(ip)*8)}
 			} else {
-				r.v6 = append(r.v6, routeInfo)
+				rule.Src = net.IPNet{IP: ip, Mask: net.CIDRMask(int(hdr.SrcLen), len(ip)*8)}
+			}
+		case unix.FRA_IIFNAME:
+			rule.InputIfaceName = nulTerminated(attr.Value)
+		case unix.FRA_OIFNAME:
+			rule.OutputIfaceName = nulTerminated(attr.Value)
+		case unix.FRA_PRIORITY:
+			rule.Priority, err = attrUint32(attr)
+		case unix.FRA_FWMARK:
+			rule.Mark, err = attrUint32(attr)
+		case unix.FRA_FWMASK:
+			rule.Mask, err = attrUint32(attr)
+			hasMask = true
+		case unix.FRA_TABLE:
+			rule.Table, err = attrUint32(attr)
+		case unix.FRA_GOTO:
+			rule.Goto, err = attrUint32(attr)
+		case unix.FRA_SUPPRESS_PREFIXLEN:
+			var n uint32
+			// The kernel reports all ones when the rule suppresses
+			// nothing.
+			if n, err = attrUint32(attr); err == nil && int32(n) >= 0 {
+				rule.SuppressPrefix, rule.SuppressPrefixLength = true, int(n)
 			}
 		}
+		if err != nil {
+			return Rule{}, false, err
+		}
 	}
-	sort.Sort(r.v4)
-	sort.Sort(r.v6)
-	return nil
+	// As in the kernel, a mark without a mask is compared in full.
+	if rule.Mark != 0 && !hasMask {
+		rule.Mask = 0xffffffff
+	}
+	return rule, true, nil
+}
+
+// attrUint32 returns the value of a 32-bit attribute.
+func attrUint32(attr syscall.NetlinkRouteAttr) (uint32, error) {
+	if len(attr.Value) < 4 {
+		return 0, fmt.Errorf("truncated attribute %d", attr.Attr.Type)
+	}
+	return *(*uint32)(unsafe.Pointer(&attr.Value[0])), nil
+}
+
+// attrIP returns a copy of the address held in attr, which must have the
+// length of the addresses of family: an address of another length would
+// never match anything.
+func attrIP(attr syscall.NetlinkRouteAttr, family byte) (net.IP, error) {
+	size := net.IPv4len
+	if family == syscall.AF_INET6 {
+		size = net.IPv6len
+	}
+	if len(attr.Value) != size {
+		return nil, fmt.Errorf("%d-byte address in attribute %d of family %d", len(attr.Value), attr.Attr.Type, family)
+	}
+	return cloneBytes(attr.Value), nil
+}
+
+// attrVia decodes the struct rtvia of an RTA_VIA attribute, the gateway of
+// a route of another family than its own, such as an IPv4 route via an
+// IPv6 nexthop (RFC 5549).
+func attrVia(attr syscall.NetlinkRouteAttr) (net.IP, error) {
+	if len(attr.Value) < 2 {
+		return nil, errors.New("truncated RTA_VIA attribute")
+	}
+	family := *(*uint16)(unsafe.Pointer(&attr.Value[0]))
+	if family != syscall.AF_INET && family != syscall.AF_INET6 {
+		return nil, fmt.Errorf("RTA_VIA attribute of family %d", family)
+	}
+	return attrIP(syscall.NetlinkRouteAttr{Attr: attr.Attr, Value: attr.Value[2:]}, byte(family))
+}
+
+// cloneBytes returns a copy of b, for values that must outlive the netlink
+// buffer they were read from.
+func cloneBytes(b []byte) []byte {
+	return append([]byte(nil), b...)
+}
+
+func nulTerminated(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// routeFlags converts the rtm_flags of a route message.
+func routeFlags(flags uint32) RouteFlags {
+	var f RouteFlags
+	if flags&unix.RTNH_F_DEAD != 0 {
+		f |= RouteDead
+	}
+	if flags&unix.RTNH_F_ONLINK != 0 {
+		f |= RouteOnLink
+	}
+	if flags&unix.RTNH_F_LINKDOWN != 0 {
+		f |= RouteLinkDown
+	}
+	if flags&unix.RTM_F_CLONED != 0 {
+		f |= RouteCloned
+	}
+	return f
+}
+
+// parseAttrs splits b into route attributes.  Unlike
+// syscall.ParseNetlinkRouteAttr it tolerates a final attribute that is not
+// padded to alignment instead of slicing past the end of b.
+func parseAttrs(b []byte) ([]syscall.NetlinkRouteAttr, error) {
+	var attrs []syscall.NetlinkRouteAttr
+	for len(b) >= syscall.SizeofRtAttr {
+		attr := (*syscall.RtAttr)(unsafe.Pointer(&b[0]))
+		attrLen := int(attr.Len)
+		if attrLen < syscall.SizeofRtAttr || attrLen > len(b) {
+			return nil, errors.New("invalid route attribute length")
+		}
+		attrs = append(attrs, syscall.NetlinkRouteAttr{
+			Attr:  *attr,
+			Value: b[syscall.SizeofRtAttr:attrLen],
+		})
+		alignedLen := (attrLen + syscall.RTA_ALIGNTO - 1) & ^(syscall.RTA_ALIGNTO - 1)
+		if alignedLen > len(b) {
+			break
+		}
+		b = b[alignedLen:]
+	}
+	return attrs, nil
+}
+
+// parseRouteMetrics decodes the nested RTAX_* attributes carried in an
+// RTA_METRICS attribute.  Malformed trailing data is ignored.
+func parseRouteMetrics(b []byte) map[int]uint32 {
+	metrics := make(map[int]uint32)
+	for len(b) >= syscall.SizeofRtAttr {
+		attr := (*syscall.RtAttr)(unsafe.Pointer(&b[0]))
+		attrLen := int(attr.Len)
+		if attrLen < syscall.SizeofRtAttr || attrLen > len(b) {
+			break
+		}
+		if attrLen >= syscall.SizeofRtAttr+4 {
+			metrics[int(attr.Type)] = *(*uint32)(unsafe.Pointer(&b[syscall.SizeofRtAttr]))
+		}
+		alignedLen := (attrLen + syscall.RTA_ALIGNTO - 1) & ^(syscall.RTA_ALIGNTO - 1)
+		if alignedLen > len(b) {
+			break
+		}
+		b = b[alignedLen:]
+	}
+	return metrics
+}
+
+// systemAddrs reads the addresses of iface over netlink rather than with
+// iface.Addrs, which drops the address flags.
+func systemAddrs(iface *net.Interface, nl netlinkConfig) ([]net.Addr, error) {
+	all, err := systemAllAddrs(nl)
+	if err != nil {
+		return nil, err
+	}
+	return all[iface.Index], nil
+}
+
+func (p systemProvider) allAddrs() (map[int][]net.Addr, error) {
+	return systemAllAddrs(p.netlink)
+}
+
+// systemAllAddrs reads the addresses of every interface, keyed by interface
+// index, with one dump of the unicast addresses and one of the IPv6 anycast
+// addresses, which are flagged AddrAnycast.
+func systemAllAddrs(nl netlinkConfig) (map[int][]net.Addr, error) {
+	addrs := make(map[int][]net.Addr)
+	collect := func(m *syscall.NetlinkMessage) error {
+		// Anycast addresses come in messages of the type of the request.
+		if m.Header.Type != syscall.RTM_NEWADDR && m.Header.Type != unix.RTM_GETANYCAST {
+			return nil
+		}
+		index, addr, err := parseIfAddrMessage(m)
+		if err != nil {
+			return err
+		}
+		if addr != nil {
+			addrs[index] = append(addrs[index], addr)
+		}
+		return nil
+	}
+	if err := netlinkDump(syscall.RTM_GETADDR, syscall.AF_UNSPEC, nl, collect); err != nil {
+		return nil, err
+	}
+	// Anycast addresses are only an addition: the sandboxes, such as gVisor,
+	// that don't dump them still have their unicast addresses read.
+	_ = netlinkDump(unix.RTM_GETANYCAST, syscall.AF_INET6, nl, collect)
+	return addrs, nil
+}
+
+// parseIfAddrMessage decodes an RTM_NEWADDR message into the interface index
+// and the address it describes.  The address is nil for families other than
+// IPv4 and IPv6.
+func parseIfAddrMessage(m *syscall.NetlinkMessage) (int, *InterfaceAddr, error) {
+	if len(m.Data) < syscall.SizeofIfAddrmsg {
+		return 0, nil, syscall.EINVAL
+	}
+	ifam := (*syscall.IfAddrmsg)(unsafe.Pointer(&m.Data[0]))
+	var size int
+	switch ifam.Family {
+	case syscall.AF_INET:
+		size = net.IPv4len
+	case syscall.AF_INET6:
+		size = net.IPv6len
+	default:
+		return int(ifam.Index), nil, nil
+	}
+	attrs, err := parseAttrs(m.Data[syscall.SizeofIfAddrmsg:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// On point-to-point links IFA_ADDRESS is the address of the peer and
+	// IFA_LOCAL the local one, as in the net package.
+	var local, address net.IP
+	var anycast bool
+	flags := uint32(ifam.Flags)
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case unix.IFA_ANYCAST:
+			// The only address of the messages of RTM_GETANYCAST.
+			if len(attr.Value) == size {
+				address, anycast = net.IP(attr.Value), true
+			}
+		case syscall.IFA_LOCAL:
+			if len(attr.Value) == size {
+				local = net.IP(attr.Value)
+			}
+		case syscall.IFA_ADDRESS:
+			if len(attr.Value) == size {
+				address = net.IP(attr.Value)
+			}
+		case unix.IFA_FLAGS:
+			if len(attr.Value) == 4 {
+				flags = *(*uint32)(unsafe.Pointer(&attr.Value[0]))
+			}
+		}
+	}
+	ip := local
+	if ip == nil {
+		ip = address
+	}
+	if ip == nil {
+		return int(ifam.Index), nil, nil
+	}
+
+	addr := &InterfaceAddr{IPNet: net.IPNet{
+		IP:   append(net.IP(nil), ip...),
+		Mask: net.CIDRMask(int(ifam.Prefixlen), 8*size),
+	}}
+	// IFA_F_SECONDARY and IFA_F_TEMPORARY are the same bit, which means
+	// the latter on IPv6 addresses.
+	switch {
+	case flags&unix.IFA_F_SECONDARY != 0 && ifam.Family == syscall.AF_INET:
+		addr.Flags |= AddrSecondary
+	case flags&unix.IFA_F_TEMPORARY != 0:
+		addr.Flags |= AddrTemporary
+	}
+	if anycast {
+		addr.Flags |= AddrAnycast
+	}
+	return int(ifam.Index), addr, nil
 }
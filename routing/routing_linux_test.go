@@ -0,0 +1,807 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+func TestParseRouteMetrics(t *testing.T) {
+	// RTAX_MTU = 1400, RTAX_HOPLIMIT = 64, followed by a truncated attribute.
+	b := []byte{
+		8, 0, unix.RTAX_MTU, 0, 0x78, 0x05, 0, 0,
+		8, 0, unix.RTAX_HOPLIMIT, 0, 64, 0, 0, 0,
+		8, 0, unix.RTAX_ADVMSS, 0,
+	}
+	metrics := parseRouteMetrics(b)
+	if len(metrics) != 2 {
+		t.Fatalf("\ngot:	%v\nwant:	2 metrics\n\n", metrics)
+	}
+	if metrics[unix.RTAX_MTU] != 1400 {
+		t.Errorf("\ngot:	%d\nwant:	%d\n\n", metrics[unix.RTAX_MTU], 1400)
+	}
+	if metrics[unix.RTAX_HOPLIMIT] != 64 {
+		t.Errorf("\ngot:	%d\nwant:	%d\n\n", metrics[unix.RTAX_HOPLIMIT], 64)
+	}
+}
+
+func TestSystemAddrs(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ifaces {
+		want, err := ifaces[i].Addrs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		all, err := systemAddrs(&ifaces[i], netlinkConfig{})
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		// The net package leaves the anycast addresses out.
+		var got []net.Addr
+		for _, addr := range all {
+			if addr.(*InterfaceAddr).Flags&AddrAnycast == 0 {
+				got = append(got, addr)
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%s\ngot:	%v\nwant:	%v\n\n", ifaces[i].Name, got, want)
+		}
+		for j := range want {
+			if got[j].String() != want[j].String() {
+				t.Errorf("%s\ngot:	%v\nwant:	%v\n\n", ifaces[i].Name, got[j], want[j])
+			}
+		}
+	}
+}
+
+func TestParseIfAddrMessage(t *testing.T) {
+	// 192.168.1.3/24 on index 2, IFA_F_SECONDARY set through IFA_FLAGS.
+	data := []byte{
+		syscall.AF_INET, 24, 0, 0, 2, 0, 0, 0,
+		8, 0, syscall.IFA_ADDRESS, 0, 192, 168, 1, 3,
+		8, 0, syscall.IFA_LOCAL, 0, 192, 168, 1, 3,
+		8, 0, unix.IFA_FLAGS, 0, unix.IFA_F_SECONDARY, 0, 0, 0,
+	}
+	m := syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Len: uint32(syscall.NLMSG_HDRLEN + len(data)), Type: syscall.RTM_NEWADDR},
+		Data:   data,
+	}
+	index, addr, err := parseIfAddrMessage(&m)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if index != 2 || addr.String() != "192.168.1.3/24" || addr.Flags != AddrSecondary {
+		t.Errorf("\ngot:	%d %v %v\nwant:	2 192.168.1.3/24 %v\n\n", index, addr, addr.Flags, AddrSecondary)
+	}
+
+	// 2001:db8::1234/64 on index 2, with the same flag meaning
+	// IFA_F_TEMPORARY.
+	data6 := []byte{
+		syscall.AF_INET6, 64, unix.IFA_F_TEMPORARY, 0, 2, 0, 0, 0,
+		20, 0, syscall.IFA_ADDRESS, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x12, 0x34,
+	}
+	m = syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Len: uint32(syscall.NLMSG_HDRLEN + len(data6)), Type: syscall.RTM_NEWADDR},
+		Data:   data6,
+	}
+	if _, addr, err := parseIfAddrMessage(&m); err != nil || addr.Flags != AddrTemporary {
+		t.Errorf("\ngot:	%v %v\nwant:	%v\n\n", addr, err, AddrTemporary)
+	}
+
+	// The subnet-router anycast address 2001:db8:: on index 2, as dumped by
+	// RTM_GETANYCAST.
+	dataAnycast := []byte{
+		syscall.AF_INET6, 128, unix.IFA_F_PERMANENT, 0, 2, 0, 0, 0,
+		20, 0, unix.IFA_ANYCAST, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	}
+	m = syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Len: uint32(syscall.NLMSG_HDRLEN + len(dataAnycast)), Type: unix.RTM_GETANYCAST},
+		Data:   dataAnycast,
+	}
+	if _, addr, err := parseIfAddrMessage(&m); err != nil || addr.String() != "2001:db8::/128" || addr.Flags != AddrAnycast {
+		t.Errorf("\ngot:	%v %v\nwant:	2001:db8::/128 %v\n\n", addr, err, AddrAnycast)
+	}
+
+	if _, _, err := parseIfAddrMessage(&syscall.NetlinkMessage{Data: data[:4]}); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for a truncated message\n\n")
+	}
+}
+
+func TestParseRouteMessages(t *testing.T) {
+	tab, err := os.ReadFile("testdata/netlink-routes.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := parseRouteMessages(tab)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if len(routes) != 14 {
+		t.Fatalf("\ngot:	%d routes\nwant:	14\n\n", len(routes))
+	}
+	if routes[0].Dst.String() != "0.0.0.0/0" || !routes[0].Gateway.Equal(net.IPv4(192, 0, 2, 1)) || routes[0].OutputIface != 4 {
+		t.Errorf("\ngot:	%+v\nwant:	default via 192.0.2.1 dev 4\n\n", routes[0])
+	}
+
+	// Routes must not refer to the buffer they were read from, which the
+	// netlink dump reuses for the next messages.
+	for i := range tab {
+		tab[i] = 0xff
+	}
+	if !routes[0].Gateway.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("\ngot:	%v\nwant:	192.0.2.1 after reuse of the buffer\n\n", routes[0].Gateway)
+	}
+
+	// An RTM_NEWROUTE message whose RTA_OIF carries only two bytes.
+	msg := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg+8)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], syscall.RTM_NEWROUTE)
+	msg[syscall.NLMSG_HDRLEN] = syscall.AF_INET
+	attr := msg[syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg:]
+	binary.NativeEndian.PutUint16(attr[0:], 6)
+	binary.NativeEndian.PutUint16(attr[2:], syscall.RTA_OIF)
+	if _, err := parseRouteMessages(msg); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for a truncated RTA_OIF\n\n")
+	}
+}
+
+func TestParseRouteFlags(t *testing.T) {
+	msg := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], syscall.RTM_NEWROUTE)
+	msg[syscall.NLMSG_HDRLEN] = syscall.AF_INET
+	msg[syscall.NLMSG_HDRLEN+3] = 0x10 // rtm_tos
+	msg[syscall.NLMSG_HDRLEN+5] = 16   // rtm_protocol
+	binary.NativeEndian.PutUint32(msg[syscall.NLMSG_HDRLEN+8:], unix.RTNH_F_DEAD|unix.RTM_F_CLONED)
+	routes, err := parseRouteMessages(msg)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if len(routes) != 1 || routes[0].Flags != RouteDead|RouteCloned {
+		t.Errorf("\ngot:	%+v\nwant:	one route with %v\n\n", routes, RouteDead|RouteCloned)
+	}
+	if len(routes) == 1 && (routes[0].TOS != 0x10 || routes[0].Protocol != ProtocolDHCP) {
+		t.Errorf("\ngot:	%#x %v\nwant:	0x10 dhcp\n\n", routes[0].TOS, routes[0].Protocol)
+	}
+}
+
+func TestParseRouteCacheInfo(t *testing.T) {
+	// An RTM_NEWROUTE message with an RTA_CACHEINFO expiring in 30s.
+	msg := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg+4+32)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], syscall.RTM_NEWROUTE)
+	msg[syscall.NLMSG_HDRLEN] = syscall.AF_INET6
+	attr := msg[syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg:]
+	binary.NativeEndian.PutUint16(attr[0:], 4+32)
+	binary.NativeEndian.PutUint16(attr[2:], syscall.RTA_CACHEINFO)
+	binary.NativeEndian.PutUint32(attr[4+8:], 30*userHZ)
+	routes, err := parseRouteMessages(msg)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if len(routes) != 1 || routes[0].ValidLifetime != 30*time.Second || routes[0].Age != 0 {
+		t.Errorf("\ngot:	%+v\nwant:	one route valid for 30s\n\n", routes)
+	}
+}
+
+func TestParseRoutePreference(t *testing.T) {
+	// An IPv6 RTM_NEWROUTE message with a high RTA_PREF.
+	msg := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg+8)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], syscall.RTM_NEWROUTE)
+	msg[syscall.NLMSG_HDRLEN] = syscall.AF_INET6
+	attr := msg[syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg:]
+	binary.NativeEndian.PutUint16(attr[0:], 4+1)
+	binary.NativeEndian.PutUint16(attr[2:], unix.RTA_PREF)
+	for value, want := range map[byte]RoutePreference{
+		routerPrefMedium: PreferenceMedium,
+		routerPrefHigh:   PreferenceHigh,
+		routerPrefLow:    PreferenceLow,
+	} {
+		attr[4] = value
+		routes, err := parseRouteMessages(msg)
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if len(routes) != 1 || routes[0].Preference != want {
+			t.Errorf("%d\ngot:	%+v\nwant:	one route with preference %v\n\n", value, routes, want)
+		}
+	}
+}
+
+func TestParseRouteMultipath(t *testing.T) {
+	// A default route over 192.0.2.1 on interface 2, weight 1, and
+	// 198.51.100.1 on interface 3, weight 3 and dead.
+	nhLen := unix.SizeofRtNexthop + 8
+	msg := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg+4+2*nhLen)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], syscall.RTM_NEWROUTE)
+	msg[syscall.NLMSG_HDRLEN] = syscall.AF_INET
+	attr := msg[syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg:]
+	binary.NativeEndian.PutUint16(attr[0:], uint16(4+2*nhLen))
+	binary.NativeEndian.PutUint16(attr[2:], syscall.RTA_MULTIPATH)
+	for i, nexthop := range []struct {
+		flags, hops byte
+		index       uint32
+		gateway     net.IP
+	}{
+		{0, 0, 2, net.IPv4(192, 0, 2, 1)},
+		{unix.RTNH_F_DEAD, 2, 3, net.IPv4(198, 51, 100, 1)},
+	} {
+		nh := attr[4+i*nhLen:]
+		binary.NativeEndian.PutUint16(nh[0:], uint16(nhLen))
+		nh[2], nh[3] = nexthop.flags, nexthop.hops
+		binary.NativeEndian.PutUint32(nh[4:], nexthop.index)
+		binary.NativeEndian.PutUint16(nh[unix.SizeofRtNexthop:], 8)
+		binary.NativeEndian.PutUint16(nh[unix.SizeofRtNexthop+2:], syscall.RTA_GATEWAY)
+		copy(nh[unix.SizeofRtNexthop+4:], nexthop.gateway.To4())
+	}
+
+	routes, err := parseRouteMessages(msg)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("\ngot:	%+v\nwant:	a route per nexthop\n\n", routes)
+	}
+	if rt := routes[0]; rt.OutputIface != 2 || !rt.Gateway.Equal(net.IPv4(192, 0, 2, 1)) || rt.Weight != 1 || rt.Flags != 0 {
+		t.Errorf("\ngot:	%+v\nwant:	via 192.0.2.1 dev 2 weight 1\n\n", rt)
+	}
+	if rt := routes[1]; rt.OutputIface != 3 || !rt.Gateway.Equal(net.IPv4(198, 51, 100, 1)) || rt.Weight != 3 || rt.Flags != RouteDead {
+		t.Errorf("\ngot:	%+v\nwant:	via 198.51.100.1 dev 3 weight 3 dead\n\n", rt)
+	}
+}
+
+func TestParseMulticastMessages(t *testing.T) {
+	// An RTM_NEWROUTE message of the IPv4 multicast table: (192.0.2.10,
+	// 239.1.1.1) from interface 1 to 2 and 3, with RTA_MFC_STATS.
+	msg := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg+8+8+8+(4+2*unix.SizeofRtNexthop)+(4+24))
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], syscall.RTM_NEWROUTE)
+	msg[syscall.NLMSG_HDRLEN] = rtnlFamilyIPMR
+	attr := msg[syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg:]
+	put := func(typ uint16, value []byte) {
+		binary.NativeEndian.PutUint16(attr[0:], uint16(4+len(value)))
+		binary.NativeEndian.PutUint16(attr[2:], typ)
+		copy(attr[4:], value)
+		attr = attr[4+len(value):]
+	}
+	put(syscall.RTA_SRC, net.IPv4(192, 0, 2, 10).To4())
+	put(syscall.RTA_DST, net.IPv4(239, 1, 1, 1).To4())
+	iif := make([]byte, 4)
+	binary.NativeEndian.PutUint32(iif, 1)
+	put(syscall.RTA_IIF, iif)
+	nexthops := make([]byte, 2*unix.SizeofRtNexthop)
+	for i, index := range []uint32{2, 3} {
+		nh := nexthops[i*unix.SizeofRtNexthop:]
+		binary.NativeEndian.PutUint16(nh[0:], unix.SizeofRtNexthop)
+		binary.NativeEndian.PutUint32(nh[4:], index)
+	}
+	put(syscall.RTA_MULTIPATH, nexthops)
+	stats := make([]byte, 24)
+	binary.NativeEndian.PutUint64(stats[0:], 10)
+	binary.NativeEndian.PutUint64(stats[8:], 1500)
+	binary.NativeEndian.PutUint64(stats[16:], 1)
+	put(unix.RTA_MFC_STATS, stats)
+
+	routes, err := parseMulticastMessages(msg)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	want := []MulticastEntry{{
+		Source:       net.IPv4(192, 0, 2, 10).To4(),
+		Group:        net.IPv4(239, 1, 1, 1).To4(),
+		InputIface:   1,
+		OutputIfaces: []int{2, 3},
+		Packets:      10,
+		Bytes:        1500,
+		WrongIface:   1,
+	}}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("\ngot:	%+v\nwant:	%+v\n\n", routes, want)
+	}
+
+	// Unicast routes, which kernels without multicast routing answer
+	// with, are skipped.
+	msg[syscall.NLMSG_HDRLEN] = syscall.AF_INET
+	if routes, err := parseMulticastMessages(msg); err != nil || len(routes) != 0 {
+		t.Errorf("\ngot:	%+v %v\nwant:	no route\n\n", routes, err)
+	}
+}
+
+func TestParseNeighborMessage(t *testing.T) {
+	// An RTM_NEWNEIGH message for 192.0.2.1 on interface 2, reachable.
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	msg := make([]byte, syscall.NLMSG_HDRLEN+unix.SizeofNdMsg+8+12)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], unix.RTM_NEWNEIGH)
+	nd := msg[syscall.NLMSG_HDRLEN:]
+	nd[0] = syscall.AF_INET
+	binary.NativeEndian.PutUint32(nd[4:], 2)
+	binary.NativeEndian.PutUint16(nd[8:], unix.NUD_REACHABLE)
+	attr := nd[unix.SizeofNdMsg:]
+	binary.NativeEndian.PutUint16(attr[0:], 4+4)
+	binary.NativeEndian.PutUint16(attr[2:], unix.NDA_DST)
+	copy(attr[4:], net.IPv4(192, 0, 2, 1).To4())
+	binary.NativeEndian.PutUint16(attr[8:], 4+6)
+	binary.NativeEndian.PutUint16(attr[10:], unix.NDA_LLADDR)
+	copy(attr[12:], mac)
+
+	msgs, err := syscall.ParseNetlinkMessage(msg)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	index, dst, lladdr, state, ok, err := parseNeighborMessage(&msgs[0])
+	if err != nil || !ok {
+		t.Fatalf("\ngot:	%v %v\nwant:	a neighbor\n\n", ok, err)
+	}
+	if index != 2 || !dst.Equal(net.IPv4(192, 0, 2, 1)) || lladdr.String() != mac.String() || state&neighborValid == 0 {
+		t.Errorf("\ngot:	%d %v %v %#x\nwant:	2 192.0.2.1 %v reachable\n\n", index, dst, lladdr, state, mac)
+	}
+}
+
+func TestParseRouteGatewayLength(t *testing.T) {
+	// An IPv4 RTM_NEWROUTE message whose RTA_GATEWAY holds 16 bytes.
+	msg := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg+4+16)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], syscall.RTM_NEWROUTE)
+	msg[syscall.NLMSG_HDRLEN] = syscall.AF_INET
+	attr := msg[syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg:]
+	binary.NativeEndian.PutUint16(attr[0:], 4+16)
+	binary.NativeEndian.PutUint16(attr[2:], syscall.RTA_GATEWAY)
+	copy(attr[4:], net.ParseIP("192.0.2.1"))
+	if routes, err := parseRouteMessages(msg); err == nil {
+		t.Errorf("\ngot:	%+v\nwant:	error for a 16-byte IPv4 gateway\n\n", routes)
+	}
+
+	// The same with 4 bytes is valid.
+	msg = msg[:len(msg)-12]
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(attr[0:], 4+4)
+	copy(attr[4:], net.IPv4(192, 0, 2, 1).To4())
+	routes, err := parseRouteMessages(msg)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if len(routes) != 1 || !routes[0].Gateway.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("\ngot:	%+v\nwant:	one route via 192.0.2.1\n\n", routes)
+	}
+}
+
+func TestParseRouteVia(t *testing.T) {
+	// An IPv4 RTM_NEWROUTE message via the IPv6 nexthop fe80::1 on
+	// interface 2.
+	msg := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg+8+4+20)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], syscall.RTM_NEWROUTE)
+	msg[syscall.NLMSG_HDRLEN] = syscall.AF_INET
+	attr := msg[syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg:]
+	binary.NativeEndian.PutUint16(attr[0:], 8)
+	binary.NativeEndian.PutUint16(attr[2:], syscall.RTA_OIF)
+	binary.NativeEndian.PutUint32(attr[4:], 2)
+	attr = attr[8:]
+	binary.NativeEndian.PutUint16(attr[0:], 4+2+16)
+	binary.NativeEndian.PutUint16(attr[2:], unix.RTA_VIA)
+	binary.NativeEndian.PutUint16(attr[4:], syscall.AF_INET6)
+	copy(attr[6:], net.ParseIP("fe80::1"))
+	routes, err := parseRouteMessages(msg)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if len(routes) != 1 || routes[0].OutputIface != 2 || !routes[0].Gateway.Equal(net.ParseIP("fe80::1")) {
+		t.Errorf("\ngot:	%+v\nwant:	one route via fe80::1 dev 2\n\n", routes)
+	}
+
+	// An address that doesn't match its family is rejected.
+	binary.NativeEndian.PutUint16(attr[4:], syscall.AF_INET)
+	if routes, err := parseRouteMessages(msg); err == nil {
+		t.Errorf("\ngot:	%+v\nwant:	error for a 16-byte IPv4 nexthop\n\n", routes)
+	}
+}
+
+func TestParseRouteNexthopObject(t *testing.T) {
+	// An IPv4 RTM_NEWROUTE message using nexthop object 7, which the
+	// kernel describes inline with an RTA_OIF in compatibility mode.
+	msg := make([]byte, syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg+8+8)
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:], syscall.RTM_NEWROUTE)
+	msg[syscall.NLMSG_HDRLEN] = syscall.AF_INET
+	attr := msg[syscall.NLMSG_HDRLEN+syscall.SizeofRtMsg:]
+	binary.NativeEndian.PutUint16(attr[0:], 8)
+	binary.NativeEndian.PutUint16(attr[2:], rtaNHID)
+	binary.NativeEndian.PutUint32(attr[4:], 7)
+	binary.NativeEndian.PutUint16(attr[8:], 8)
+	binary.NativeEndian.PutUint16(attr[10:], syscall.RTA_OIF)
+	binary.NativeEndian.PutUint32(attr[12:], 2)
+	routes, err := parseRouteMessages(msg)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if len(routes) != 1 || routes[0].OutputIface != 2 {
+		t.Errorf("\ngot:	%+v\nwant:	one route on dev 2\n\n", routes)
+	}
+
+	// Without it, the nexthop is unknown and the route is left out.
+	msg = msg[:len(msg)-8]
+	binary.NativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	routes, err = parseRouteMessages(msg)
+	if err != nil || len(routes) != 0 {
+		t.Errorf("\ngot:	%+v %v\nwant:	no route\n\n", routes, err)
+	}
+}
+
+func FuzzParseNetlinkRoutes(f *testing.F) {
+	if tab, err := os.ReadFile("testdata/netlink-routes.bin"); err == nil {
+		f.Add(tab)
+	}
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, tab []byte) {
+		routes, err := parseRouteMessages(tab)
+		if err != nil && routes != nil {
+			t.Errorf("\ngot:	%d routes with %v\nwant:	nil\n\n", len(routes), err)
+		}
+		rules, err := parseRuleMessages(tab)
+		if err != nil && rules != nil {
+			t.Errorf("\ngot:	%d rules with %v\nwant:	nil\n\n", len(rules), err)
+		}
+	})
+}
+
+func TestParseRuleMessages(t *testing.T) {
+	// from 10.0.0.0/8 fwmark 0x1 lookup 100 suppress_prefixlength 0, at
+	// priority 100.
+	data := []byte{
+		syscall.AF_INET, 0, 8, 0, unix.RT_TABLE_UNSPEC, 0, 0, unix.FR_ACT_TO_TBL, 0, 0, 0, 0,
+		8, 0, unix.FRA_SRC, 0, 10, 0, 0, 0,
+		8, 0, unix.FRA_PRIORITY, 0, 100, 0, 0, 0,
+		8, 0, unix.FRA_FWMARK, 0, 1, 0, 0, 0,
+		8, 0, unix.FRA_TABLE, 0, 100, 0, 0, 0,
+		8, 0, unix.FRA_IIFNAME, 0, 'l', 'o', 0, 0,
+		8, 0, unix.FRA_SUPPRESS_PREFIXLEN, 0, 0, 0, 0, 0,
+	}
+	msg := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(data))
+	binary.NativeEndian.PutUint32(msg[0:], uint32(syscall.NLMSG_HDRLEN+len(data)))
+	binary.NativeEndian.PutUint16(msg[4:], unix.RTM_NEWRULE)
+	msg = append(msg, data...)
+
+	rules, err := parseRuleMessages(msg)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	want := Rule{
+		Family:         FamilyV4,
+		Priority:       100,
+		Src:            net.IPNet{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+		Mark:           1,
+		Mask:           0xffffffff,
+		InputIfaceName: "lo",
+		Action:         RuleLookup,
+		Table:          100,
+		SuppressPrefix: true,
+	}
+	if len(rules) != 1 || rules[0].Src.String() != want.Src.String() || rules[0].Priority != want.Priority ||
+		rules[0].Mark != want.Mark || rules[0].Mask != want.Mask || rules[0].InputIfaceName != want.InputIfaceName ||
+		rules[0].Action != want.Action || rules[0].Table != want.Table ||
+		rules[0].SuppressPrefix != want.SuppressPrefix || rules[0].SuppressPrefixLength != want.SuppressPrefixLength {
+		t.Errorf("\ngot:	%+v\nwant:	%+v\n\n", rules, want)
+	}
+
+	short := append([]byte(nil), msg[:syscall.NLMSG_HDRLEN+8]...)
+	binary.NativeEndian.PutUint32(short[0:], uint32(len(short)))
+	if _, err := parseRuleMessages(short); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for a truncated message\n\n")
+	}
+}
+
+func TestParseLinkAltNames(t *testing.T) {
+	// Index 2 with the altnames enp0s31f6 and lan, in IFLA_PROP_LIST.
+	data := []byte{
+		syscall.AF_UNSPEC, 0, 1, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		8, 0, syscall.IFLA_MTU, 0, 0xdc, 0x05, 0, 0,
+		4 + 16 + 8, 0, unix.IFLA_PROP_LIST, unix.NLA_F_NESTED >> 8,
+		14, 0, unix.IFLA_ALT_IFNAME, 0, 'e', 'n', 'p', '0', 's', '3', '1', 'f', '6', 0, 0, 0,
+		8, 0, unix.IFLA_ALT_IFNAME, 0, 'l', 'a', 'n', 0,
+	}
+	m := syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Len: uint32(syscall.NLMSG_HDRLEN + len(data)), Type: syscall.RTM_NEWLINK},
+		Data:   data,
+	}
+	index, names, err := parseLinkAltNames(&m)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if index != 2 || !reflect.DeepEqual(names, []string{"enp0s31f6", "lan"}) {
+		t.Errorf("\ngot:	%d %q\nwant:	2 [enp0s31f6 lan]\n\n", index, names)
+	}
+
+	if _, err := systemAltNames(netlinkConfig{}); err != nil {
+		t.Errorf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+}
+
+func TestParseLinkMaster(t *testing.T) {
+	// Index 2, enslaved to index 5, of kind "veth" in IFLA_LINKINFO.
+	data := []byte{
+		syscall.AF_UNSPEC, 0, 1, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		8, 0, syscall.IFLA_MASTER, 0, 5, 0, 0, 0,
+		4 + 12, 0, syscall.IFLA_LINKINFO, 0,
+		9, 0, unix.IFLA_INFO_KIND, 0, 'v', 'e', 't', 'h', 0, 0, 0, 0,
+	}
+	m := syscall.NetlinkMessage{
+		Header: syscall.NlMsghdr{Len: uint32(syscall.NLMSG_HDRLEN + len(data)), Type: syscall.RTM_NEWLINK},
+		Data:   data,
+	}
+	index, master, kind, err := parseLinkMaster(&m)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if index != 2 || master != 5 || kind != "veth" {
+		t.Errorf("\ngot:	%d %d %q\nwant:	2 5 veth\n\n", index, master, kind)
+	}
+
+	if _, err := systemMasters(netlinkConfig{}); err != nil {
+		t.Errorf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+}
+
+func TestSystemRules(t *testing.T) {
+	rules, err := systemRules(syscall.AF_INET, netlinkConfig{})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	for _, rule := range rules {
+		if rule.Action == RuleLookup && rule.Table == TableMain {
+			return
+		}
+	}
+	t.Errorf("\ngot:	%+v\nwant:	a rule looking up the main table\n\n", rules)
+}
+
+func TestNetlinkDump(t *testing.T) {
+	tab, err := syscall.NetlinkRIB(syscall.RTM_GETROUTE, syscall.AF_UNSPEC)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	want, err := parseRouteMessages(tab)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	for _, size := range []int{0, 4096, 1 << 20} {
+		got, _, err := systemRoutes(syscall.AF_UNSPEC, netlinkConfig{bufferSize: size})
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("\ngot:	%+v\nwant:	%+v\n\n", got, want)
+		}
+	}
+}
+
+func TestKernelRouteGet(t *testing.T) {
+	res, err := KernelRouteGet(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if !res.IsLocal || res.Iface.Flags&net.FlagLoopback == 0 || !res.PreferredSrc.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("\ngot:	%+v\nwant:	local on the loopback interface\n\n", res)
+	}
+
+	r, err := New()
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	dst := net.IPv4(192, 0, 2, 99)
+	want, err := r.(EgressRouter).RouteGet(nil, nil, dst)
+	if err != nil {
+		t.Skipf("no route to %v: %v", dst, err)
+	}
+	got, err := KernelRouteGet(dst)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if got.Iface.Index != want.Iface.Index || !got.Gateway.Equal(want.Gateway) || !got.PreferredSrc.Equal(want.PreferredSrc) {
+		t.Errorf("\ngot:	%+v\nwant:	%+v\n\n", got, want)
+	}
+}
+
+func TestCheckSocket(t *testing.T) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9})
+	if err != nil {
+		t.Skipf("no loopback: %v", err)
+	}
+	defer conn.Close()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	ethAddr := mustParseCIDR("10.0.0.1/8")
+	ifaces := []net.Interface{
+		{Index: 1, MTU: 65536, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+		{Index: 2, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+	}
+	addrs := map[int][]net.Addr{2: {&ethAddr}}
+	for _, tc := range []struct {
+		route         RouteEntry
+		discrepancies int
+	}{
+		{RouteEntry{Dst: mustParseCIDR("127.0.0.0/8"), OutputIface: 1, Scope: ScopeHost}, 0},
+		{RouteEntry{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 0, 0, 254), OutputIface: 2}, 1},
+	} {
+		r, err := NewFromRoutes([]RouteEntry{tc.route}, ifaces, addrs)
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		var rep SocketReport
+		raw.Control(func(fd uintptr) {
+			rep, err = CheckSocket(r, int(fd))
+		})
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if !rep.Peer.Equal(net.IPv4(127, 0, 0, 1)) || rep.Device != "" || len(rep.Discrepancies) != tc.discrepancies {
+			t.Errorf("\ngot:	%+v\nwant:	%d discrepancies\n\n", rep, tc.discrepancies)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("no network namespaces: %v", err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("no network namespaces: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(origin)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, err := Subscribe(ctx)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	// The loopback interface of a new namespace is down.
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Errorf("\ngot:	nothing\nwant:	a change after setting lo up\n\n")
+	}
+
+	cancel()
+	for range changes {
+	}
+}
+
+func TestSourceNetlink(t *testing.T) {
+	r, err := New()
+	if err != nil {
+		t.Skipf("no system table: %v", err)
+	}
+	if got := r.(DynamicRouter).Table().Source(); got != SourceNetlink {
+		t.Errorf("\ngot:	%q\nwant:	%q\n\n", got, SourceNetlink)
+	}
+}
+
+func TestNewInNamespace(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("no network namespaces: %v", err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("no network namespaces: %v", err)
+	}
+	defer ns.Close()
+
+	// Give the loopback interface of the new namespace a subnet, which
+	// the caller's namespace has no route to.
+	lo, err := netlink.LinkByName("lo")
+	if err == nil {
+		err = netlink.LinkSetUp(lo)
+	}
+	if err == nil {
+		err = netlink.AddrAdd(lo, &netlink.Addr{IPNet: &net.IPNet{IP: net.IPv4(198, 18, 7, 1), Mask: net.CIDRMask(24, 32)}})
+	}
+	netns.Set(origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewInNamespace(fmt.Sprintf("/proc/self/fd/%d", ns))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if ifaces := r.(DynamicRouter).Table().Interfaces(); len(ifaces) != 1 || ifaces[0].Name != "lo" {
+		t.Errorf("\ngot:	%v\nwant:	lo only\n\n", ifaces)
+	}
+	found := false
+	for _, rt := range r.(DynamicRouter).Table().Routes() {
+		found = found || rt.Dst.String() == "198.18.7.0/24"
+	}
+	if !found {
+		t.Errorf("\ngot:	%v\nwant:	a route to 198.18.7.0/24\n\n", r.(DynamicRouter).Table().Routes())
+	}
+	if err := r.(DynamicRouter).Refresh(); err != nil {
+		t.Errorf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	// Once closed, the namespace can't be read.
+	if err := r.(io.Closer).Close(); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if err := r.(DynamicRouter).Refresh(); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error after Close\n\n")
+	}
+}
+
+func TestNewForPID(t *testing.T) {
+	r, err := NewForPID(os.Getpid())
+	if err != nil {
+		t.Skipf("no network namespaces: %v", err)
+	}
+	if len(r.(DynamicRouter).Table().Interfaces()) == 0 {
+		t.Errorf("\ngot:	no interfaces\nwant:	those of the caller\n\n")
+	}
+
+	if err := r.(io.Closer).Close(); err != nil {
+		t.Errorf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	// PIDs are at most 2^22.
+	if _, err := NewForPID(1 << 23); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, fs.ErrNotExist)
+	}
+
+	// The namespace is closed when the router can't be created.
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewForPID(os.Getpid(), WithFamily(FamilyInvalid)); err == nil {
+		t.Fatalf("\ngot:	nil\nwant:	error for an invalid family\n\n")
+	}
+	if after, _ := os.ReadDir("/proc/self/fd"); len(after) != len(fds) {
+		t.Errorf("\ngot:	%d open files\nwant:	%d\n\n", len(after), len(fds))
+	}
+}
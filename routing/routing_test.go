@@ -10,12 +10,24 @@
 package routing
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net"
+	"reflect"
 	"runtime"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/gopacket/gopacket"
+	"github.com/gopacket/gopacket/layers"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 )
@@ -23,18 +35,18 @@ import (
 func TestPrivateRoute(t *testing.T) {
 	tests := []struct {
 		name                          string
-		router                        router
+		router                        *router
 		routes                        routeSlice
-		input                         int64
+		input                         int
 		src, dst                      net.IP
-		wantIface                     int64
+		wantIface                     int
 		wantGateway, wantPreferredSrc net.IP
 		wantErr                       error
 	}{
 		{
 			name: "only static routes",
-			router: router{
-				ifaces: map[int64]*net.Interface{
+			router: &router{RouteTable: &RouteTable{
+				ifaces: map[int]*net.Interface{
 					1: {
 						Index:        1,
 						MTU:          1500,
@@ -50,22 +62,22 @@ func TestPrivateRoute(t *testing.T) {
 						Flags:        net.FlagUp,
 					},
 				},
-				addrs: map[int64]ipAddrs{
+				addrs: map[int]ipAddrs{
 					1: {
 						v4: []net.IPNet{{
-							IP: net.ParseIP("192.168.10.1"),
+							IP:   net.ParseIP("192.168.10.1"),
 							Mask: net.CIDRMask(24, 32),
 						}},
 					},
 					2: {
 						v4: []net.IPNet{{
-							IP: net.ParseIP("192.168.20.1"),
+							IP:   net.ParseIP("192.168.20.1"),
 							Mask: net.CIDRMask(24, 32),
 						}},
 					},
 				},
-			},
-			routes: []rtInfo{
+			}},
+			routes: []RouteEntry{
 				{
 					Dst: net.IPNet{
 						IP:   net.ParseIP("192.168.10.0"),
@@ -93,8 +105,8 @@ func TestPrivateRoute(t *testing.T) {
 		},
 		{
 			name: "not exists route with default gateway",
-			router: router{
-				ifaces: map[int64]*net.Interface{
+			router: &router{RouteTable: &RouteTable{
+				ifaces: map[int]*net.Interface{
 					1: {
 						Index:        1,
 						MTU:          1500,
@@ -110,22 +122,22 @@ func TestPrivateRoute(t *testing.T) {
 						Flags:        net.FlagUp,
 					},
 				},
-				addrs: map[int64]ipAddrs{
+				addrs: map[int]ipAddrs{
 					1: {
 						v4: []net.IPNet{{
-							IP: net.ParseIP("192.168.10.1"),
+							IP:   net.ParseIP("192.168.10.1"),
 							Mask: net.CIDRMask(24, 32),
 						}},
 					},
 					2: {
 						v4: []net.IPNet{{
-							IP: net.ParseIP("192.168.20.1"),
+							IP:   net.ParseIP("192.168.20.1"),
 							Mask: net.CIDRMask(24, 32),
 						}},
 					},
 				},
-			},
-			routes: []rtInfo{
+			}},
+			routes: []RouteEntry{
 				{
 					Gateway:     net.ParseIP("192.168.20.254"),
 					PrefSrc:     net.ParseIP("192.168.20.1"),
@@ -158,8 +170,8 @@ func TestPrivateRoute(t *testing.T) {
 		},
 		{
 			name: "exists route with default gateway",
-			router: router{
-				ifaces: map[int64]*net.Interface{
+			router: &router{RouteTable: &RouteTable{
+				ifaces: map[int]*net.Interface{
 					1: {
 						Index:        1,
 						MTU:          1500,
@@ -175,22 +187,22 @@ func TestPrivateRoute(t *testing.T) {
 						Flags:        net.FlagUp,
 					},
 				},
-				addrs: map[int64]ipAddrs{
+				addrs: map[int]ipAddrs{
 					1: {
 						v4: []net.IPNet{{
-							IP: net.ParseIP("192.168.10.1"),
+							IP:   net.ParseIP("192.168.10.1"),
 							Mask: net.CIDRMask(24, 32),
 						}},
 					},
 					2: {
 						v4: []net.IPNet{{
-							IP: net.ParseIP("192.168.20.1"),
+							IP:   net.ParseIP("192.168.20.1"),
 							Mask: net.CIDRMask(24, 32),
 						}},
 					},
 				},
-			},
-			routes: []rtInfo{
+			}},
+			routes: []RouteEntry{
 				{
 					Gateway:     net.ParseIP("192.168.20.254"),
 					PrefSrc:     net.ParseIP("192.168.20.1"),
@@ -223,8 +235,8 @@ func TestPrivateRoute(t *testing.T) {
 		},
 		{
 			name: "not exists route without default gateway",
-			router: router{
-				ifaces: map[int64]*net.Interface{
+			router: &router{RouteTable: &RouteTable{
+				ifaces: map[int]*net.Interface{
 					1: {
 						Index:        1,
 						MTU:          1500,
@@ -240,22 +252,22 @@ func TestPrivateRoute(t *testing.T) {
 						Flags:        net.FlagUp,
 					},
 				},
-				addrs: map[int64]ipAddrs{
+				addrs: map[int]ipAddrs{
 					1: {
 						v4: []net.IPNet{{
-							IP: net.ParseIP("192.168.10.1"),
+							IP:   net.ParseIP("192.168.10.1"),
 							Mask: net.CIDRMask(24, 32),
 						}},
 					},
 					2: {
 						v4: []net.IPNet{{
-							IP: net.ParseIP("192.168.20.1"),
+							IP:   net.ParseIP("192.168.20.1"),
 							Mask: net.CIDRMask(24, 32),
 						}},
 					},
 				},
-			},
-			routes: []rtInfo{
+			}},
+			routes: []RouteEntry{
 				{
 					Dst: net.IPNet{
 						IP:   net.ParseIP("192.168.10.0"),
@@ -315,8 +327,10 @@ func TestPrivateRoute(t *testing.T) {
 }
 
 func TestRouting(t *testing.T) {
+	// The namespaces are switched on locked threads that are never
+	// unlocked, so that they exit with the test instead of running other
+	// tests in the wrong namespace.
 	runtime.LockOSThread()
-	defer runtime.UnlockOSThread()
 
 	// parent network namespace
 	testNs, _ := netns.New()
@@ -425,6 +439,7 @@ func TestRouting(t *testing.T) {
 	 */
 
 	t.Run("exists route without default gateway", func(t *testing.T) {
+		runtime.LockOSThread()
 		netns.Set(newns)
 		r, err := New()
 		if err != nil {
@@ -452,6 +467,7 @@ func TestRouting(t *testing.T) {
 	})
 
 	t.Run("not exists route without default gateway", func(t *testing.T) {
+		runtime.LockOSThread()
 		netns.Set(newns)
 
 		r, err := New()
@@ -467,6 +483,7 @@ func TestRouting(t *testing.T) {
 	})
 
 	t.Run("exists route with default gateway", func(t *testing.T) {
+		runtime.LockOSThread()
 		netns.Set(newns)
 
 		netlink.RouteAdd(&netlink.Route{
@@ -507,6 +524,7 @@ func TestRouting(t *testing.T) {
 	})
 
 	t.Run("not exists route with default gateway", func(t *testing.T) {
+		runtime.LockOSThread()
 		netns.Set(newns)
 
 		netlink.RouteAdd(&netlink.Route{
@@ -550,18 +568,18 @@ func TestRouting(t *testing.T) {
 var testRouter router
 
 func init() {
-	testRouter = router{ifaces: make(map[int64]*net.Interface), addrs: make(map[int64]ipAddrs)}
+	testRouter = router{RouteTable: &RouteTable{ifaces: make(map[int]*net.Interface), addrs: make(map[int]ipAddrs)}}
 	// Configure default route
 	defaultHW, _ := net.ParseMAC("01:23:45:67:89:ab")
 	defaultInterface := net.Interface{Index: 5, MTU: 1500, Name: "Default", HardwareAddr: defaultHW, Flags: 1}
 	testRouter.ifaces[2] = &defaultInterface
 	testRouter.addrs[2] = ipAddrs{
 		v4: []net.IPNet{{
-			IP: net.ParseIP("192.168.1.2"),
+			IP:   net.ParseIP("192.168.1.2"),
 			Mask: net.CIDRMask(24, 32),
 		}},
 	}
-	defaultRoute := rtInfo{Gateway: net.IPv4(192, 168, 1, 1), InputIface: 0, OutputIface: 2, Priority: 600}
+	defaultRoute := RouteEntry{Gateway: net.IPv4(192, 168, 1, 1), InputIface: 0, OutputIface: 2, Priority: 600}
 	testRouter.v4 = append(testRouter.v4, defaultRoute)
 	// Configure local route
 	localHW, _ := net.ParseMAC("01:23:45:67:89:ac")
@@ -569,11 +587,11 @@ func init() {
 	testRouter.ifaces[1] = &localInterface
 	testRouter.addrs[1] = ipAddrs{
 		v4: []net.IPNet{{
-			IP: net.ParseIP("10.0.0.2"),
+			IP:   net.ParseIP("10.0.0.2"),
 			Mask: net.CIDRMask(8, 32),
 		}},
 	}
-	localRoute := rtInfo{Dst: net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	localRoute := RouteEntry{Dst: net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
 		Gateway: net.IPv4(10, 0, 0, 1), InputIface: 0, OutputIface: 1, Priority: 300}
 	testRouter.v4 = append(testRouter.v4, localRoute)
 	sort.Sort(testRouter.v4)
@@ -598,3 +616,3388 @@ func TestRoute(t *testing.T) {
 		})
 	}
 }
+
+func TestFamilyDisabled(t *testing.T) {
+	r := router{RouteTable: &RouteTable{family: FamilyV4, ifaces: testRouter.ifaces, addrs: testRouter.addrs, v4: testRouter.v4}}
+	if _, _, _, err := r.Route(net.IPv4(10, 0, 0, 3)); err != nil {
+		t.Errorf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, _, _, err := r.Route(net.ParseIP("2001:db8::1")); err != ErrFamilyDisabled {
+		t.Errorf("\ngot:	%#v\nwant:	%#v\n\n", err, ErrFamilyDisabled)
+	}
+
+	if _, err := New(WithFamily(FamilyInvalid)); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	unsupported address family error\n\n")
+	}
+}
+
+func TestRoutesOrderedByPriority(t *testing.T) {
+	r := router{RouteTable: &RouteTable{v4: routeSlice{
+		{Dst: net.IPNet{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(0, 32)}, Priority: 600, Metrics: map[int]uint32{2: 1}},
+		{Dst: net.IPNet{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(0, 32)}, Priority: 100, Metrics: map[int]uint32{2: 9}},
+		{Dst: net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}, Priority: 900},
+	}}}
+	sort.Sort(r.v4)
+	routes := r.Routes()
+	want := []uint32{900, 100, 600}
+	for i, route := range routes {
+		if route.Priority != want[i] {
+			t.Errorf("route %d\ngot:	%d\nwant:	%d\n\n", i, route.Priority, want[i])
+		}
+	}
+}
+
+type testProvider struct {
+	ifaces []net.Interface
+	addrs  map[int][]net.Addr
+	routes []RouteEntry
+}
+
+func (p *testProvider) Interfaces() ([]net.Interface, error) {
+	return p.ifaces, nil
+}
+
+func (p *testProvider) Addrs(iface *net.Interface) ([]net.Addr, error) {
+	return p.addrs[iface.Index], nil
+}
+
+func (p *testProvider) Routes(family AddressFamily) ([]RouteEntry, error) {
+	return p.routes, nil
+}
+
+func mustParseCIDR(s string) net.IPNet {
+	ip, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	n.IP = ip
+	return *n
+}
+
+func TestProvider(t *testing.T) {
+	eth0Addr := mustParseCIDR("192.168.1.2/24")
+	eth1Addr := mustParseCIDR("2001:db8::2/64")
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			{Index: 2, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+		},
+		addrs: map[int][]net.Addr{
+			1: {&eth0Addr},
+			2: {&eth1Addr},
+		},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("2001:db8::/64"), OutputIface: 2},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		},
+	}
+
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if routes := r.(DynamicRouter).Table().Routes(); len(routes) != 3 || !routes[0].Dst.IP.Equal(net.IPv4(192, 168, 1, 0)) {
+		t.Errorf("\ngot:	%+v\nwant:	192.168.1.0/24 first of 3 routes\n\n", routes)
+	}
+
+	iface, gateway, preferredSrc, err := r.Route(net.IPv4(8, 8, 8, 8))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if iface.Name != "eth0" {
+		t.Errorf("\ngot:	%s\nwant:	eth0\n\n", iface.Name)
+	}
+	if !gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("\ngot:	%v\nwant:	192.168.1.1\n\n", gateway)
+	}
+	if !preferredSrc.Equal(net.IPv4(192, 168, 1, 2)) {
+		t.Errorf("\ngot:	%v\nwant:	192.168.1.2\n\n", preferredSrc)
+	}
+
+	iface, _, preferredSrc, err = r.Route(net.ParseIP("2001:db8::1"))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if iface.Name != "eth1" || !preferredSrc.Equal(eth1Addr.IP) {
+		t.Errorf("\ngot:	%s %v\nwant:	eth1 %v\n\n", iface.Name, preferredSrc, eth1Addr.IP)
+	}
+
+	r, err = New(WithProvider(p), WithFamily(FamilyV6))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if routes := r.(DynamicRouter).Table().Routes(); len(routes) != 1 {
+		t.Errorf("\ngot:	%+v\nwant:	only the IPv6 route\n\n", routes)
+	}
+}
+
+func TestLinkLocalGateway(t *testing.T) {
+	r := router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v6: []net.IPNet{
+				mustParseCIDR("fe80::2/64"),
+				mustParseCIDR("2001:db8::2/64"),
+			}},
+		},
+		v6: routeSlice{
+			{Dst: mustParseCIDR("fe80::/64"), OutputIface: 1, Priority: 256},
+			{Dst: mustParseCIDR("::/0"), Gateway: net.ParseIP("fe80::1"), OutputIface: 1, Priority: 1024},
+		},
+	}}
+	sort.Sort(r.v6)
+
+	iface, gateway, preferredSrc, err := r.Route(net.ParseIP("2001:4860:4860::8888"))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if iface.Index != 1 {
+		t.Errorf("\ngot:	%d\nwant:	1\n\n", iface.Index)
+	}
+	if !gateway.Equal(net.ParseIP("fe80::1")) {
+		t.Errorf("\ngot:	%v\nwant:	fe80::1\n\n", gateway)
+	}
+	if !preferredSrc.Equal(net.ParseIP("2001:db8::2")) {
+		t.Errorf("\ngot:	%v\nwant:	2001:db8::2\n\n", preferredSrc)
+	}
+	if res, _ := r.RouteGet(nil, nil, net.ParseIP("2001:4860:4860::8888")); res.GatewayZone != "eth0" {
+		t.Errorf("\ngot:	%q\nwant:	%q\n\n", res.GatewayZone, "eth0")
+	}
+
+	_, _, preferredSrc, err = r.Route(net.ParseIP("fe80::5"))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if !preferredSrc.Equal(net.ParseIP("fe80::2")) {
+		t.Errorf("\ngot:	%v\nwant:	fe80::2\n\n", preferredSrc)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	addr := mustParseCIDR("192.168.1.2/24")
+	p := &testProvider{
+		ifaces: []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}},
+		addrs:  map[int][]net.Addr{1: {&addr}},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		},
+	}
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	renewed := mustParseCIDR("192.168.1.3/24")
+	p.addrs = map[int][]net.Addr{1: {&renewed}}
+	p.routes = append(p.routes, RouteEntry{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1})
+	if err := r.(DynamicRouter).RefreshAddrs(); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, _, src, _ := r.Route(net.IPv4(192, 168, 1, 9)); !src.Equal(renewed.IP) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", src, renewed.IP)
+	}
+	if _, _, _, err := r.Route(net.IPv4(8, 8, 8, 8)); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	no route before Refresh\n\n")
+	}
+
+	if err := r.(DynamicRouter).Refresh(); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, gateway, _, err := r.Route(net.IPv4(8, 8, 8, 8)); err != nil || !gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("\ngot:	%v %#v\nwant:	192.168.1.1 nil\n\n", gateway, err)
+	}
+}
+
+func TestSourceAmbiguous(t *testing.T) {
+	tests := []struct {
+		name          string
+		addrs         []net.IPNet
+		prefSrc       net.IP
+		wantAmbiguous bool
+	}{
+		{
+			name:          "single address",
+			addrs:         []net.IPNet{mustParseCIDR("192.168.1.2/24")},
+			wantAmbiguous: false,
+		},
+		{
+			name:          "two addresses in the same subnet",
+			addrs:         []net.IPNet{mustParseCIDR("192.168.1.2/24"), mustParseCIDR("192.168.1.3/24")},
+			wantAmbiguous: true,
+		},
+		{
+			name:          "different prefix lengths",
+			addrs:         []net.IPNet{mustParseCIDR("192.168.1.2/24"), mustParseCIDR("192.168.1.3/16")},
+			wantAmbiguous: false,
+		},
+		{
+			name:          "route names the source",
+			addrs:         []net.IPNet{mustParseCIDR("192.168.1.2/24"), mustParseCIDR("192.168.1.3/24")},
+			prefSrc:       net.IPv4(192, 168, 1, 2),
+			wantAmbiguous: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := router{RouteTable: &RouteTable{
+				ifaces: map[int]*net.Interface{1: {Index: 1, Name: "eth0"}},
+				addrs:  map[int]ipAddrs{1: {v4: tt.addrs}},
+				v4: routeSlice{
+					{Dst: mustParseCIDR("192.168.0.0/16"), OutputIface: 1, PrefSrc: tt.prefSrc},
+				},
+			}}
+			res, err := r.RouteGet(nil, nil, net.IPv4(192, 168, 1, 9))
+			if err != nil {
+				t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+			}
+			if res.SourceAmbiguous != tt.wantAmbiguous {
+				t.Errorf("\ngot:	%v\nwant:	%v\n\n", res.SourceAmbiguous, tt.wantAmbiguous)
+			}
+			if tt.prefSrc != nil && !res.PreferredSrc.Equal(tt.prefSrc) {
+				t.Errorf("\ngot:	%v\nwant:	%v\n\n", res.PreferredSrc, tt.prefSrc)
+			}
+		})
+	}
+}
+
+func TestSourceLongestPrefix(t *testing.T) {
+	// Whatever their order, the /24 address is chosen over the /16 one
+	// which also contains the gateway.
+	for _, addrs := range [][]net.IPNet{
+		{mustParseCIDR("192.168.1.2/24"), mustParseCIDR("192.168.0.2/16")},
+		{mustParseCIDR("192.168.0.2/16"), mustParseCIDR("192.168.1.2/24")},
+	} {
+		r := router{RouteTable: &RouteTable{
+			ifaces: map[int]*net.Interface{1: {Index: 1, Name: "eth0"}},
+			addrs:  map[int]ipAddrs{1: {v4: addrs}},
+			v4: routeSlice{
+				{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+			},
+		}}
+		res, err := r.RouteGet(nil, nil, net.IPv4(8, 8, 8, 8))
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if !res.PreferredSrc.Equal(net.IPv4(192, 168, 1, 2)) || res.SourceAmbiguous {
+			t.Errorf("%v\ngot:	%v %v\nwant:	192.168.1.2 false\n\n", addrs, res.PreferredSrc, res.SourceAmbiguous)
+		}
+	}
+}
+
+func TestAddrIndex(t *testing.T) {
+	addrs := map[int]ipAddrs{
+		1: {
+			v4: []net.IPNet{
+				mustParseCIDR("192.168.1.2/24"),
+				mustParseCIDR("192.168.0.2/16"),
+				{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(104, 128)},
+				{IP: net.IPv4(172, 16, 0, 1).To4(), Mask: net.IPv4Mask(255, 0, 255, 0)},
+			},
+			v6: []net.IPNet{mustParseCIDR("2001:db8::2/64"), mustParseCIDR("::ffff:0:0/96")},
+		},
+		2: {
+			v4: []net.IPNet{mustParseCIDR("192.168.1.3/24"), mustParseCIDR("0.0.0.0/0")},
+			v6: []net.IPNet{mustParseCIDR("2001:db8::/32")},
+		},
+	}
+	for _, ipv6 := range []bool{false, true} {
+		x := newAddrIndex(addrs, ipv6)
+		for _, s := range []string{"192.168.1.9", "192.168.7.9", "10.1.2.3", "10.0.9.9", "172.9.0.7", "8.8.8.8", "2001:db8::9", "2001:db8:1::9", "::ffff:1.2.3.4"} {
+			ip := net.ParseIP(s)
+			var got, want []string
+			x.containing(addrs, ip, ipv6, func(ifindex, j int, addr net.IPNet) {
+				got = append(got, fmt.Sprintf("%d %v", ifindex, addr.String()))
+			})
+			for ifindex, a := range addrs {
+				for _, addr := range a.family(ipv6) {
+					if addr.Contains(ip) {
+						want = append(want, fmt.Sprintf("%d %v", ifindex, addr.String()))
+					}
+				}
+			}
+			sort.Strings(got)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s ipv6=%v\ngot:	%q\nwant:	%q\n\n", s, ipv6, got, want)
+			}
+		}
+	}
+}
+
+func TestSecondarySourceDemoted(t *testing.T) {
+	var addrs ipAddrs
+	addrs.add(mustParseCIDR("192.168.1.2/24"), AddrSecondary, false)
+	addrs.add(mustParseCIDR("192.168.1.3/24"), 0, false)
+	addrs.add(mustParseCIDR("192.168.1.4/24"), AddrAnycast, false)
+	r := router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{1: {Index: 1, Name: "eth0"}},
+		addrs:  map[int]ipAddrs{1: addrs},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		},
+	}}
+	res, err := r.RouteGet(nil, nil, net.IPv4(192, 168, 1, 9))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if !res.PreferredSrc.Equal(net.IPv4(192, 168, 1, 3)) || res.SourceAmbiguous {
+		t.Errorf("\ngot:	%v %v\nwant:	192.168.1.3 false\n\n", res.PreferredSrc, res.SourceAmbiguous)
+	}
+
+	// Without a primary address, a secondary one is still usable.
+	addrs = ipAddrs{}
+	addrs.add(mustParseCIDR("192.168.1.2/24"), AddrSecondary, false)
+	r.addrs[1] = addrs
+	if res, err = r.RouteGet(nil, nil, net.IPv4(192, 168, 1, 9)); err != nil || !res.PreferredSrc.Equal(net.IPv4(192, 168, 1, 2)) {
+		t.Errorf("\ngot:	%v %#v\nwant:	192.168.1.2 nil\n\n", res.PreferredSrc, err)
+	}
+}
+
+func TestNextHopChain(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("10.0.0.0/8"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+			{Dst: mustParseCIDR("172.16.0.0/12"), Gateway: net.IPv4(10, 1, 1, 1), OutputIface: 1},
+			{Dst: mustParseCIDR("198.51.100.0/24"), Gateway: net.IPv4(203, 0, 113, 1), OutputIface: 1},
+			{Dst: mustParseCIDR("203.0.113.0/24"), Gateway: net.IPv4(198, 51, 100, 1), OutputIface: 1},
+			{Dst: mustParseCIDR("192.0.2.0/24"), Gateway: net.IPv4(192, 0, 2, 1), OutputIface: 1},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	tests := []struct {
+		dst   string
+		chain []string
+	}{
+		{"192.168.1.5", nil},
+		{"10.2.3.4", []string{"192.168.1.1"}},
+		{"172.16.5.5", []string{"10.1.1.1", "192.168.1.1"}},
+	}
+	for _, tt := range tests {
+		chain, err := r.NextHopChain(net.ParseIP(tt.dst))
+		if err != nil {
+			t.Errorf("%s\ngot:	%#v\nwant:	nil\n\n", tt.dst, err)
+			continue
+		}
+		if len(chain) != len(tt.chain) {
+			t.Errorf("%s\ngot:	%v\nwant:	%v\n\n", tt.dst, chain, tt.chain)
+			continue
+		}
+		for i := range chain {
+			if !chain[i].Equal(net.ParseIP(tt.chain[i])) {
+				t.Errorf("%s\ngot:	%v\nwant:	%v\n\n", tt.dst, chain, tt.chain)
+			}
+		}
+	}
+
+	for _, dst := range []string{"198.51.100.7", "192.0.2.9"} {
+		if _, err := r.NextHopChain(net.ParseIP(dst)); err != ErrRouteLoop {
+			t.Errorf("%s\ngot:	%#v\nwant:	%#v\n\n", dst, err, ErrRouteLoop)
+		}
+	}
+	if _, err := r.NextHopChain(net.ParseIP("8.8.8.8")); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for an unroutable destination\n\n")
+	}
+
+	// The gateway of an onlink route is reached without a route of its
+	// own, even when the only one containing it is the route itself.
+	r.v4 = append(r.v4, RouteEntry{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(100, 64, 9, 1), OutputIface: 1, Flags: RouteOnLink})
+	sort.Sort(r.v4)
+	chain, err := r.NextHopChain(net.ParseIP("8.8.8.8"))
+	if err != nil || len(chain) != 1 || !chain[0].Equal(net.IPv4(100, 64, 9, 1)) {
+		t.Errorf("\ngot:	%v %#v\nwant:	[100.64.9.1] nil\n\n", chain, err)
+	}
+}
+
+func TestOnLinkGatewaySource(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 9, 9, 1), OutputIface: 1, Flags: RouteOnLink},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	res, err := r.RouteGet(nil, nil, net.IPv4(8, 8, 8, 8))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if res.Iface.Name != "eth0" || !res.Gateway.Equal(net.IPv4(10, 9, 9, 1)) || !res.PreferredSrc.Equal(net.IPv4(192, 168, 1, 2)) {
+		t.Errorf("\ngot:	%+v\nwant:	eth0 via 10.9.9.1 from 192.168.1.2\n\n", res)
+	}
+}
+
+func TestDeadRouteSkipped(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			2: {Index: 2, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24")}},
+			2: {v4: []net.IPNet{mustParseCIDR("10.0.0.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Priority: 10, Flags: RouteDead},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 0, 0, 1), OutputIface: 2, Priority: 20},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	iface, gateway, _, err := r.Route(net.IPv4(8, 8, 8, 8))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if iface.Name != "eth1" || !gateway.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("\ngot:	%s %v\nwant:	eth1 10.0.0.1\n\n", iface.Name, gateway)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	eth0Addr := mustParseCIDR("192.168.1.2/24")
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		},
+		addrs: map[int][]net.Addr{
+			1: {&eth0Addr},
+		},
+		routes: []RouteEntry{
+			// A default route without a Dst, and a prefix and gateway held
+			// in 16 bytes.
+			{Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Priority: 100},
+			{Dst: net.IPNet{IP: net.IPv4(192, 168, 1, 0), Mask: net.CIDRMask(24, 32)}, Gateway: net.IPv4zero, OutputIface: 1},
+		},
+	}
+
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	for _, rt := range r.(DynamicRouter).Table().Routes() {
+		if len(rt.Dst.IP) != net.IPv4len || len(rt.Dst.Mask) != net.IPv4len || len(rt.Src.IP) != net.IPv4len {
+			t.Errorf("\ngot:	%+v\nwant:	4-byte addresses\n\n", rt)
+		}
+		if rt.Gateway != nil && len(rt.Gateway) != net.IPv4len {
+			t.Errorf("\ngot:	%+v\nwant:	4-byte gateway\n\n", rt)
+		}
+	}
+
+	_, gateway, _, err := r.RouteWithSrc(nil, net.IPv4(192, 168, 1, 2), net.IPv4(8, 8, 8, 8).To16())
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if !gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("\ngot:	%v\nwant:	192.168.1.1\n\n", gateway)
+	}
+	if _, gateway, _, _ = r.Route(net.IPv4(192, 168, 1, 9).To4()); !gateway.Equal(net.IPv4(192, 168, 1, 9)) {
+		t.Errorf("\ngot:	%v\nwant:	192.168.1.9\n\n", gateway)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	addr := mustParseCIDR("192.168.1.2/24")
+	p := &testProvider{
+		ifaces: []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}},
+		addrs:  map[int][]net.Addr{1: {&addr}},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		},
+	}
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	snap := r.(DynamicRouter).Snapshot()
+
+	renewed := mustParseCIDR("192.168.1.3/24")
+	p.addrs = map[int][]net.Addr{1: {&renewed}}
+	p.routes = p.routes[:1]
+	if err := r.(DynamicRouter).Refresh(); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, _, _, err := r.Route(net.IPv4(8, 8, 8, 8)); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	no route after Refresh\n\n")
+	}
+
+	_, gateway, src, err := snap.Route(net.IPv4(8, 8, 8, 8))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if !gateway.Equal(net.IPv4(192, 168, 1, 1)) || !src.Equal(addr.IP) {
+		t.Errorf("\ngot:	%v %v\nwant:	192.168.1.1 %v\n\n", gateway, src, addr.IP)
+	}
+	if len(snap.Routes()) != 2 {
+		t.Errorf("\ngot:	%+v\nwant:	2 routes\n\n", snap.Routes())
+	}
+}
+
+func TestRoutesCopy(t *testing.T) {
+	addr := mustParseCIDR("192.168.1.2/24")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Metrics: map[int]uint32{2: 1400}},
+		// Shadowed by the first.
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1, Priority: 10},
+	}, []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}}, map[int][]net.Addr{1: {&addr}})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	tab := r.(DynamicRouter).Table()
+	for _, accessor := range []struct {
+		name   string
+		routes func() []RouteEntry
+	}{
+		{"Routes", tab.Routes},
+		{"RoutesViaGateway", func() []RouteEntry {
+			routes, _ := tab.RoutesViaGateway(net.IPv4(192, 168, 1, 1))
+			return routes
+		}},
+		{"RouteAll", func() []RouteEntry {
+			routes, _ := tab.RouteAll(net.IPv4(8, 8, 8, 8))
+			return routes
+		}},
+		{"RouteForPrefix", func() []RouteEntry {
+			rt, err := tab.RouteForPrefix(mustParseCIDR("0.0.0.0/0"))
+			if err != nil {
+				return nil
+			}
+			return []RouteEntry{rt}
+		}},
+		{"DefaultRoutes", tab.DefaultRoutes},
+		{"DefaultUplinks", func() []RouteEntry {
+			var routes []RouteEntry
+			for _, tier := range tab.DefaultUplinks() {
+				routes = append(routes, tier...)
+			}
+			return routes
+		}},
+		{"ShadowedRoutes", func() []RouteEntry {
+			var routes []RouteEntry
+			for _, pair := range tab.ShadowedRoutes() {
+				routes = append(routes, pair[:]...)
+			}
+			return routes
+		}},
+	} {
+		routes := accessor.routes()
+		if len(routes) == 0 {
+			t.Fatalf("%s\ngot:	none\nwant:	the default route\n\n", accessor.name)
+		}
+		routes[0].Dst.IP[0] = 10
+		routes[0].Dst.Mask[0] = 255
+		routes[0].Gateway[3] = 254
+		routes[0].Metrics[2] = 9000
+
+		rt := accessor.routes()[0]
+		if rt.Dst.String() != "0.0.0.0/0" || !rt.Gateway.Equal(net.IPv4(192, 168, 1, 1)) || rt.Metrics[2] != 1400 {
+			t.Errorf("%s\ngot:	%+v\nwant:	the table unchanged\n\n", accessor.name, rt)
+		}
+	}
+}
+
+func TestRouterInterfaces(t *testing.T) {
+	r, err := NewFromRoutes(nil, nil, nil)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, ok := r.(interface {
+		LinkRouter
+		EgressRouter
+		PolicyRouter
+		DynamicRouter
+	}); !ok {
+		t.Errorf("\ngot:	%T\nwant:	a LinkRouter, EgressRouter, PolicyRouter and DynamicRouter\n\n", r)
+	}
+}
+
+func TestIgnoreDuplicateIndex(t *testing.T) {
+	addr := mustParseCIDR("192.168.1.2/24")
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			{Index: 1, MTU: 1500, Name: "eth0.dup", Flags: net.FlagUp},
+		},
+		addrs: map[int][]net.Addr{1: {&addr}},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		},
+	}
+	if _, err := New(WithProvider(p)); err == nil {
+		t.Fatalf("\ngot:	nil\nwant:	error for a duplicated index\n\n")
+	}
+
+	r, err := New(WithProvider(p), WithIgnoreDuplicateIndex())
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if iface, _, _, err := r.Route(net.IPv4(192, 168, 1, 9)); err != nil || iface.Name != "eth0" {
+		t.Errorf("\ngot:	%v %#v\nwant:	eth0 nil\n\n", iface, err)
+	}
+}
+
+func TestRouteWithMark(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			2: {Index: 2, MTU: 1420, Name: "wg0", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24")}},
+			2: {v4: []net.IPNet{mustParseCIDR("10.64.0.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1, Table: TableMain},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Table: TableMain},
+		},
+		tables: map[uint32]tableRoutes{
+			51820: {v4: routeSlice{
+				{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 64, 0, 1), OutputIface: 2, Table: 51820},
+			}},
+			100: {v4: routeSlice{
+				{Dst: mustParseCIDR("172.16.0.0/12"), Gateway: net.IPv4(10, 64, 0, 1), OutputIface: 2, Table: 100},
+			}},
+		},
+		rules: []Rule{
+			{Family: FamilyV4, Priority: 100, Mark: 0x10000, Mask: 0xf0000, Action: RuleLookup, Table: 100},
+			{Family: FamilyV4, Priority: 32764, Mark: 0xca6c, Mask: 0xffffffff, Invert: true, Action: RuleLookup, Table: 51820},
+			{Family: FamilyV4, Priority: 32766, Action: RuleLookup, Table: TableMain},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	tests := []struct {
+		mark  uint32
+		dst   string
+		iface string
+	}{
+		// Unmarked traffic goes through the tunnel, marked traffic (the
+		// tunnel's own packets) through the main table.
+		{0, "8.8.8.8", "wg0"},
+		{0xca6c, "8.8.8.8", "eth0"},
+		// Table 100 only has 172.16.0.0/12; other destinations fall
+		// through to the next rules.
+		{0x10000, "172.20.0.1", "wg0"},
+		{0x10000, "192.168.1.7", "wg0"},
+	}
+	for _, tt := range tests {
+		res, err := r.RouteWithMark(tt.mark, nil, net.ParseIP(tt.dst))
+		if err != nil {
+			t.Errorf("%#x %s\ngot:	%#v\nwant:	nil\n\n", tt.mark, tt.dst, err)
+			continue
+		}
+		if res.Iface.Name != tt.iface {
+			t.Errorf("%#x %s\ngot:	%s\nwant:	%s\n\n", tt.mark, tt.dst, res.Iface.Name, tt.iface)
+		}
+	}
+
+	// Without rules, only the main table is used.
+	r.rules = nil
+	if res, err := r.RouteWithMark(0, nil, net.IPv4(8, 8, 8, 8)); err != nil || res.Iface.Name != "eth0" {
+		t.Errorf("\ngot:	%+v %#v\nwant:	eth0 nil\n\n", res, err)
+	}
+}
+
+func TestRouteTypes(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			2: {Index: 2, MTU: 1420, Name: "wg0", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24")}},
+			2: {v4: []net.IPNet{mustParseCIDR("10.64.0.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1, Table: TableMain},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Table: TableMain},
+			// Neither of these has an output interface, and no address
+			// of wg0 must be picked for them.
+			{Dst: mustParseCIDR("10.64.0.0/16"), Type: TypeBlackhole, Table: TableMain},
+			{Dst: mustParseCIDR("172.16.0.0/12"), Gateway: net.IPv4(10, 64, 0, 1), Type: TypeUnicast, Table: TableMain},
+		},
+		tables: map[uint32]tableRoutes{
+			100: {v4: routeSlice{
+				{Dst: mustParseCIDR("10.64.0.0/24"), OutputIface: 2, Table: 100},
+				{Dst: mustParseCIDR("0.0.0.0/0"), Type: TypeThrow, Table: 100},
+			}},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	if _, err := r.RouteGet(nil, nil, net.IPv4(10, 64, 1, 1)); !errors.Is(err, ErrRouteRejected) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrRouteRejected)
+	}
+	// The interface of a unicast route without one is that of the address
+	// containing its gateway.
+	if res, err := r.RouteGet(nil, nil, net.IPv4(172, 16, 0, 1)); err != nil || res.Iface.Name != "wg0" {
+		t.Errorf("\ngot:	%+v %v\nwant:	wg0\n\n", res, err)
+	}
+
+	// A thrown lookup goes on with the next rule.
+	r.rules = []Rule{
+		{Family: FamilyV4, Priority: 100, Action: RuleLookup, Table: 100},
+		{Family: FamilyV4, Priority: 32766, Action: RuleLookup, Table: TableMain},
+	}
+	if res, err := r.RouteWithMark(0, nil, net.IPv4(8, 8, 8, 8)); err != nil || res.Iface.Name != "eth0" {
+		t.Errorf("\ngot:	%+v %v\nwant:	eth0\n\n", res, err)
+	}
+	if res, err := r.RouteWithMark(0, nil, net.IPv4(10, 64, 0, 9)); err != nil || res.Iface.Name != "wg0" {
+		t.Errorf("\ngot:	%+v %v\nwant:	wg0\n\n", res, err)
+	}
+}
+
+func TestRouteWithMarkActions(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			2: {Index: 2, MTU: 1420, Name: "wg0", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24")}},
+			2: {v4: []net.IPNet{mustParseCIDR("10.64.0.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1, Table: TableMain},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Table: TableMain},
+		},
+		tables: map[uint32]tableRoutes{
+			51820: {v4: routeSlice{
+				{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 64, 0, 1), OutputIface: 2, Table: 51820},
+			}},
+		},
+		// The rules of wg-quick, behind a goto skipping a blackhole for
+		// marked packets.
+		rules: []Rule{
+			{Family: FamilyV4, Priority: 100, Mark: 0x1, Mask: 0xffffffff, Action: RuleGoto, Goto: 300},
+			{Family: FamilyV4, Priority: 200, Mark: 0x1, Mask: 0xffffffff, Action: RuleBlackhole},
+			{Family: FamilyV4, Priority: 300, Action: RuleNop},
+			{Family: FamilyV4, Priority: 400, Dst: mustParseCIDR("203.0.113.0/24"), Action: RuleProhibit},
+			{Family: FamilyV4, Priority: 32764, Action: RuleLookup, Table: TableMain, SuppressPrefix: true},
+			{Family: FamilyV4, Priority: 32765, Mark: 0xca6c, Mask: 0xffffffff, Invert: true, Action: RuleLookup, Table: 51820},
+			{Family: FamilyV4, Priority: 32766, Action: RuleLookup, Table: TableMain},
+		},
+	}}
+
+	tests := []struct {
+		mark  uint32
+		dst   string
+		iface string
+	}{
+		// The default route of the main table is suppressed, not its
+		// other routes.
+		{0, "8.8.8.8", "wg0"},
+		{0, "192.168.1.7", "eth0"},
+		{0xca6c, "8.8.8.8", "eth0"},
+		// The goto jumps over the blackhole.
+		{0x1, "8.8.8.8", "wg0"},
+	}
+	for _, tt := range tests {
+		res, err := r.RouteWithMark(tt.mark, nil, net.ParseIP(tt.dst))
+		if err != nil {
+			t.Errorf("%#x %s\ngot:	%#v\nwant:	nil\n\n", tt.mark, tt.dst, err)
+			continue
+		}
+		if res.Iface.Name != tt.iface {
+			t.Errorf("%#x %s\ngot:	%s\nwant:	%s\n\n", tt.mark, tt.dst, res.Iface.Name, tt.iface)
+		}
+	}
+
+	if _, err := r.RouteWithMark(0, nil, net.IPv4(203, 0, 113, 5)); !errors.Is(err, ErrRuleRejected) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrRuleRejected)
+	}
+	// Without a target, the goto is skipped and the blackhole reached.
+	r.rules[0].Goto = 250
+	if _, err := r.RouteWithMark(0x1, nil, net.IPv4(8, 8, 8, 8)); !errors.Is(err, ErrRuleRejected) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrRuleRejected)
+	}
+}
+
+func TestRouteWithRuleTrace(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			2: {Index: 2, MTU: 1420, Name: "wg0", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24")}},
+			2: {v4: []net.IPNet{mustParseCIDR("10.64.0.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Table: TableMain},
+		},
+		tables: map[uint32]tableRoutes{
+			51820: {v4: routeSlice{
+				{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 64, 0, 1), OutputIface: 2, Table: 51820},
+			}},
+		},
+		rules: []Rule{
+			{Family: FamilyV6, Priority: 0, Action: RuleLookup, Table: TableLocal},
+			{Family: FamilyV4, Priority: 100, Mark: 0x1, Mask: 0xffffffff, Action: RuleLookup, Table: 100},
+			{Family: FamilyV4, Priority: 32764, Action: RuleLookup, Table: TableMain, SuppressPrefix: true},
+			{Family: FamilyV4, Priority: 32765, Action: RuleLookup, Table: 51820},
+		},
+	}}
+
+	res, trace, err := r.RouteWithRuleTrace(0x1, nil, net.IPv4(8, 8, 8, 8))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if res.Iface.Name != "wg0" {
+		t.Errorf("\ngot:	%s\nwant:	wg0\n\n", res.Iface.Name)
+	}
+	want := []struct {
+		priority uint32
+		outcome  string
+	}{
+		{100, "no route in table 100"},
+		{32764, "route 0.0.0.0/0 in table 254 suppressed"},
+		{32765, "route 0.0.0.0/0 in table 51820"},
+	}
+	if len(trace) != len(want) {
+		t.Fatalf("\ngot:	%+v\nwant:	%+v\n\n", trace, want)
+	}
+	for i, step := range trace {
+		if step.Rule.Priority != want[i].priority || !step.Matched || step.Outcome != want[i].outcome {
+			t.Errorf("\ngot:	%d %v %q\nwant:	%d true %q\n\n", step.Rule.Priority, step.Matched, step.Outcome, want[i].priority, want[i].outcome)
+		}
+	}
+
+	_, trace, _ = r.RouteWithRuleTrace(0, nil, net.IPv4(8, 8, 8, 8))
+	if len(trace) == 0 || trace[0].Matched || trace[0].Outcome != "not matched" {
+		t.Errorf("\ngot:	%+v\nwant:	the fwmark rule not matched first\n\n", trace)
+	}
+}
+
+func TestRouteInTable(t *testing.T) {
+	addr := mustParseCIDR("192.168.1.2/24")
+	p := &testProvider{
+		ifaces: []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}},
+		addrs:  map[int][]net.Addr{1: {&addr}},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1, Table: 100},
+			{Dst: mustParseCIDR("192.168.1.2/32"), OutputIface: 1, Table: TableLocal},
+		},
+	}
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	if _, _, _, err := r.Route(net.IPv4(8, 8, 8, 8)); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	no route outside the main table\n\n")
+	}
+	res, err := r.(PolicyRouter).RouteInTable(100, net.IPv4(8, 8, 8, 8))
+	if err != nil || !res.Gateway.Equal(net.IPv4(192, 168, 1, 254)) {
+		t.Errorf("\ngot:	%+v %#v\nwant:	via 192.168.1.254\n\n", res, err)
+	}
+	if _, err := r.(PolicyRouter).RouteInTable(200, net.IPv4(8, 8, 8, 8)); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	no route in an empty table\n\n")
+	}
+
+	routes := r.(DynamicRouter).Table().Routes()
+	if len(routes) != 3 || routes[0].Table != TableMain || routes[1].Table != 100 || routes[2].Table != TableLocal {
+		t.Errorf("\ngot:	%+v\nwant:	main, 100 and local routes in that order\n\n", routes)
+	}
+	if s := fmt.Sprint(r); !strings.Contains(s, "--- TABLE 100 V4 ---") || !strings.Contains(s, "--- TABLE 255 V4 ---") {
+		t.Errorf("\ngot:	%s\nwant:	routes grouped by table\n\n", s)
+	}
+}
+
+func TestBroadcastFor(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("10.0.0.0/8"), OutputIface: 2},
+			{Dst: mustParseCIDR("198.51.100.6/31"), OutputIface: 3},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	for dst, want := range map[string]string{
+		"192.168.1.77": "192.168.1.255",
+		"10.20.30.40":  "10.255.255.255",
+	} {
+		bcast, err := r.BroadcastFor(net.ParseIP(dst))
+		if err != nil || !bcast.Equal(net.ParseIP(want)) {
+			t.Errorf("%s\ngot:	%v %#v\nwant:	%s nil\n\n", dst, bcast, err, want)
+		}
+	}
+	for _, dst := range []string{"8.8.8.8", "198.51.100.7", "2001:db8::1"} {
+		if bcast, err := r.BroadcastFor(net.ParseIP(dst)); err == nil {
+			t.Errorf("%s\ngot:	%v\nwant:	error\n\n", dst, bcast)
+		}
+	}
+}
+
+func TestMTU(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("10.0.0.0/8"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1, Metrics: map[int]uint32{rtaxMTU: 1400}},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	for dst, want := range map[string]int{"192.168.1.9": 1500, "10.1.2.3": 1400} {
+		res, err := r.RouteGet(nil, nil, net.ParseIP(dst))
+		if err != nil || res.MTU != want {
+			t.Errorf("%s\ngot:	%d %#v\nwant:	%d nil\n\n", dst, res.MTU, err, want)
+		}
+	}
+	if mtu, err := r.InterfaceMTU(1); err != nil || mtu != 1500 {
+		t.Errorf("\ngot:	%d %#v\nwant:	1500 nil\n\n", mtu, err)
+	}
+	if _, err := r.InterfaceMTU(2); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for an unknown interface\n\n")
+	}
+}
+
+func TestRouteFromSource(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			2: {Index: 2, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24"), mustParseCIDR("192.168.1.3/24")}},
+			2: {v4: []net.IPNet{mustParseCIDR("10.0.0.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("10.0.0.0/24"), OutputIface: 2},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), PrefSrc: net.IPv4(192, 168, 1, 3), OutputIface: 1},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	res, err := r.RouteFromSource(net.IPv4(192, 168, 1, 2), net.IPv4(8, 8, 8, 8))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if !res.PreferredSrc.Equal(net.IPv4(192, 168, 1, 2)) || res.Iface.Name != "eth0" {
+		t.Errorf("\ngot:	%+v\nwant:	eth0 from 192.168.1.2\n\n", res)
+	}
+	if _, err := r.RouteFromSource(net.IPv4(10, 0, 0, 2), net.IPv4(8, 8, 8, 8)); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for a source on another interface\n\n")
+	}
+}
+
+func TestInputIfaceName(t *testing.T) {
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			{Index: 2, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+		},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("10.0.0.0/8"), InputIface: 2, OutputIface: 1},
+			{Dst: mustParseCIDR("10.1.0.0/16"), InputIface: 9, OutputIface: 1},
+			{Dst: mustParseCIDR("0.0.0.0/0"), OutputIface: 1},
+		},
+	}
+
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	want := map[string]string{"10.0.0.0/8": "eth1", "10.1.0.0/16": "", "0.0.0.0/0": ""}
+	for _, rt := range r.(DynamicRouter).Table().Routes() {
+		if rt.InputIfaceName != want[rt.Dst.String()] {
+			t.Errorf("\ngot:	%q for %v\nwant:	%q\n\n", rt.InputIfaceName, rt.Dst.String(), want[rt.Dst.String()])
+		}
+	}
+}
+
+func TestSameEgress(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			2: {Index: 2, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24")}},
+			2: {v4: []net.IPNet{mustParseCIDR("10.0.0.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("10.0.0.0/24"), OutputIface: 2},
+			{Dst: mustParseCIDR("172.16.0.0/12"), Gateway: net.IPv4(10, 0, 0, 1), OutputIface: 2},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+			{Dst: mustParseCIDR("10.9.0.0/16"), Type: TypeLocal},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	tests := []struct {
+		a, b net.IP
+		want bool
+	}{
+		{net.IPv4(8, 8, 8, 8), net.IPv4(1, 1, 1, 1), true},
+		// Local routes without an output interface.
+		{net.IPv4(10, 9, 0, 1), net.IPv4(10, 9, 0, 2), true},
+		{net.IPv4(10, 9, 0, 1), net.IPv4(8, 8, 8, 8), false},
+		{net.IPv4(8, 8, 8, 8), net.IPv4(172, 16, 1, 1), false},
+		{net.IPv4(10, 0, 0, 5), net.IPv4(10, 0, 0, 5), true},
+		{net.IPv4(10, 0, 0, 5), net.IPv4(10, 0, 0, 6), false},
+	}
+	for _, tt := range tests {
+		got, err := r.SameEgress(tt.a, tt.b)
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if got != tt.want {
+			t.Errorf("%v %v\ngot:	%v\nwant:	%v\n\n", tt.a, tt.b, got, tt.want)
+		}
+	}
+	if _, err := r.SameEgress(net.IPv4(8, 8, 8, 8), net.ParseIP("2001:db8::1")); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrNoRoute)
+	}
+}
+
+func TestHostScopeRoute(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 65536, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			2: {Index: 2, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("127.0.0.1/8")}},
+			2: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 2},
+			{Dst: mustParseCIDR("192.168.1.2/32"), OutputIface: 2, Scope: ScopeHost},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 2},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	res, err := r.RouteGet(nil, nil, net.IPv4(192, 168, 1, 2))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if !res.IsLocal || res.Iface.Name != "lo" || res.Gateway != nil || !res.PreferredSrc.Equal(net.IPv4(192, 168, 1, 2)) {
+		t.Errorf("\ngot:	%+v\nwant:	local on lo from 192.168.1.2\n\n", res)
+	}
+	if res.IfaceIndex() != 1 {
+		t.Errorf("\ngot:	%d\nwant:	1\n\n", res.IfaceIndex())
+	}
+	if res, _ = r.RouteGet(nil, nil, net.IPv4(192, 168, 1, 3)); res.IsLocal || res.Iface.Name != "eth0" {
+		t.Errorf("\ngot:	%+v\nwant:	eth0, not local\n\n", res)
+	}
+}
+
+func TestRouteLocalTable(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 65536, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			2: {Index: 2, MTU: 1500, Name: "eth0", Flags: net.FlagUp | net.FlagMulticast},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("127.0.0.1/8")}, v6: []net.IPNet{mustParseCIDR("::1/128")}},
+			2: {v4: []net.IPNet{mustParseCIDR("192.0.2.2/24")}, v6: []net.IPNet{mustParseCIDR("fe80::2/64")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.0.2.0/24"), OutputIface: 2, Table: TableMain},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 0, 2, 1), OutputIface: 2, Table: TableMain},
+		},
+		v6: routeSlice{
+			{Dst: mustParseCIDR("fe80::/64"), OutputIface: 2, Table: TableMain},
+		},
+		tables: map[uint32]tableRoutes{
+			TableLocal: {
+				v4: routeSlice{
+					{Dst: mustParseCIDR("127.0.0.0/8"), PrefSrc: net.IPv4(127, 0, 0, 1), OutputIface: 1, Type: TypeLocal, Scope: ScopeHost, Table: TableLocal},
+					{Dst: mustParseCIDR("192.0.2.2/32"), PrefSrc: net.IPv4(192, 0, 2, 2), OutputIface: 2, Type: TypeLocal, Scope: ScopeHost, Table: TableLocal},
+					{Dst: mustParseCIDR("192.0.2.255/32"), PrefSrc: net.IPv4(192, 0, 2, 2), OutputIface: 2, Type: TypeBroadcast, Scope: ScopeLink, Table: TableLocal},
+				},
+				v6: routeSlice{
+					{Dst: mustParseCIDR("::1/128"), OutputIface: 1, Type: TypeLocal, Table: TableLocal},
+					{Dst: mustParseCIDR("fe80::2/128"), OutputIface: 2, Type: TypeLocal, Table: TableLocal},
+					{Dst: mustParseCIDR("ff00::/8"), OutputIface: 2, Type: TypeMulticast, Table: TableLocal},
+				},
+			},
+		},
+		rules: []Rule{
+			{Family: FamilyV4, Priority: 0, Action: RuleLookup, Table: TableLocal},
+			{Family: FamilyV4, Priority: 32766, Action: RuleLookup, Table: TableMain},
+			{Family: FamilyV6, Priority: 0, Action: RuleLookup, Table: TableLocal},
+			{Family: FamilyV6, Priority: 32766, Action: RuleLookup, Table: TableMain},
+		},
+	}}
+	for _, rs := range []routeSlice{r.v4, r.v6, r.tables[TableLocal].v4, r.tables[TableLocal].v6} {
+		sort.Sort(rs)
+	}
+
+	tests := []struct {
+		dst   string
+		iface string
+		local bool
+	}{
+		{"127.0.0.1", "lo", true},
+		{"127.1.2.3", "lo", true},
+		{"::1", "lo", true},
+		{"192.0.2.2", "lo", true},
+		{"fe80::2", "lo", true},
+		{"192.0.2.3", "eth0", false},
+		{"192.0.2.255", "eth0", false},
+		{"ff02::1", "eth0", false},
+		{"8.8.8.8", "eth0", false},
+	}
+	for _, test := range tests {
+		dst := net.ParseIP(test.dst)
+		res, err := r.RouteGet(nil, nil, dst)
+		if err != nil || res.Iface.Name != test.iface || res.IsLocal != test.local {
+			t.Errorf("%s:\ngot:\t%+v %v\nwant:\t%s, local %v\n\n", test.dst, res, err, test.iface, test.local)
+			continue
+		}
+		marked, err := r.RouteWithMark(0, nil, dst)
+		if err != nil || marked.Iface.Name != res.Iface.Name || marked.IsLocal != res.IsLocal || !marked.PreferredSrc.Equal(res.PreferredSrc) {
+			t.Errorf("%s:\ngot:\t%+v %v\nwant:\t%+v, as Route\n\n", test.dst, marked, err, res)
+		}
+	}
+
+	// RouteInTable looks up the main table alone.
+	res, err := r.RouteInTable(int(TableMain), net.IPv4(192, 0, 2, 2))
+	if err != nil || res.IsLocal || res.Iface.Name != "eth0" {
+		t.Errorf("\ngot:\t%+v %v\nwant:\ton-link on eth0\n\n", res, err)
+	}
+}
+
+func TestRouteExplain(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("10.1.2.3/16")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("10.0.0.0/8"), Gateway: net.IPv4(10, 1, 0, 1), OutputIface: 1, Priority: 100, Table: TableMain},
+			{Dst: mustParseCIDR("10.0.0.0/16"), Gateway: net.IPv4(10, 1, 0, 2), OutputIface: 1, Flags: RouteDead, Table: TableMain},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	res, steps, err := r.RouteExplain(net.IPv4(10, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	want := []string{
+		"skipped 10.0.0.0/16 prio 0 (dead)",
+		"matched 10.0.0.0/8 prio 100 in table 254",
+		"next hop is gateway 10.1.0.1",
+		"selected src 10.1.2.3 on eth0",
+	}
+	if strings.Join(steps, "\n") != strings.Join(want, "\n") {
+		t.Errorf("\ngot:	%q\nwant:	%q\n\n", steps, want)
+	}
+	if !res.Gateway.Equal(net.IPv4(10, 1, 0, 1)) {
+		t.Errorf("\ngot:	%v\nwant:	10.1.0.1\n\n", res.Gateway)
+	}
+
+	if _, steps, err = r.RouteExplain(net.IPv4(192, 0, 2, 1)); err == nil || len(steps) != 1 {
+		t.Errorf("\ngot:	%q, %v\nwant:	one step and an error\n\n", steps, err)
+	}
+}
+
+func TestUnmatchedInput(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", HardwareAddr: net.HardwareAddr{0x54, 0x52, 0, 0, 0, 1}, Flags: net.FlagUp},
+			2: {Index: 2, MTU: 1420, Name: "tun0", Flags: net.FlagUp | net.FlagPointToPoint},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24")}},
+			2: {v4: []net.IPNet{mustParseCIDR("10.8.0.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("10.0.0.0/8"), Gateway: net.IPv4(10, 8, 0, 1), InputIface: 2, OutputIface: 2},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	if _, err := r.RouteGet(net.HardwareAddr{0x54, 0x52, 0, 0, 0, 9}, nil, net.IPv4(10, 1, 1, 1)); !errors.Is(err, ErrInputNotFound) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrInputNotFound)
+	}
+	// An empty address is no input at all, rather than that of tun0.
+	res, err := r.RouteGet(net.HardwareAddr{}, nil, net.IPv4(10, 1, 1, 1))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if res.Iface.Name != "tun0" {
+		t.Errorf("\ngot:	%s\nwant:	tun0\n\n", res.Iface.Name)
+	}
+	if res, _ = r.RouteGet(net.HardwareAddr{0x54, 0x52, 0, 0, 0, 1}, nil, net.IPv4(10, 1, 1, 1)); res.Iface.Name != "eth0" {
+		t.Errorf("\ngot:	%s\nwant:	eth0, skipping the route bound to tun0\n\n", res.Iface.Name)
+	}
+}
+
+func TestConnectFallback(t *testing.T) {
+	// Run in a namespace of its own: other tests leave threads in
+	// namespaces without a usable loopback interface.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		t.Skipf("no network namespaces: %v", err)
+	}
+	defer origin.Close()
+	ns, err := netns.New()
+	if err != nil {
+		t.Skipf("no network namespaces: %v", err)
+	}
+	defer ns.Close()
+	defer netns.Set(origin)
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 65536, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("127.0.0.1/8")}},
+		},
+	}}
+	if _, err := r.RouteGet(nil, nil, net.IPv4(127, 0, 0, 1)); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrNoRoute)
+	}
+
+	WithConnectFallback().apply(r)
+	res, err := r.RouteGet(nil, nil, net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if res.Iface.Name != "lo" || !res.PreferredSrc.Equal(net.IPv4(127, 0, 0, 1)) || res.Gateway != nil {
+		t.Errorf("\ngot:	%+v\nwant:	lo from 127.0.0.1 without a gateway\n\n", res)
+	}
+}
+
+func TestStats(t *testing.T) {
+	eth0Addr := mustParseCIDR("192.168.1.2/24")
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		},
+		addrs: map[int][]net.Addr{
+			1: {&eth0Addr},
+		},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("10.0.0.0/8"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Table: 100},
+		},
+	}
+
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	r.Route(net.IPv4(192, 168, 1, 9))
+	if st := r.(DynamicRouter).Stats(); st != (Stats{Routes: 2}) {
+		t.Errorf("\ngot:	%+v\nwant:	only Routes without WithStats\n\n", st)
+	}
+
+	r, err = New(WithProvider(p), WithStats())
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	r.Route(net.IPv4(192, 168, 1, 9))
+	r.Route(net.IPv4(8, 8, 8, 8))
+	r.Route(net.IP{1, 2, 3})
+	if err := r.(DynamicRouter).Refresh(); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	st := r.(DynamicRouter).Stats()
+	if st.Lookups != 3 || st.Hits != 1 || st.Misses != 1 || st.Refreshes != 2 || st.Routes != 2 {
+		t.Errorf("\ngot:	%+v\nwant:	3 lookups, 1 hit, 1 miss, 2 refreshes, 2 routes\n\n", st)
+	}
+	if st.RefreshTime < st.LastRefresh {
+		t.Errorf("\ngot:	%v total, %v last\nwant:	total >= last\n\n", st.RefreshTime, st.LastRefresh)
+	}
+}
+
+func TestMetricOverride(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	wwanAddr := mustParseCIDR("10.64.0.2/16")
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			{Index: 2, MTU: 1500, Name: "wwan0", Flags: net.FlagUp},
+		},
+		addrs: map[int][]net.Addr{
+			1: {&ethAddr},
+			2: {&wwanAddr},
+		},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Priority: 700},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 64, 0, 1), OutputIface: 2, Priority: 100},
+		},
+	}
+
+	r, err := New(WithProvider(p), WithMetricOverride(func(rt RouteEntry) int {
+		if rt.OutputIface == 1 {
+			return 0
+		}
+		return int(rt.Priority)
+	}))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if iface, _, _, _ := r.Route(net.IPv4(8, 8, 8, 8)); iface.Name != "eth0" {
+		t.Errorf("\ngot:	%s\nwant:	eth0\n\n", iface.Name)
+	}
+	if routes := r.(DynamicRouter).Table().Routes(); routes[0].Priority != 0 || routes[1].Priority != 100 {
+		t.Errorf("\ngot:	%+v\nwant:	priorities 0 and 100\n\n", routes)
+	}
+	if clampPriority(-1) != 0 {
+		t.Errorf("\ngot:	%d\nwant:	0\n\n", clampPriority(-1))
+	}
+	if math.MaxInt > math.MaxUint32 && clampPriority(math.MaxInt) != math.MaxUint32 {
+		t.Errorf("\ngot:	%d\nwant:	%d\n\n", clampPriority(math.MaxInt), uint32(math.MaxUint32))
+	}
+}
+
+func TestSkipExpired(t *testing.T) {
+	addr := mustParseCIDR("2001:db8::2/64")
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			{Index: 2, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+		},
+		addrs: map[int][]net.Addr{
+			1: {&addr},
+			2: {&addr},
+		},
+		routes: []RouteEntry{
+			// A default route from a router advertisement that was not
+			// renewed, and a worse one that never expires.
+			{Dst: mustParseCIDR("::/0"), Gateway: net.ParseIP("fe80::1"), OutputIface: 1, Priority: 100, ValidLifetime: 30 * time.Minute, Age: time.Hour},
+			{Dst: mustParseCIDR("::/0"), Gateway: net.ParseIP("fe80::2"), OutputIface: 2, Priority: 200},
+		},
+	}
+	dst := net.ParseIP("2001:4860:4860::8888")
+
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if iface, _, _, _ := r.Route(dst); iface.Name != "eth0" {
+		t.Errorf("\ngot:	%s\nwant:	eth0 without WithSkipExpired\n\n", iface.Name)
+	}
+
+	r, err = New(WithProvider(p), WithSkipExpired())
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if iface, _, _, _ := r.Route(dst); iface.Name != "eth1" {
+		t.Errorf("\ngot:	%s\nwant:	eth1\n\n", iface.Name)
+	}
+	if iface, _, _, _ := r.(DynamicRouter).Snapshot().Route(dst); iface.Name != "eth1" {
+		t.Errorf("\ngot:	%s\nwant:	eth1 from the snapshot\n\n", iface.Name)
+	}
+}
+
+func TestRouteTable(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	wwanAddr := mustParseCIDR("10.64.0.2/16")
+	tab, err := NewRouteTable([]RouteEntry{
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Priority: 100},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 64, 0, 1), OutputIface: 2, Priority: 700},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 64, 0, 254), OutputIface: 2, Priority: 800, Flags: RouteDead},
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		{Index: 2, MTU: 1500, Name: "wwan0", Flags: net.FlagUp},
+	}, map[int][]net.Addr{
+		1: {&ethAddr},
+		2: {&wwanAddr},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	res, err := tab.Route(net.IPv4(8, 8, 8, 8))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if res.Iface.Name != "eth0" || !res.Gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("\ngot:	%+v\nwant:	via 192.168.1.1 on eth0\n\n", res)
+	}
+
+	routes, err := tab.RouteAll(net.IPv4(8, 8, 8, 8))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if len(routes) != 2 || routes[0].OutputIface != 1 || routes[1].OutputIface != 2 {
+		t.Errorf("\ngot:	%+v\nwant:	the default routes of eth0 and wwan0\n\n", routes)
+	}
+	if routes, _ := tab.RouteAll(net.IPv4(192, 168, 1, 7)); len(routes) != 3 || routes[0].Gateway != nil {
+		t.Errorf("\ngot:	%+v\nwant:	the on-link route first, then the default routes\n\n", routes)
+	}
+	if _, err := tab.RouteAll(net.ParseIP("2001:db8::1")); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrNoRoute)
+	}
+	if len(tab.Routes()) != 4 {
+		t.Errorf("\ngot:	%d routes\nwant:	4\n\n", len(tab.Routes()))
+	}
+}
+
+func TestAddresslessEgress(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	v6Addr := mustParseCIDR("2001:db8::2/64")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		// wg0 was just created and has no address yet.
+		{Dst: mustParseCIDR("10.8.0.0/16"), OutputIface: 2},
+		{Dst: mustParseCIDR("10.9.0.0/16"), OutputIface: 2, PrefSrc: net.IPv4(10, 8, 0, 5)},
+		// eth1 only has an IPv6 address.
+		{Dst: mustParseCIDR("172.16.0.0/12"), OutputIface: 3},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		{Index: 2, MTU: 1420, Name: "wg0", Flags: net.FlagUp},
+		{Index: 3, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+	}, map[int][]net.Addr{
+		1: {&ethAddr},
+		3: {&v6Addr},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, tc := range []struct {
+		dst   net.IP
+		iface string
+	}{
+		{net.IPv4(10, 8, 1, 1), "wg0"},
+		{net.IPv4(172, 16, 0, 1), "eth1"},
+	} {
+		_, err := r.(EgressRouter).RouteGet(nil, nil, tc.dst)
+		if !errors.Is(err, ErrNoSourceOnInterface) || !strings.Contains(err.Error(), tc.iface) {
+			t.Errorf("\ngot:	%v\nwant:	%v naming %s\n\n", err, ErrNoSourceOnInterface, tc.iface)
+		}
+	}
+
+	res, err := r.(EgressRouter).RouteGet(nil, nil, net.IPv4(10, 9, 1, 1))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if res.Iface.Name != "wg0" || !res.PreferredSrc.Equal(net.IPv4(10, 8, 0, 5)) {
+		t.Errorf("\ngot:	%+v\nwant:	from 10.8.0.5 on wg0\n\n", res)
+	}
+}
+
+func TestPrimaryInterface(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	v6Addr := mustParseCIDR("2001:db8::2/64")
+	ifaces := []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		{Index: 2, MTU: 1280, Name: "he-ipv6", Flags: net.FlagUp},
+	}
+	addrs := map[int][]net.Addr{
+		1: {&ethAddr},
+		2: {&v6Addr},
+	}
+	routes := []RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("0.0.0.0/1"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		{Dst: mustParseCIDR("::/0"), Gateway: net.ParseIP("fe80::1"), OutputIface: 2},
+	}
+
+	for _, tc := range []struct {
+		opts  []Option
+		iface string
+		src   net.IP
+	}{
+		{nil, "eth0", net.IPv4(192, 168, 1, 2)},
+		{[]Option{WithPreferIPv6()}, "he-ipv6", net.ParseIP("2001:db8::2")},
+		{[]Option{WithFamily(FamilyV6)}, "he-ipv6", net.ParseIP("2001:db8::2")},
+	} {
+		r, err := NewFromRoutes(routes, ifaces, addrs, tc.opts...)
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		iface, src, err := r.(EgressRouter).PrimaryInterface()
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if iface.Name != tc.iface || !src.Equal(tc.src) {
+			t.Errorf("\ngot:	%s %v\nwant:	%s %v\n\n", iface.Name, src, tc.iface, tc.src)
+		}
+	}
+
+	r, err := NewFromRoutes(routes[:2], ifaces, addrs)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, _, err := r.(EgressRouter).PrimaryInterface(); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrNoRoute)
+	}
+}
+
+func TestRoutesViaGateway(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	v6Addr := mustParseCIDR("2001:db8::2/64")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		{Dst: mustParseCIDR("10.0.0.0/8"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		{Dst: mustParseCIDR("10.1.0.0/16"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1},
+		// An IPv6 route via an IPv4 gateway (RFC 5549).
+		{Dst: mustParseCIDR("2001:db8:1::/48"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		{Dst: mustParseCIDR("172.16.0.0/12"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Table: 100},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+	}, map[int][]net.Addr{
+		1: {&ethAddr, &v6Addr},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	routes, err := r.(DynamicRouter).Table().RoutesViaGateway(net.ParseIP("192.168.1.1"))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	var got []string
+	for _, rt := range routes {
+		got = append(got, rt.Dst.String())
+	}
+	want := []string{"2001:db8:1::/48", "172.16.0.0/12", "10.0.0.0/8", "0.0.0.0/0"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", got, want)
+	}
+	if routes, err := r.(DynamicRouter).Table().RoutesViaGateway(net.IPv4(192, 168, 1, 2)); err != nil || len(routes) != 0 {
+		t.Errorf("\ngot:	%v %v\nwant:	no routes\n\n", routes, err)
+	}
+	if _, err := r.(DynamicRouter).Table().RoutesViaGateway(nil); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for an invalid gateway\n\n")
+	}
+}
+
+func TestIPAddrAddresses(t *testing.T) {
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "tun0", Flags: net.FlagUp | net.FlagPointToPoint},
+		},
+		addrs: map[int][]net.Addr{
+			1: {&net.IPAddr{IP: net.ParseIP("10.0.0.5")}, &net.IPAddr{IP: net.ParseIP("2001:db8::5")}},
+		},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("::/0"), Gateway: net.ParseIP("fe80::1"), OutputIface: 1},
+		},
+	}
+	rtr, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	r := rtr.(*router)
+	if addrs := r.addrs[1]; len(addrs.v4) != 1 || addrs.v4[0].String() != "10.0.0.5/32" || len(addrs.v6) != 1 || addrs.v6[0].String() != "2001:db8::5/128" {
+		t.Errorf("\ngot:	%v %v\nwant:	10.0.0.5/32 and 2001:db8::5/128\n\n", addrs.v4, addrs.v6)
+	}
+	_, _, src, err := r.Route(net.ParseIP("2001:4860:4860::8888"))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if !src.Equal(net.ParseIP("2001:db8::5")) {
+		t.Errorf("\ngot:	%v\nwant:	2001:db8::5\n\n", src)
+	}
+}
+
+func TestInterfaces(t *testing.T) {
+	r, err := NewFromRoutes(nil, []net.Interface{
+		{Index: 3, Name: "wlan0"},
+		{Index: 1, Name: "lo"},
+		{Index: 2, Name: "eth0"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	var got []string
+	for _, iface := range r.(DynamicRouter).Table().Interfaces() {
+		got = append(got, iface.Name)
+	}
+	if strings.Join(got, " ") != "lo eth0 wlan0" {
+		t.Errorf("\ngot:	%v\nwant:	[lo eth0 wlan0]\n\n", got)
+	}
+}
+
+func TestRouteWithTOS(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	wwanAddr := mustParseCIDR("10.64.0.2/16")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Priority: 100},
+		// Low-delay traffic leaves through the cellular uplink.
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 64, 0, 1), OutputIface: 2, Priority: 50, TOS: 0x10},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		{Index: 2, MTU: 1500, Name: "wwan0", Flags: net.FlagUp},
+	}, map[int][]net.Addr{
+		1: {&ethAddr},
+		2: {&wwanAddr},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, tc := range []struct {
+		tos   byte
+		iface string
+	}{
+		{0x10, "wwan0"},
+		{0x08, "eth0"},
+		{0, "eth0"},
+	} {
+		res, err := r.(PolicyRouter).RouteWithTOS(tc.tos, nil, net.IPv4(8, 8, 8, 8))
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if res.Iface.Name != tc.iface {
+			t.Errorf("tos %#x\ngot:	%s\nwant:	%s\n\n", tc.tos, res.Iface.Name, tc.iface)
+		}
+	}
+
+	// The TOS route doesn't capture the traffic of the other lookups.
+	if iface, _, _, err := r.Route(net.IPv4(8, 8, 8, 8)); err != nil || iface.Name != "eth0" {
+		t.Errorf("\ngot:	%v %v\nwant:	eth0\n\n", iface, err)
+	}
+	if res, err := r.(EgressRouter).RouteGet(nil, net.IPv4(192, 168, 1, 2), net.IPv4(8, 8, 8, 8)); err != nil || res.Iface.Name != "eth0" {
+		t.Errorf("\ngot:	%+v %v\nwant:	eth0\n\n", res, err)
+	}
+}
+
+func TestSourceSelectionErrors(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("10.0.0.0/8"), Gateway: net.IPv4(172, 16, 0, 1), OutputIface: 1},
+		{Dst: mustParseCIDR("10.1.0.0/16"), Gateway: net.IPv4(172, 16, 0, 1), PrefSrc: net.IPv4(10, 1, 0, 9)},
+		{Dst: mustParseCIDR("10.2.0.0/16"), Gateway: net.IPv4(172, 16, 0, 1)},
+		{Dst: mustParseCIDR("10.3.0.0/16"), OutputIface: 2},
+		{Dst: mustParseCIDR("10.4.0.0/16"), OutputIface: 9},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		{Index: 2, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+	}, map[int][]net.Addr{
+		1: {&ethAddr},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, tc := range []struct {
+		dst  net.IP
+		want error
+	}{
+		{net.IPv4(10, 0, 0, 1), ErrNoSourceForGateway},
+		{net.IPv4(10, 1, 0, 1), ErrPrefSrcNotFound},
+		{net.IPv4(10, 2, 0, 1), ErrNoSourceForGateway},
+		{net.IPv4(10, 3, 0, 1), ErrNoSourceOnInterface},
+		{net.IPv4(10, 4, 0, 1), ErrOutputNotFound},
+	} {
+		_, err := r.(EgressRouter).RouteGet(nil, nil, tc.dst)
+		if !errors.Is(err, tc.want) || !strings.Contains(err.Error(), tc.dst.String()) {
+			t.Errorf("\ngot:	%v\nwant:	%v for %v\n\n", err, tc.want, tc.dst)
+		}
+	}
+}
+
+func TestProtocolFilter(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	routes := []RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1, Protocol: ProtocolKernel},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Priority: 100, Protocol: ProtocolDHCP},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1, Priority: 200, Protocol: ProtocolStatic},
+	}
+	ifaces := []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}}
+	addrs := map[int][]net.Addr{1: {&ethAddr}}
+
+	r, err := NewFromRoutes(routes, ifaces, addrs, WithProtocolFilter(ProtocolDHCP))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, gw, _, _ := r.Route(net.IPv4(8, 8, 8, 8)); !gw.Equal(net.IPv4(192, 168, 1, 254)) {
+		t.Errorf("\ngot:	%v\nwant:	192.168.1.254\n\n", gw)
+	}
+	if n := len(r.(DynamicRouter).Table().Routes()); n != 2 {
+		t.Errorf("\ngot:	%d routes\nwant:	2\n\n", n)
+	}
+	if ProtocolDHCP.String() != "dhcp" || RouteProtocol(42).String() != "42" {
+		t.Errorf("\ngot:	%v %v\nwant:	dhcp 42\n\n", ProtocolDHCP, RouteProtocol(42))
+	}
+}
+
+// delayedProvider is a testProvider whose routes only appear after a number
+// of loads.
+type delayedProvider struct {
+	testProvider
+	mu    sync.Mutex
+	loads int
+	after int
+}
+
+func (p *delayedProvider) Routes(family AddressFamily) ([]RouteEntry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.loads++; p.loads <= p.after {
+		return nil, nil
+	}
+	return p.routes, nil
+}
+
+func TestWaitForRoute(t *testing.T) {
+	defer func(d time.Duration) { waitPollInterval = d }(waitPollInterval)
+	waitPollInterval = 10 * time.Millisecond
+
+	tunAddr := mustParseCIDR("10.8.0.2/16")
+	p := &delayedProvider{
+		testProvider: testProvider{
+			ifaces: []net.Interface{{Index: 1, MTU: 1420, Name: "tun0", Flags: net.FlagUp}},
+			addrs:  map[int][]net.Addr{1: {&tunAddr}},
+			routes: []RouteEntry{{Dst: mustParseCIDR("10.8.0.0/16"), OutputIface: 1}},
+		},
+		after: 3,
+	}
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.(DynamicRouter).WaitForRoute(ctx, net.IPv4(10, 8, 1, 1)); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, _, _, err := r.Route(net.IPv4(10, 8, 1, 1)); err != nil {
+		t.Errorf("\ngot:	%#v\nwant:	nil after WaitForRoute\n\n", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.(DynamicRouter).WaitForRoute(ctx, net.IPv4(192, 0, 2, 1)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, context.DeadlineExceeded)
+	}
+}
+
+func TestDefaultUplinks(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	wanAddr := mustParseCIDR("10.64.0.2/16")
+	v6Addr := mustParseCIDR("2001:db8::2/64")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 64, 0, 1), OutputIface: 2, Priority: 600},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Priority: 100},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1, Priority: 100},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 253), OutputIface: 1, Priority: 100, Flags: RouteDead},
+		{Dst: mustParseCIDR("::/0"), Gateway: net.ParseIP("fe80::1"), OutputIface: 1, Priority: 100},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		{Index: 2, MTU: 1500, Name: "wwan0", Flags: net.FlagUp},
+	}, map[int][]net.Addr{
+		1: {&ethAddr, &v6Addr},
+		2: {&wanAddr},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	if n := len(r.(DynamicRouter).Table().DefaultRoutes()); n != 4 {
+		t.Errorf("\ngot:	%d default routes\nwant:	4\n\n", n)
+	}
+	var got []string
+	for _, tier := range r.(DynamicRouter).Table().DefaultUplinks() {
+		var gws []string
+		for _, rt := range tier {
+			gws = append(gws, rt.Gateway.String())
+		}
+		got = append(got, strings.Join(gws, ","))
+	}
+	want := []string{"192.168.1.1,192.168.1.254", "fe80::1", "10.64.0.1"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", got, want)
+	}
+}
+
+func TestStableSourceAddresses(t *testing.T) {
+	p := &testProvider{
+		ifaces: []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}},
+		addrs: map[int][]net.Addr{
+			1: {
+				&InterfaceAddr{IPNet: mustParseCIDR("2001:db8::2/64")},
+				&InterfaceAddr{IPNet: mustParseCIDR("2001:db8::8c1f:3e2a:9b71:d4c0/64"), Flags: AddrTemporary},
+			},
+		},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("::/0"), Gateway: net.ParseIP("2001:db8::1"), OutputIface: 1},
+		},
+	}
+	dst := net.ParseIP("2001:4860:4860::8888")
+
+	for _, tc := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, "2001:db8::8c1f:3e2a:9b71:d4c0"},
+		{[]Option{WithStableSourceAddresses()}, "2001:db8::2"},
+	} {
+		r, err := New(append(tc.opts, WithProvider(p))...)
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if _, _, src, _ := r.Route(dst); !src.Equal(net.ParseIP(tc.want)) {
+			t.Errorf("\ngot:	%v\nwant:	%s\n\n", src, tc.want)
+		}
+	}
+
+	// Temporary addresses are still used when there is no other.
+	p.addrs[1] = p.addrs[1][1:]
+	r, err := New(WithProvider(p), WithStableSourceAddresses())
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, _, src, _ := r.Route(dst); !src.Equal(net.ParseIP("2001:db8::8c1f:3e2a:9b71:d4c0")) {
+		t.Errorf("\ngot:	%v\nwant:	the temporary address\n\n", src)
+	}
+}
+
+func TestSourceAddresses(t *testing.T) {
+	lo := mustParseCIDR("127.0.0.1/8")
+	eth := mustParseCIDR("192.168.1.2/24")
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 65536, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			{Index: 2, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			{Index: 3, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+		},
+		addrs: map[int][]net.Addr{
+			1: {&lo, &InterfaceAddr{IPNet: mustParseCIDR("::1/128")}},
+			2: {
+				&InterfaceAddr{IPNet: mustParseCIDR("fe80::2/64")},
+				&InterfaceAddr{IPNet: mustParseCIDR("2001:db8::2/64")},
+				&InterfaceAddr{IPNet: mustParseCIDR("2001:db8::8c1f:3e2a:9b71:d4c0/64"), Flags: AddrTemporary},
+				&eth,
+				&InterfaceAddr{IPNet: mustParseCIDR("192.168.1.3/24"), Flags: AddrSecondary},
+			},
+			// The same address on two interfaces is listed once.
+			3: {&eth, &InterfaceAddr{IPNet: mustParseCIDR("2001:db8::64/64"), Flags: AddrAnycast}},
+		},
+	}
+	for _, tc := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, "[192.168.1.2 2001:db8::2 2001:db8::8c1f:3e2a:9b71:d4c0]"},
+		{[]Option{WithStableSourceAddresses()}, "[192.168.1.2 2001:db8::2]"},
+		{[]Option{WithLocalSourceAddresses()}, "[127.0.0.1 192.168.1.2 ::1 fe80::2 2001:db8::2 2001:db8::8c1f:3e2a:9b71:d4c0]"},
+	} {
+		r, err := New(append(tc.opts, WithProvider(p))...)
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if got := fmt.Sprint(r.(DynamicRouter).Table().SourceAddresses()); got != tc.want {
+			t.Errorf("\ngot:	%s\nwant:	%s\n\n", got, tc.want)
+		}
+	}
+}
+
+func TestGeneration(t *testing.T) {
+	r, err := NewFromRoutes(nil, []net.Interface{{Index: 1, Name: "eth0"}}, nil)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if g := r.(DynamicRouter).Generation(); g != 1 {
+		t.Errorf("\ngot:	%d\nwant:	1 after New\n\n", g)
+	}
+	if err := r.(DynamicRouter).Refresh(); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if err := r.(DynamicRouter).RefreshAddrs(); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if g := r.(DynamicRouter).Generation(); g != 3 {
+		t.Errorf("\ngot:	%d\nwant:	3 after Refresh and RefreshAddrs\n\n", g)
+	}
+}
+
+func TestL2Target(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		{Dst: mustParseCIDR("192.168.1.2/32"), OutputIface: 1, Scope: ScopeHost},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+	}, map[int][]net.Addr{
+		1: {&ethAddr},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, tc := range []struct {
+		dst, want net.IP
+	}{
+		{net.IPv4(8, 8, 8, 8), net.IPv4(192, 168, 1, 1)},
+		{net.IPv4(192, 168, 1, 7), net.IPv4(192, 168, 1, 7)},
+	} {
+		ip, iface, err := r.(LinkRouter).L2Target(tc.dst)
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if !ip.Equal(tc.want) || iface.Name != "eth0" {
+			t.Errorf("\ngot:	%v on %v\nwant:	%v on eth0\n\n", ip, iface, tc.want)
+		}
+	}
+	if _, _, err := r.(LinkRouter).L2Target(net.IPv4(192, 168, 1, 2)); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for a local address\n\n")
+	}
+}
+
+func TestRouteSockaddr(t *testing.T) {
+	ethAddr4 := mustParseCIDR("192.168.1.2/24")
+	ethAddr6 := mustParseCIDR("2001:db8::2/64")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 2},
+		{Dst: mustParseCIDR("::/0"), Gateway: net.ParseIP("fe80::1"), OutputIface: 2},
+		{Dst: mustParseCIDR("2001:db8::/64"), OutputIface: 2},
+	}, []net.Interface{
+		{Index: 2, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+	}, map[int][]net.Addr{
+		2: {&ethAddr4, &ethAddr6},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, tc := range []struct {
+		dst  string
+		want syscall.Sockaddr
+	}{
+		{"8.8.8.8", &syscall.SockaddrInet4{Addr: [4]byte{8, 8, 8, 8}}},
+		{"2001:4860::8888", &syscall.SockaddrInet6{Addr: [16]byte{0x20, 0x01, 0x48, 0x60, 14: 0x88, 15: 0x88}, ZoneId: 2}},
+		{"2001:db8::7", &syscall.SockaddrInet6{Addr: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 7}}},
+	} {
+		sa, iface, err := r.(LinkRouter).RouteSockaddr(net.ParseIP(tc.dst))
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if !reflect.DeepEqual(sa, tc.want) || iface.Index != 2 {
+			t.Errorf("%v\ngot:	%+v on %v\nwant:	%+v on eth0\n\n", tc.dst, sa, iface, tc.want)
+		}
+	}
+}
+
+func TestPointToPointDefault(t *testing.T) {
+	// The address of a tun device, whose peer is 10.8.0.1.
+	tunAddr := mustParseCIDR("10.8.0.2/32")
+	tunAddr6 := mustParseCIDR("fd00::2/128")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("0.0.0.0/0"), OutputIface: 5},
+		{Dst: mustParseCIDR("::/0"), OutputIface: 5},
+	}, []net.Interface{
+		{Index: 5, MTU: 1420, Name: "tun0", Flags: net.FlagUp | net.FlagPointToPoint},
+	}, map[int][]net.Addr{
+		5: {&tunAddr, &tunAddr6},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, tc := range []struct {
+		dst, src string
+	}{
+		{"8.8.8.8", "10.8.0.2"},
+		{"2001:4860::8888", "fd00::2"},
+	} {
+		iface, gateway, src, err := r.Route(net.ParseIP(tc.dst))
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if iface.Name != "tun0" || !gateway.Equal(net.ParseIP(tc.dst)) || !src.Equal(net.ParseIP(tc.src)) {
+			t.Errorf("\ngot:	%v via %v src %v\nwant:	tun0 via %v src %v\n\n", iface.Name, gateway, src, tc.dst, tc.src)
+		}
+	}
+}
+
+func TestDefaultRouteChanges(t *testing.T) {
+	defer func(d time.Duration) { waitPollInterval = d }(waitPollInterval)
+	waitPollInterval = 10 * time.Millisecond
+
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	p := &delayedProvider{
+		testProvider: testProvider{
+			ifaces: []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}},
+			addrs:  map[int][]net.Addr{1: {&ethAddr}},
+			routes: []RouteEntry{{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1}},
+		},
+		after: 2,
+	}
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, err := r.(DynamicRouter).DefaultRouteChanges(ctx)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	ev, ok := <-events
+	if !ok {
+		t.Fatalf("\ngot:	closed channel\nwant:	an event\n\n")
+	}
+	if ev.Family != FamilyV4 || ev.Old != nil || ev.New == nil || !ev.New.Gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("\ngot:	%+v\nwant:	the IPv4 default route via 192.168.1.1\n\n", ev)
+	}
+
+	// The table does not change anymore.
+	select {
+	case ev := <-events:
+		t.Errorf("\ngot:	%+v\nwant:	no event\n\n", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	if _, ok := <-events; ok {
+		t.Errorf("\ngot:	open channel\nwant:	closed when ctx is done\n\n")
+	}
+}
+
+func TestLocalSubnets(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	ethAddr6 := mustParseCIDR("2001:db8::2/64")
+	wlanAddr := mustParseCIDR("10.1.0.5/16")
+	tunAddr := mustParseCIDR("10.8.0.2/32")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("172.16.0.0/12"), OutputIface: 1},
+		{Dst: mustParseCIDR("10.0.0.0/8"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		{Dst: mustParseCIDR("0.0.0.0/0"), OutputIface: 3},
+		{Dst: mustParseCIDR("192.168.1.2/32"), OutputIface: 1, Scope: ScopeHost},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		{Index: 2, MTU: 1500, Name: "wlan0", Flags: net.FlagUp},
+		{Index: 3, MTU: 1420, Name: "tun0", Flags: net.FlagUp | net.FlagPointToPoint},
+	}, map[int][]net.Addr{
+		1: {&ethAddr, &ethAddr6},
+		2: {&wlanAddr},
+		3: {&tunAddr},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	subnets, err := r.(DynamicRouter).Table().LocalSubnets()
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	var got []string
+	for _, n := range subnets {
+		got = append(got, n.String())
+	}
+	want := []string{"192.168.1.0/24", "172.16.0.0/12", "10.1.0.0/16", "2001:db8::/64"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", got, want)
+	}
+}
+
+func TestRouteVia(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	wlanAddr := mustParseCIDR("10.1.0.5/16")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Priority: 100},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 1, 0, 1), OutputIface: 2, Priority: 600},
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("10.1.0.0/16"), OutputIface: 2},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		{Index: 2, MTU: 1500, Name: "wlan0", Flags: net.FlagUp},
+		{Index: 3, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+	}, map[int][]net.Addr{
+		1: {&ethAddr},
+		2: {&wlanAddr},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	ifaces := r.(DynamicRouter).Table().Interfaces()
+
+	res, err := r.(EgressRouter).RouteVia(ifaces[1], net.IPv4(8, 8, 8, 8))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if res.Iface.Name != "wlan0" || !res.Gateway.Equal(net.IPv4(10, 1, 0, 1)) || !res.PreferredSrc.Equal(net.IPv4(10, 1, 0, 5)) {
+		t.Errorf("\ngot:	%+v\nwant:	wlan0 via 10.1.0.1 src 10.1.0.5\n\n", res)
+	}
+	if _, err := r.(EgressRouter).RouteVia(ifaces[2], net.IPv4(8, 8, 8, 8)); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrNoRoute)
+	}
+	if _, err := r.(EgressRouter).RouteVia(nil, net.IPv4(8, 8, 8, 8)); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for a nil interface\n\n")
+	}
+}
+
+func TestIncludeDownInterfaces(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	eth1Addr := mustParseCIDR("10.1.0.5/16")
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			{Index: 2, MTU: 1500, Name: "eth1"},
+		},
+		addrs: map[int][]net.Addr{1: {&ethAddr}, 2: {&eth1Addr}},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 1, 0, 1), OutputIface: 2, Priority: 10},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Priority: 100},
+		},
+	}
+	tests := []struct {
+		name  string
+		opts  []Option
+		flags RouteFlags // of the route through eth1
+		iface string
+	}{
+		// By default the flags of the interfaces don't matter.
+		{"default", nil, 0, "eth1"},
+		{"include", []Option{WithIncludeDownInterfaces()}, RouteIfaceDown, "eth0"},
+	}
+	for _, test := range tests {
+		r, err := New(append(test.opts, WithProvider(p))...)
+		if err != nil {
+			t.Fatalf("%s:\ngot:\t%#v\nwant:\tnil\n\n", test.name, err)
+		}
+
+		routes := r.(DynamicRouter).Table().Routes()
+		if len(routes) != 2 || routes[0].OutputIface != 2 || routes[0].Flags != test.flags {
+			t.Errorf("%s:\ngot:\t%+v\nwant:\t2 routes, that through eth1 flagged %v\n\n", test.name, routes, test.flags)
+		}
+		iface, _, _, err := r.Route(net.IPv4(8, 8, 8, 8))
+		if err != nil {
+			t.Fatalf("%s:\ngot:\t%#v\nwant:\tnil\n\n", test.name, err)
+		}
+		if iface.Name != test.iface {
+			t.Errorf("%s:\ngot:\t%v\nwant:\t%v\n\n", test.name, iface.Name, test.iface)
+		}
+
+		// RouteAll lists the routes of down interfaces last.
+		all, err := r.(DynamicRouter).Table().RouteAll(net.IPv4(8, 8, 8, 8))
+		if err != nil {
+			t.Fatalf("%s:\ngot:\t%#v\nwant:\tnil\n\n", test.name, err)
+		}
+		if len(all) != 2 || all[0].OutputIface != iface.Index {
+			t.Errorf("%s:\ngot:\t%+v\nwant:\tthrough %s first\n\n", test.name, all, test.iface)
+		}
+	}
+
+	// The routes of down interfaces are selected when no route through an
+	// up one applies.
+	p.routes = p.routes[:1]
+	r, err := New(WithIncludeDownInterfaces(), WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:\t%#v\nwant:\tnil\n\n", err)
+	}
+	iface, gateway, _, err := r.Route(net.IPv4(8, 8, 8, 8))
+	if err != nil || iface.Name != "eth1" || !gateway.Equal(net.IPv4(10, 1, 0, 1)) {
+		t.Errorf("\ngot:\t%v %v %v\nwant:\teth1 via 10.1.0.1\n\n", iface, gateway, err)
+	}
+}
+
+func TestNewFromRoutesWithoutFlags(t *testing.T) {
+	// Interfaces made up for NewFromRoutes rarely carry FlagUp.
+	addr := mustParseCIDR("192.168.1.2/24")
+	r, err := NewFromRoutes(
+		[]RouteEntry{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		},
+		[]net.Interface{{Index: 1, MTU: 1500, Name: "eth0"}},
+		map[int][]net.Addr{1: {&addr}},
+	)
+	if err != nil {
+		t.Fatalf("\ngot:\t%#v\nwant:\tnil\n\n", err)
+	}
+	if n := len(r.(DynamicRouter).Table().Routes()); n != 2 {
+		t.Errorf("\ngot:\t%d routes\nwant:\t2\n\n", n)
+	}
+	iface, gateway, _, err := r.Route(net.IPv4(8, 8, 8, 8))
+	if err != nil || iface.Name != "eth0" || !gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("\ngot:\t%v %v %v\nwant:\teth0 via 192.168.1.1\n\n", iface, gateway, err)
+	}
+}
+
+func TestPreferredSource(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	ethAddr6 := mustParseCIDR("2001:db8::2/64")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		{Dst: mustParseCIDR("2001:db8::/64"), OutputIface: 1},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+	}, map[int][]net.Addr{
+		1: {&ethAddr, &ethAddr6},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, tc := range []struct {
+		dst, want string
+	}{
+		{"8.8.8.8", "192.168.1.2"},
+		{"2001:db8::7", "2001:db8::2"},
+	} {
+		src, err := r.(EgressRouter).PreferredSource(net.ParseIP(tc.dst))
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		_, _, want, _ := r.Route(net.ParseIP(tc.dst))
+		if !src.Equal(net.ParseIP(tc.want)) || !src.Equal(want) {
+			t.Errorf("%s\ngot:	%v\nwant:	%v\n\n", tc.dst, src, tc.want)
+		}
+	}
+	if _, err := r.(EgressRouter).PreferredSource(net.ParseIP("2001:4860::8888")); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrNoRoute)
+	}
+}
+
+func TestIsMartian(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("198.51.100.0/24"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1},
+		{Dst: mustParseCIDR("fe80::/64"), OutputIface: 1},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+	}, map[int][]net.Addr{
+		1: {&ethAddr},
+	}, WithAllowedMartians(mustParseCIDR("198.18.0.0/15")))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, tc := range []struct {
+		dst  string
+		want bool
+	}{
+		{"8.8.8.8", false},
+		{"10.1.2.3", false},
+		{"0.1.2.3", true},
+		{"127.0.0.1", true},
+		{"169.254.1.1", true},
+		{"192.0.2.7", true},
+		{"255.255.255.255", true},
+		{"2001:db8::1", true},
+		{"::1", true},
+		{"2001:4860::8888", false},
+		// Routed by the table, or allowed.
+		{"198.51.100.7", false},
+		{"fe80::1", false},
+		{"198.18.0.1", false},
+	} {
+		if got := r.(EgressRouter).IsMartian(net.ParseIP(tc.dst)); got != tc.want {
+			t.Errorf("%s\ngot:	%v\nwant:	%v\n\n", tc.dst, got, tc.want)
+		}
+	}
+	if !r.(EgressRouter).IsMartian(nil) {
+		t.Errorf("\ngot:	false\nwant:	true for an invalid address\n\n")
+	}
+}
+
+// fixedResolver answers every lookup with the same addresses.
+type fixedResolver struct {
+	ips     []net.IP
+	lookups int
+}
+
+func (f *fixedResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	f.lookups++
+	return f.ips, nil
+}
+
+func TestHostRouteCache(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	p := &testProvider{
+		ifaces: []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}},
+		addrs:  map[int][]net.Addr{1: {&ethAddr}},
+		routes: []RouteEntry{{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1}},
+	}
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	resolver := &fixedResolver{ips: []net.IP{net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1)}}
+	c := NewHostRouteCache(r, resolver, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		res, err := c.Route(context.Background(), "example.com")
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if !res.Gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+			t.Errorf("\ngot:	%v\nwant:	192.168.1.1\n\n", res.Gateway)
+		}
+	}
+	if resolver.lookups != 1 {
+		t.Errorf("\ngot:	%d lookups\nwant:	1\n\n", resolver.lookups)
+	}
+
+	// A new table is used without resolving again.
+	p.routes[0].Gateway = net.IPv4(192, 168, 1, 254)
+	if err := r.(DynamicRouter).Refresh(); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if res, _ := c.Route(context.Background(), "example.com"); !res.Gateway.Equal(net.IPv4(192, 168, 1, 254)) || resolver.lookups != 1 {
+		t.Errorf("\ngot:	%v after %d lookups\nwant:	192.168.1.254 after 1\n\n", res.Gateway, resolver.lookups)
+	}
+
+	now = now.Add(time.Minute)
+	c.Route(context.Background(), "example.com")
+	if resolver.lookups != 2 {
+		t.Errorf("\ngot:	%d lookups\nwant:	2 once the TTL elapsed\n\n", resolver.lookups)
+	}
+}
+
+// coreRouter only implements the methods of Router, as the Routers of other
+// packages and mocks may.
+type coreRouter struct {
+	Router
+}
+
+func TestHostRouteCacheCoreRouter(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	p := &testProvider{
+		ifaces: []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}},
+		addrs:  map[int][]net.Addr{1: {&ethAddr}},
+		routes: []RouteEntry{{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1}},
+	}
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	resolver := &fixedResolver{ips: []net.IP{net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1)}}
+	c := NewHostRouteCache(coreRouter{r}, resolver, time.Minute)
+	res, err := c.Route(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if res.Iface == nil || res.Iface.Index != 1 || !res.Gateway.Equal(net.IPv4(192, 168, 1, 1)) || !res.PreferredSrc.Equal(ethAddr.IP) {
+		t.Errorf("\ngot:	%+v\nwant:	eth0 via 192.168.1.1 from 192.168.1.2\n\n", res)
+	}
+}
+
+// altNameProvider is a testProvider that knows alternative names.
+type altNameProvider struct {
+	testProvider
+	altNames map[int][]string
+}
+
+func (p *altNameProvider) AltNames() (map[int][]string, error) {
+	return p.altNames, nil
+}
+
+func TestInterfaceByName(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	p := &altNameProvider{
+		testProvider: testProvider{
+			ifaces: []net.Interface{
+				{Index: 1, MTU: 65536, Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+				{Index: 2, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			},
+			addrs:  map[int][]net.Addr{2: {&ethAddr}},
+			routes: []RouteEntry{{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 2}},
+		},
+		altNames: map[int][]string{2: {"enp0s31f6"}, 7: {"gone"}},
+	}
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, name := range []string{"eth0", "enp0s31f6"} {
+		iface, err := r.(DynamicRouter).Table().InterfaceByName(name)
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if iface.Index != 2 {
+			t.Errorf("%s\ngot:	%d\nwant:	2\n\n", name, iface.Index)
+		}
+		if res, err := r.(EgressRouter).RouteVia(iface, net.IPv4(8, 8, 8, 8)); err != nil || !res.Gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+			t.Errorf("%s\ngot:	%+v %v\nwant:	via 192.168.1.1\n\n", name, res, err)
+		}
+	}
+	if _, err := r.(DynamicRouter).Table().InterfaceByName("gone"); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for the altname of an unknown interface\n\n")
+	}
+}
+
+func TestNextHopTargets(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		{Dst: mustParseCIDR("192.168.1.2/32"), OutputIface: 1, Scope: ScopeHost},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+	}, map[int][]net.Addr{
+		1: {&ethAddr},
+	})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	targets, err := r.(LinkRouter).NextHopTargets([]net.IP{
+		net.IPv4(8, 8, 8, 8),
+		net.IPv4(192, 168, 1, 7),
+		net.IPv4(1, 1, 1, 1),
+		net.IPv4(192, 168, 1, 2),
+		net.ParseIP("2001:db8::1"),
+		net.IPv4(192, 168, 1, 7),
+	})
+	if !errors.Is(err, ErrNoRoute) {
+		t.Errorf("\ngot:	%v\nwant:	%v for the IPv6 destination\n\n", err, ErrNoRoute)
+	}
+	want := []net.IP{net.IPv4(192, 168, 1, 1), net.IPv4(192, 168, 1, 7)}
+	if len(targets) != len(want) {
+		t.Fatalf("\ngot:	%+v\nwant:	%v\n\n", targets, want)
+	}
+	for i, target := range targets {
+		if !target.IP.Equal(want[i]) || target.Iface.Name != "eth0" {
+			t.Errorf("\ngot:	%v on %v\nwant:	%v on eth0\n\n", target.IP, target.Iface, want[i])
+		}
+	}
+}
+
+func TestSourceProvider(t *testing.T) {
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+	}, nil)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if got := r.(DynamicRouter).Table().Source(); got != SourceProvider {
+		t.Errorf("\ngot:	%q\nwant:	%q\n\n", got, SourceProvider)
+	}
+}
+
+func TestUnspecifiedDestination(t *testing.T) {
+	routes := []RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+	}
+	ifaces := []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}}
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	addrs := map[int][]net.Addr{1: {&ethAddr}}
+
+	r, err := NewFromRoutes(routes, ifaces, addrs)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	for _, dst := range []net.IP{net.IPv4zero, net.IPv6unspecified} {
+		if _, _, _, err := r.Route(dst); !errors.Is(err, ErrUnspecifiedDestination) {
+			t.Errorf("%v\ngot:	%v\nwant:	%v\n\n", dst, err, ErrUnspecifiedDestination)
+		}
+	}
+	if _, err := r.(DynamicRouter).Table().RouteAll(net.IPv4zero); !errors.Is(err, ErrUnspecifiedDestination) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrUnspecifiedDestination)
+	}
+	if iface, _, err := r.(EgressRouter).PrimaryInterface(); err != nil || iface.Name != "eth0" {
+		t.Errorf("\ngot:	%v %v\nwant:	eth0\n\n", iface, err)
+	}
+
+	r, err = NewFromRoutes(routes, ifaces, addrs, WithUnspecifiedDestination())
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, gw, _, err := r.Route(net.IPv4zero); err != nil || !gw.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("\ngot:	%v %v\nwant:	via 192.168.1.1\n\n", gw, err)
+	}
+}
+
+func TestRouteForPrefix(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		{Dst: mustParseCIDR("10.0.0.0/8"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1},
+		{Dst: mustParseCIDR("10.1.0.0/16"), Gateway: net.IPv4(192, 168, 1, 253), OutputIface: 1},
+		{Dst: mustParseCIDR("10.2.0.0/16"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+	}, map[int][]net.Addr{1: {&ethAddr}})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, test := range []struct {
+		prefix string
+		want   string
+		err    error
+	}{
+		{"192.168.1.128/25", "192.168.1.0/24", nil},
+		{"10.2.0.0/15", "10.0.0.0/8", nil},
+		{"10.3.0.0/16", "10.0.0.0/8", nil},
+		{"172.16.0.0/12", "0.0.0.0/0", nil},
+		{"10.0.0.0/8", "", ErrPrefixSplit},
+		{"0.0.0.0/0", "", ErrPrefixSplit},
+	} {
+		rt, err := r.(DynamicRouter).Table().RouteForPrefix(mustParseCIDR(test.prefix))
+		if !errors.Is(err, test.err) || test.err == nil && rt.Dst.String() != test.want {
+			t.Errorf("%s\ngot:	%v %v\nwant:	%s %v\n\n", test.prefix, rt.Dst.String(), err, test.want, test.err)
+		}
+	}
+	if _, err := r.(DynamicRouter).Table().RouteForPrefix(mustParseCIDR("2001:db8::/32")); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrNoRoute)
+	}
+}
+
+func TestSetTable(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	ifaces := []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}}
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+	}, ifaces, map[int][]net.Addr{1: {&ethAddr}})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	gen := r.(DynamicRouter).Generation()
+
+	err = r.(DynamicRouter).SetTable([]RouteEntry{
+		{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+		{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1},
+	}, []*net.Interface{&ifaces[0]})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if got := r.(DynamicRouter).Generation(); got != gen+1 {
+		t.Errorf("\ngot:	%d\nwant:	%d\n\n", got, gen+1)
+	}
+	_, gw, src, err := r.Route(net.IPv4(8, 8, 8, 8))
+	if err != nil || !gw.Equal(net.IPv4(192, 168, 1, 254)) || !src.Equal(net.IPv4(192, 168, 1, 2)) {
+		t.Errorf("\ngot:	%v %v %v\nwant:	via 192.168.1.254 from 192.168.1.2\n\n", gw, src, err)
+	}
+
+	if err := r.(DynamicRouter).SetTable(nil, []*net.Interface{&ifaces[0], &ifaces[0]}); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for a duplicated index\n\n")
+	}
+	if err := r.(DynamicRouter).SetTable(nil, []*net.Interface{&ifaces[0], nil}); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for a nil interface\n\n")
+	}
+	if _, gw, _, _ := r.Route(net.IPv4(8, 8, 8, 8)); !gw.Equal(net.IPv4(192, 168, 1, 254)) {
+		t.Errorf("\ngot:	%v\nwant:	table kept after a failed SetTable\n\n", gw)
+	}
+}
+
+func TestRoutePreference(t *testing.T) {
+	ethAddr := mustParseCIDR("2001:db8:1::2/64")
+	r, err := NewFromRoutes([]RouteEntry{
+		{Dst: mustParseCIDR("2001:db8:2::/64"), Gateway: net.ParseIP("fe80::2"), OutputIface: 1, Priority: 1024},
+		{Dst: mustParseCIDR("::/0"), Gateway: net.ParseIP("fe80::1"), OutputIface: 1, Priority: 1024, Preference: PreferenceHigh},
+		{Dst: mustParseCIDR("::/0"), Gateway: net.ParseIP("fe80::3"), OutputIface: 1, Priority: 100, Preference: PreferenceLow},
+		{Dst: mustParseCIDR("2001:db8:1::/64"), OutputIface: 1, Priority: 256},
+		{Dst: mustParseCIDR("2001:db8:3::/64"), Gateway: net.ParseIP("fe80::4"), OutputIface: 1, Priority: 1024, Preference: PreferenceLow},
+		{Dst: mustParseCIDR("2001:db8:3::/64"), Gateway: net.ParseIP("fe80::5"), OutputIface: 1, Priority: 1024, Preference: PreferenceHigh},
+	}, []net.Interface{
+		{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+	}, map[int][]net.Addr{1: {&ethAddr}})
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, test := range []struct {
+		dst, gateway string
+	}{
+		// The more specific medium preference route wins in its prefix.
+		{"2001:db8:2::1", "fe80::2"},
+		// The low preference default route wins over the high preference
+		// one with a worse metric, as in Linux.
+		{"2001:4860:4860::8888", "fe80::3"},
+		// Preference breaks the tie between routes of the same metric.
+		{"2001:db8:3::1", "fe80::5"},
+	} {
+		_, gw, _, err := r.Route(net.ParseIP(test.dst))
+		if err != nil || gw.String() != test.gateway {
+			t.Errorf("%s\ngot:	%v %v\nwant:	%s\n\n", test.dst, gw, err, test.gateway)
+		}
+	}
+}
+
+func TestIsAsymmetric(t *testing.T) {
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			1: {Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			2: {Index: 2, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			1: {v4: []net.IPNet{mustParseCIDR("192.168.1.2/24")}},
+			2: {v4: []net.IPNet{mustParseCIDR("192.168.2.2/24")}},
+		},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1, Table: TableMain},
+			{Dst: mustParseCIDR("192.168.2.0/24"), OutputIface: 2, Table: TableMain},
+			{Dst: mustParseCIDR("10.1.0.0/16"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Table: TableMain},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 2, 1), OutputIface: 2, Table: TableMain},
+			{Dst: mustParseCIDR("10.9.0.0/16"), Type: TypeLocal, Table: TableMain},
+			{Dst: mustParseCIDR("192.168.1.2/32"), Type: TypeLocal, OutputIface: 1, Table: TableMain},
+			{Dst: mustParseCIDR("192.168.2.2/32"), Type: TypeLocal, OutputIface: 2, Table: TableMain},
+		},
+		tables: map[uint32]tableRoutes{
+			100: {v4: routeSlice{
+				{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 2, 1), OutputIface: 2, Table: 100},
+			}},
+		},
+		rules: []Rule{
+			{Family: FamilyV4, Priority: 100, Src: mustParseCIDR("10.1.0.0/16"), Action: RuleLookup, Table: 100},
+		},
+	}}
+	sort.Sort(r.v4)
+
+	for _, test := range []struct {
+		src, dst   net.IP
+		asymmetric bool
+		forward    string
+		reverse    string
+	}{
+		// Sent by the rule to eth1, while the replies go to eth0.
+		{net.IPv4(10, 1, 0, 5), net.IPv4(8, 8, 8, 8), true, "eth1", "eth0"},
+		{net.IPv4(192, 168, 2, 7), net.IPv4(8, 8, 8, 8), false, "eth1", "eth1"},
+	} {
+		asymmetric, forward, reverse, err := r.IsAsymmetric(test.src, test.dst)
+		if err != nil {
+			t.Fatalf("%v -> %v\ngot:	%#v\nwant:	nil\n\n", test.src, test.dst, err)
+		}
+		if asymmetric != test.asymmetric || forward.Iface.Name != test.forward || reverse.Iface.Name != test.reverse {
+			t.Errorf("%v -> %v\ngot:	%v %s %s\nwant:	%v %s %s\n\n", test.src, test.dst,
+				asymmetric, forward.Iface.Name, reverse.Iface.Name, test.asymmetric, test.forward, test.reverse)
+		}
+	}
+
+	// The replies to a flow from a local address are delivered to the
+	// host, and expected on the interface holding that address.
+	for _, test := range []struct {
+		src, dst   net.IP
+		asymmetric bool
+	}{
+		{net.IPv4(192, 168, 2, 2), net.IPv4(8, 8, 8, 8), false},
+		{net.IPv4(192, 168, 1, 2), net.IPv4(8, 8, 8, 8), true},
+		{net.IPv4(8, 8, 8, 8), net.IPv4(192, 168, 1, 2), true},
+		{net.IPv4(192, 168, 1, 2), net.IPv4(192, 168, 1, 7), false},
+		// No interface holds the addresses of 10.9.0.0/16.
+		{net.IPv4(10, 9, 0, 5), net.IPv4(192, 168, 2, 7), false},
+	} {
+		asymmetric, forward, reverse, err := r.IsAsymmetric(test.src, test.dst)
+		if err != nil {
+			t.Fatalf("%v -> %v\ngot:\t%#v\nwant:\tnil\n\n", test.src, test.dst, err)
+		}
+		if asymmetric != test.asymmetric || !forward.IsLocal && !reverse.IsLocal {
+			t.Errorf("%v -> %v\ngot:\t%v %+v %+v\nwant:\t%v, with a local result\n\n", test.src, test.dst,
+				asymmetric, forward, reverse, test.asymmetric)
+		}
+	}
+}
+
+type multicastProvider struct {
+	testProvider
+	multicast []MulticastEntry
+}
+
+func (p *multicastProvider) MulticastRoutes(family AddressFamily) ([]MulticastEntry, error) {
+	return p.multicast, nil
+}
+
+func TestMulticastRoute(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	p := &multicastProvider{
+		testProvider: testProvider{
+			ifaces: []net.Interface{
+				{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp | net.FlagMulticast},
+				{Index: 2, MTU: 1500, Name: "eth1", Flags: net.FlagUp | net.FlagMulticast},
+				{Index: 3, MTU: 1500, Name: "eth2", Flags: net.FlagUp | net.FlagMulticast},
+			},
+			addrs:  map[int][]net.Addr{1: {&ethAddr}},
+			routes: []RouteEntry{{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1}},
+		},
+		multicast: []MulticastEntry{
+			{Source: net.IPv4zero.To4(), Group: net.IPv4(239, 1, 1, 1).To4(), InputIface: 1, OutputIfaces: []int{2, 3}},
+			{Source: net.IPv4(192, 168, 1, 10).To4(), Group: net.IPv4(239, 1, 1, 1).To4(), InputIface: 1, OutputIfaces: []int{2}},
+		},
+	}
+
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, err := r.(DynamicRouter).Table().MulticastRoute(net.IPv4(239, 1, 1, 1), nil); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("\ngot:	%v\nwant:	%v without WithMulticastRoutes\n\n", err, ErrNoRoute)
+	}
+
+	r, err = New(WithProvider(p), WithMulticastRoutes())
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	for _, test := range []struct {
+		source net.IP
+		want   []int
+	}{
+		{net.IPv4(192, 168, 1, 10), []int{2}},
+		{net.IPv4(192, 168, 1, 11), []int{2, 3}},
+		{nil, []int{2, 3}},
+	} {
+		mr, err := r.(DynamicRouter).Table().MulticastRoute(net.IPv4(239, 1, 1, 1), test.source)
+		if err != nil {
+			t.Fatalf("%v\ngot:	%#v\nwant:	nil\n\n", test.source, err)
+		}
+		if !reflect.DeepEqual(mr.OutputIfaces, test.want) {
+			t.Errorf("%v\ngot:	%v\nwant:	%v\n\n", test.source, mr.OutputIfaces, test.want)
+		}
+	}
+	if _, err := r.(DynamicRouter).Table().MulticastRoute(net.IPv4(239, 2, 2, 2), nil); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrNoRoute)
+	}
+	if _, err := r.(DynamicRouter).Table().MulticastRoute(net.IPv4(192, 168, 1, 10), nil); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error for a unicast group\n\n")
+	}
+}
+
+type neighborProvider struct {
+	testProvider
+	neighbors map[string]net.HardwareAddr // by ifindex/ip
+}
+
+func (p *neighborProvider) Neighbor(ip net.IP, ifindex int) (net.HardwareAddr, error) {
+	if mac, ok := p.neighbors[fmt.Sprintf("%d/%v", ifindex, ip)]; ok {
+		return mac, nil
+	}
+	return nil, fmt.Errorf("%w for %v", ErrNeighborUnresolved, ip)
+}
+
+func TestGatewayNeighbor(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	gwMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	hostMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 7}
+	tp := testProvider{
+		ifaces: []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}},
+		addrs:  map[int][]net.Addr{1: {&ethAddr}},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+		},
+	}
+	r, err := New(WithProvider(&neighborProvider{
+		testProvider: tp,
+		neighbors: map[string]net.HardwareAddr{
+			"1/192.168.1.1": gwMAC,
+			"1/192.168.1.7": hostMAC,
+		},
+	}))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	for _, test := range []struct {
+		dst  net.IP
+		want net.HardwareAddr
+	}{
+		{net.IPv4(8, 8, 8, 8), gwMAC},
+		{net.IPv4(192, 168, 1, 7), hostMAC},
+	} {
+		mac, err := r.(LinkRouter).GatewayNeighbor(test.dst)
+		if err != nil || mac.String() != test.want.String() {
+			t.Errorf("%v\ngot:	%v %v\nwant:	%v\n\n", test.dst, mac, err, test.want)
+		}
+	}
+	if _, err := r.(LinkRouter).GatewayNeighbor(net.IPv4(192, 168, 1, 8)); !errors.Is(err, ErrNeighborUnresolved) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrNeighborUnresolved)
+	}
+
+	r, err = New(WithProvider(&tp))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, err := r.(LinkRouter).GatewayNeighbor(net.IPv4(8, 8, 8, 8)); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	error without a neighbor table\n\n")
+	}
+}
+
+func TestPacketHeaders(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	ethMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	gwMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	r, err := New(WithProvider(&neighborProvider{
+		testProvider: testProvider{
+			ifaces: []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", HardwareAddr: ethMAC, Flags: net.FlagUp}},
+			addrs:  map[int][]net.Addr{1: {&ethAddr}},
+			routes: []RouteEntry{
+				{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+				{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+				{Dst: mustParseCIDR("10.9.0.0/16"), Type: TypeLocal},
+			},
+		},
+		neighbors: map[string]net.HardwareAddr{"1/192.168.1.1": gwMAC},
+	}))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	h, err := r.(LinkRouter).PacketHeaders(net.IPv4(8, 8, 8, 8))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if h.Iface.Name != "eth0" || h.IPv6 != nil || !h.IPv4.SrcIP.Equal(net.IPv4(192, 168, 1, 2)) {
+		t.Errorf("\ngot:	%+v\nwant:	IPv4 headers from 192.168.1.2 on eth0\n\n", h)
+	}
+	h.IPv4.Protocol = layers.IPProtocolUDP
+	udp := &layers.UDP{SrcPort: 4000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(h.IPv4)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, h.Layers(udp)...); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	p := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	eth, _ := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip, _ := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if eth == nil || ip == nil || eth.SrcMAC.String() != ethMAC.String() || eth.DstMAC.String() != gwMAC.String() || !ip.DstIP.Equal(net.IPv4(8, 8, 8, 8)) {
+		t.Errorf("\ngot:	%v\nwant:	%v > %v, to 8.8.8.8\n\n", p, ethMAC, gwMAC)
+	}
+
+	// An unresolved next hop leaves the destination MAC zero.
+	h, err = r.(LinkRouter).PacketHeaders(net.IPv4(192, 168, 1, 7))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if h.Ethernet.DstMAC.String() != "00:00:00:00:00:00" {
+		t.Errorf("\ngot:	%v\nwant:	00:00:00:00:00:00\n\n", h.Ethernet.DstMAC)
+	}
+
+	// Local routes need not have an output interface to send through.
+	if _, err := r.(LinkRouter).PacketHeaders(net.IPv4(10, 9, 1, 1)); !errors.Is(err, ErrOutputNotFound) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrOutputNotFound)
+	}
+}
+
+// slowProvider is a testProvider whose Routes blocks until release is
+// closed.
+type slowProvider struct {
+	testProvider
+	release chan struct{}
+	loads   atomic.Int32 // calls to Routes
+}
+
+func (p *slowProvider) Routes(family AddressFamily) ([]RouteEntry, error) {
+	p.loads.Add(1)
+	<-p.release
+	return p.testProvider.Routes(family)
+}
+
+func TestLoadTimeout(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	p := &slowProvider{
+		testProvider: testProvider{
+			ifaces: []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}},
+			addrs:  map[int][]net.Addr{1: {&ethAddr}},
+			routes: []RouteEntry{{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1}},
+		},
+		release: make(chan struct{}),
+	}
+	if _, err := New(WithProvider(p), WithLoadTimeout(10*time.Millisecond)); !errors.Is(err, ErrLoadTimeout) {
+		t.Fatalf("\ngot:	%v\nwant:	%v\n\n", err, ErrLoadTimeout)
+	}
+
+	close(p.release)
+	r, err := New(WithProvider(p), WithLoadTimeout(time.Minute))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if iface, _, _, err := r.Route(net.IPv4(192, 168, 1, 7)); err != nil || iface.Name != "eth0" {
+		t.Errorf("\ngot:	%v %v\nwant:	eth0 nil\n\n", iface, err)
+	}
+
+	// The Refreshes after a timeout wait for the load still running rather
+	// than starting others.
+	p = &slowProvider{testProvider: p.testProvider, release: p.release}
+	r, err = New(WithProvider(p), WithLoadTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	p.release = make(chan struct{})
+	for i := 0; i < 3; i++ {
+		if err := r.(DynamicRouter).Refresh(); !errors.Is(err, ErrLoadTimeout) {
+			t.Fatalf("\ngot:	%v\nwant:	%v\n\n", err, ErrLoadTimeout)
+		}
+	}
+	close(p.release)
+	r.(*router).loadTimeout = time.Minute
+	if err := r.(DynamicRouter).Refresh(); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if n := p.loads.Load(); n != 2 {
+		t.Errorf("\ngot:	%d loads\nwant:	2, that of New and one for the Refreshes\n\n", n)
+	}
+}
+
+// changingProvider is a testProvider whose table is replaced by next once
+// Addrs has been entered, and whose Addrs then blocks until release is
+// closed.
+type changingProvider struct {
+	testProvider
+	mu      sync.Mutex
+	next    *testProvider
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (p *changingProvider) current() *testProvider {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &p.testProvider
+}
+
+func (p *changingProvider) Interfaces() ([]net.Interface, error) {
+	return p.current().Interfaces()
+}
+
+func (p *changingProvider) Routes(family AddressFamily) ([]RouteEntry, error) {
+	return p.current().Routes(family)
+}
+
+func (p *changingProvider) Addrs(iface *net.Interface) ([]net.Addr, error) {
+	p.mu.Lock()
+	next := p.next
+	if next != nil {
+		p.testProvider, p.next = *next, nil
+	}
+	p.mu.Unlock()
+	if next != nil {
+		close(p.entered)
+		<-p.release
+	}
+	return p.current().Addrs(iface)
+}
+
+func TestRefreshAddrsDuringRefresh(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	wgAddr := mustParseCIDR("10.64.0.2/24")
+	p := &changingProvider{
+		testProvider: testProvider{
+			ifaces: []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}},
+			addrs:  map[int][]net.Addr{1: {&ethAddr}},
+			routes: []RouteEntry{{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1}},
+		},
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	// An interface comes up while RefreshAddrs reads the addresses of the
+	// old ones, and Refresh loads it.
+	p.next = &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			{Index: 2, MTU: 1420, Name: "wg0", Flags: net.FlagUp},
+		},
+		addrs: map[int][]net.Addr{1: {&ethAddr}, 2: {&wgAddr}},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("10.64.0.0/24"), OutputIface: 2},
+		},
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- r.(DynamicRouter).RefreshAddrs() }()
+	<-p.entered
+	go func() { errs <- r.(DynamicRouter).Refresh() }()
+	time.Sleep(10 * time.Millisecond)
+	close(p.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+	}
+
+	res, err := r.(EgressRouter).RouteGet(nil, nil, net.IPv4(10, 64, 0, 1))
+	if err != nil || res.Iface.Name != "wg0" || !res.PreferredSrc.Equal(net.IPv4(10, 64, 0, 2)) {
+		t.Errorf("\ngot:	%+v %v\nwant:	wg0 from 10.64.0.2\n\n", res, err)
+	}
+}
+
+// masterProvider is a testProvider that also knows the masters of enslaved
+// interfaces.
+type masterProvider struct {
+	testProvider
+	masters map[int]int
+}
+
+func (p *masterProvider) Masters() (map[int]int, error) {
+	return p.masters, nil
+}
+
+func TestMasterInterfaces(t *testing.T) {
+	bondAddr := mustParseCIDR("192.168.1.2/24")
+	p := &masterProvider{
+		testProvider: testProvider{
+			ifaces: []net.Interface{
+				{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+				{Index: 2, MTU: 1500, Name: "eth1", Flags: net.FlagUp},
+				{Index: 3, MTU: 9000, Name: "bond0", Flags: net.FlagUp},
+			},
+			addrs: map[int][]net.Addr{3: {&bondAddr}},
+			routes: []RouteEntry{
+				{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 3},
+				// A route bound to a slave, whose source is an address
+				// of the bond.
+				{Dst: mustParseCIDR("10.0.0.0/8"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+			},
+		},
+		masters: map[int]int{1: 3, 2: 3},
+	}
+	for _, tc := range []struct {
+		opts  []Option
+		iface string
+	}{
+		{nil, "bond0"},
+		{[]Option{WithSlaveInterfaces()}, "eth0"},
+	} {
+		r, err := New(append(tc.opts, WithProvider(p))...)
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		res, err := r.(EgressRouter).RouteGet(nil, nil, net.IPv4(10, 1, 2, 3))
+		if err != nil || res.Iface.Name != tc.iface || !res.PreferredSrc.Equal(net.IPv4(192, 168, 1, 2)) {
+			t.Errorf("\ngot:	%+v %v\nwant:	%s from 192.168.1.2\n\n", res, err, tc.iface)
+		}
+		if _, err := r.(EgressRouter).RouteVia(&p.ifaces[0], net.IPv4(10, 1, 2, 3)); err != nil {
+			t.Errorf("\ngot:	%v\nwant:	nil for the route via eth0\n\n", err)
+		}
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	ethAddr := mustParseCIDR("192.168.1.2/24")
+	r, err := New(WithProvider(&testProvider{
+		ifaces: []net.Interface{{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp}},
+		addrs:  map[int][]net.Addr{1: {&ethAddr}},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+			{Dst: mustParseCIDR("10.0.0.0/8"), Type: TypeBlackhole},
+		},
+	}), WithFamily(FamilyV4))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if err := r.(DynamicRouter).Table().SelfCheck(); err != nil {
+		t.Errorf("\ngot:	%v\nwant:	nil\n\n", err)
+	}
+
+	tab := &RouteTable{
+		ifaces: map[int]*net.Interface{1: {Index: 1, Name: "eth0"}},
+		addrs: map[int]ipAddrs{1: {v4: []net.IPNet{
+			ethAddr,
+			{IP: net.IPv4(192, 168, 2, 2).To4(), Mask: net.IPv4Mask(255, 0, 255, 0)},
+		}}},
+		v4: routeSlice{
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+			{Dst: mustParseCIDR("172.16.0.0/12"), OutputIface: 7},
+			{Dst: mustParseCIDR("172.32.0.0/12")},
+			{Dst: mustParseCIDR("172.48.0.0/12"), Gateway: net.ParseIP("2001:db8::1"), OutputIface: 1},
+		},
+	}
+	err = tab.SelfCheck()
+	for _, want := range []string{
+		"output interface not found: 7",
+		"172.32.0.0/12: neither output interface nor gateway",
+		"gateway 2001:db8::1 is not an IPv4 address",
+		"address 192.168.2.2/ff00ff00 of eth0: mask ff00ff00 is not contiguous",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("\ngot:	%v\nwant:	%q\n\n", err, want)
+		}
+	}
+	if !errors.Is(err, ErrOutputNotFound) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrOutputNotFound)
+	}
+	if !errors.Is(err, ErrNoDefaultRoute) || !strings.Contains(err.Error(), "no default route for IPv6") {
+		t.Errorf("\ngot:	%v\nwant:	%v for IPv6\n\n", err, ErrNoDefaultRoute)
+	}
+	if strings.Contains(err.Error(), "no default route for IPv4") {
+		t.Errorf("\ngot:	%v\nwant:	the IPv4 default route found\n\n", err)
+	}
+}
+
+func TestSubnetCache(t *testing.T) {
+	eth0Addr := mustParseCIDR("192.168.1.2/24")
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+		},
+		addrs: map[int][]net.Addr{
+			1: {&eth0Addr},
+		},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1},
+			{Dst: mustParseCIDR("198.51.100.64/26"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1},
+		},
+	}
+	r, err := New(WithProvider(p), WithStats(), WithSubnetCache())
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	for _, tc := range []struct {
+		dst, gateway net.IP
+		cacheHits    uint64
+	}{
+		{net.IPv4(192, 168, 1, 9), net.IPv4(192, 168, 1, 9), 0},
+		// The gateway of an on-link result is the destination itself.
+		{net.IPv4(192, 168, 1, 10), net.IPv4(192, 168, 1, 10), 1},
+		{net.IPv4(203, 0, 113, 1), net.IPv4(192, 168, 1, 1), 1},
+		{net.IPv4(203, 0, 113, 2), net.IPv4(192, 168, 1, 1), 2},
+		// The /26 splits its /24, which is then never cached.
+		{net.IPv4(198, 51, 100, 65), net.IPv4(192, 168, 1, 254), 2},
+		{net.IPv4(198, 51, 100, 1), net.IPv4(192, 168, 1, 1), 2},
+		{net.IPv4(198, 51, 100, 66), net.IPv4(192, 168, 1, 254), 2},
+	} {
+		_, gateway, _, err := r.Route(tc.dst)
+		if err != nil {
+			t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+		}
+		if !gateway.Equal(tc.gateway) {
+			t.Errorf("%v\ngot:	%v\nwant:	%v\n\n", tc.dst, gateway, tc.gateway)
+		}
+		if st := r.(DynamicRouter).Stats(); st.CacheHits != tc.cacheHits {
+			t.Errorf("%v\ngot:	%d cache hits\nwant:	%d\n\n", tc.dst, st.CacheHits, tc.cacheHits)
+		}
+	}
+
+	// The unspecified address is not routed, even once another address of
+	// its network is cached.
+	if _, _, _, err := r.Route(net.IPv4(0, 0, 0, 1)); err != nil {
+		t.Fatalf("\ngot:\t%#v\nwant:\tnil\n\n", err)
+	}
+	if _, _, _, err := r.Route(net.IPv4(0, 0, 0, 0)); !errors.Is(err, ErrUnspecifiedDestination) {
+		t.Errorf("\ngot:\t%v\nwant:\t%v\n\n", err, ErrUnspecifiedDestination)
+	}
+
+	// A new table empties the cache.
+	p.routes = p.routes[:1]
+	if err := r.(DynamicRouter).Refresh(); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if _, _, _, err := r.Route(net.IPv4(203, 0, 113, 3)); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrNoRoute)
+	}
+}
+
+func TestSaveLoadSnapshot(t *testing.T) {
+	eth0Addr := mustParseCIDR("192.168.1.2/24")
+	p := &masterProvider{
+		testProvider: testProvider{
+			ifaces: []net.Interface{
+				{Index: 1, MTU: 1500, Name: "eth0", HardwareAddr: net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55}, Flags: net.FlagUp},
+				{Index: 2, MTU: 1500, Name: "bond0", Flags: net.FlagUp},
+			},
+			addrs: map[int][]net.Addr{
+				1: {
+					&eth0Addr,
+					&InterfaceAddr{IPNet: mustParseCIDR("192.168.1.3/24"), Flags: AddrSecondary},
+					&InterfaceAddr{IPNet: mustParseCIDR("2001:db8::2/64")},
+				},
+			},
+			routes: []RouteEntry{
+				{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1, Protocol: ProtocolKernel, Scope: ScopeLink},
+				{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Priority: 100, Metrics: map[int]uint32{2: 1400}},
+				{Dst: mustParseCIDR("2001:db8::/64"), OutputIface: 1, Weight: 2},
+				{Dst: mustParseCIDR("10.0.0.0/8"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1, Table: 100},
+			},
+		},
+		masters: map[int]int{1: 2},
+	}
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	var saved bytes.Buffer
+	if err := r.(DynamicRouter).Table().SaveSnapshot(&saved); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	loaded, err := LoadSnapshot(bytes.NewReader(saved.Bytes()))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if got, want := loaded.(DynamicRouter).Table().Routes(), r.(DynamicRouter).Table().Routes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot:	%+v\nwant:	%+v\n\n", got, want)
+	}
+	if got, want := loaded.(DynamicRouter).Table().Interfaces(), r.(DynamicRouter).Table().Interfaces(); !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot:	%+v\nwant:	%+v\n\n", got, want)
+	}
+	for _, dst := range []net.IP{net.IPv4(192, 168, 1, 9), net.IPv4(203, 0, 113, 1), net.ParseIP("2001:db8::9")} {
+		got, gotErr := loaded.(EgressRouter).RouteGet(nil, nil, dst)
+		want, wantErr := r.(EgressRouter).RouteGet(nil, nil, dst)
+		if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(gotErr, wantErr) {
+			t.Errorf("%v\ngot:	%+v %v\nwant:	%+v %v\n\n", dst, got, gotErr, want, wantErr)
+		}
+	}
+	var again bytes.Buffer
+	if err := loaded.(DynamicRouter).Table().SaveSnapshot(&again); err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if again.String() != saved.String() {
+		t.Errorf("\ngot:	%s\nwant:	%s\n\n", again.String(), saved.String())
+	}
+
+	// Policy rules are loaded too.
+	const ruled = `{"Version": 1,
+		"Interfaces": [{"Index": 1, "MTU": 1500, "Name": "eth0", "Flags": 1, "Addrs": [{"Addr": "192.168.1.2/24"}]}],
+		"Routes": [{"Dst": "10.0.0.0/8", "Src": "0.0.0.0/0", "OutputIface": 1, "Gateway": "192.168.1.254", "Table": 100}],
+		"Rules": [{"Family": 1, "Priority": 10, "Dst": "10.0.0.0/8", "Action": 1, "Table": 100}]}`
+	loaded, err = LoadSnapshot(strings.NewReader(ruled))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if res, err := loaded.(PolicyRouter).RouteWithMark(0, nil, net.IPv4(10, 1, 2, 3)); err != nil || !res.Gateway.Equal(net.IPv4(192, 168, 1, 254)) {
+		t.Errorf("\ngot:	%v %v\nwant:	192.168.1.254\n\n", res.Gateway, err)
+	}
+
+	if _, err := LoadSnapshot(strings.NewReader(`{"Version": 2}`)); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	an unsupported version\n\n")
+	}
+}
+
+func TestShadowedRoutes(t *testing.T) {
+	eth0Addr := mustParseCIDR("192.168.1.2/24")
+	gw1, gw2 := net.IPv4(192, 168, 1, 1), net.IPv4(192, 168, 1, 254)
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			{Index: 2, MTU: 1400, Name: "tun0", Flags: net.FlagUp | net.FlagPointToPoint},
+		},
+		addrs: map[int][]net.Addr{
+			1: {&eth0Addr},
+		},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: gw1, OutputIface: 1, Priority: 100},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: gw2, OutputIface: 1, Priority: 200},
+			// A VPN taking over the default route.
+			{Dst: mustParseCIDR("0.0.0.0/1"), OutputIface: 2},
+			{Dst: mustParseCIDR("128.0.0.0/1"), OutputIface: 2},
+			// Half of 10.0.0.0/8 is covered unconditionally, the other
+			// half only from a source.
+			{Dst: mustParseCIDR("10.0.0.0/8"), Gateway: gw1, OutputIface: 1},
+			{Dst: mustParseCIDR("10.0.0.0/9"), Gateway: gw2, OutputIface: 1},
+			{Dst: mustParseCIDR("10.128.0.0/9"), Src: mustParseCIDR("192.168.1.0/24"), Gateway: gw2, OutputIface: 1},
+			// The nexthops of a multipath route.
+			{Dst: mustParseCIDR("172.16.0.0/12"), Gateway: gw1, OutputIface: 1, Weight: 1},
+			{Dst: mustParseCIDR("172.16.0.0/12"), Gateway: gw2, OutputIface: 1, Weight: 1},
+		},
+	}
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	var got []string
+	for _, pair := range r.(DynamicRouter).Table().ShadowedRoutes() {
+		got = append(got, fmt.Sprintf("%v via %v > %v via %v", &pair[0].Dst, pair[0].Gateway, &pair[1].Dst, pair[1].Gateway))
+	}
+	sort.Strings(got)
+	want := []string{
+		"0.0.0.0/0 via 192.168.1.1 > 0.0.0.0/0 via 192.168.1.254",
+		"0.0.0.0/1 via <nil> > 0.0.0.0/0 via 192.168.1.1",
+		"128.0.0.0/1 via <nil> > 0.0.0.0/0 via 192.168.1.1",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("\ngot:	%q\nwant:	%q\n\n", got, want)
+	}
+}
+
+func TestSubflowRoutes(t *testing.T) {
+	eth0Addr := mustParseCIDR("192.168.1.2/24")
+	wlan0Addr := mustParseCIDR("10.0.0.5/24")
+	p := &testProvider{
+		ifaces: []net.Interface{
+			{Index: 1, MTU: 1500, Name: "eth0", Flags: net.FlagUp},
+			{Index: 2, MTU: 1500, Name: "wlan0", Flags: net.FlagUp},
+			{Index: 3, MTU: 1500, Name: "wwan0"},
+		},
+		addrs: map[int][]net.Addr{
+			1: {&eth0Addr},
+			2: {&wlan0Addr},
+		},
+		routes: []RouteEntry{
+			{Dst: mustParseCIDR("192.168.1.0/24"), OutputIface: 1},
+			{Dst: mustParseCIDR("10.0.0.0/24"), OutputIface: 2},
+			{Dst: mustParseCIDR("203.0.113.0/24"), Gateway: net.IPv4(192, 168, 1, 254), OutputIface: 1, Priority: 1000},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(192, 168, 1, 1), OutputIface: 1, Priority: 100},
+			{Dst: mustParseCIDR("0.0.0.0/0"), Gateway: net.IPv4(10, 0, 0, 1), OutputIface: 2, Priority: 600},
+			// Interface down.
+			{Dst: mustParseCIDR("0.0.0.0/0"), OutputIface: 3, Priority: 700},
+			{Dst: mustParseCIDR("198.51.100.0/24"), OutputIface: 2, Type: TypeBlackhole},
+		},
+	}
+	r, err := New(WithProvider(p))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	for _, tc := range []struct {
+		dst  net.IP
+		want string
+	}{
+		// eth0 is reported with its most specific route.
+		{net.IPv4(203, 0, 113, 9), "[eth0 192.168.1.2 via 192.168.1.254 wlan0 10.0.0.5 via 10.0.0.1]"},
+		{net.IPv4(8, 8, 8, 8), "[eth0 192.168.1.2 via 192.168.1.1 wlan0 10.0.0.5 via 10.0.0.1]"},
+		{net.IPv4(10, 0, 0, 9), "[wlan0 10.0.0.5 via 10.0.0.9 eth0 192.168.1.2 via 192.168.1.1]"},
+	} {
+		results, err := r.(DynamicRouter).Table().SubflowRoutes(tc.dst)
+		if err != nil {
+			t.Fatalf("%v\ngot:	%#v\nwant:	nil\n\n", tc.dst, err)
+		}
+		var got []string
+		for _, res := range results {
+			got = append(got, fmt.Sprintf("%s %v via %v", res.Iface.Name, res.PreferredSrc, res.Gateway))
+		}
+		if s := fmt.Sprint(got); s != tc.want {
+			t.Errorf("%v\ngot:	%s\nwant:	%s\n\n", tc.dst, s, tc.want)
+		}
+	}
+	if _, err := r.(DynamicRouter).Table().SubflowRoutes(net.IPv4(198, 51, 100, 1)); !errors.Is(err, ErrRouteRejected) {
+		t.Errorf("\ngot:	%v\nwant:	%v\n\n", err, ErrRouteRejected)
+	}
+}
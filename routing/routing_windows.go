@@ -1,12 +1,15 @@
 package routing
 
 import (
+	"fmt"
 	"net"
-	"sort"
+	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
 )
 
 // Pulled from https://learn.microsoft.com/zh-cn/windows/win32/winsock/sockaddr-2
@@ -37,22 +40,22 @@ type ipAddressPrefix struct {
 
 // Pulled from https://learn.microsoft.com/zh-cn/windows/win32/api/netioapi/ns-netioapi-mib_ipforward_row2
 type mibIPForwardRow2 struct {
-    InterfaceLuid        uint64
-    InterfaceIndex       uint32
-    DestinationPrefix    ipAddressPrefix
+	InterfaceLuid        uint64
+	InterfaceIndex       uint32
+	DestinationPrefix    ipAddressPrefix
 	_                    [3]byte // To fix the problem caused by memory alignment
-    NextHop              sockaddrINet
-    SitePrefixLength     uint8
-    ValidLifetime        uint32
-    PreferredLifetime    uint32
-    Metric               uint32
-    Protocol             uint32
-    Loopback             bool
-    AutoconfigureAddress bool
-    Publish              bool
-    Immortal             bool
-    Age                  bool
-    Origin               uint32
+	NextHop              sockaddrINet
+	SitePrefixLength     uint8
+	ValidLifetime        uint32
+	PreferredLifetime    uint32
+	Metric               uint32
+	Protocol             uint32
+	Loopback             bool
+	AutoconfigureAddress bool
+	Publish              bool
+	Immortal             bool
+	Age                  uint32
+	Origin               uint32
 }
 
 // Pulled from https://learn.microsoft.com/zh-cn/windows/win32/api/netioapi/nf-netioapi-getipforwardtable2
@@ -61,59 +64,265 @@ type mibIPForwardRowTable2 struct {
 	Table      [1]mibIPForwardRow2 // It is [NumEntries]mibIPForwardRow2 in fact
 }
 
-func (r *router) setupRouteTable() error {
-	modIPhelperAPI := windows.NewLazySystemDLL("iphlpapi.dll")
-	procGetIpForwardTable2 := modIPhelperAPI.NewProc("GetIpForwardTable2")
-	procFreeMibTable := modIPhelperAPI.NewProc("FreeMibTable")
+var (
+	modIPhelperAPI         = windows.NewLazySystemDLL("iphlpapi.dll")
+	procGetIpForwardTable2 = modIPhelperAPI.NewProc("GetIpForwardTable2")
+	procFreeMibTable       = modIPhelperAPI.NewProc("FreeMibTable")
+)
 
+// systemRoutes reads the routes from GetIpForwardTable2.  Should it be
+// missing or fail for IPv4, the IPv4 routes are queried from WMI's
+// Win32_IP4RouteTable instead; it has no IPv6 counterpart.
+func systemRoutes(family int, nl netlinkConfig) (routes []RouteEntry, source string, err error) {
+	source = SourceIPHelper
+	if family == syscall.AF_UNSPEC || family == windows.AF_INET {
+		v4, err := getIPForwardTable(windows.AF_INET)
+		if err != nil {
+			var wmiErr error
+			if v4, wmiErr = getWMIRouteTable(); wmiErr != nil {
+				return nil, "", err
+			}
+			source = SourceWMI
+		}
+		routes = append(routes, v4...)
+	}
+	if family == syscall.AF_UNSPEC || family == windows.AF_INET6 {
+		v6, err := getIPForwardTable(windows.AF_INET6)
+		if err != nil {
+			return nil, "", err
+		}
+		routes = append(routes, v6...)
+	}
+	return routes, source, nil
+}
+
+// getIPForwardTable dumps the routes of a single address family.
+func getIPForwardTable(family uint16) ([]RouteEntry, error) {
 	var table *mibIPForwardRowTable2
-	result, _, err := procGetIpForwardTable2.Call(windows.AF_INET, uintptr(unsafe.Pointer(&table)))
+	result, _, err := procGetIpForwardTable2.Call(uintptr(family), uintptr(unsafe.Pointer(&table)))
 	if errno, ok := err.(syscall.Errno); ok && errno != 0 || !ok {
-		return err
+		return nil, err
 	}
 	if result != windows.NO_ERROR {
-		return syscall.Errno(result)
+		return nil, syscall.Errno(result)
 	}
 	defer procFreeMibTable.Call(uintptr(unsafe.Pointer(table)))
 
+	var persistent map[string]bool
+	if family == windows.AF_INET {
+		persistent = persistentRoutes()
+	}
+	var routes []RouteEntry
 	if table.NumEntries > 0 {
 		pFirstRow := unsafe.Pointer(&table.Table[0])
 		rowSize := unsafe.Sizeof(table.Table[0])
 
 		for i := uint32(0); i < table.NumEntries; i++ {
-			row := (*mibIPForwardRow2)(unsafe.Pointer(uintptr(pFirstRow) + rowSize * uintptr(i)))
-			routeInfo := rtInfo{
-				Src: net.IPNet{
-					IP: make([]byte, 4),
-					Mask: make([]byte, 4),
-				},
+			row := (*mibIPForwardRow2)(unsafe.Pointer(uintptr(pFirstRow) + rowSize*uintptr(i)))
+			rt := row.routeEntry(family)
+			if persistent[persistentKey(&rt)] {
+				rt.Flags |= RoutePersistent
 			}
+			routes = append(routes, rt)
+		}
+	}
+	return routes, nil
+}
 
-			dstAddr := make([]byte, 4)
-			copy(dstAddr, ((*sockaddrIN)(unsafe.Pointer(&row.DestinationPrefix.Prefix[0]))).SinAddr[:])
-			routeInfo.Dst = net.IPNet{
-				IP:   dstAddr,
-				Mask: net.CIDRMask(int(row.DestinationPrefix.PrefixLength), 32),
-			}
+// persistentRoutesKey holds the IPv4 routes added with "route -p", as values
+// named "destination,mask,gateway,metric".
+const persistentRoutesKey = `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters\PersistentRoutes`
 
-			routeInfo.OutputIface = int64(row.InterfaceIndex)
+// persistentRoutes returns the keys, as of persistentKey, of the persistent
+// IPv4 routes.  It returns nil if they can't be read.
+func persistentRoutes() map[string]bool {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, persistentRoutesKey, registry.QUERY_VALUE)
+	if err != nil {
+		return nil
+	}
+	defer k.Close()
+	names, err := k.ReadValueNames(0)
+	if err != nil {
+		return nil
+	}
+	return parsePersistentRoutes(names)
+}
 
-			gatewayAddr := make([]byte, 4)
-			copy(gatewayAddr, ((*sockaddrIN)(unsafe.Pointer(&row.NextHop[0]))).SinAddr[:])
-			routeInfo.Gateway = gatewayAddr
+// parsePersistentRoutes keys the value names of persistentRoutesKey by
+// destination, mask and gateway.  The metric is left out as the metric of
+// the installed route also counts that of the interface.
+func parsePersistentRoutes(names []string) map[string]bool {
+	keys := make(map[string]bool, len(names))
+	for _, name := range names {
+		fields := strings.Split(name, ",")
+		if len(fields) < 3 {
+			continue
+		}
+		dst, mask, gw := net.ParseIP(fields[0]), net.ParseIP(fields[1]).To4(), net.ParseIP(fields[2])
+		if dst == nil || mask == nil || gw == nil {
+			continue
+		}
+		keys[dst.String()+","+net.IP(mask).String()+","+gw.String()] = true
+	}
+	return keys
+}
 
-			routeInfo.Metrics = int64(row.Metric)
+// persistentKey returns the key of rt in the map of persistentRoutes.
+func persistentKey(rt *RouteEntry) string {
+	return rt.Dst.IP.String() + "," + net.IP(rt.Dst.Mask).String() + "," + rt.Gateway.String()
+}
 
-			r.v4 = append(r.v4, routeInfo)
-		}
+// routeEntry converts a forward table row of the given family.
+func (row *mibIPForwardRow2) routeEntry(family uint16) RouteEntry {
+	size := net.IPv4len
+	if family == windows.AF_INET6 {
+		size = net.IPv6len
+	}
+	routeInfo := RouteEntry{
+		Src: net.IPNet{
+			IP:   make([]byte, size),
+			Mask: make([]byte, size),
+		},
 	}
 
-	result, _, err = procGetIpForwardTable2.Call(windows.AF_INET6, uintptr(unsafe.Pointer(&table)))
-	if errno, ok := err.(syscall.Errno); ok && errno != 0 || !ok {
-		return err
+	dstAddr := make([]byte, size)
+	gatewayAddr := make([]byte, size)
+	var scopeID uint32
+	if family == windows.AF_INET6 {
+		nextHop := (*sockaddrIN6)(unsafe.Pointer(&row.NextHop[0]))
+		copy(dstAddr, ((*sockaddrIN6)(unsafe.Pointer(&row.DestinationPrefix.Prefix[0]))).Sin6Addr[:])
+		copy(gatewayAddr, nextHop.Sin6Addr[:])
+		scopeID = nextHop.Sin6ScopeId
+	} else {
+		copy(dstAddr, ((*sockaddrIN)(unsafe.Pointer(&row.DestinationPrefix.Prefix[0]))).SinAddr[:])
+		copy(gatewayAddr, ((*sockaddrIN)(unsafe.Pointer(&row.NextHop[0]))).SinAddr[:])
+	}
+	routeInfo.Dst = net.IPNet{
+		IP:   dstAddr,
+		Mask: net.CIDRMask(int(row.DestinationPrefix.PrefixLength), size*8),
+	}
+
+	routeInfo.OutputIface = int(row.InterfaceIndex)
+	if scopeID != 0 && net.IP(gatewayAddr).IsLinkLocalUnicast() {
+		// The scope of a link-local nexthop is the index of the interface
+		// it is reachable on.
+		routeInfo.OutputIface = int(scopeID)
+	}
+	routeInfo.Gateway = gatewayAddr
+	routeInfo.Priority = row.Metric
+	routeInfo.Protocol = originProtocol(row.Origin)
+	if !row.Immortal {
+		routeInfo.ValidLifetime = lifetime(row.ValidLifetime)
+		routeInfo.PreferredLifetime = lifetime(row.PreferredLifetime)
+	}
+	routeInfo.Age = time.Duration(row.Age) * time.Second
+	return routeInfo
+}
+
+// Pulled from https://learn.microsoft.com/en-us/windows/win32/api/nldef/ne-nldef-nl_route_origin
+const (
+	nlroManual              = 0
+	nlroWellKnown           = 1
+	nlroDHCP                = 2
+	nlroRouterAdvertisement = 3
+	nlro6to4                = 4
+)
+
+// originProtocol maps the NL_ROUTE_ORIGIN of a row to the protocol Linux
+// would report for a route installed the same way.
+func originProtocol(origin uint32) RouteProtocol {
+	switch origin {
+	case nlroManual:
+		return ProtocolStatic
+	case nlroWellKnown, nlro6to4:
+		return ProtocolKernel
+	case nlroDHCP:
+		return ProtocolDHCP
+	case nlroRouterAdvertisement:
+		return ProtocolRA
+	}
+	return ProtocolUnspec
+}
+
+// infiniteLifetime is the lifetime of a row that never expires.
+const infiniteLifetime = 0xffffffff
+
+// lifetime converts a lifetime of a row, in seconds, to the convention of
+// RouteEntry, where zero is forever.
+func lifetime(seconds uint32) time.Duration {
+	if seconds == infiniteLifetime {
+		return 0
 	}
+	return time.Duration(seconds) * time.Second
+}
+
+func systemInterfaces(nl netlinkConfig) ([]net.Interface, error) {
+	return net.Interfaces()
+}
+
+func systemAddrs(iface *net.Interface, nl netlinkConfig) ([]net.Addr, error) {
+	return iface.Addrs()
+}
+
+// systemAltNames returns no names: interfaces only have alternative names
+// on Linux.
+func systemAltNames(nl netlinkConfig) (map[int][]string, error) {
+	return nil, nil
+}
+
+// systemMasters returns no masters: they are only read on Linux.
+func systemMasters(nl netlinkConfig) (map[int]int, error) {
+	return nil, nil
+}
+
+// systemMulticastRoutes returns no routes: multicast routes are only read
+// on Linux.
+func systemMulticastRoutes(family int, nl netlinkConfig) ([]MulticastEntry, error) {
+	return nil, nil
+}
+
+// systemRules returns no rules: policy routing is only read on Linux.
+func systemRules(family int, nl netlinkConfig) ([]Rule, error) {
+	return nil, nil
+}
+
+func systemRouteGet(dst net.IP) (RouteResult, error) {
+	return RouteResult{}, ErrUnsupportedPlatform
+}
+
+// Pulled from https://learn.microsoft.com/en-us/windows/win32/api/netioapi/ns-netioapi-mib_ipnet_row2
+type mibIPNetRow2 struct {
+	Address               sockaddrINet
+	InterfaceIndex        uint32
+	InterfaceLuid         uint64
+	PhysicalAddress       [32]byte
+	PhysicalAddressLength uint32
+	State                 uint32
+	Flags                 uint8
+	ReachabilityTime      uint32
+}
+
+// Pulled from https://learn.microsoft.com/en-us/windows/win32/api/netioapi/nf-netioapi-getipnettable2
+type mibIPNetTable2 struct {
+	NumEntries uint32
+	Table      [1]mibIPNetRow2 // It is [NumEntries]mibIPNetRow2 in fact
+}
+
+// nlnsProbe is the first NL_NEIGHBOR_STATE whose physical address may be
+// used: probe, delay, stale, reachable and permanent.
+const nlnsProbe = 2
+
+var procGetIpNetTable2 = modIPhelperAPI.NewProc("GetIpNetTable2")
+
+func systemNeighbor(ip net.IP, ifindex int, nl netlinkConfig) (net.HardwareAddr, error) {
+	family := uint16(windows.AF_INET)
+	if FamilyOf(ip) == FamilyV6 {
+		family = windows.AF_INET6
+	}
+	var table *mibIPNetTable2
+	result, _, _ := procGetIpNetTable2.Call(uintptr(family), uintptr(unsafe.Pointer(&table)))
 	if result != windows.NO_ERROR {
-		return syscall.Errno(result)
+		return nil, syscall.Errno(result)
 	}
 	defer procFreeMibTable.Call(uintptr(unsafe.Pointer(table)))
 
@@ -122,34 +331,27 @@ func (r *router) setupRouteTable() error {
 		rowSize := unsafe.Sizeof(table.Table[0])
 
 		for i := uint32(0); i < table.NumEntries; i++ {
-			row := (*mibIPForwardRow2)(unsafe.Pointer(uintptr(pFirstRow) + rowSize * uintptr(i)))
-			routeInfo := rtInfo{
-				Src: net.IPNet{
-					IP: make([]byte, 16),
-					Mask: make([]byte, 16),
-				},
+			row := (*mibIPNetRow2)(unsafe.Pointer(uintptr(pFirstRow) + rowSize*uintptr(i)))
+			if int(row.InterfaceIndex) != ifindex || !row.ip(family).Equal(ip) {
+				continue
 			}
-
-			dstAddr := make([]byte, 16)
-			copy(dstAddr, ((*sockaddrIN6)(unsafe.Pointer(&row.DestinationPrefix.Prefix[0]))).Sin6Addr[:])
-			routeInfo.Dst = net.IPNet{
-				IP:   dstAddr,
-				Mask: net.CIDRMask(int(row.DestinationPrefix.PrefixLength), 128),
+			if row.State < nlnsProbe || row.PhysicalAddressLength == 0 || row.PhysicalAddressLength > uint32(len(row.PhysicalAddress)) {
+				break
 			}
-
-			routeInfo.OutputIface = int64(row.InterfaceIndex)
-
-			gatewayAddr := make([]byte, 16)
-			copy(gatewayAddr, ((*sockaddrIN6)(unsafe.Pointer(&row.NextHop[0]))).Sin6Addr[:])
-			routeInfo.Gateway = gatewayAddr
-
-			routeInfo.Metrics = int64(row.Metric)
-
-			r.v6 = append(r.v6, routeInfo)
+			return append(net.HardwareAddr(nil), row.PhysicalAddress[:row.PhysicalAddressLength]...), nil
 		}
 	}
+	return nil, fmt.Errorf("%w for %v", ErrNeighborUnresolved, ip)
+}
+
+// ip returns the address of a neighbor table row of the given family.
+func (row *mibIPNetRow2) ip(family uint16) net.IP {
+	if family == windows.AF_INET6 {
+		return append(net.IP(nil), (*sockaddrIN6)(unsafe.Pointer(&row.Address[0])).Sin6Addr[:]...)
+	}
+	return append(net.IP(nil), (*sockaddrIN)(unsafe.Pointer(&row.Address[0])).SinAddr[:]...)
+}
 
-	sort.Sort(r.v4)
-	sort.Sort(r.v6)
-	return nil
+func systemSocketInfo(fd int) (local, peer net.IP, device string, err error) {
+	return nil, nil, "", ErrUnsupportedPlatform
 }
@@ -0,0 +1,186 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+func TestRouteEntryLinkLocalGateway(t *testing.T) {
+	// ::/0 via fe80::1%12, as reported with the index of another interface.
+	var row mibIPForwardRow2
+	row.InterfaceIndex = 7
+	row.Metric = 256
+	(*sockaddrIN6)(unsafe.Pointer(&row.DestinationPrefix.Prefix[0])).SinFamily = windows.AF_INET6
+	nextHop := (*sockaddrIN6)(unsafe.Pointer(&row.NextHop[0]))
+	nextHop.SinFamily = windows.AF_INET6
+	nextHop.Sin6Addr = in6Addr{0xfe, 0x80, 15: 1}
+	nextHop.Sin6ScopeId = 12
+
+	rt := row.routeEntry(windows.AF_INET6)
+	if rt.OutputIface != 12 || !rt.Gateway.Equal(net.ParseIP("fe80::1")) || rt.Dst.String() != "::/0" {
+		t.Fatalf("\ngot:	%+v\nwant:	::/0 via fe80::1 on 12\n\n", rt)
+	}
+
+	r := &router{RouteTable: &RouteTable{
+		ifaces: map[int]*net.Interface{
+			12: {Index: 12, MTU: 1500, Name: "Ethernet", Flags: net.FlagUp},
+		},
+		addrs: map[int]ipAddrs{
+			12: {v6: []net.IPNet{mustParseCIDR("2001:db8::2/64")}},
+		},
+		v6: routeSlice{rt},
+	}}
+	sort.Sort(r.v6)
+	res, err := r.RouteGet(nil, nil, net.ParseIP("2001:4860:4860::8888"))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if res.Iface.Name != "Ethernet" || res.GatewayZone != "Ethernet" || !res.PreferredSrc.Equal(net.ParseIP("2001:db8::2")) {
+		t.Errorf("\ngot:	%+v\nwant:	via fe80::1%%Ethernet from 2001:db8::2\n\n", res)
+	}
+}
+
+func TestRouteEntryLifetimes(t *testing.T) {
+	var row mibIPForwardRow2
+	row.ValidLifetime = 1800
+	row.PreferredLifetime = infiniteLifetime
+	row.Age = 600
+	rt := row.routeEntry(windows.AF_INET6)
+	if rt.ValidLifetime != 30*time.Minute || rt.PreferredLifetime != 0 || rt.Age != 10*time.Minute {
+		t.Errorf("\ngot:	%v %v %v\nwant:	30m0s 0s 10m0s\n\n", rt.ValidLifetime, rt.PreferredLifetime, rt.Age)
+	}
+
+	row.Immortal = true
+	rt = row.routeEntry(windows.AF_INET6)
+	if rt.ValidLifetime != 0 || rt.PreferredLifetime != 0 {
+		t.Errorf("\ngot:	%v %v\nwant:	no lifetime for an immortal row\n\n", rt.ValidLifetime, rt.PreferredLifetime)
+	}
+}
+
+func TestPersistentRoutes(t *testing.T) {
+	keys := parsePersistentRoutes([]string{"10.0.0.0,255.0.0.0,192.168.1.254,1", "bogus"})
+
+	var row mibIPForwardRow2
+	row.DestinationPrefix.PrefixLength = 8
+	(*sockaddrIN)(unsafe.Pointer(&row.DestinationPrefix.Prefix[0])).SinAddr = inAddr{10}
+	(*sockaddrIN)(unsafe.Pointer(&row.NextHop[0])).SinAddr = inAddr{192, 168, 1, 254}
+	rt := row.routeEntry(windows.AF_INET)
+	if !keys[persistentKey(&rt)] {
+		t.Errorf("\ngot:	%q not in %v\nwant:	persistent\n\n", persistentKey(&rt), keys)
+	}
+
+	(*sockaddrIN)(unsafe.Pointer(&row.NextHop[0])).SinAddr = inAddr{192, 168, 1, 1}
+	rt = row.routeEntry(windows.AF_INET)
+	if keys[persistentKey(&rt)] {
+		t.Errorf("\ngot:	%q persistent\nwant:	not persistent with another gateway\n\n", persistentKey(&rt))
+	}
+}
+
+func TestOriginProtocol(t *testing.T) {
+	for origin, want := range map[uint32]RouteProtocol{
+		nlroManual:              ProtocolStatic,
+		nlroWellKnown:           ProtocolKernel,
+		nlroDHCP:                ProtocolDHCP,
+		nlroRouterAdvertisement: ProtocolRA,
+		nlro6to4:                ProtocolKernel,
+	} {
+		var row mibIPForwardRow2
+		row.Origin = origin
+		if rt := row.routeEntry(windows.AF_INET); rt.Protocol != want {
+			t.Errorf("origin %d\ngot:	%v\nwant:	%v\n\n", origin, rt.Protocol, want)
+		}
+	}
+}
+
+func TestWMIRouteEntry(t *testing.T) {
+	keys := parsePersistentRoutes([]string{"10.0.0.0,255.0.0.0,192.168.1.254,1"})
+
+	row := wmiRoute{
+		Destination:    "10.0.0.0",
+		Mask:           "255.0.0.0",
+		NextHop:        "192.168.1.254",
+		InterfaceIndex: 7,
+		Protocol:       wmiProtoNetMgmt,
+		Age:            60,
+		Metric1:        35,
+	}
+	rt, err := row.routeEntry()
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if rt.Dst.String() != "10.0.0.0/8" || !rt.Gateway.Equal(net.IPv4(192, 168, 1, 254)) || rt.OutputIface != 7 ||
+		rt.Priority != 35 || rt.Protocol != ProtocolStatic || rt.Age != time.Minute {
+		t.Errorf("\ngot:	%+v\nwant:	10.0.0.0/8 via 192.168.1.254 on 7, metric 35, static, 1m0s old\n\n", rt)
+	}
+	if !keys[persistentKey(&rt)] {
+		t.Errorf("\ngot:	%q not in %v\nwant:	persistent\n\n", persistentKey(&rt), keys)
+	}
+
+	row.NextHop = ""
+	if _, err := row.routeEntry(); err == nil {
+		t.Errorf("\ngot:	nil\nwant:	an invalid route without a next hop\n\n")
+	}
+}
+
+func TestVariantSize(t *testing.T) {
+	if size := unsafe.Sizeof(variant{}); size < 16 || unsafe.Sizeof(uintptr(0)) == 8 && size != 24 {
+		t.Errorf("\ngot:	%d\nwant:	the size of VARIANT\n\n", size)
+	}
+}
+
+func TestNeighborRow(t *testing.T) {
+	if size := unsafe.Sizeof(mibIPNetRow2{}); size != 88 {
+		t.Errorf("\ngot:	%d\nwant:	88, the size of MIB_IPNET_ROW2\n\n", size)
+	}
+	var row mibIPNetRow2
+	(*sockaddrIN)(unsafe.Pointer(&row.Address[0])).SinAddr = inAddr{192, 0, 2, 1}
+	if ip := row.ip(windows.AF_INET); !ip.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("\ngot:	%v\nwant:	192.0.2.1\n\n", ip)
+	}
+}
+
+func TestRouteAllAdapters(t *testing.T) {
+	// The same prefix through two adapters, as after connecting both
+	// Ethernet and Wi-Fi.
+	var routes []RouteEntry
+	for _, adapter := range []struct {
+		index  uint32
+		metric uint32
+		gw     inAddr
+	}{
+		{12, 35, inAddr{192, 168, 1, 1}},
+		{7, 25, inAddr{10, 0, 0, 1}},
+	} {
+		var row mibIPForwardRow2
+		row.InterfaceIndex = adapter.index
+		row.Metric = adapter.metric
+		(*sockaddrIN)(unsafe.Pointer(&row.NextHop[0])).SinAddr = adapter.gw
+		routes = append(routes, row.routeEntry(windows.AF_INET))
+	}
+	tab, err := NewRouteTable(routes, []net.Interface{
+		{Index: 7, Name: "Ethernet", Flags: net.FlagUp},
+		{Index: 12, Name: "Wi-Fi", Flags: net.FlagUp},
+	}, nil)
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+
+	all, err := tab.RouteAll(net.IPv4(8, 8, 8, 8))
+	if err != nil {
+		t.Fatalf("\ngot:	%#v\nwant:	nil\n\n", err)
+	}
+	if len(all) != 2 || all[0].OutputIface != 7 || all[1].OutputIface != 12 {
+		t.Errorf("\ngot:	%v\nwant:	the routes through Ethernet then Wi-Fi\n\n", all)
+	}
+}
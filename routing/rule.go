@@ -0,0 +1,294 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+)
+
+// RuleAction is what a policy routing rule does with the packets it
+// matches.  The values are those of FR_ACT_* on Linux.
+type RuleAction uint8
+
+const (
+	// RuleLookup looks the packet up in the rule's Table.
+	RuleLookup RuleAction = 1
+	// RuleGoto continues with another rule.
+	RuleGoto RuleAction = 2
+	// RuleNop does nothing.
+	RuleNop RuleAction = 3
+	// RuleBlackhole silently drops the packet.
+	RuleBlackhole RuleAction = 6
+	// RuleUnreachable rejects the packet as unreachable.
+	RuleUnreachable RuleAction = 7
+	// RuleProhibit rejects the packet as administratively prohibited.
+	RuleProhibit RuleAction = 8
+)
+
+var ruleActionNames = map[RuleAction]string{
+	RuleLookup:      "lookup",
+	RuleGoto:        "goto",
+	RuleNop:         "nop",
+	RuleBlackhole:   "blackhole",
+	RuleUnreachable: "unreachable",
+	RuleProhibit:    "prohibit",
+}
+
+// String returns the keyword of the action in "ip rule", or its number.
+func (a RuleAction) String() string {
+	if name, ok := ruleActionNames[a]; ok {
+		return name
+	}
+	return strconv.Itoa(int(a))
+}
+
+// ErrRuleRejected is wrapped by the error returned when a policy routing
+// rule of action RuleBlackhole, RuleUnreachable or RuleProhibit applies to
+// the packet.
+var ErrRuleRejected = errors.New("rejected by policy rule")
+
+// Rule is a policy routing rule choosing the route table a packet is looked
+// up in, as listed by "ip rule" on Linux.
+type Rule struct {
+	// Family is FamilyV4 or FamilyV6.
+	Family AddressFamily
+	// Priority orders the rules; lower priorities are evaluated first.
+	Priority uint32
+	// Src and Dst are the prefixes the source and destination of a packet
+	// must be in.  A zero value matches every address.
+	Src, Dst net.IPNet
+	// Mark and Mask select the packets whose fwmark, masked with Mask,
+	// equals Mark.  A zero Mask matches every packet.
+	Mark, Mask uint32
+	// InputIfaceName and OutputIfaceName restrict the rule to packets
+	// received on the named interface, or sent from a socket bound to it.
+	// Locally generated packets are received on "lo".
+	InputIfaceName, OutputIfaceName string
+	// Invert makes the rule apply to the packets it doesn't match.
+	Invert bool
+	// Action is what the rule does with the packets it applies to.
+	Action RuleAction
+	// Table is the route table looked up by RuleLookup.
+	Table uint32
+	// Goto is the priority of the rule RuleGoto continues with.  A goto
+	// to a priority no later rule has does nothing.
+	Goto uint32
+	// SuppressPrefix makes RuleLookup ignore the routes it finds whose
+	// prefix is SuppressPrefixLength bits or shorter, and pass the packet
+	// on to the next rule instead ("ip rule ... suppress_prefixlength").
+	SuppressPrefix       bool
+	SuppressPrefixLength int
+}
+
+// matches reports whether the rule applies to a locally generated packet
+// with the given fwmark, source and destination.  A nil src only matches
+// rules without a source prefix.
+func (rule *Rule) matches(mark uint32, src, dst net.IP) bool {
+	ok := (mark^rule.Mark)&rule.Mask == 0 &&
+		prefixMatches(rule.Src, src) &&
+		prefixMatches(rule.Dst, dst) &&
+		(rule.InputIfaceName == "" || rule.InputIfaceName == "lo") &&
+		rule.OutputIfaceName == ""
+	return ok != rule.Invert
+}
+
+// prefixMatches is like prefixContains, but a nil ip is only in prefixes
+// that contain every address.
+func prefixMatches(n net.IPNet, ip net.IP) bool {
+	if ones, _ := n.Mask.Size(); n.IP == nil || ones == 0 {
+		return true
+	}
+	return ip != nil && n.Contains(ip)
+}
+
+// RuleStep is a policy routing rule evaluated by RouteWithRuleTrace.
+type RuleStep struct {
+	Rule Rule
+	// Matched is set when the rule applied to the packet.
+	Matched bool
+	// Outcome tells, in human-readable form, what became of the packet:
+	// the route found in the table the rule directed it to, or why it went
+	// on to the next rule.
+	Outcome string
+}
+
+// RuleTrace is the path of a decision of RouteWithMark, one step per rule
+// of the family of the destination, in the order they were evaluated.  A
+// last step with a zero Rule tells when the main table was used because no
+// rule gave a route.
+type RuleTrace []RuleStep
+
+// add records a step.  It does nothing on a nil *RuleTrace, so that lookups
+// only pay for tracing when it is asked for.
+func (t *RuleTrace) add(rule *Rule, matched bool, format string, args ...interface{}) {
+	if t != nil {
+		*t = append(*t, RuleStep{Rule: *rule, Matched: matched, Outcome: fmt.Sprintf(format, args...)})
+	}
+}
+
+func (r *router) RouteWithMark(mark uint32, src, dst net.IP) (RouteResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res, err := r.routeWithMark(mark, src, dst, nil)
+	r.stats.lookup(err)
+	return res, err
+}
+
+func (r *router) RouteWithRuleTrace(mark uint32, src, dst net.IP) (RouteResult, RuleTrace, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	trace := RuleTrace{}
+	res, err := r.routeWithMark(mark, src, dst, &trace)
+	r.stats.lookup(err)
+	return res, trace, err
+}
+
+func (r *router) IsAsymmetric(src, dst net.IP) (bool, RouteResult, RouteResult, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	forward, err := r.routeWithMark(0, src, dst, nil)
+	r.stats.lookup(err)
+	if err != nil {
+		return false, RouteResult{}, RouteResult{}, err
+	}
+	reverse, err := r.routeWithMark(0, dst, src, nil)
+	r.stats.lookup(err)
+	if err != nil {
+		return false, RouteResult{}, RouteResult{}, err
+	}
+	// The lookup towards a local address gives local delivery rather than
+	// an interface: the packets of that direction are instead expected on
+	// the interface holding the address.
+	switch {
+	case forward.IsLocal && reverse.IsLocal:
+		return false, forward, reverse, nil
+	case reverse.IsLocal:
+		holder := r.addrIface(src)
+		return holder != 0 && holder != ifaceIndex(forward.Iface), forward, reverse, nil
+	case forward.IsLocal:
+		holder := r.addrIface(dst)
+		return holder != 0 && holder != ifaceIndex(reverse.Iface), forward, reverse, nil
+	}
+	return ifaceIndex(forward.Iface) != ifaceIndex(reverse.Iface), forward, reverse, nil
+}
+
+// routeWithMark implements RouteWithMark, recording the rules evaluated in
+// t.  The caller must hold r.mu.
+func (r *router) routeWithMark(mark uint32, src, dst net.IP, t *RuleTrace) (RouteResult, error) {
+	ipv6 := FamilyOf(dst) == FamilyV6
+	for i := 0; i < len(r.rules); i++ {
+		rule := &r.rules[i]
+		if (rule.Family == FamilyV6) != ipv6 {
+			continue
+		}
+		if !rule.matches(mark, src, dst) {
+			t.add(rule, false, "not matched")
+			continue
+		}
+		switch rule.Action {
+		case RuleLookup:
+			var matched *RouteEntry
+			res, err := r.resolve(0, src, dst, 0, rule.Table, func(rt *RouteEntry) bool {
+				matched = rt
+				return true
+			}, nil)
+			// As in the kernel, a table without a route for dst, or
+			// with a suppressed one, passes the packet on to the next
+			// rule.
+			switch {
+			case errors.Is(err, ErrNoRoute):
+				t.add(rule, true, "no route in table %d", rule.Table)
+				continue
+			case err == nil && rule.suppresses(matched):
+				t.add(rule, true, "route %v in table %d suppressed", &matched.Dst, rule.Table)
+				continue
+			case err != nil:
+				t.add(rule, true, "failed in table %d: %v", rule.Table, err)
+			default:
+				t.add(rule, true, "route %v in table %d", &matched.Dst, rule.Table)
+			}
+			return res, err
+		case RuleGoto:
+			if j := r.gotoTarget(i); j >= 0 {
+				t.add(rule, true, "goto %d", rule.Goto)
+				i = j - 1
+			} else {
+				t.add(rule, true, "no rule at priority %d to go to", rule.Goto)
+			}
+			continue
+		case RuleBlackhole, RuleUnreachable, RuleProhibit:
+			t.add(rule, true, "rejected")
+			return RouteResult{}, fmt.Errorf("%w (%v) for %v", ErrRuleRejected, rule.Action, dst)
+		}
+		// Other actions, such as RuleNop, pass the packet on.
+		t.add(rule, true, "passed on")
+	}
+	res, err := r.resolve(0, src, dst, 0, defaultTables, nil, nil)
+	if err != nil {
+		t.add(&Rule{}, false, "no rule gave a route, main table failed: %v", err)
+	} else {
+		t.add(&Rule{}, false, "no rule gave a route, main table used")
+	}
+	return res, err
+}
+
+// suppresses reports whether the rule ignores the route rt it looked up.
+func (rule *Rule) suppresses(rt *RouteEntry) bool {
+	if !rule.SuppressPrefix || rt == nil {
+		return false
+	}
+	ones, _ := rt.Dst.Mask.Size()
+	return ones <= rule.SuppressPrefixLength
+}
+
+// gotoTarget returns the index of the rule the RuleGoto rule at index i
+// continues with: the first later rule of the same family with the
+// priority it names.  It is -1 when there is none.
+func (r *router) gotoTarget(i int) int {
+	from := &r.rules[i]
+	for j := i + 1; j < len(r.rules); j++ {
+		if to := &r.rules[j]; to.Family == from.Family && to.Priority == from.Goto {
+			return j
+		}
+	}
+	return -1
+}
+
+// loadRules reads the rules of the provider, if it has any, sorted by
+// priority.
+func (r *router) loadRules() ([]Rule, error) {
+	p, ok := r.provider.(RuleProvider)
+	if !ok {
+		return nil, nil
+	}
+	all, err := p.Rules(r.family)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	for _, rule := range all {
+		ipv6 := rule.Family == FamilyV6
+		if !familyEnabled(r.family, ipv6) {
+			continue
+		}
+		if rule.Src.IP != nil {
+			rule.Src = canonicalPrefix(rule.Src, ipv6)
+		}
+		if rule.Dst.IP != nil {
+			rule.Dst = canonicalPrefix(rule.Dst, ipv6)
+		}
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority < rules[j].Priority
+	})
+	return rules, nil
+}
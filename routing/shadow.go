@@ -0,0 +1,129 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"net"
+)
+
+// ShadowedRoutes returns the routes that lookups never select, each paired
+// with a route selected instead: the first of a pair shadows the second.  A
+// route is shadowed when the routes preferred to it for every destination
+// it covers, of its own prefix with a better preference or priority, or of
+// more specific ones, leave it nothing, as when 0.0.0.0/1 and 128.0.0.0/1
+// routes shadow a default route.  It is then paired with a better route of
+// its own prefix if there is one, and else with each of the least specific
+// routes covering it.  Only the routes applying to every packet shadow
+// others: those restricted to a source, an input interface or a TOS, and
+// those that are dead, on a down interface or expiring, don't.  The
+// nexthops of a multipath route don't shadow one another, though lookups
+// only select the first usable one.
+func (tab *RouteTable) ShadowedRoutes() [][2]RouteEntry {
+	var pairs [][2]RouteEntry
+	for _, table := range append([]uint32{TableMain}, tab.tableIDs()...) {
+		for _, ipv6 := range []bool{false, true} {
+			pairs = append(pairs, shadowedRoutes(tab.routes(table, ipv6))...)
+		}
+	}
+	return pairs
+}
+
+// shadowedRoutes returns the shadowed routes of rs, which are sorted in
+// selection order, as ShadowedRoutes does.
+func shadowedRoutes(rs routeSlice) [][2]RouteEntry {
+	var pairs [][2]RouteEntry
+	// Routes are sorted from the most specific, so the trie only holds
+	// routes preferred to those still to come.
+	var trie prefixTrie
+	for j := range rs {
+		b := &rs[j]
+		if t := trie.node(b.Dst, false); t != nil {
+			var same *RouteEntry
+			for _, a := range t.routes {
+				if !multipathSiblings(a, b) {
+					same = a
+					break
+				}
+			}
+			if same != nil {
+				pairs = append(pairs, [2]RouteEntry{same.clone(), b.clone()})
+			} else {
+				for _, a := range t.split() {
+					pairs = append(pairs, [2]RouteEntry{a.clone(), b.clone()})
+				}
+			}
+		}
+		if appliesToAll(b) {
+			t := trie.node(b.Dst, true)
+			t.routes = append(t.routes, b)
+		}
+	}
+	return pairs
+}
+
+// appliesToAll reports whether lookups select rt for every destination of
+// its prefix, with no condition on the packet or the state of the route.
+func appliesToAll(rt *RouteEntry) bool {
+	srcOnes, _ := rt.Src.Mask.Size()
+	return srcOnes == 0 && rt.InputIface == 0 && rt.TOS == 0 && rt.ValidLifetime == 0 &&
+		rt.Flags&(RouteDead|RouteIfaceDown) == 0
+}
+
+// multipathSiblings reports whether a and b are nexthops of the same
+// multipath route.
+func multipathSiblings(a, b *RouteEntry) bool {
+	return a.Weight != 0 && b.Weight != 0 && a.Priority == b.Priority && a.Dst.String() == b.Dst.String()
+}
+
+// prefixTrie is a binary trie of routes by destination prefix, each node
+// standing for the prefix of the path to it.
+type prefixTrie struct {
+	routes   []*RouteEntry // to the prefix of the node, in selection order
+	children [2]*prefixTrie
+}
+
+// node returns the node of n, or nil if it has none unless create is set.
+func (t *prefixTrie) node(n net.IPNet, create bool) *prefixTrie {
+	ones, _ := n.Mask.Size()
+	for i := 0; i < ones; i++ {
+		bit := n.IP[i/8] >> (7 - i%8) & 1
+		if t.children[bit] == nil {
+			if !create {
+				return nil
+			}
+			t.children[bit] = &prefixTrie{}
+		}
+		t = t.children[bit]
+	}
+	return t
+}
+
+// cover returns the least specific routes of t that together cover the
+// whole of its prefix, in address order, or nil if they don't.
+func (t *prefixTrie) cover() []*RouteEntry {
+	if len(t.routes) > 0 {
+		return t.routes[:1]
+	}
+	return t.split()
+}
+
+// split returns the cover of each half of the prefix of t, or nil if either
+// half is not covered.
+func (t *prefixTrie) split() []*RouteEntry {
+	if t.children[0] == nil || t.children[1] == nil {
+		return nil
+	}
+	low := t.children[0].cover()
+	if low == nil {
+		return nil
+	}
+	high := t.children[1].cover()
+	if high == nil {
+		return nil
+	}
+	return append(append([]*RouteEntry(nil), low...), high...)
+}
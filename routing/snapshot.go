@@ -0,0 +1,261 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+)
+
+// RouteSnapshot is a read-only copy of the table of a Router at the time
+// Snapshot was called.  Refreshing the Router does not affect it, so a
+// sequence of lookups against a snapshot gives consistent answers even
+// while the system table changes.  It is safe for concurrent use.
+type RouteSnapshot struct {
+	r *router
+}
+
+func (r *router) Snapshot() *RouteSnapshot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	// Refresh replaces the table rather than modifying it, so it can be
+	// shared.
+	return &RouteSnapshot{r: &router{RouteTable: r.RouteTable}}
+}
+
+// Route is like Router.Route, against the snapshot.
+func (s *RouteSnapshot) Route(dst net.IP) (iface *net.Interface, gateway, preferredSrc net.IP, err error) {
+	return s.r.Route(dst)
+}
+
+// RouteWithSrc is like Router.RouteWithSrc, against the snapshot.
+func (s *RouteSnapshot) RouteWithSrc(input net.HardwareAddr, src, dst net.IP) (iface *net.Interface, gateway, preferredSrc net.IP, err error) {
+	return s.r.RouteWithSrc(input, src, dst)
+}
+
+// RouteGet is like EgressRouter.RouteGet, against the snapshot.
+func (s *RouteSnapshot) RouteGet(input net.HardwareAddr, src, dst net.IP) (RouteResult, error) {
+	return s.r.RouteGet(input, src, dst)
+}
+
+// Routes is like RouteTable.Routes, against the snapshot.
+func (s *RouteSnapshot) Routes() []RouteEntry {
+	return s.r.Table().Routes()
+}
+
+// snapshotVersion is the version of the format SaveSnapshot writes, which
+// LoadSnapshot checks.
+const snapshotVersion = 1
+
+// snapshotFile is the JSON document SaveSnapshot writes.  Prefixes are
+// written in CIDR notation and addresses as strings; the other fields of
+// routes and rules as encoding/json does.
+type snapshotFile struct {
+	Version    int
+	Interfaces []snapshotIface
+	Routes     []snapshotRoute
+	Rules      []snapshotRule   `json:",omitempty"`
+	Multicast  []MulticastEntry `json:",omitempty"`
+}
+
+type snapshotIface struct {
+	Index        int
+	MTU          int
+	Name         string
+	AltNames     []string `json:",omitempty"`
+	HardwareAddr string   `json:",omitempty"`
+	Flags        net.Flags
+	// Master is the index of the bond, team or bridge the interface is
+	// enslaved to, if any.
+	Master int            `json:",omitempty"`
+	Addrs  []snapshotAddr `json:",omitempty"`
+}
+
+type snapshotAddr struct {
+	// Addr is the address with the prefix length of its subnet, as in
+	// "192.168.1.2/24".
+	Addr  string
+	Flags AddrFlags `json:",omitempty"`
+}
+
+// snapshotRoute and snapshotRule shadow the prefixes of RouteEntry and Rule
+// with their CIDR form.
+type snapshotRoute struct {
+	RouteEntry
+	Dst, Src string
+}
+
+type snapshotRule struct {
+	Rule
+	Src, Dst string `json:",omitempty"`
+}
+
+// SaveSnapshot writes the interfaces, addresses, routes, policy rules and
+// multicast routes of the table to w, for LoadSnapshot to read back.
+func (tab *RouteTable) SaveSnapshot(w io.Writer) error {
+	f := snapshotFile{Version: snapshotVersion}
+	altNames := make(map[int][]string)
+	for name, index := range tab.altNames {
+		altNames[index] = append(altNames[index], name)
+	}
+	for _, iface := range tab.Interfaces() {
+		si := snapshotIface{
+			Index:    iface.Index,
+			MTU:      iface.MTU,
+			Name:     iface.Name,
+			AltNames: altNames[iface.Index],
+			Flags:    iface.Flags,
+			Master:   tab.masters[iface.Index],
+		}
+		sort.Strings(si.AltNames)
+		if len(iface.HardwareAddr) > 0 {
+			si.HardwareAddr = iface.HardwareAddr.String()
+		}
+		addrs := tab.addrs[iface.Index]
+		for _, ipv6 := range []bool{false, true} {
+			for i, addr := range addrs.family(ipv6) {
+				ones, _ := addr.Mask.Size()
+				si.Addrs = append(si.Addrs, snapshotAddr{
+					Addr:  fmt.Sprintf("%v/%d", addr.IP, ones),
+					Flags: addrs.flags(ipv6, i),
+				})
+			}
+		}
+		f.Interfaces = append(f.Interfaces, si)
+	}
+	for _, rt := range tab.Routes() {
+		f.Routes = append(f.Routes, snapshotRoute{RouteEntry: rt, Dst: rt.Dst.String(), Src: rt.Src.String()})
+	}
+	for _, rule := range tab.rules {
+		sr := snapshotRule{Rule: rule}
+		if rule.Src.IP != nil {
+			sr.Src = rule.Src.String()
+		}
+		if rule.Dst.IP != nil {
+			sr.Dst = rule.Dst.String()
+		}
+		f.Rules = append(f.Rules, sr)
+	}
+	f.Multicast = tab.multicast
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(&f)
+}
+
+// LoadSnapshot creates a router selecting from a table written by
+// SaveSnapshot, such as one captured on another machine, to reproduce its
+// routing decisions.  The options of the router that saved the table, such
+// as WithFamily or WithStableSourceAddresses, are not saved with it and may
+// be given again in opts; the multicast routes are loaded whenever the
+// snapshot has some.  Refresh reads the snapshot again.
+func LoadSnapshot(r io.Reader, opts ...Option) (Router, error) {
+	var f snapshotFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return nil, fmt.Errorf("reading snapshot: %w", err)
+	}
+	if f.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", f.Version)
+	}
+	p := &snapshotProvider{
+		staticProvider: staticProvider{addrs: make(map[int][]net.Addr)},
+		altNames:       make(map[int][]string),
+		masters:        make(map[int]int),
+		multicast:      f.Multicast,
+	}
+	for _, si := range f.Interfaces {
+		iface := net.Interface{Index: si.Index, MTU: si.MTU, Name: si.Name, Flags: si.Flags}
+		if si.HardwareAddr != "" {
+			mac, err := net.ParseMAC(si.HardwareAddr)
+			if err != nil {
+				return nil, fmt.Errorf("interface %s: %w", si.Name, err)
+			}
+			iface.HardwareAddr = mac
+		}
+		p.ifaces = append(p.ifaces, iface)
+		if len(si.AltNames) > 0 {
+			p.altNames[si.Index] = si.AltNames
+		}
+		if si.Master != 0 {
+			p.masters[si.Index] = si.Master
+		}
+		for _, sa := range si.Addrs {
+			ip, n, err := net.ParseCIDR(sa.Addr)
+			if err != nil {
+				return nil, fmt.Errorf("interface %s: %w", si.Name, err)
+			}
+			addr := &InterfaceAddr{IPNet: net.IPNet{IP: canonicalIP(ip, len(n.IP) == net.IPv6len), Mask: n.Mask}, Flags: sa.Flags}
+			p.addrs[si.Index] = append(p.addrs[si.Index], addr)
+		}
+	}
+	for _, sr := range f.Routes {
+		rt := sr.RouteEntry
+		var err error
+		if rt.Dst, err = parseSnapshotPrefix(sr.Dst); err != nil {
+			return nil, fmt.Errorf("route: %w", err)
+		}
+		if rt.Src, err = parseSnapshotPrefix(sr.Src); err != nil {
+			return nil, fmt.Errorf("route to %s: %w", sr.Dst, err)
+		}
+		p.routes = append(p.routes, rt)
+	}
+	for _, sr := range f.Rules {
+		rule := sr.Rule
+		var err error
+		if rule.Src, err = parseSnapshotPrefix(sr.Src); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", rule.Priority, err)
+		}
+		if rule.Dst, err = parseSnapshotPrefix(sr.Dst); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", rule.Priority, err)
+		}
+		p.rules = append(p.rules, rule)
+	}
+	if len(p.multicast) > 0 {
+		opts = append(opts, WithMulticastRoutes())
+	}
+	return New(append(opts, WithProvider(p))...)
+}
+
+// parseSnapshotPrefix parses a prefix of a snapshot, where an empty string
+// stands for the zero net.IPNet.
+func parseSnapshotPrefix(s string) (net.IPNet, error) {
+	if s == "" {
+		return net.IPNet{}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return net.IPNet{}, err
+	}
+	return *n, nil
+}
+
+// snapshotProvider serves the table read by LoadSnapshot.
+type snapshotProvider struct {
+	staticProvider
+	rules     []Rule
+	altNames  map[int][]string
+	masters   map[int]int
+	multicast []MulticastEntry
+}
+
+func (p *snapshotProvider) Rules(family AddressFamily) ([]Rule, error) {
+	return p.rules, nil
+}
+
+func (p *snapshotProvider) AltNames() (map[int][]string, error) {
+	return p.altNames, nil
+}
+
+func (p *snapshotProvider) Masters() (map[int]int, error) {
+	return p.masters, nil
+}
+
+func (p *snapshotProvider) MulticastRoutes(family AddressFamily) ([]MulticastEntry, error) {
+	return p.multicast, nil
+}
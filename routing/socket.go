@@ -0,0 +1,57 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"fmt"
+	"net"
+)
+
+// SocketReport compares the addresses of a connected socket to the route r
+// selects for its peer.
+type SocketReport struct {
+	// Local and Peer are the addresses of the socket, as getsockname and
+	// getpeername return them.
+	Local, Peer net.IP
+	// Device is the interface the socket is bound to with
+	// SO_BINDTODEVICE, or empty.
+	Device string
+	// Predicted is what Route selects for Peer.
+	Predicted RouteResult
+	// Discrepancies describes, in human-readable form, how the socket
+	// differs from Predicted.  It is empty when they agree.
+	Discrepancies []string
+}
+
+// CheckSocket compares the connected socket fd to the route r selects for
+// its peer, to tell why packets left through another interface or with
+// another source than r predicts.  A socket bound to an address or a
+// device, or steered by policy rules r does not know, reports
+// discrepancies.  It is only supported on Linux, and fails with
+// ErrUnsupportedPlatform elsewhere.
+func CheckSocket(r Router, fd int) (SocketReport, error) {
+	local, peer, device, err := systemSocketInfo(fd)
+	if err != nil {
+		return SocketReport{}, err
+	}
+	rep := SocketReport{Local: local, Peer: peer, Device: device}
+	rep.Predicted, err = routeResult(r, peer)
+	if err != nil {
+		return rep, err
+	}
+	if !local.Equal(rep.Predicted.PreferredSrc) {
+		rep.Discrepancies = append(rep.Discrepancies, fmt.Sprintf("local address is %v, predicted source %v", local, rep.Predicted.PreferredSrc))
+	}
+	if iface := rep.Predicted.Iface; device != "" && (iface == nil || device != iface.Name) {
+		name := "unknown"
+		if iface != nil {
+			name = iface.Name
+		}
+		rep.Discrepancies = append(rep.Discrepancies, fmt.Sprintf("bound to device %s, predicted interface %s", device, name))
+	}
+	return rep, nil
+}
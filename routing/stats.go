@@ -0,0 +1,98 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are counters of the activity of a Router, for monitoring.  They are
+// only kept by a Router created with WithStats.
+type Stats struct {
+	// Lookups is the number of lookups made, of which Hits found a route
+	// and Misses found none.  Lookups failing for other reasons, such as
+	// a disabled family, are neither.
+	Lookups, Hits, Misses uint64
+	// CacheHits is the number of Hits answered by the cache of
+	// WithSubnetCache.
+	CacheHits uint64
+
+	// Refreshes is the number of successful calls to Refresh, including
+	// the one made by New.  LastRefresh is the time the last one took, and
+	// RefreshTime the time all of them took.
+	Refreshes                uint64
+	LastRefresh, RefreshTime time.Duration
+
+	// Routes is the number of routes currently loaded, in all tables.  It
+	// is kept with or without WithStats.
+	Routes int
+}
+
+// routerStats holds the counters of Stats.  The methods of a nil
+// *routerStats do nothing, so that a Router without WithStats doesn't pay
+// for them.
+type routerStats struct {
+	lookups, hits, misses atomic.Uint64
+	cacheHits             atomic.Uint64
+	refreshes             atomic.Uint64
+	lastRefresh           atomic.Int64
+	refreshTime           atomic.Int64
+}
+
+// lookup counts a lookup that returned err.
+func (s *routerStats) lookup(err error) {
+	if s == nil {
+		return
+	}
+	s.lookups.Add(1)
+	switch {
+	case err == nil:
+		s.hits.Add(1)
+	case errors.Is(err, ErrNoRoute):
+		s.misses.Add(1)
+	}
+}
+
+// cacheHit counts a lookup answered by the cache of WithSubnetCache, which
+// is also counted by lookup.
+func (s *routerStats) cacheHit() {
+	if s != nil {
+		s.cacheHits.Add(1)
+	}
+}
+
+// refresh counts a refresh that took d.
+func (s *routerStats) refresh(d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.refreshes.Add(1)
+	s.lastRefresh.Store(int64(d))
+	s.refreshTime.Add(int64(d))
+}
+
+func (r *router) Stats() Stats {
+	r.mu.RLock()
+	st := Stats{Routes: len(r.v4) + len(r.v6)}
+	for _, t := range r.tables {
+		st.Routes += len(t.v4) + len(t.v6)
+	}
+	r.mu.RUnlock()
+
+	if s := r.stats; s != nil {
+		st.Lookups = s.lookups.Load()
+		st.Hits = s.hits.Load()
+		st.Misses = s.misses.Load()
+		st.CacheHits = s.cacheHits.Load()
+		st.Refreshes = s.refreshes.Load()
+		st.LastRefresh = time.Duration(s.lastRefresh.Load())
+		st.RefreshTime = time.Duration(s.refreshTime.Load())
+	}
+	return st
+}
@@ -0,0 +1,59 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// SubflowRoutes returns a route to dst for each pair of an output interface
+// and a source address that may originate traffic to it, as the local
+// endpoints an MPTCP path manager opens subflows from.  The pairs are those
+// of the routes of RouteAll, with the source each selects, best first: the
+// route a pair is reported with is the best one through its interface, and
+// the pairs are ordered by it, as RouteAll orders routes by prefix length
+// and then by metric.  Routes that have no source address or reach the
+// machine itself are left out, and a route rejecting dst, such as a
+// blackhole route, ends the list, as lookups go no further.  It fails with
+// the error of that route if it comes first, and with an error wrapping
+// ErrNoRoute if no pair is left.
+func (tab *RouteTable) SubflowRoutes(dst net.IP) ([]RouteResult, error) {
+	routes, err := tab.RouteAll(dst)
+	if err != nil {
+		return nil, err
+	}
+	var results []RouteResult
+	seen := make(map[string]bool)
+	for i := range routes {
+		rt := &routes[i]
+		res, err := tab.resolve(0, nil, dst, rt.TOS, TableMain, func(c *RouteEntry) bool {
+			return c.Equal(rt)
+		}, nil)
+		if errors.Is(err, ErrRouteRejected) {
+			// No lookup goes further.
+			if len(results) == 0 {
+				return nil, err
+			}
+			break
+		}
+		if err != nil || res.IsLocal || res.Iface == nil || res.PreferredSrc == nil {
+			continue
+		}
+		key := strconv.Itoa(res.ifindex) + "/" + string(res.PreferredSrc.To16())
+		if !seen[key] {
+			seen[key] = true
+			results = append(results, res)
+		}
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("%w with a source address for %v", ErrNoRoute, dst)
+	}
+	return results, nil
+}
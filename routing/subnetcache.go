@@ -0,0 +1,143 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"net"
+	"sync"
+)
+
+// The prefix lengths of the networks WithSubnetCache keys results by.
+const (
+	subnetCacheBitsV4 = 24
+	subnetCacheBitsV6 = 64
+)
+
+// subnetCacheSize bounds the number of networks WithSubnetCache remembers;
+// the cache is emptied when it is full, which only scans of huge ranges
+// make it.
+const subnetCacheSize = 1 << 16
+
+// subnetCache holds the results of the lookups of a Router by the network
+// of their destination, for WithSubnetCache.
+type subnetCache struct {
+	mu         sync.Mutex
+	generation uint64 // of the table the results were selected from
+	results    map[[net.IPv6len]byte]cachedRoute
+}
+
+// cachedRoute is a result of subnetCache.  The gateway of an on-link route
+// is the destination itself, so it is set again for each destination.
+type cachedRoute struct {
+	res    RouteResult
+	onLink bool
+}
+
+// subnetKey returns the network of dst that results are cached by, and its
+// prefix length.
+func subnetKey(dst net.IP, ipv6 bool) (key [net.IPv6len]byte, bits int) {
+	bits = subnetCacheBitsV4
+	if ipv6 {
+		bits = subnetCacheBitsV6
+	}
+	n := bits / 8
+	if !ipv6 {
+		n += net.IPv6len - net.IPv4len
+	}
+	copy(key[:], dst.To16()[:n])
+	return key, bits
+}
+
+// get returns the result cached for the network of dst, if it was selected
+// from the table of the given generation.
+func (c *subnetCache) get(dst net.IP, ipv6 bool, generation uint64) (RouteResult, bool) {
+	key, _ := subnetKey(dst, ipv6)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		c.generation, c.results = generation, nil
+		return RouteResult{}, false
+	}
+	cached, ok := c.results[key]
+	if !ok {
+		return RouteResult{}, false
+	}
+	res := cached.res
+	if cached.onLink {
+		res.Gateway = canonicalIP(dst, ipv6)
+	}
+	return res, true
+}
+
+// put caches res, which rt was matched for dst in the table of the given
+// generation.
+func (c *subnetCache) put(dst net.IP, ipv6 bool, generation uint64, rt *RouteEntry, res RouteResult) {
+	key, _ := subnetKey(dst, ipv6)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return
+	}
+	if c.results == nil || len(c.results) >= subnetCacheSize {
+		c.results = make(map[[net.IPv6len]byte]cachedRoute)
+	}
+	onLink := rt.Gateway == nil || rt.Gateway.IsUnspecified()
+	c.results[key] = cachedRoute{res: res, onLink: onLink}
+}
+
+// cachedRouteGet implements RouteGet for a destination alone with the cache
+// of WithSubnetCache.  The caller must hold r.mu.
+func (r *router) cachedRouteGet(dst net.IP) (RouteResult, error) {
+	family := FamilyOf(dst)
+	if family == FamilyInvalid {
+		return r.resolve(0, nil, dst, 0, defaultTables, nil, nil)
+	}
+	ipv6 := family == FamilyV6
+	// The cache is keyed by network, so dst must pass the checks of
+	// resolve before the network is looked up.
+	if !familyEnabled(r.family, ipv6) {
+		return RouteResult{}, ErrFamilyDisabled
+	}
+	if err := r.checkUnspecified(dst); err != nil {
+		return RouteResult{}, err
+	}
+	generation := r.generation.Load()
+	if res, ok := r.cache.get(dst, ipv6, generation); ok {
+		r.stats.cacheHit()
+		return res, nil
+	}
+	t := &routeTrace{}
+	res, err := r.resolve(0, nil, dst, 0, defaultTables, nil, t)
+	if err == nil && t.matched != nil && !res.IsLocal && !r.splitsSubnet(dst, ipv6) {
+		r.cache.put(dst, ipv6, generation, t.matched, res)
+	}
+	return res, err
+}
+
+// splitsSubnet reports whether a route of any table is more specific than
+// the network of dst the cache is keyed by, and within it, so that the
+// destinations of the network may not be routed alike.
+func (tab *RouteTable) splitsSubnet(dst net.IP, ipv6 bool) bool {
+	key, bits := subnetKey(dst, ipv6)
+	ip := net.IP(key[:])
+	if !ipv6 {
+		ip = ip.To4()
+	}
+	network := net.IPNet{IP: ip, Mask: net.CIDRMask(bits, 8*len(ip))}
+	for _, table := range append(tab.tableIDs(), TableMain) {
+		// Routes are sorted from the most specific.
+		for _, rt := range tab.routes(table, ipv6) {
+			if ones, _ := rt.Dst.Mask.Size(); ones <= bits {
+				break
+			}
+			if network.Contains(rt.Dst.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Subscribe returns a channel that receives a value whenever the routing
+// table of the operating system, or the interfaces and addresses routes
+// depend on, change.  Changes arriving faster than they are received are
+// coalesced into one value, so a receiver typically calls Refresh on the
+// routers it keeps for each value.  The channel is closed when ctx is done
+// or the notifications fail.
+//
+// It is supported on Linux, where it listens on a netlink socket, and on
+// the BSDs and macOS, where it reads the routing socket.  It fails with
+// ErrUnsupportedPlatform elsewhere.
+func Subscribe(ctx context.Context) (<-chan struct{}, error) {
+	return systemSubscribe(ctx)
+}
+
+// subscribable reports whether Subscribe reports the changes of the table r
+// reads, which are those of the system in the caller's network namespace.
+func (r *router) subscribable() bool {
+	p, ok := r.provider.(systemProvider)
+	return ok && p.netlink.netns == nil
+}
+
+// DefaultRouteEvent tells that the best default route of a family changed.
+type DefaultRouteEvent struct {
+	Family AddressFamily
+	// Old and New are the best default routes before and after the
+	// change, or nil when there was none or is none left.
+	Old, New *RouteEntry
+}
+
+func (r *router) DefaultRouteChanges(ctx context.Context) (<-chan DefaultRouteEvent, error) {
+	// Like WaitForRoute, be notified of the changes of the system table and
+	// poll other providers.
+	var changes <-chan struct{}
+	if r.subscribable() {
+		var err error
+		if changes, err = Subscribe(ctx); err != nil && !errors.Is(err, ErrUnsupportedPlatform) {
+			return nil, err
+		}
+	}
+	events := make(chan DefaultRouteEvent)
+	old := r.bestDefaults()
+	go func() {
+		defer close(events)
+		var poll <-chan time.Time
+		if changes == nil {
+			ticker := time.NewTicker(waitPollInterval)
+			defer ticker.Stop()
+			poll = ticker.C
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-changes:
+				if !ok {
+					return
+				}
+			case <-poll:
+			}
+			if err := r.Refresh(); err != nil {
+				// Keep the previous table, and try again on the next
+				// change.
+				continue
+			}
+			cur := r.bestDefaults()
+			for i, family := range []AddressFamily{FamilyV4, FamilyV6} {
+				if sameNextHop(old[i], cur[i]) {
+					continue
+				}
+				select {
+				case events <- DefaultRouteEvent{Family: family, Old: old[i], New: cur[i]}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			old = cur
+		}
+	}()
+	return events, nil
+}
+
+// bestDefaults returns the default routes selected for IPv4 and IPv6, or
+// nil for a family without any.
+func (r *router) bestDefaults() (best [2]*RouteEntry) {
+	for _, rt := range r.Table().DefaultRoutes() {
+		i := 0
+		if rt.ipv6() {
+			i = 1
+		}
+		if best[i] == nil {
+			best[i] = &rt
+		}
+	}
+	return best
+}
+
+// sameNextHop reports whether a and b send packets the same way: through
+// the same gateway and interface.
+func sameNextHop(a, b *RouteEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Gateway.Equal(b.Gateway) && a.OutputIface == b.OutputIface
+}
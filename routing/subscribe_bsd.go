@@ -0,0 +1,51 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package routing
+
+import (
+	"encoding/binary"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openChangeSocket opens a routing socket, which receives every change of
+// the routing table and of interface addresses.
+func openChangeSocket() (*os.File, error) {
+	fd, err := unix.Socket(unix.AF_ROUTE, unix.SOCK_RAW, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	unix.CloseOnExec(fd)
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	return os.NewFile(uintptr(fd), "route"), nil
+}
+
+// isRouteChange reports whether b holds a routing message announcing a
+// change.  Every message starts with its length, version and type, as in
+// struct rt_msghdr.
+func isRouteChange(b []byte) bool {
+	for len(b) >= 4 {
+		n := int(binary.NativeEndian.Uint16(b))
+		if b[2] != unix.RTM_VERSION || n < 4 || n > len(b) {
+			return false
+		}
+		switch b[3] {
+		case unix.RTM_ADD, unix.RTM_DELETE, unix.RTM_CHANGE,
+			unix.RTM_NEWADDR, unix.RTM_DELADDR, unix.RTM_IFINFO:
+			return true
+		}
+		b = b[n:]
+	}
+	return false
+}
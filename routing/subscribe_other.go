@@ -0,0 +1,18 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package routing
+
+import (
+	"context"
+)
+
+func systemSubscribe(ctx context.Context) (<-chan struct{}, error) {
+	return nil, ErrUnsupportedPlatform
+}
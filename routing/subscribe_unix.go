@@ -0,0 +1,54 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"syscall"
+)
+
+func systemSubscribe(ctx context.Context) (<-chan struct{}, error) {
+	f, err := openChangeSocket()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	stop := context.AfterFunc(ctx, func() {
+		f.Close()
+	})
+	go func() {
+		defer close(ch)
+		defer f.Close()
+		defer stop()
+		buf := make([]byte, 1<<16)
+		for {
+			n, err := f.Read(buf)
+			switch {
+			case err == nil:
+				if isRouteChange(buf[:n]) {
+					notify()
+				}
+			case errors.Is(err, syscall.ENOBUFS):
+				// The socket overflowed: some changes were lost.
+				notify()
+			default:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,446 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"sort"
+	"time"
+)
+
+// RouteTable is a loaded routing table: the routes of each table in
+// selection order, the interfaces by index and their addresses.  It selects
+// routes without any interaction with the operating system, so captured
+// tables can be analysed offline.  A RouteTable is never modified once
+// built, and is safe for concurrent use.
+//
+// A Router holds the RouteTable of its last Refresh.
+type RouteTable struct {
+	family         AddressFamily
+	skipExpired    bool
+	stableSources  bool
+	localSources   bool
+	slaveIfaces    bool
+	unspecifiedDst bool
+
+	ifaces    map[int]*net.Interface
+	altNames  map[string]int // interface index by alternative name
+	masters   map[int]int    // bond or bridge index by enslaved index
+	addrs     map[int]ipAddrs
+	v4, v6    routeSlice // TableMain
+	tables    map[uint32]tableRoutes
+	rules     []Rule
+	multicast []MulticastEntry
+	source    string    // backend the routes were read from
+	loaded    time.Time // when the routes were loaded
+
+	// byGateway indexes the routes of every table by the To16 form of
+	// their gateway.
+	byGateway map[string][]RouteEntry
+	// v4Addrs and v6Addrs index addrs by prefix.  They are nil in tables
+	// built field by field, whose addresses are then gone through one by
+	// one.
+	v4Addrs, v6Addrs *addrIndex
+}
+
+// tableRoutes are the routes of a route table other than TableMain.
+type tableRoutes struct {
+	v4, v6 routeSlice
+}
+
+// NewRouteTable builds a RouteTable from the given routes, as NewFromRoutes
+// builds a Router.  Options that only concern refreshing, such as
+// WithStats, have no effect.
+func NewRouteTable(routes []RouteEntry, ifaces []net.Interface, addrs map[int][]net.Addr, opts ...Option) (*RouteTable, error) {
+	p := &staticProvider{ifaces: ifaces, addrs: addrs, routes: routes}
+	rtr, err := newRouter(append(opts, WithProvider(p)))
+	if err != nil {
+		return nil, err
+	}
+	return rtr.load()
+}
+
+// Route returns where to send a packet to dst, as EgressRouter.RouteGet
+// does with a nil input and src.
+func (tab *RouteTable) Route(dst net.IP) (RouteResult, error) {
+	return tab.resolve(0, nil, dst, 0, defaultTables, nil, nil)
+}
+
+// RouteAll returns the routes of TableMain that apply to dst, best first:
+// the first one is the route Route selects, the others those it would fall
+// back on, such as the default routes of other uplinks, and last those
+// through interfaces that are down.  Dead routes are left out.  It fails
+// with an error wrapping ErrNoRoute if there are none.
+func (tab *RouteTable) RouteAll(dst net.IP) ([]RouteEntry, error) {
+	family := FamilyOf(dst)
+	if family == FamilyInvalid {
+		return nil, errInvalidIP
+	}
+	ipv6 := family == FamilyV6
+	if !familyEnabled(tab.family, ipv6) {
+		return nil, ErrFamilyDisabled
+	}
+	if err := tab.checkUnspecified(dst); err != nil {
+		return nil, err
+	}
+	if !ipv6 {
+		dst = dst.To4()
+	}
+	var routes, down []RouteEntry
+	rs := tab.routes(TableMain, ipv6)
+	for i := range rs {
+		rt := &rs[i]
+		if !prefixContains(rt.Dst, dst) || rt.Flags&RouteDead != 0 || tab.skipExpired && tab.expired(rt) {
+			continue
+		}
+		if rt.Flags&RouteIfaceDown != 0 {
+			down = append(down, rt.clone())
+		} else {
+			routes = append(routes, rt.clone())
+		}
+	}
+	routes = append(routes, down...)
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("%w for %v", ErrNoRoute, dst)
+	}
+	return routes, nil
+}
+
+// RouteForPrefix returns the route of TableMain selected for every address of
+// n, the longest usable one covering it whole.  It fails with an error
+// wrapping ErrPrefixSplit if a more specific route sends part of n to
+// another next hop, and with one wrapping ErrNoRoute if no route covers n.
+func (tab *RouteTable) RouteForPrefix(n net.IPNet) (RouteEntry, error) {
+	family := FamilyOf(n.IP)
+	if family == FamilyInvalid {
+		return RouteEntry{}, errInvalidIP
+	}
+	ipv6 := family == FamilyV6
+	if !familyEnabled(tab.family, ipv6) {
+		return RouteEntry{}, ErrFamilyDisabled
+	}
+	n = canonicalPrefix(n, ipv6)
+	ones, bits := n.Mask.Size()
+	if bits != 8*len(n.IP) {
+		return RouteEntry{}, fmt.Errorf("invalid prefix %v", n)
+	}
+	n.IP = n.IP.Mask(n.Mask)
+
+	var inner []*RouteEntry
+	rs := tab.routes(TableMain, ipv6)
+	for i := range rs {
+		rt := &rs[i]
+		if !tab.usable(rt, rt.Dst.IP) {
+			continue
+		}
+		switch rtOnes := countMaskOnes(rt.Dst.Mask); {
+		case rtOnes <= ones && prefixContains(rt.Dst, n.IP):
+			for _, in := range inner {
+				if !sameNextHop(in, rt) {
+					return RouteEntry{}, fmt.Errorf("%w for %v: %v", ErrPrefixSplit, n.String(), in.Dst.String())
+				}
+			}
+			return rt.clone(), nil
+		case rtOnes > ones && n.Contains(rt.Dst.IP):
+			inner = append(inner, rt)
+		}
+	}
+	return RouteEntry{}, fmt.Errorf("%w for %v", ErrNoRoute, n.String())
+}
+
+// RoutesViaGateway returns the routes of every table whose gateway is gw,
+// the prefixes affected when gw goes down, longest prefix first.  It is
+// empty if no route uses gw.
+func (tab *RouteTable) RoutesViaGateway(gw net.IP) ([]RouteEntry, error) {
+	if FamilyOf(gw) == FamilyInvalid {
+		return nil, errInvalidIP
+	}
+	var routes []RouteEntry
+	for _, rt := range tab.byGateway[string(gw.To16())] {
+		routes = append(routes, rt.clone())
+	}
+	return routes, nil
+}
+
+// indexGateways builds the byGateway index of tab.
+func (tab *RouteTable) indexGateways() {
+	tab.byGateway = make(map[string][]RouteEntry)
+	for _, rt := range tab.Routes() {
+		if rt.Gateway == nil || rt.Gateway.IsUnspecified() {
+			continue
+		}
+		key := string(rt.Gateway.To16())
+		tab.byGateway[key] = append(tab.byGateway[key], rt)
+	}
+	for _, routes := range tab.byGateway {
+		sort.SliceStable(routes, func(i, j int) bool {
+			return countMaskOnes(routes[i].Dst.Mask) > countMaskOnes(routes[j].Dst.Mask)
+		})
+	}
+}
+
+// indexAddrs builds the v4Addrs and v6Addrs indices of tab.
+func (tab *RouteTable) indexAddrs() {
+	tab.v4Addrs = newAddrIndex(tab.addrs, false)
+	tab.v6Addrs = newAddrIndex(tab.addrs, true)
+}
+
+// addrsContaining calls fn with each address of the family of ipv6 whose
+// prefix contains ip.
+func (tab *RouteTable) addrsContaining(ip net.IP, ipv6 bool, fn func(ifindex, j int, addr net.IPNet)) {
+	x := tab.v4Addrs
+	if ipv6 {
+		x = tab.v6Addrs
+	}
+	if x != nil {
+		x.containing(tab.addrs, ip, ipv6, fn)
+		return
+	}
+	for ifindex, a := range tab.addrs {
+		for j, addr := range a.family(ipv6) {
+			if addr.Contains(ip) {
+				fn(ifindex, j, addr)
+			}
+		}
+	}
+}
+
+// addrIface returns the index of the interface ip is an address of, or 0
+// if it is none's.
+func (tab *RouteTable) addrIface(ip net.IP) (index int) {
+	family := FamilyOf(ip)
+	if family == FamilyInvalid {
+		return 0
+	}
+	ipv6 := family == FamilyV6
+	if !ipv6 {
+		ip = ip.To4()
+	}
+	tab.addrsContaining(ip, ipv6, func(ifindex, j int, addr net.IPNet) {
+		if index == 0 && addr.IP.Equal(ip) {
+			index = ifindex
+		}
+	})
+	return index
+}
+
+// DefaultRoutes returns the default routes of TableMain that may be
+// selected, IPv4 first, each family best first.
+func (tab *RouteTable) DefaultRoutes() []RouteEntry {
+	var routes []RouteEntry
+	for _, rs := range []routeSlice{tab.v4, tab.v6} {
+		for i := range rs {
+			rt := &rs[i]
+			if isDefaultRoute(rt) && tab.usable(rt, rt.Dst.IP) {
+				routes = append(routes, rt.clone())
+			}
+		}
+	}
+	return routes
+}
+
+// DefaultUplinks returns the default routes of DefaultRoutes grouped into
+// tiers of equal Priority and family, best first: the routes of a tier may
+// share the load, and those of the next tiers take over when they fail.
+func (tab *RouteTable) DefaultUplinks() [][]RouteEntry {
+	var tiers [][]RouteEntry
+	for _, rt := range tab.DefaultRoutes() {
+		if n := len(tiers); n > 0 {
+			last := tiers[n-1][0]
+			if last.Priority == rt.Priority && last.ipv6() == rt.ipv6() {
+				tiers[n-1] = append(tiers[n-1], rt)
+				continue
+			}
+		}
+		tiers = append(tiers, []RouteEntry{rt})
+	}
+	sort.SliceStable(tiers, func(i, j int) bool {
+		return tiers[i][0].Priority < tiers[j][0].Priority
+	})
+	return tiers
+}
+
+// LocalSubnets returns the prefixes reached without a gateway, IPv4 first:
+// those of the usable on-link routes of TableMain, then the networks of the
+// interface addresses not already listed.  Default routes through a
+// point-to-point interface, and the host prefixes of local addresses, are
+// left out.
+func (tab *RouteTable) LocalSubnets() ([]net.IPNet, error) {
+	var subnets []net.IPNet
+	seen := make(map[string]bool)
+	add := func(n net.IPNet) {
+		if key := n.String(); !seen[key] {
+			seen[key] = true
+			subnets = append(subnets, n)
+		}
+	}
+	ifaces := tab.Interfaces()
+	for _, ipv6 := range []bool{false, true} {
+		rs := tab.routes(TableMain, ipv6)
+		for i := range rs {
+			rt := &rs[i]
+			if rt.OutputIface != 0 && (rt.Gateway == nil || rt.Gateway.IsUnspecified()) &&
+				rt.Scope != ScopeHost && !isDefaultRoute(rt) && tab.usable(rt, rt.Dst.IP) {
+				add(rt.Dst)
+			}
+		}
+		for _, iface := range ifaces {
+			for _, addr := range tab.addrs[iface.Index].family(ipv6) {
+				if ones, bits := addr.Mask.Size(); ones < bits {
+					add(net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask})
+				}
+			}
+		}
+	}
+	return subnets, nil
+}
+
+// SourceAddresses returns the distinct addresses of the up interfaces that
+// may originate traffic, IPv4 first, then by interface index.  Secondary
+// and anycast addresses, temporary ones with WithStableSourceAddresses, and
+// loopback and link-local addresses unless WithLocalSourceAddresses is
+// given, are left out.
+func (tab *RouteTable) SourceAddresses() []net.IP {
+	var srcs []net.IP
+	seen := make(map[string]bool)
+	ifaces := tab.Interfaces()
+	for _, ipv6 := range []bool{false, true} {
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 {
+				continue
+			}
+			addrs := tab.addrs[iface.Index]
+			for j, addr := range addrs.family(ipv6) {
+				flags := addrs.flags(ipv6, j)
+				switch {
+				case flags&notPrimary != 0, tab.stableSources && flags&AddrTemporary != 0:
+					continue
+				case !tab.localSources && (addr.IP.IsLoopback() || addr.IP.IsLinkLocalUnicast()):
+					continue
+				}
+				if key := string(addr.IP.To16()); !seen[key] {
+					seen[key] = true
+					srcs = append(srcs, addr.IP)
+				}
+			}
+		}
+	}
+	return srcs
+}
+
+// usable reports whether rt applies to dst and may be selected.
+func (tab *RouteTable) usable(rt *RouteEntry, dst net.IP) bool {
+	return prefixContains(rt.Dst, dst) && rt.Flags&(RouteDead|RouteIfaceDown) == 0 && !(tab.skipExpired && tab.expired(rt))
+}
+
+// Routes returns a copy of the routes of the table: those of TableMain,
+// IPv4 routes first, each family in the order they are tried, then those of
+// the other tables by increasing ID.  Their addresses and metrics are
+// copied too, so the caller may modify them.
+func (tab *RouteTable) Routes() []RouteEntry {
+	routes := make([]RouteEntry, 0, len(tab.v4)+len(tab.v6))
+	for _, rs := range [][]RouteEntry{tab.v4, tab.v6} {
+		for i := range rs {
+			routes = append(routes, rs[i].clone())
+		}
+	}
+	for _, id := range tab.tableIDs() {
+		for _, rs := range [][]RouteEntry{tab.tables[id].v4, tab.tables[id].v6} {
+			for i := range rs {
+				routes = append(routes, rs[i].clone())
+			}
+		}
+	}
+	return routes
+}
+
+// clone returns a copy of rt that shares none of its addresses, masks and
+// metrics.
+func (rt *RouteEntry) clone() RouteEntry {
+	c := *rt
+	c.Dst = net.IPNet{IP: cloneIP(rt.Dst.IP), Mask: cloneMask(rt.Dst.Mask)}
+	c.Src = net.IPNet{IP: cloneIP(rt.Src.IP), Mask: cloneMask(rt.Src.Mask)}
+	c.Gateway = cloneIP(rt.Gateway)
+	c.PrefSrc = cloneIP(rt.PrefSrc)
+	if rt.Metrics != nil {
+		c.Metrics = maps.Clone(rt.Metrics)
+	}
+	return c
+}
+
+func cloneIP(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	return append(net.IP(nil), ip...)
+}
+
+func cloneMask(mask net.IPMask) net.IPMask {
+	if mask == nil {
+		return nil
+	}
+	return append(net.IPMask(nil), mask...)
+}
+
+// Source returns the backend the routes of the table were read from: one of
+// SourceNetlink, SourceIPHelper and SourceWMI for the system table, and
+// SourceProvider for the tables of other providers.
+func (tab *RouteTable) Source() string {
+	return tab.source
+}
+
+// InterfaceByName returns the interface of the table named name, or having
+// name among its alternative names.
+func (tab *RouteTable) InterfaceByName(name string) (*net.Interface, error) {
+	for _, iface := range tab.ifaces {
+		if iface.Name == name {
+			return iface, nil
+		}
+	}
+	if index, ok := tab.altNames[name]; ok {
+		return tab.ifaces[index], nil
+	}
+	return nil, fmt.Errorf("no interface named %q", name)
+}
+
+// Interfaces returns the interfaces of the table, by increasing index.
+// They are those RouteResult.Iface points to, and must not be modified.
+func (tab *RouteTable) Interfaces() []*net.Interface {
+	ifaces := make([]*net.Interface, 0, len(tab.ifaces))
+	for _, iface := range tab.ifaces {
+		ifaces = append(ifaces, iface)
+	}
+	sort.Slice(ifaces, func(i, j int) bool { return ifaces[i].Index < ifaces[j].Index })
+	return ifaces
+}
+
+// routes returns the routes of the given table and family.
+func (tab *RouteTable) routes(table uint32, ipv6 bool) routeSlice {
+	var t tableRoutes
+	if table == TableMain {
+		t = tableRoutes{tab.v4, tab.v6}
+	} else {
+		t = tab.tables[table]
+	}
+	if ipv6 {
+		return t.v6
+	}
+	return t.v4
+}
+
+// tableIDs returns the IDs of the tables other than TableMain, in
+// increasing order.
+func (tab *RouteTable) tableIDs() []uint32 {
+	ids := make([]uint32, 0, len(tab.tables))
+	for id := range tab.tables {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,58 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// waitPollInterval is how often WaitForRoute refreshes the table when it
+// can't be notified of changes.
+var waitPollInterval = time.Second
+
+func (r *router) WaitForRoute(ctx context.Context, dst net.IP) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Subscribe before the first lookup, so that no change is missed
+	// between the two.
+	var changes <-chan struct{}
+	if r.subscribable() {
+		changes, _ = Subscribe(ctx)
+	}
+	var poll <-chan time.Time
+	if changes == nil {
+		ticker := time.NewTicker(waitPollInterval)
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+
+	for {
+		if err := r.Refresh(); err != nil {
+			return err
+		}
+		_, err := r.RouteGet(nil, nil, dst)
+		if err == nil || errors.Is(err, errInvalidIP) || errors.Is(err, ErrFamilyDisabled) || errors.Is(err, ErrUnspecifiedDestination) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-changes:
+			if !ok {
+				// The notifications failed: poll from now on.
+				ticker := time.NewTicker(waitPollInterval)
+				defer ticker.Stop()
+				changes, poll = nil, ticker.C
+			}
+		case <-poll:
+		}
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2012 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package routing
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// The WMI locator class and interface, from wbemcli.h.
+var (
+	clsidWbemLocator = windows.GUID{Data1: 0x4590f811, Data2: 0x1d3a, Data3: 0x11d0, Data4: [8]byte{0x89, 0x1f, 0x00, 0xaa, 0x00, 0x4b, 0x2e, 0x24}}
+	iidIWbemLocator  = windows.GUID{Data1: 0xdc12a687, Data2: 0x737f, Data3: 0x11cf, Data4: [8]byte{0x88, 0x4d, 0x00, 0xaa, 0x00, 0x4b, 0x2e, 0x24}}
+)
+
+// The vtable slots of the COM methods called, counting those of IUnknown.
+const (
+	methodRelease       = 2
+	methodConnectServer = 3  // IWbemLocator
+	methodExecQuery     = 20 // IWbemServices
+	methodNext          = 4  // IEnumWbemClassObject
+	methodGet           = 4  // IWbemClassObject
+)
+
+// Pulled from combaseapi.h, rpcdce.h, objidl.h and wbemcli.h
+const (
+	clsctxInprocServer        = 0x1
+	rpcCAuthnWinNT            = 10
+	rpcCAuthzNone             = 0
+	rpcCAuthnLevelCall        = 3
+	rpcCImpLevelImpersonate   = 3
+	eoacNone                  = 0
+	wbemFlagReturnImmediately = 0x10
+	wbemFlagForwardOnly       = 0x20
+	wbemInfinite              = 0xffffffff
+	vtBSTR                    = 8
+)
+
+var (
+	modOle32              = windows.NewLazySystemDLL("ole32.dll")
+	procCoCreateInstance  = modOle32.NewProc("CoCreateInstance")
+	procCoSetProxyBlanket = modOle32.NewProc("CoSetProxyBlanket")
+
+	modOleAut32        = windows.NewLazySystemDLL("oleaut32.dll")
+	procSysAllocString = modOleAut32.NewProc("SysAllocString")
+	procSysFreeString  = modOleAut32.NewProc("SysFreeString")
+	procVariantClear   = modOleAut32.NewProc("VariantClear")
+)
+
+// comObject is a COM interface pointer, which points to its vtable.
+type comObject struct {
+	vtbl *[methodExecQuery + 1]uintptr
+}
+
+// call calls the method in the given vtable slot, and returns its HRESULT
+// if it is a failure.
+func (o *comObject) call(method int, args ...uintptr) error {
+	hr, _, _ := syscall.SyscallN(o.vtbl[method], append([]uintptr{uintptr(unsafe.Pointer(o))}, args...)...)
+	return hresultError(hr)
+}
+
+func (o *comObject) release() {
+	syscall.SyscallN(o.vtbl[methodRelease], uintptr(unsafe.Pointer(o)))
+}
+
+// hresultError returns hr as an error if it is a failure.
+func hresultError(hr uintptr) error {
+	if int32(hr) < 0 {
+		return syscall.Errno(hr)
+	}
+	return nil
+}
+
+// Pulled from https://learn.microsoft.com/en-us/windows/win32/api/oaidl/ns-oaidl-variant
+type variant struct {
+	VT  uint16
+	_   [3]uint16
+	Val uint64
+	_   uint64 // The size of a VARIANT on 64-bit Windows
+}
+
+// sysAllocString returns s as a BSTR, which must be freed with
+// SysFreeString.
+func sysAllocString(s string) (uintptr, error) {
+	p, err := windows.UTF16PtrFromString(s)
+	if err != nil {
+		return 0, err
+	}
+	bstr, _, _ := procSysAllocString.Call(uintptr(unsafe.Pointer(p)))
+	if bstr == 0 {
+		return 0, windows.ERROR_NOT_ENOUGH_MEMORY
+	}
+	return bstr, nil
+}
+
+// wmiQuery runs a WQL query in the ROOT\CIMV2 namespace and calls fn with
+// each object returned.  COM is initialized for the calling thread, which
+// is locked meanwhile.
+func wmiQuery(query string, fn func(obj *comObject) error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	switch err := windows.CoInitializeEx(0, windows.COINIT_MULTITHREADED); err {
+	case nil, syscall.Errno(windows.S_FALSE):
+		defer windows.CoUninitialize()
+	case syscall.Errno(windows.RPC_E_CHANGED_MODE):
+		// The thread is already in a single-threaded apartment, which WMI
+		// works in as well.
+	default:
+		return err
+	}
+
+	var locator *comObject
+	hr, _, _ := procCoCreateInstance.Call(uintptr(unsafe.Pointer(&clsidWbemLocator)), 0, clsctxInprocServer,
+		uintptr(unsafe.Pointer(&iidIWbemLocator)), uintptr(unsafe.Pointer(&locator)))
+	if err := hresultError(hr); err != nil {
+		return err
+	}
+	defer locator.release()
+
+	namespace, err := sysAllocString(`ROOT\CIMV2`)
+	if err != nil {
+		return err
+	}
+	defer procSysFreeString.Call(namespace)
+	var services *comObject
+	if err := locator.call(methodConnectServer, namespace, 0, 0, 0, 0, 0, 0, uintptr(unsafe.Pointer(&services))); err != nil {
+		return err
+	}
+	defer services.release()
+	hr, _, _ = procCoSetProxyBlanket.Call(uintptr(unsafe.Pointer(services)), rpcCAuthnWinNT, rpcCAuthzNone, 0,
+		rpcCAuthnLevelCall, rpcCImpLevelImpersonate, 0, eoacNone)
+	if err := hresultError(hr); err != nil {
+		return err
+	}
+
+	language, err := sysAllocString("WQL")
+	if err != nil {
+		return err
+	}
+	defer procSysFreeString.Call(language)
+	wql, err := sysAllocString(query)
+	if err != nil {
+		return err
+	}
+	defer procSysFreeString.Call(wql)
+	var enum *comObject
+	if err := services.call(methodExecQuery, language, wql, wbemFlagForwardOnly|wbemFlagReturnImmediately, 0, uintptr(unsafe.Pointer(&enum))); err != nil {
+		return err
+	}
+	defer enum.release()
+
+	for {
+		var obj *comObject
+		var n uint32
+		if err := enum.call(methodNext, wbemInfinite, 1, uintptr(unsafe.Pointer(&obj)), uintptr(unsafe.Pointer(&n))); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		err := fn(obj)
+		obj.release()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// wmiProperty reads the named property of a WMI object, a string into s or
+// a 32-bit integer into n.  A null property is left zero.
+func wmiProperty(obj *comObject, name string, s *string, n *uint32) error {
+	p, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var v variant
+	if err := obj.call(methodGet, uintptr(unsafe.Pointer(p)), 0, uintptr(unsafe.Pointer(&v)), 0, 0); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	defer procVariantClear.Call(uintptr(unsafe.Pointer(&v)))
+	switch {
+	case v.VT == vtBSTR && s != nil:
+		*s = windows.UTF16PtrToString(*(**uint16)(unsafe.Pointer(&v.Val)))
+	case v.VT != vtBSTR && n != nil:
+		*n = uint32(v.Val)
+	}
+	return nil
+}
+
+// wmiRouteQuery selects the properties of the Win32_IP4RouteTable instances
+// routes are made of.
+const wmiRouteQuery = "SELECT Destination, Mask, NextHop, InterfaceIndex, Metric1, Protocol, Type, Age FROM Win32_IP4RouteTable"
+
+// Pulled from https://learn.microsoft.com/en-us/previous-versions/windows/desktop/wmiiprouteprov/win32-ip4routetable
+type wmiRoute struct {
+	Destination    string
+	Mask           string
+	NextHop        string
+	InterfaceIndex uint32
+	Metric1        uint32
+	Protocol       uint32
+	Type           uint32
+	Age            uint32
+}
+
+// Values of wmiRoute.Type and Protocol, those of ipRouteType and
+// ipRouteProto in RFC 1354.
+const (
+	wmiRouteTypeInvalid = 2
+
+	wmiProtoLocal   = 2
+	wmiProtoNetMgmt = 3
+	wmiProtoICMP    = 4
+)
+
+// getWMIRouteTable queries the IPv4 routes from WMI's Win32_IP4RouteTable.
+func getWMIRouteTable() ([]RouteEntry, error) {
+	persistent := persistentRoutes()
+	var routes []RouteEntry
+	err := wmiQuery(wmiRouteQuery, func(obj *comObject) error {
+		var row wmiRoute
+		for _, p := range []struct {
+			name string
+			s    *string
+			n    *uint32
+		}{
+			{"Destination", &row.Destination, nil},
+			{"Mask", &row.Mask, nil},
+			{"NextHop", &row.NextHop, nil},
+			{"InterfaceIndex", nil, &row.InterfaceIndex},
+			{"Metric1", nil, &row.Metric1},
+			{"Protocol", nil, &row.Protocol},
+			{"Type", nil, &row.Type},
+			{"Age", nil, &row.Age},
+		} {
+			if err := wmiProperty(obj, p.name, p.s, p.n); err != nil {
+				return err
+			}
+		}
+		if row.Type == wmiRouteTypeInvalid {
+			return nil
+		}
+		rt, err := row.routeEntry()
+		if err != nil {
+			return err
+		}
+		if persistent[persistentKey(&rt)] {
+			rt.Flags |= RoutePersistent
+		}
+		routes = append(routes, rt)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Win32_IP4RouteTable: %w", err)
+	}
+	return routes, nil
+}
+
+// routeEntry converts an instance of Win32_IP4RouteTable, whose protocols
+// are coarser than the origins of GetIpForwardTable2.
+func (row *wmiRoute) routeEntry() (RouteEntry, error) {
+	dst, mask, gw := net.ParseIP(row.Destination).To4(), net.ParseIP(row.Mask).To4(), net.ParseIP(row.NextHop).To4()
+	if dst == nil || mask == nil || gw == nil {
+		return RouteEntry{}, fmt.Errorf("invalid route to %s/%s via %s", row.Destination, row.Mask, row.NextHop)
+	}
+	rt := RouteEntry{
+		Src: net.IPNet{
+			IP:   make(net.IP, net.IPv4len),
+			Mask: make(net.IPMask, net.IPv4len),
+		},
+		Dst:         net.IPNet{IP: dst, Mask: net.IPMask(mask)},
+		Gateway:     gw,
+		OutputIface: int(row.InterfaceIndex),
+		Priority:    row.Metric1,
+		Age:         time.Duration(row.Age) * time.Second,
+	}
+	switch row.Protocol {
+	case wmiProtoLocal:
+		rt.Protocol = ProtocolKernel
+	case wmiProtoNetMgmt:
+		rt.Protocol = ProtocolStatic
+	case wmiProtoICMP:
+		rt.Protocol = ProtocolRedirect
+	}
+	return rt, nil
+}